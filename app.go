@@ -15,6 +15,8 @@
 package fuji
 
 import (
+	"time"
+
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/shiguredo/fuji/broker"
@@ -30,16 +32,109 @@ func Start(configPath string) {
 		log.Fatalf("loading config file faild, %v", err)
 	}
 
-	commandChannel := make(chan string)
+	// followUp runs with the gateway started after the config is pushed
+	// or rolled back.
+	var followUp func(gw *gateway.Gateway)
+LOOP:
+	for {
+		commandChannel := make(chan string)
+
+		gw := setupGateway(conf, commandChannel)
+		gw.ConfigPath = configPath
+		if followUp != nil {
+			go followUp(gw)
+			followUp = nil
+		}
+		err = gw.Start()
+		switch err {
+		case gateway.ErrReload:
+		case gateway.ErrConfigPushed:
+			followUp = (*gateway.Gateway).ConfirmConfig
+		case gateway.ErrConfigRolledBack:
+			followUp = (*gateway.Gateway).ReportRollback
+		default:
+			break LOOP
+		}
 
-	err = StartByFileWithChannel(conf, commandChannel)
+		// the current config is kept if the new one is invalid
+		newConf, lerr := config.LoadConfig(configPath)
+		if lerr == nil {
+			lerr = gateway.ValidateConfig(newConf)
+		}
+		if lerr != nil {
+			log.Errorf("reloading config file failed, %v", lerr)
+			if err == gateway.ErrConfigPushed {
+				if rerr := config.RestoreConfig(configPath); rerr != nil {
+					log.Errorf("config restore failed, %v", rerr)
+				}
+			}
+			followUp = nil
+			continue
+		}
+		log.Infof("config reloaded: %v", configPath)
+		conf = newConf
+	}
 	if err != nil {
 		log.Error(err)
 	}
 }
 
+// CheckConfig loads the config file and returns all errors found by
+// creating the gateway, brokers, devices and status. Nothing is connected.
+func CheckConfig(configPath string) []error {
+	conf, err := config.LoadConfig(configPath)
+	if errs, ok := err.(config.SchemaErrors); ok {
+		ret := make([]error, 0, len(errs))
+		for _, e := range errs {
+			ret = append(ret, e)
+		}
+		return ret
+	}
+	if err != nil {
+		return []error{err}
+	}
+	return gateway.CheckConfig(conf)
+}
+
 // StartByFileWithChannel starts Gateway with command Channel
 func StartByFileWithChannel(conf config.Config, commandChannel chan string) error {
+	gw := setupGateway(conf, commandChannel)
+
+	// start gateway
+	return gw.Start()
+}
+
+// Bench runs the gateway for duration and returns the report of
+// published messages.
+func Bench(configPath string, duration time.Duration) (gateway.StatsReport, error) {
+	conf, err := config.LoadConfig(configPath)
+	if err != nil {
+		return gateway.StatsReport{}, err
+	}
+
+	commandChannel := make(chan string)
+	gw := setupGateway(conf, commandChannel)
+	gw.Stats = gateway.NewStats()
+
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		done <- gw.Start()
+	}()
+
+	select {
+	case <-time.After(duration):
+	case err := <-done:
+		// stopped by SIGINT
+		return gw.Stats.Report(time.Since(start)), err
+	}
+	report := gw.Stats.Report(time.Since(start))
+	commandChannel <- "close"
+	return report, <-done
+}
+
+// setupGateway creates the gateway, connects brokers and starts devices.
+func setupGateway(conf config.Config, commandChannel chan string) *gateway.Gateway {
 	gw, err := gateway.NewGateway(conf)
 	if err != nil {
 		log.Fatalf("gateway create error, %v", err)
@@ -67,12 +162,32 @@ func StartByFileWithChannel(conf config.Config, commandChannel chan string) erro
 	}
 
 	// add to brokers subscribed
-	for _, device := range gw.Devices {
-		err := device.AddSubscribe()
+	for _, d := range gw.Devices {
+		err := d.AddSubscribe()
 		if err != nil {
 			log.Errorf("device subscribe error, %v", err)
 			continue
 		}
+		// RPC requests
+		if c, ok := d.(device.Caller); ok {
+			for _, b := range gw.Brokers {
+				b.AddRPCSubscribed(c.DeviceName(), 1)
+			}
+		}
+	}
+
+	// remote control
+	if gw.ControlBroker != "" {
+		found := false
+		for _, b := range gw.Brokers {
+			if b.Name == gw.ControlBroker {
+				b.AddControlSubscribed(1)
+				found = true
+			}
+		}
+		if !found {
+			log.Errorf("control broker not found, %v", gw.ControlBroker)
+		}
 	}
 
 	// Start brokers and devices
@@ -83,6 +198,7 @@ func StartByFileWithChannel(conf config.Config, commandChannel chan string) erro
 			continue
 		}
 	}
+	gw.ConnectAvailability()
 	for _, device := range gw.Devices {
 		err := device.Start(gw.MsgChan)
 		if err != nil {
@@ -90,7 +206,5 @@ func StartByFileWithChannel(conf config.Config, commandChannel chan string) erro
 			continue
 		}
 	}
-
-	// start gateway
-	return gw.Start()
+	return gw
 }
@@ -23,6 +23,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 
 	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
 	log "github.com/Sirupsen/logrus"
@@ -30,7 +31,6 @@ import (
 
 	"github.com/shiguredo/fuji/config"
 	"github.com/shiguredo/fuji/message"
-	"github.com/shiguredo/fuji/utils"
 )
 
 const (
@@ -50,6 +50,9 @@ type Broker struct {
 	IsWill        bool
 	WillMessage   []byte `validate:"max=256"`
 	WillTopic     string `validate:"max=256,validtopic"`
+	Will          LifecycleMessage
+	Birth         LifecycleMessage
+	Offline       LifecycleMessage
 	Tls           bool
 	CaCert        string `validate:"max=256"`
 	ClientCert    string `validate:"max=256"`
@@ -60,7 +63,7 @@ type Broker struct {
 	GwChan chan message.Message
 
 	MQTTClient *MQTT.Client
-	connected  bool
+	connected  int32 // set by the callbacks of the client, use atomic
 }
 
 func (broker *Broker) String() string {
@@ -132,10 +135,6 @@ func NewBrokers(conf config.Config, gwChan chan message.Message) (Brokers, error
 		}
 		values := section.Values
 
-		willMsg, err := utils.ParsePayload(values["will_message"])
-		if err != nil {
-			log.Warnf("will_message, %v", err)
-		}
 		broker := &Broker{
 			GatewayName:   conf.GatewayName,
 			Name:          section.Name,
@@ -143,8 +142,6 @@ func NewBrokers(conf config.Config, gwChan chan message.Message) (Brokers, error
 			Username:      values["username"],
 			Password:      values["password"],
 			TopicPrefix:   values["topic_prefix"],
-			IsWill:        false,
-			WillMessage:   willMsg,
 			Tls:           false,
 			CaCert:        "",
 			RetryInterval: int(0),
@@ -152,16 +149,9 @@ func NewBrokers(conf config.Config, gwChan chan message.Message) (Brokers, error
 			GwChan:        gwChan,
 		}
 
-		for k, v := range values {
-			if k == "will_message" {
-				broker.IsWill = true
-				w, err := utils.ParsePayload(v)
-				if err != nil {
-					log.Warnf("parse error will_message, %v", err)
-				}
-				log.Debugf("will_message, %v", w)
-				broker.WillMessage = w
-			}
+		err := broker.parseLifecycleMessages(values)
+		if err != nil {
+			return nil, err
 		}
 
 		priority := 1
@@ -211,11 +201,6 @@ func NewBrokers(conf config.Config, gwChan chan message.Message) (Brokers, error
 			}
 		}
 
-		if values["will_topic"] != "" {
-			broker.WillTopic = strings.Join([]string{broker.TopicPrefix, values["will_topic"]}, "/")
-		} else {
-			broker.WillTopic = strings.Join([]string{broker.TopicPrefix, broker.GatewayName, defaultWillTopic}, "/")
-		}
 		// Validation
 		if err := validator.Validate(broker); err != nil {
 			return brokers, err
@@ -230,7 +215,7 @@ func NewBrokers(conf config.Config, gwChan chan message.Message) (Brokers, error
 }
 
 func (b *Broker) IsConnected() bool {
-	if b.MQTTClient != nil && b.MQTTClient.IsConnected() && b.connected {
+	if b.MQTTClient != nil && b.MQTTClient.IsConnected() && atomic.LoadInt32(&b.connected) == 1 {
 		return true
 	}
 	return false
@@ -238,7 +223,7 @@ func (b *Broker) IsConnected() bool {
 
 func (b *Broker) onConnectionLost(client *MQTT.Client, reason error) {
 	log.Errorf("MQTT broker disconnected(%s): %s", b.Name, reason)
-	b.connected = false
+	atomic.StoreInt32(&b.connected, 0)
 }
 
 func (b *Broker) onMessageReceived(client *MQTT.Client, m MQTT.Message) {
@@ -255,7 +240,10 @@ func (b *Broker) onMessageReceived(client *MQTT.Client, m MQTT.Message) {
 
 func (b *Broker) SubscribeOnConnect(client *MQTT.Client) {
 	log.Infof("client connected")
-	b.connected = true
+	atomic.StoreInt32(&b.connected, 1)
+
+	// replace the retained will, without blocking the handler
+	go b.publishLifecycle(client, b.Birth)
 
 	if b.Subscribed.Length() > 0 {
 		// subscribe
@@ -285,8 +273,7 @@ func (b *Broker) MQTTClientSetup(gwName string) error {
 
 func (b *Broker) Publish(msg *message.Message) error {
 	if b.MQTTClient == nil || !b.IsConnected() {
-		log.Warn("message got but Broker not connected")
-		return nil
+		return fmt.Errorf("broker not connected, %v", b.Name)
 	}
 
 	topic, err := b.GenerateTopic(msg)
@@ -309,8 +296,14 @@ func (b *Broker) Publish(msg *message.Message) error {
 // GenerateTopic generates topic from topicprefix, gwname and message.
 func (b *Broker) GenerateTopic(msg *message.Message) (message.TopicString, error) {
 	var topicString string
-	switch msg.Sender {
-	case "status": // status device topic structure is difference
+	switch {
+	case msg.Type == message.TypeRPC && msg.Topic != "": // reply_to of the request
+		topicString = msg.Topic
+	case msg.Type == message.TypeRPC:
+		topicString = strings.Join([]string{b.TopicPrefix, b.GatewayName, msg.Sender, msg.Type, "publish"}, "/")
+	case msg.Type == message.TypeAvailability:
+		topicString = strings.Join([]string{b.TopicPrefix, b.GatewayName, msg.Sender, msg.Type}, "/")
+	case msg.Sender == "status": // status device topic structure is difference
 		topicString = strings.Join([]string{b.TopicPrefix, msg.Topic}, "/")
 	default:
 		topicString = strings.Join([]string{b.TopicPrefix, b.GatewayName, msg.Sender, msg.Type, "publish"}, "/")
@@ -328,6 +321,9 @@ func (b *Broker) GenerateTopic(msg *message.Message) (message.TopicString, error
 }
 
 func (b *Broker) Close() error {
+	if b.IsConnected() {
+		b.publishLifecycle(b.MQTTClient, b.Offline)
+	}
 	if b.MQTTClient != nil {
 		b.MQTTClient.Disconnect(250) // msec wait
 	}
@@ -360,9 +356,7 @@ func MQTTConnect(gwName string, b *Broker) (*MQTT.Client, error) {
 	opts.SetUsername(b.Username)
 	opts.SetPassword(b.Password)
 	if b.IsWill {
-		willTopic := b.WillTopic
-		willQoS := 0
-		opts.SetBinaryWill(willTopic, b.WillMessage, byte(willQoS), true)
+		opts.SetBinaryWill(b.Will.Topic, b.Will.render(b.GatewayName), b.Will.QoS, b.Will.Retain)
 	}
 	opts.SetOnConnectHandler(b.SubscribeOnConnect)
 	opts.SetConnectionLostHandler(b.onConnectionLost)
@@ -283,3 +283,49 @@ func TestBrokersPrioritySort(t *testing.T) {
 	assert.Equal(3, bs[2].Priority)
 
 }
+
+func TestGenerateTopicRPC(t *testing.T) {
+	assert := assert.New(t)
+	b := &Broker{
+		GatewayName: "gw",
+		Name:        "b",
+		TopicPrefix: "prefix",
+	}
+
+	t1, err := b.GenerateTopic(&message.Message{Sender: "status", Type: message.TypeRPC})
+	assert.Nil(err)
+	assert.Equal("prefix/gw/status/rpc/publish", t1.Str)
+
+	t2, err := b.GenerateTopic(&message.Message{Sender: "dora", Type: message.TypeRPC, Topic: "app/replies/1"})
+	assert.Nil(err)
+	assert.Equal("app/replies/1", t2.Str)
+
+	b.Subscribed = NewSubscribed()
+	assert.Nil(b.AddRPCSubscribed("dora", 1))
+	assert.Equal(map[string]byte{"prefix/gw/dora/rpc": 1}, b.Subscribed.List())
+}
+
+func TestGenerateTopicAvailability(t *testing.T) {
+	assert := assert.New(t)
+	b := &Broker{
+		GatewayName: "gw",
+		Name:        "b",
+		TopicPrefix: "prefix",
+	}
+
+	t1, err := b.GenerateTopic(&message.Message{Sender: "dora", Type: message.TypeAvailability})
+	assert.Nil(err)
+	assert.Equal("prefix/gw/dora/availability", t1.Str)
+}
+
+func TestPublishNotConnected(t *testing.T) {
+	assert := assert.New(t)
+	b := &Broker{
+		GatewayName: "gw",
+		Name:        "b",
+	}
+
+	// the gateway tries the next broker by the error
+	err := b.Publish(&message.Message{Sender: "dora", Type: "temp"})
+	assert.NotNil(err)
+}
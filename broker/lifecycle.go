@@ -0,0 +1,211 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/shiguredo/fuji/message"
+	"github.com/shiguredo/fuji/utils"
+)
+
+// Version is the version of the gateway used in payload templates. It is
+// set by fuji-gw.
+var Version = ""
+
+// lifecycleTimeout is how long birth and offline messages are waited.
+const lifecycleTimeout = 3 * time.Second
+
+// LifecycleMessage is the will, birth or offline message of the gateway.
+// Payload can be a template.
+// ex:
+//   birth_message = "{\"status\": \"online\", \"gateway\": \"{{.Gateway}}\", \"version\": \"{{.Version}}\", \"at\": \"{{.Timestamp}}\"}"
+type LifecycleMessage struct {
+	Topic   string `validate:"max=256,validtopic"`
+	Payload []byte `validate:"max=256"`
+	QoS     byte   `validate:"min=0,max=2"`
+	Retain  bool
+
+	enabled bool
+	tmpl    *utils.PayloadTemplate
+}
+
+// IsZero returns true if the message is not configured.
+func (m LifecycleMessage) IsZero() bool {
+	return !m.enabled
+}
+
+// render returns the payload rendered with the gateway name, version and
+// the current time.
+func (m LifecycleMessage) render(gwName string) []byte {
+	if m.tmpl == nil {
+		return m.Payload
+	}
+	payload, err := m.tmpl.Execute(utils.PayloadContext{
+		Gateway: gwName,
+		Version: Version,
+		Time:    time.Now(),
+	})
+	if err != nil {
+		log.Errorf("payload template failed, %v", err)
+		return m.Payload
+	}
+	return payload
+}
+
+// parseLifecycleMessage reads "<kind>_message", "<kind>_qos" and
+// "<kind>_retain". Retain is true by default.
+func parseLifecycleMessage(values map[string]string, kind string) (LifecycleMessage, error) {
+	ret := LifecycleMessage{Retain: true}
+
+	if v, ok := values[kind+"_message"]; ok {
+		// invalid binary is not error, just warn
+		payload, err := utils.ParsePayload(v)
+		if err != nil {
+			log.Warnf("parse error %v_message, %v", kind, err)
+		}
+		ret.Payload = payload
+		ret.enabled = true
+		if utils.IsPayloadTemplate(string(payload)) {
+			ret.tmpl, err = utils.NewPayloadTemplate(string(payload))
+			if err != nil {
+				return ret, fmt.Errorf("%v_message template parse failed, %v", kind, err)
+			}
+		}
+	}
+	if v := values[kind+"_qos"]; v != "" {
+		qos, err := strconv.Atoi(v)
+		if err != nil || qos < 0 || qos > 2 {
+			return ret, fmt.Errorf("%v_qos parse failed, %v", kind, v)
+		}
+		ret.QoS = byte(qos)
+	}
+	if v := values[kind+"_retain"]; v != "" {
+		retain, err := strconv.ParseBool(v)
+		if err != nil {
+			return ret, fmt.Errorf("%v_retain parse failed, %v", kind, v)
+		}
+		ret.Retain = retain
+	}
+	return ret, nil
+}
+
+// parseLifecycleMessages reads the will, birth and offline messages. The
+// birth and offline messages are published to the will topic unless
+// birth_topic is set, so that they replace the retained will.
+// ex:
+//   will_message = "offline"
+//   will_qos = 1
+//   birth_message = "online"
+//   offline_message = "offline"
+func (b *Broker) parseLifecycleMessages(values map[string]string) error {
+	var err error
+	if b.Will, err = parseLifecycleMessage(values, "will"); err != nil {
+		return err
+	}
+	if b.Birth, err = parseLifecycleMessage(values, "birth"); err != nil {
+		return err
+	}
+	if b.Offline, err = parseLifecycleMessage(values, "offline"); err != nil {
+		return err
+	}
+
+	if values["will_topic"] != "" {
+		b.Will.Topic = strings.Join([]string{b.TopicPrefix, values["will_topic"]}, "/")
+	} else {
+		b.Will.Topic = strings.Join([]string{b.TopicPrefix, b.GatewayName, defaultWillTopic}, "/")
+	}
+	b.Birth.Topic = b.Will.Topic
+	if values["birth_topic"] != "" {
+		b.Birth.Topic = strings.Join([]string{b.TopicPrefix, values["birth_topic"]}, "/")
+	}
+	b.Offline.Topic = b.Birth.Topic
+	// offline is the same as the will by default
+	if b.Offline.IsZero() && !b.Will.IsZero() {
+		topic := b.Offline.Topic
+		b.Offline = b.Will
+		b.Offline.Topic = topic
+	}
+
+	// for compatibility
+	b.IsWill = !b.Will.IsZero()
+	b.WillMessage = b.Will.Payload
+	b.WillTopic = b.Will.Topic
+	return nil
+}
+
+// publishLifecycle publishes the birth or offline message.
+func (b *Broker) publishLifecycle(client *MQTT.Client, m LifecycleMessage) {
+	if m.IsZero() {
+		return
+	}
+	token := client.Publish(m.Topic, m.QoS, m.Retain, m.render(b.GatewayName))
+	if !token.WaitTimeout(lifecycleTimeout) {
+		log.Warnf("publish timeout, %v", m.Topic)
+		return
+	}
+	if token.Error() != nil {
+		log.Errorf("failed to publish, %v: %v", m.Topic, token.Error())
+	}
+}
+
+// NewAvailabilityBroker returns a copy of the broker to publish the
+// availability of the device. MQTT has only one will per connection, so
+// the device has its own connection whose will is the retained offline on
+// "<prefix>/<gateway>/<device>/availability".
+func NewAvailabilityBroker(b *Broker, device string) (*Broker, error) {
+	ret := &Broker{
+		GatewayName:   b.GatewayName,
+		Name:          b.Name,
+		Priority:      b.Priority,
+		Host:          b.Host,
+		Port:          b.Port,
+		Username:      b.Username,
+		Password:      b.Password,
+		RetryInterval: b.RetryInterval,
+		TopicPrefix:   b.TopicPrefix,
+		Tls:           b.Tls,
+		CaCert:        b.CaCert,
+		ClientCert:    b.ClientCert,
+		ClientKey:     b.ClientKey,
+		TLSConfig:     b.TLSConfig,
+		Subscribed:    NewSubscribed(),
+		GwChan:        b.GwChan,
+	}
+	topic, err := ret.GenerateTopic(&message.Message{
+		Sender: device,
+		Type:   message.TypeAvailability,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret.Will = LifecycleMessage{
+		Topic:   topic.Str,
+		Payload: []byte(message.Offline),
+		QoS:     1,
+		Retain:  true,
+		enabled: true,
+	}
+	ret.IsWill = true
+	ret.WillMessage = ret.Will.Payload
+	ret.WillTopic = ret.Will.Topic
+	return ret, nil
+}
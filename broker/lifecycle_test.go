@@ -0,0 +1,143 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+)
+
+func TestLifecycleMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[gateway]
+    name = "ham"
+
+[[broker."sango/1"]]
+    host = "192.168.1.22"
+    port = 1883
+    topic_prefix = "pre"
+    will_message = "dead"
+    will_qos = 1
+    birth_message = "{\"gateway\": \"{{.Gateway}}\", \"version\": \"{{.Version}}\"}"
+    birth_retain = false
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	b, err := NewBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+	assert.Equal(1, len(b))
+
+	assert.True(b[0].IsWill)
+	assert.Equal("pre/ham/will", b[0].Will.Topic)
+	assert.Equal(byte(1), b[0].Will.QoS)
+	assert.True(b[0].Will.Retain)
+
+	// birth and offline replace the retained will
+	assert.Equal("pre/ham/will", b[0].Birth.Topic)
+	assert.False(b[0].Birth.Retain)
+	Version = "0.3.0"
+	defer func() { Version = "" }()
+	assert.Equal(`{"gateway": "ham", "version": "0.3.0"}`, string(b[0].Birth.render("ham")))
+
+	// offline is the will by default
+	assert.Equal("pre/ham/will", b[0].Offline.Topic)
+	assert.Equal([]byte("dead"), b[0].Offline.render("ham"))
+	assert.Equal(byte(1), b[0].Offline.QoS)
+}
+
+func TestLifecycleMessagesNotConfigured(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[[broker."sango/1"]]
+    host = "192.168.1.22"
+    port = 1883
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	b, err := NewBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+	assert.False(b[0].IsWill)
+	assert.True(b[0].Birth.IsZero())
+	assert.True(b[0].Offline.IsZero())
+}
+
+func TestLifecycleMessagesInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, v := range []string{
+		`will_qos = 3`,
+		`birth_retain = "maybe"`,
+		`birth_message = "{{.Gateway"`,
+	} {
+		configStr := `
+[[broker."sango/1"]]
+    host = "192.168.1.22"
+    port = 1883
+    ` + v + "\n"
+		// rejected by the config schema or by the broker
+		conf, err := config.LoadConfigByte([]byte(configStr))
+		if err == nil {
+			_, err = NewBrokers(conf, make(chan message.Message))
+		}
+		assert.NotNil(err, v)
+	}
+}
+
+func TestNewAvailabilityBroker(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[gateway]
+    name = "ham"
+
+[[broker."sango/1"]]
+    host = "192.168.1.22"
+    port = 1883
+    topic_prefix = "pre"
+    will_message = "dead"
+    birth_message = "alive"
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	b, err := NewBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+	b[0].AddRPCSubscribed("dora", 1)
+
+	a, err := NewAvailabilityBroker(b[0], "dora")
+	assert.Nil(err)
+	assert.Equal("sango", a.Name)
+	assert.Equal("192.168.1.22", a.Host)
+	assert.Equal(1883, a.Port)
+	assert.Equal(0, a.Subscribed.Length())
+
+	// the will of the device, not of the gateway
+	assert.True(a.IsWill)
+	assert.Equal("pre/ham/dora/availability", a.Will.Topic)
+	assert.Equal([]byte("offline"), a.Will.render("ham"))
+	assert.Equal(byte(1), a.Will.QoS)
+	assert.True(a.Will.Retain)
+	assert.True(a.Birth.IsZero())
+	assert.True(a.Offline.IsZero())
+
+	_, err = NewAvailabilityBroker(b[0], "#")
+	assert.NotNil(err)
+}
@@ -20,6 +20,8 @@ import (
 	"sync"
 
 	log "github.com/Sirupsen/logrus"
+
+	"github.com/shiguredo/fuji/message"
 )
 
 type Subscribed struct {
@@ -69,6 +71,20 @@ func (b *Broker) AddSubscribed(deviceName string, qos byte) error {
 	log.Infof("subscribe: %#v", t)
 	return b.Subscribed.Add(t, qos)
 }
+
+// AddRPCSubscribed subscribes "<prefix>/<gateway>/<device>/rpc".
+func (b *Broker) AddRPCSubscribed(deviceName string, qos byte) error {
+	t := strings.Join([]string{b.TopicPrefix, b.GatewayName, deviceName, message.TypeRPC}, "/")
+	log.Infof("subscribe rpc: %#v", t)
+	return b.Subscribed.Add(t, qos)
+}
+
+// AddControlSubscribed subscribes "<prefix>/<gateway>/$control/#".
+func (b *Broker) AddControlSubscribed(qos byte) error {
+	t := strings.Join([]string{b.TopicPrefix, b.GatewayName, "$control", "#"}, "/")
+	log.Infof("subscribe control: %#v", t)
+	return b.Subscribed.Add(t, qos)
+}
 func (b *Broker) DeleteSubscribed(deviceName string, qos byte) error {
 	t := strings.Join([]string{b.TopicPrefix, b.GatewayName, deviceName}, "/")
 	return b.Subscribed.Delete(t)
@@ -19,11 +19,13 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
 
 	"github.com/shiguredo/fuji"
+	"github.com/shiguredo/fuji/broker"
 )
 
 var app *cli.App
@@ -34,6 +36,7 @@ func main() {
 	app.Name = "fuji-gw"
 	app.Usage = "fuji-gw -c config-file"
 	app.Version = version
+	broker.Version = version
 
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
@@ -48,10 +51,43 @@ func main() {
 		},
 	}
 
+	app.Commands = []cli.Command{
+		{
+			Name:   "check",
+			Usage:  "validate the config file without connecting anywhere",
+			Action: Check,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "conf, c",
+					Usage: "config filepath, instead of the global one",
+				},
+			},
+		},
+		{
+			Name:   "bench",
+			Usage:  "run the gateway for a fixed duration and report publish throughput",
+			Action: Bench,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "conf, c",
+					Usage: "config filepath, instead of the global one",
+				},
+				cli.DurationFlag{
+					Name:  "duration, t",
+					Value: 30 * time.Second,
+					Usage: "benchmark duration",
+				},
+			},
+		},
+	}
+
 	cli.VersionPrinter = printVersion
 
 	app.Action = Action
-	app.Run(os.Args)
+	if err := app.Run(os.Args); err != nil {
+		// usage error, help is already shown
+		os.Exit(2)
+	}
 }
 
 func printVersion(c *cli.Context) {
@@ -70,7 +106,7 @@ func Action(c *cli.Context) {
 	if err != nil {
 		log.Error(err)
 		cli.ShowAppHelp(c)
-		return
+		os.Exit(2)
 	}
 
 	if c.Bool("d") {
@@ -81,6 +117,63 @@ func Action(c *cli.Context) {
 	fuji.Start(c.String("conf"))
 }
 
+// Bench runs the gateway and prints the report. It exits with 1 if the
+// benchmark could not be run. Like check, -c is accepted after "bench".
+func Bench(c *cli.Context) {
+	if c.GlobalBool("d") {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.WarnLevel)
+	}
+
+	duration := c.Duration("duration")
+	if duration <= 0 {
+		log.Errorf("invalid duration, %v", duration)
+		os.Exit(1)
+	}
+
+	path := c.String("conf")
+	if path == "" {
+		path = c.GlobalString("conf")
+	}
+	fmt.Fprintf(c.App.Writer, "benchmark fuji gateway for %v\n", duration)
+	report, err := fuji.Bench(path, duration)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	fmt.Fprintln(c.App.Writer, report)
+}
+
+// Check validates the config file and exits with 1 if it has errors.
+// Both "fuji-gw -c <file> check" and "fuji-gw check -c <file>" are
+// accepted.
+func Check(c *cli.Context) {
+	log.SetLevel(log.ErrorLevel)
+
+	if err := ValidateArgs(c); err != nil {
+		log.Error(err)
+		cli.ShowCommandHelp(c, "check")
+		os.Exit(2)
+	}
+
+	path := c.String("conf")
+	if path == "" {
+		path = c.GlobalString("conf")
+	}
+	errs := fuji.CheckConfig(path)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", path, err)
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+	fmt.Fprintf(c.App.Writer, "%v: OK\n", path)
+}
+
 func ValidateArgs(c *cli.Context) error {
+	if len(c.Args()) > 0 {
+		return fmt.Errorf("unknown arguments: %v", c.Args())
+	}
 	return nil
 }
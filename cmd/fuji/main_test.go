@@ -0,0 +1,71 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestHelperMain runs main with the args in FUJI_TEST_ARGS. It is invoked
+// as a subprocess by runMain.
+func TestHelperMain(t *testing.T) {
+	if os.Getenv("FUJI_TEST_ARGS") == "" {
+		return
+	}
+	os.Args = append([]string{"fuji-gw"}, strings.Split(os.Getenv("FUJI_TEST_ARGS"), "\n")...)
+	main()
+	os.Exit(0)
+}
+
+// runMain runs fuji-gw with args and returns true if it exits with 0.
+func runMain(args ...string) bool {
+	cmd := exec.Command(os.Args[0], "-test.run=TestHelperMain")
+	cmd.Env = append(os.Environ(), "FUJI_TEST_ARGS="+strings.Join(args, "\n"))
+	return cmd.Run() == nil
+}
+
+func TestCheckExitStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	good := "../../tests/connect.toml"
+	bad := "../../tests/nonexistent.toml"
+
+	assert.True(runMain("-c", good, "check"))
+	assert.True(runMain("check", "-c", good))
+	assert.False(runMain("-c", bad, "check"))
+	assert.False(runMain("check", "-c", bad))
+	assert.False(runMain("check", "--conf", bad))
+
+	// usage errors
+	assert.False(runMain("check", "-x", good))
+	assert.False(runMain("check", "-c", good, "extra"))
+}
+
+func TestBenchExitStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	good := "../../tests/connect.toml"
+	bad := "../../tests/nonexistent.toml"
+
+	assert.True(runMain("bench", "-c", good, "-t", "100ms"))
+	assert.False(runMain("bench", "-c", bad, "-t", "100ms"))
+	assert.False(runMain("-c", bad, "bench", "-t", "100ms"))
+	assert.False(runMain("bench", "-c", good, "-t", "0"))
+}
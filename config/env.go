@@ -0,0 +1,126 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// FileSuffix is the suffix of keys whose value is read from the file.
+// ex:
+//
+//	password_file = "/run/secrets/sango_password"
+const FileSuffix = "_file"
+
+// reEnvVar matches ${NAME} and $${ which is an escaped "${". $NAME
+// without braces is not expanded because it is used in topics like $SYS.
+var reEnvVar = regexp.MustCompile(`\$?\$\{([^}]*)\}`)
+
+var reEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// expandEnv replaces ${NAME} in the value by the environment variable,
+// and ${NAME:-default} by default if it is unset or empty. Undefined
+// variables without default are error, so that empty credentials are not
+// used silently.
+func expandEnv(value string) (string, error) {
+	var err error
+	ret := reEnvVar.ReplaceAllStringFunc(value, func(s string) string {
+		if strings.HasPrefix(s, "$$") {
+			return s[1:]
+		}
+		name := s[2 : len(s)-1]
+		def, hasDefault := "", false
+		if i := strings.Index(name, ":-"); i >= 0 {
+			name, def, hasDefault = name[:i], name[i+2:], true
+		}
+		if !reEnvName.MatchString(name) {
+			if err == nil {
+				err = fmt.Errorf("invalid environment variable name, %q", name)
+			}
+			return s
+		}
+		v, ok := os.LookupEnv(name)
+		switch {
+		case hasDefault && v == "":
+			return def
+		case !ok:
+			if err == nil {
+				err = fmt.Errorf("environment variable %v is not set", name)
+			}
+			return s
+		}
+		return v
+	})
+	return ret, err
+}
+
+// readValueFile returns the content of the file without trailing newlines.
+func readValueFile(path string) (string, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(dat), "\r\n"), nil
+}
+
+// resolveSection expands environment variables in the values of the
+// section, and replaces "<key>_file" by "<key>" with the content of the
+// file.
+func resolveSection(s *ConfigSection) SchemaErrors {
+	var errs SchemaErrors
+
+	keys := make([]string, 0, len(s.Values))
+	for k := range s.Values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v, err := expandEnv(s.Values[k])
+		if err != nil {
+			errs = append(errs, s.schemaError(k, err.Error()))
+			continue
+		}
+		s.Values[k] = v
+	}
+
+	for _, k := range keys {
+		if !strings.HasSuffix(k, FileSuffix) || len(k) == len(FileSuffix) {
+			continue
+		}
+		key := strings.TrimSuffix(k, FileSuffix)
+		if _, ok := s.Values[key]; ok {
+			errs = append(errs, s.schemaError(k, fmt.Sprintf("could not be set with %v", key)))
+			continue
+		}
+		v, err := readValueFile(s.Values[k])
+		if err != nil {
+			errs = append(errs, s.schemaError(k, err.Error()))
+			continue
+		}
+		delete(s.Values, k)
+		s.Values[key] = v
+		if s.lists != nil {
+			s.lists[key] = s.lists[k]
+			delete(s.lists, k)
+		}
+	}
+	return errs
+}
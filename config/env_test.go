@@ -0,0 +1,115 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandEnv(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv("FUJI_TEST_USER", "shiguredo")
+	defer os.Unsetenv("FUJI_TEST_USER")
+	os.Unsetenv("FUJI_TEST_UNDEFINED")
+
+	v, err := expandEnv("${FUJI_TEST_USER}@sango")
+	assert.Nil(err)
+	assert.Equal("shiguredo@sango", v)
+
+	// $NAME without braces and escaped $${ are left as is
+	v, err = expandEnv("$SYS/$${FUJI_TEST_USER}")
+	assert.Nil(err)
+	assert.Equal("$SYS/${FUJI_TEST_USER}", v)
+
+	// default is used if the variable is unset or empty
+	v, err = expandEnv("${FUJI_TEST_UNDEFINED:-fuji-gw}/${FUJI_TEST_USER:-fuji-gw}")
+	assert.Nil(err)
+	assert.Equal("fuji-gw/shiguredo", v)
+	v, err = expandEnv("${FUJI_TEST_UNDEFINED:-}")
+	assert.Nil(err)
+	assert.Equal("", v)
+
+	_, err = expandEnv("${FUJI_TEST_UNDEFINED}")
+	assert.NotNil(err)
+	_, err = expandEnv("${1NVALID}")
+	assert.NotNil(err)
+}
+
+func TestLoadConfigEnvAndFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fuji-config")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	secret := filepath.Join(dir, "password")
+	assert.Nil(ioutil.WriteFile(secret, []byte("s3cret\n"), 0600))
+
+	os.Setenv("FUJI_TEST_GATEWAY", "ham")
+	os.Setenv("FUJI_TEST_DIR", dir)
+	defer os.Unsetenv("FUJI_TEST_GATEWAY")
+	defer os.Unsetenv("FUJI_TEST_DIR")
+
+	configStr := `
+[gateway]
+    name = "${FUJI_TEST_GATEWAY}"
+
+[[broker."sango/1"]]
+    host = "192.168.1.22"
+    port = 1883
+    password_file = "${FUJI_TEST_DIR}/password"
+`
+	conf, err := LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	assert.Equal("ham", conf.GatewayName)
+	assert.Equal(2, len(conf.Sections))
+	values := conf.Sections[1].Values
+	assert.Equal("s3cret", values["password"])
+	_, ok := values["password_file"]
+	assert.False(ok)
+}
+
+func TestLoadConfigEnvAndFileInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Unsetenv("FUJI_TEST_UNDEFINED")
+
+	for _, c := range []struct {
+		value string
+		line  int
+	}{
+		{`password = "${FUJI_TEST_UNDEFINED}"`, 5},
+		{`password_file = "/nonexistent/password"`, 5},
+		{`password = "pass"
+    password_file = "/nonexistent/password"`, 6},
+	} {
+		configStr := `
+[[broker."sango/1"]]
+    host = "192.168.1.22"
+    port = 1883
+    ` + c.value + "\n"
+		_, err := LoadConfigByte([]byte(configStr))
+		errs, ok := err.(SchemaErrors)
+		assert.True(ok, c.value)
+		if assert.Equal(1, len(errs), c.value) {
+			assert.Equal(c.line, errs[0].Line, c.value)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// includePaths returns the files matched by include patterns in order.
+// Relative patterns are relative to the directory of confPath. A pattern
+// without wildcards must match an existing file.
+func includePaths(confPath string, patterns []string) ([]string, error) {
+	dir := filepath.Dir(confPath)
+	seen := map[string]bool{filepath.Clean(confPath): true}
+	var ret []string
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include, %v, %v", pattern, err)
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, fmt.Errorf("include file not found, %v", pattern)
+		}
+		for _, m := range matches {
+			if fi, err := os.Stat(m); err != nil || fi.IsDir() {
+				continue
+			}
+			if seen[m] {
+				continue
+			}
+			seen[m] = true
+			ret = append(ret, m)
+		}
+	}
+	return ret, nil
+}
+
+// mergeSections adds sections of an included file. Keys of gateway and
+// status sections are merged, and other sections are appended. It is an
+// error if the same key or section is defined in both files.
+func mergeSections(sections, added []ConfigSection) ([]ConfigSection, error) {
+	for _, a := range added {
+		i := findSection(sections, a)
+		if i < 0 {
+			sections = append(sections, a)
+			continue
+		}
+		s := &sections[i]
+		if a.Type != "gateway" && !(a.Type == "status" && a.Name == "") {
+			return nil, fmt.Errorf("%v is defined in both %v and %v", a.label(), fileLabel(s.file), fileLabel(a.file))
+		}
+		for k, v := range a.Values {
+			if _, ok := s.Values[k]; ok {
+				return nil, fmt.Errorf("%v: %v is defined in both %v and %v", a.label(), k, fileLabel(s.file), fileLabel(a.file))
+			}
+			s.Values[k] = v
+		}
+	}
+	return sections, nil
+}
+
+func findSection(sections []ConfigSection, s ConfigSection) int {
+	for i, c := range sections {
+		if c.Title == s.Title && c.Name == s.Name && c.Arg == s.Arg {
+			return i
+		}
+	}
+	return -1
+}
+
+func fileLabel(file string) string {
+	if file == "" {
+		return "config"
+	}
+	return file
+}
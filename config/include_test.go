@@ -0,0 +1,140 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeConfigFiles writes files into a temporary directory, and returns
+// the directory.
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "fuji-config")
+	assert.Nil(t, err)
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+	return dir
+}
+
+const includeBase = `
+include = ["conf.d/*.toml"]
+
+[gateway]
+    name = "ham"
+
+[[broker."sango/1"]]
+    host = "192.168.1.22"
+    port = 1883
+`
+
+func TestLoadConfigInclude(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := writeConfigFiles(t, map[string]string{
+		"config.toml": includeBase,
+		"conf.d/a.toml": `
+[gateway]
+    max_retry_count = 7
+
+[device."spam"]
+    type = "schematest"
+    broker = "sango"
+`,
+		"conf.d/b.toml": `
+[[broker."sango/2"]]
+    host = "192.168.1.23"
+    port = 1883
+
+[device."egg"]
+    type = "schematest"
+    broker = "sango"
+`,
+		"conf.d/ignored.txt": `not toml`,
+	})
+	defer os.RemoveAll(dir)
+
+	conf, err := LoadConfig(filepath.Join(dir, "config.toml"))
+	assert.Nil(err)
+	assert.Equal("ham", conf.GatewayName)
+	assert.Equal([]string{"sango", "sango"}, conf.BrokerNames)
+
+	var labels []string
+	for _, s := range conf.Sections {
+		labels = append(labels, s.label())
+	}
+	assert.Equal([]string{`gateway`, `broker "sango/1"`, `device "spam"`, `broker "sango/2"`, `device "egg"`}, labels)
+	assert.Equal("7", conf.Sections[0].Values["max_retry_count"])
+}
+
+func TestLoadConfigIncludeConflict(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, c := range []struct {
+		included string
+		msg      string
+	}{
+		{`
+[gateway]
+    name = "egg"
+`, `gateway: name is defined in both`},
+		{`
+[[broker."sango/1"]]
+    host = "192.168.1.23"
+    port = 1883
+`, `broker "sango/1" is defined in both`},
+		{`
+[device."spam"]
+    type = "schematest"
+    unknown = 1
+`, `conf.d/a.toml: line 4: device "spam": unknown: unknown key`},
+		{`
+include = ["*.toml"]
+`, `include is not supported in included files`},
+	} {
+		dir := writeConfigFiles(t, map[string]string{
+			"config.toml":   includeBase,
+			"conf.d/a.toml": c.included,
+		})
+		_, err := LoadConfig(filepath.Join(dir, "config.toml"))
+		if assert.NotNil(err, c.msg) {
+			assert.True(strings.Contains(err.Error(), c.msg), err.Error())
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLoadConfigIncludeNotFound(t *testing.T) {
+	assert := assert.New(t)
+
+	// patterns with wildcards may match nothing
+	dir := writeConfigFiles(t, map[string]string{
+		"config.toml": includeBase,
+	})
+	defer os.RemoveAll(dir)
+	_, err := LoadConfig(filepath.Join(dir, "config.toml"))
+	assert.Nil(err)
+
+	_, err = LoadConfigByte([]byte(`include = ["/nonexistent/fuji.toml"]`))
+	assert.NotNil(err)
+}
@@ -16,52 +16,70 @@ package config
 
 import (
 	"fmt"
-	"github.com/BurntSushi/toml"
 	"io/ioutil"
+	"sort"
 	"strconv"
 	"strings"
-)
+	"time"
 
-func buildUniqueValueMap(values map[string]interface{}) map[string]string {
-	valueMap := make(map[string]string)
+	"github.com/BurntSushi/toml"
+)
 
-	for k, v := range values {
-		switch v.(type) {
-		case int64:
-			valueMap[k] = strconv.FormatInt(v.(int64), 10)
-		case bool:
-			valueMap[k] = strconv.FormatBool(v.(bool))
-		default:
-			valueMap[k] = v.(string)
+// stringify returns the TOML value as string. Arrays are joined with
+// commas, which sections parse as lists.
+func stringify(v interface{}) (value string, isList bool, err error) {
+	switch t := v.(type) {
+	case string:
+		return t, false, nil
+	case int64:
+		return strconv.FormatInt(t, 10), false, nil
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), false, nil
+	case bool:
+		return strconv.FormatBool(t), false, nil
+	case time.Time:
+		return t.Format(time.RFC3339), false, nil
+	case []interface{}:
+		items := make([]string, 0, len(t))
+		for _, i := range t {
+			s, nested, err := stringify(i)
+			if err != nil || nested {
+				return "", true, fmt.Errorf("nested array or table is not supported")
+			}
+			items = append(items, s)
 		}
+		return strings.Join(items, ", "), true, nil
 	}
-
-	return valueMap
+	return "", false, fmt.Errorf("table is not supported here")
 }
 
-func buildMultipleValueMap(values []map[string]interface{}) map[string]string {
-	valueMap := make(map[string]string)
-
-	for _, m := range values {
+// buildValueMap stringifies values of the tables into a section. Values
+// of later tables override.
+func buildValueMap(section *ConfigSection, tables ...map[string]interface{}) SchemaErrors {
+	var errs SchemaErrors
+	section.Values = make(ValueMap)
+	section.lists = make(map[string]bool)
+	for _, m := range tables {
 		for k, v := range m {
-			switch v.(type) {
-			case int64:
-				valueMap[k] = strconv.FormatInt(v.(int64), 10)
-			case bool:
-				valueMap[k] = strconv.FormatBool(v.(bool))
-			default:
-				valueMap[k] = v.(string)
+			value, isList, err := stringify(v)
+			if err != nil {
+				errs = append(errs, section.schemaError(k, err.Error()))
+				continue
 			}
+			section.Values[k] = value
+			section.lists[k] = isList
 		}
 	}
-
-	return valueMap
+	return errs
 }
 
 func getGatewayName(gatewaySectionMap SectionMap) (string, error) {
 	for name, value := range gatewaySectionMap {
 		if name == "name" {
-			gatewayName := value.(string)
+			gatewayName, _, err := stringify(value)
+			if err != nil {
+				return "", ConfigSection{Title: "gateway"}.schemaError("name", err.Error())
+			}
 			if gatewayName == "" {
 				return "", fmt.Errorf("gateway has not name")
 			}
@@ -71,139 +89,123 @@ func getGatewayName(gatewaySectionMap SectionMap) (string, error) {
 	return "", nil
 }
 
-func addGatewaySection(configSections []ConfigSection, gatewaySectionMap SectionMap) []ConfigSection {
-	valueMap := make(ValueMap)
-	for name, value := range gatewaySectionMap {
-
-		switch value.(type) {
-		case int64:
-			valueMap[name] = strconv.FormatInt(value.(int64), 10)
-		case bool:
-			valueMap[name] = strconv.FormatBool(value.(bool))
-		default:
-			valueMap[name] = value.(string)
-		}
-
+func addGatewaySection(configSections []ConfigSection, gatewaySectionMap SectionMap) ([]ConfigSection, SchemaErrors) {
+	rt := ConfigSection{
+		Title: "gateway",
+		Type:  "gateway",
 	}
-
-	if len(valueMap) > 0 {
-		rt := ConfigSection{
-			Title:  "gateway",
-			Type:   "gateway",
-			Values: valueMap,
-		}
+	errs := buildValueMap(&rt, gatewaySectionMap)
+	if len(rt.Values) > 0 {
 		configSections = append(configSections, rt)
 	}
 
-	return configSections
+	return configSections, errs
 }
 
-func addStatusSections(configSections []ConfigSection, statusSectionMap SectionMap) []ConfigSection {
-	valueMap := make(ValueMap)
+func addStatusSections(configSections []ConfigSection, statusSectionMap SectionMap) ([]ConfigSection, SchemaErrors) {
+	// children are arrays of tables. ex: [[status."cpu"]]
+	values := make(map[string]interface{})
+	children := make(map[string][]map[string]interface{})
 	for name, value := range statusSectionMap {
-
-		switch value.(type) {
-		case int64:
-			valueMap[name] = strconv.FormatInt(value.(int64), 10)
-		case bool:
-			valueMap[name] = strconv.FormatBool(value.(bool))
-		case []map[string]interface{}:
-			// do nothing
-		default:
-			valueMap[name] = value.(string)
+		if c, ok := value.([]map[string]interface{}); ok {
+			children[name] = c
+		} else {
+			values[name] = value
 		}
+	}
 
+	rt := ConfigSection{
+		Title: "status",
+		Type:  "status",
 	}
-	if len(valueMap) > 0 {
-		rt := ConfigSection{
-			Title:  "status",
-			Type:   "status",
-			Values: valueMap,
-		}
+	errs := buildValueMap(&rt, values)
+	if len(rt.Values) > 0 {
 		configSections = append(configSections, rt)
 	}
 
-	for name, value := range statusSectionMap {
-
-		valueMap := make(ValueMap)
-		switch value.(type) {
-		case []map[string]interface{}:
-			{
-				m := value.([]map[string]interface{})
-				for _, v := range m {
-					for k, vv := range v {
-						switch vv.(type) {
-						case int64:
-							valueMap[k] = strconv.FormatInt(vv.(int64), 10)
-						case bool:
-							valueMap[k] = strconv.FormatBool(vv.(bool))
-						default:
-							valueMap[k] = vv.(string)
-						}
-					}
-				}
-			}
+	for _, name := range sortedKeys(children) {
+		rt := ConfigSection{
+			Title: "status",
+			Type:  "status",
+			Name:  name,
 		}
-
-		if len(valueMap) > 0 {
-			rt := ConfigSection{
-				Title:  "status",
-				Type:   "status",
-				Name:   name,
-				Values: valueMap,
-			}
+		errs = append(errs, buildValueMap(&rt, children[name]...)...)
+		if len(rt.Values) > 0 {
 			configSections = append(configSections, rt)
 		}
 	}
 
-	return configSections
+	return configSections, errs
 }
 
-func addConfigSections(configSections []ConfigSection, title string, sectionMap SectionMap) ([]ConfigSection, error) {
-	for name, values := range sectionMap {
+func addConfigSections(configSections []ConfigSection, title string, sectionMap SectionMap) ([]ConfigSection, SchemaErrors) {
+	var errs SchemaErrors
+	for _, name := range sortedKeys(sectionMap) {
+		values := sectionMap[name]
+		invalid := func(msg string) SchemaErrors {
+			return SchemaErrors{ConfigSection{Title: title, Name: name}.schemaError("", msg)}
+		}
 		t := strings.Split(name, "/")
 		if len(t) > 2 {
-			return configSections, fmt.Errorf("invalid section(slash), %v", t)
+			return configSections, invalid("invalid section name, too many slashes")
 		}
 
-		var valueMap map[string]string
+		rt := ConfigSection{
+			Title: title,
+			Type:  title,
+			Name:  t[0],
+		}
+		if len(t) == 2 { // if args exists, store it
+			rt.Arg = t[1]
+		}
 
-		switch values.(type) {
+		switch v := values.(type) {
 		case map[string]interface{}:
 			if title == "broker" {
 				msgFmt := "invalid broker section. not [broker.\"%s\"] but [[broker.\"%s\"]]"
-				return configSections, fmt.Errorf(msgFmt, name, name)
+				return configSections, invalid(fmt.Sprintf(msgFmt, name, name))
 			}
-			valueMap = buildUniqueValueMap(values.(map[string]interface{}))
+			errs = append(errs, buildValueMap(&rt, v)...)
 		case []map[string]interface{}:
 			if title == "device" {
 				msgFmt := "invalid device section. not [[device.\"%s\"]] but [device.\"%s\"]"
-				return configSections, fmt.Errorf(msgFmt, name, name)
+				return configSections, invalid(fmt.Sprintf(msgFmt, name, name))
 			}
-			valueMap = buildMultipleValueMap(values.([]map[string]interface{}))
+			errs = append(errs, buildValueMap(&rt, v...)...)
 		default:
-			return configSections, fmt.Errorf("valid section not found", name)
+			return configSections, invalid(fmt.Sprintf("invalid section, %T", values))
 		}
 
-		if len(valueMap) == 0 {
+		if len(rt.Values) == 0 {
 			continue
 		}
-
-		rt := ConfigSection{
-			Title:  title,
-			Type:   title,
-			Name:   t[0],
-			Values: valueMap,
-		}
-
-		if len(t) == 2 { // if args exists, store it
-			rt.Arg = t[1]
+		// legacy form, [device."<name>/<type>"]
+		if title == "device" && rt.Values["type"] == "" && rt.Arg != "" {
+			rt.Values["type"] = rt.Arg
 		}
 
 		configSections = append(configSections, rt)
 	}
 
-	return configSections, nil
+	return configSections, errs
+}
+
+// sortedKeys returns keys of the map in order, so that sections and
+// errors are stable.
+func sortedKeys(m interface{}) []string {
+	var ret []string
+	switch t := m.(type) {
+	case SectionMap:
+		for k := range t {
+			ret = append(ret, k)
+		}
+	case map[string][]map[string]interface{}:
+		for k := range t {
+			ret = append(ret, k)
+		}
+	}
+	sort.Strings(ret)
+	return ret
 }
 
 // LoadConfig loads toml format file from confPath arg and returns []ConfigSection.
@@ -214,9 +216,11 @@ func addConfigSections(configSections []ConfigSection, title string, sectionMap
 // [[broker."sango/2"]]
 //
 // ret = [
-//   ConfigSection{Type: "broker", Name: "sango"},
-//   ConfigSection{Type: "broker", Name: "sango", Arg: "1"},
-//   ConfigSection{Type: "broker", Name: "sango", Arg: "2"},
+//
+//	ConfigSection{Type: "broker", Name: "sango"},
+//	ConfigSection{Type: "broker", Name: "sango", Arg: "1"},
+//	ConfigSection{Type: "broker", Name: "sango", Arg: "2"},
+//
 // ]
 func LoadConfig(confPath string) (Config, error) {
 	dat, err := ioutil.ReadFile(confPath)
@@ -224,52 +228,66 @@ func LoadConfig(confPath string) (Config, error) {
 		return Config{}, err
 	}
 
-	return LoadConfigByte(dat)
+	return LoadConfigByteFrom(dat, confPath)
 }
 
 // LoadConfigByte returns []ConfigSection from []byte.
-// This is invoked from LoadConfig.
+// Included files are relative to the current directory.
 func LoadConfigByte(conf []byte) (Config, error) {
-	config := Config{}
-	var configToml ConfigToml
-
-	if err := toml.Unmarshal(conf, &configToml); err != nil {
-		return config, err
-	}
+	return LoadConfigByteFrom(conf, "")
+}
 
-	var sections []ConfigSection
-	var bn []string
+// LoadConfigByteFrom returns []ConfigSection from []byte which is the
+// content of confPath. Included files are relative to the directory of
+// confPath, and merged into the config.
+// ex:
+//
+//	include = ["conf.d/*.toml"]
+func LoadConfigByteFrom(conf []byte, confPath string) (Config, error) {
+	config := Config{}
 
-	// gateway section
-	gatewayName, err := getGatewayName(configToml.Gateway)
+	sections, includes, err := loadSections(conf, confPath)
 	if err != nil {
 		return config, err
 	}
-	config.GatewayName = gatewayName
-	sections = addGatewaySection(sections, configToml.Gateway)
-
-	// status section
-	sections = addStatusSections(sections, configToml.Status)
 
-	// broker sections
-	sections, err = addConfigSections(sections, "broker", configToml.Brokers)
+	paths, err := includePaths(confPath, includes)
 	if err != nil {
 		return config, err
 	}
-
-	// device sections
-	sections, err = addConfigSections(sections, "device", configToml.Devices)
-	if err != nil {
-		return config, err
+	for _, path := range paths {
+		dat, err := ioutil.ReadFile(path)
+		if err != nil {
+			return config, err
+		}
+		added, nested, err := loadSections(dat, path)
+		if errs, ok := err.(SchemaErrors); ok {
+			for i := range errs {
+				errs[i].File = path
+			}
+			return config, errs
+		}
+		if err != nil {
+			return config, fmt.Errorf("%v: %v", path, err)
+		}
+		if len(nested) > 0 {
+			return config, fmt.Errorf("%v: include is not supported in included files", path)
+		}
+		sections, err = mergeSections(sections, added)
+		if err != nil {
+			return config, err
+		}
 	}
 
 	// broker names
-	for name, _ := range configToml.Brokers {
-		t := strings.Split(name, "/")
-		if len(t) > 2 {
-			continue
+	var bn []string
+	for _, s := range sections {
+		switch s.Type {
+		case "gateway":
+			config.GatewayName = s.Values["name"]
+		case "broker":
+			bn = append(bn, s.Name)
 		}
-		bn = append(bn, t[0])
 	}
 
 	config.Sections = sections
@@ -277,3 +295,76 @@ func LoadConfigByte(conf []byte) (Config, error) {
 
 	return config, nil
 }
+
+// topLevelKeys are the keys which could be written at the top level.
+var topLevelKeys = map[string]bool{
+	"include": true,
+	"gateway": true,
+	"broker":  true,
+	"device":  true,
+	"status":  true,
+}
+
+// loadSections returns sections of the config file, and include
+// patterns of it.
+func loadSections(conf []byte, file string) ([]ConfigSection, []string, error) {
+	var configToml ConfigToml
+
+	md, err := toml.Decode(string(conf), &configToml)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var sections []ConfigSection
+	var errs, e SchemaErrors
+
+	// unknown sections. ex: [devices."spam"]
+	unknown := map[string]bool{}
+	for _, k := range md.Keys() {
+		if !topLevelKeys[k[0]] && !unknown[k[0]] {
+			unknown[k[0]] = true
+			errs = append(errs, ConfigSection{Title: k[0]}.schemaError("", "unknown section"))
+		}
+	}
+
+	// gateway section
+	if _, err := getGatewayName(configToml.Gateway); err != nil {
+		if se, ok := err.(SchemaError); ok {
+			errs := SchemaErrors{se}
+			errs.setLines(conf)
+			return nil, nil, errs
+		}
+		return nil, nil, err
+	}
+	sections, e = addGatewaySection(sections, configToml.Gateway)
+	errs = append(errs, e...)
+
+	// status section
+	sections, e = addStatusSections(sections, configToml.Status)
+	errs = append(errs, e...)
+
+	// broker sections
+	sections, e = addConfigSections(sections, "broker", configToml.Brokers)
+	errs = append(errs, e...)
+
+	// device sections
+	sections, e = addConfigSections(sections, "device", configToml.Devices)
+	errs = append(errs, e...)
+
+	// keys and values
+	for i := range sections {
+		sections[i].file = file
+		if e := resolveSection(&sections[i]); len(e) > 0 {
+			errs = append(errs, e...)
+			continue
+		}
+		errs = append(errs, validateSection(&sections[i])...)
+	}
+	if len(errs) > 0 {
+		errs.setLines(conf)
+		sort.Stable(errs)
+		return nil, nil, errs
+	}
+
+	return sections, configToml.Include, nil
+}
@@ -0,0 +1,270 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// keyLines returns the first lines where the toml keys are defined,
+// indexed by keyString. The config is walked once, skipping values so
+// that multi-line strings and inline tables which look like keys are
+// not taken. The line of a key is where it is written, and an implicit
+// table is on the line of its first key.
+func keyLines(conf []byte) map[string]int {
+	ret := make(map[string]int)
+	add := func(key []string, line int) {
+		// implicit tables like "devices" of [devices."spam"] are
+		// not written
+		for i := 1; i <= len(key); i++ {
+			s := keyString(key[:i])
+			if _, ok := ret[s]; !ok {
+				ret[s] = line
+			}
+		}
+	}
+
+	s := &tomlScanner{buf: conf, line: 1}
+	var table []string
+	for {
+		s.skipSpace()
+		if s.pos >= len(s.buf) {
+			break
+		}
+		line := s.line
+		if s.buf[s.pos] == '[' {
+			key, ok := s.header()
+			if !ok {
+				break
+			}
+			table = key
+			add(table, line)
+			continue
+		}
+		key, ok := s.key('=')
+		if !ok {
+			break
+		}
+		add(append(table[:len(table):len(table)], key...), line)
+		s.value()
+	}
+	return ret
+}
+
+// tomlScanner walks the toml config for keyLines. It is not a parser,
+// the config is validated by the decoder before.
+type tomlScanner struct {
+	buf  []byte
+	pos  int
+	line int
+}
+
+// skipSpace skips white spaces, new lines and comments.
+func (s *tomlScanner) skipSpace() {
+	for s.pos < len(s.buf) {
+		switch s.buf[s.pos] {
+		case '\n':
+			s.line++
+		case ' ', '\t', '\r':
+		case '#':
+			s.skipLine()
+			continue
+		default:
+			return
+		}
+		s.pos++
+	}
+}
+
+// skipLine skips to the new line, which is not consumed.
+func (s *tomlScanner) skipLine() {
+	for s.pos < len(s.buf) && s.buf[s.pos] != '\n' {
+		s.pos++
+	}
+}
+
+// header returns the key of [table] or [[array of tables]].
+func (s *tomlScanner) header() ([]string, bool) {
+	s.pos++
+	array := s.pos < len(s.buf) && s.buf[s.pos] == '['
+	if array {
+		s.pos++
+	}
+	key, ok := s.key(']')
+	if !ok {
+		return nil, false
+	}
+	if array {
+		if s.pos >= len(s.buf) || s.buf[s.pos] != ']' {
+			return nil, false
+		}
+		s.pos++
+	}
+	s.skipLine()
+	return key, true
+}
+
+// key returns the dotted key which ends with end. end is consumed.
+func (s *tomlScanner) key(end byte) ([]string, bool) {
+	var ret []string
+	for {
+		for s.pos < len(s.buf) && (s.buf[s.pos] == ' ' || s.buf[s.pos] == '\t') {
+			s.pos++
+		}
+		if s.pos >= len(s.buf) {
+			return nil, false
+		}
+		start := s.pos
+		switch c := s.buf[s.pos]; c {
+		case '"', '\'':
+			if !s.skipString() {
+				return nil, false
+			}
+			k := string(s.buf[start+1 : s.pos-1])
+			if c == '"' {
+				if u, err := strconv.Unquote(`"` + k + `"`); err == nil {
+					k = u
+				}
+			}
+			ret = append(ret, k)
+		default:
+			for s.pos < len(s.buf) && isBareKeyChar(s.buf[s.pos]) {
+				s.pos++
+			}
+			if s.pos == start {
+				return nil, false
+			}
+			ret = append(ret, string(s.buf[start:s.pos]))
+		}
+		for s.pos < len(s.buf) && (s.buf[s.pos] == ' ' || s.buf[s.pos] == '\t') {
+			s.pos++
+		}
+		if s.pos >= len(s.buf) {
+			return nil, false
+		}
+		switch s.buf[s.pos] {
+		case '.':
+			s.pos++
+		case end:
+			s.pos++
+			return ret, true
+		default:
+			return nil, false
+		}
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '_' || c == '-'
+}
+
+// value skips the value to the end of the line where it ends. Arrays and
+// inline tables may continue to the following lines.
+func (s *tomlScanner) value() {
+	depth := 0
+	for s.pos < len(s.buf) {
+		switch s.buf[s.pos] {
+		case '"', '\'':
+			if !s.skipString() {
+				return
+			}
+			continue
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		case '#':
+			s.skipLine()
+			continue
+		case '\n':
+			if depth <= 0 {
+				return
+			}
+			s.line++
+		}
+		s.pos++
+	}
+}
+
+// skipString skips the basic or literal string at pos, which may be
+// multi-line.
+func (s *tomlScanner) skipString() bool {
+	q := s.buf[s.pos]
+	delim := []byte{q}
+	if s.pos+2 < len(s.buf) && s.buf[s.pos+1] == q && s.buf[s.pos+2] == q {
+		delim = []byte{q, q, q}
+	}
+	s.pos += len(delim)
+	for s.pos < len(s.buf) {
+		c := s.buf[s.pos]
+		switch {
+		case c == '\\' && q == '"':
+			if s.pos+1 < len(s.buf) && s.buf[s.pos+1] == '\n' {
+				s.line++
+			}
+			s.pos += 2
+			continue
+		case c == '\n':
+			if len(delim) == 1 {
+				return false
+			}
+			s.line++
+		case c == q && bytes.HasPrefix(s.buf[s.pos:], delim):
+			s.pos += len(delim)
+			// """"" ends with quotes in the string
+			for len(delim) == 3 && s.pos < len(s.buf) && s.buf[s.pos] == q {
+				s.pos++
+			}
+			return true
+		}
+		s.pos++
+	}
+	return false
+}
+
+// keyString returns the key which could be compared, because names may
+// contain dots.
+func keyString(key []string) string {
+	return strings.Join(key, "\x00")
+}
+
+// setLines sets the lines of the errors. The line of the section is used
+// if the key is not found, and "<key>_file" is tried because the value
+// may be read from the file.
+func (errs SchemaErrors) setLines(conf []byte) {
+	var lines map[string]int
+	for i := range errs {
+		e := &errs[i]
+		if e.Line > 0 || e.path == nil {
+			continue
+		}
+		if lines == nil {
+			lines = keyLines(conf)
+		}
+		if e.Key != "" {
+			for _, k := range []string{e.Key, e.Key + FileSuffix} {
+				if n, ok := lines[keyString(append(e.path[:len(e.path):len(e.path)], k))]; ok {
+					e.Line = n
+					break
+				}
+			}
+		}
+		if e.Line == 0 {
+			e.Line = lines[keyString(e.path)]
+		}
+	}
+}
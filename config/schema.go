@@ -0,0 +1,402 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Seconds is a config value in seconds. It accepts an integer or a
+// duration like "1m30s".
+type Seconds int
+
+// Millis is a config value in milliseconds. It accepts an integer or a
+// duration like "500ms".
+type Millis int
+
+// List is a config value which is an array or a comma separated string.
+type List []string
+
+var (
+	secondsType = reflect.TypeOf(Seconds(0))
+	millisType  = reflect.TypeOf(Millis(0))
+	listType    = reflect.TypeOf(List(nil))
+)
+
+var (
+	sectionTypes   = make(map[string]reflect.Type)
+	sectionTypesMu sync.RWMutex
+)
+
+// RegisterSection registers the struct of the section type. name is the
+// section type, "status/<name>" for status children or "device/<type>"
+// for devices. Keys are the toml tags of the fields, and embedded structs
+// are flattened. Device packages register their sections in init.
+// ex:
+//
+//	type DummyDeviceSection struct {
+//		config.DeviceSection
+//		Interval config.Seconds `toml:"interval"`
+//	}
+//
+//	func init() {
+//		config.RegisterSection("device/dummy", DummyDeviceSection{})
+//	}
+func RegisterSection(name string, section interface{}) {
+	t := reflect.TypeOf(section)
+	if t.Kind() != reflect.Struct {
+		panic("config: section must be a struct, " + name)
+	}
+	sectionTypesMu.Lock()
+	defer sectionTypesMu.Unlock()
+	sectionTypes[name] = t
+}
+
+func lookupSection(name string) (reflect.Type, bool) {
+	sectionTypesMu.RLock()
+	defer sectionTypesMu.RUnlock()
+	t, ok := sectionTypes[name]
+	return t, ok
+}
+
+// sectionTypeName returns the name of the registered struct of the
+// section.
+func sectionTypeName(s ConfigSection) string {
+	switch {
+	case s.Type == "device":
+		return "device/" + s.Values["type"]
+	case s.Type == "status" && s.Name != "":
+		return "status/" + s.Name
+	}
+	return s.Type
+}
+
+// SchemaError is an error of the config with the position.
+type SchemaError struct {
+	File    string // empty if it is the loaded file
+	Line    int    // 0 if unknown
+	Section string // ex: device "spam"
+	Key     string
+	Msg     string
+
+	path []string // toml key of the section
+}
+
+func (e SchemaError) Error() string {
+	var b bytes.Buffer
+	if e.File != "" {
+		fmt.Fprintf(&b, "%s: ", e.File)
+	}
+	if e.Line > 0 {
+		fmt.Fprintf(&b, "line %d: ", e.Line)
+	}
+	b.WriteString(e.Section)
+	if e.Key != "" {
+		fmt.Fprintf(&b, ": %s", e.Key)
+	}
+	fmt.Fprintf(&b, ": %s", e.Msg)
+	return b.String()
+}
+
+// SchemaErrors is all errors of the config.
+type SchemaErrors []SchemaError
+
+func (e SchemaErrors) Len() int           { return len(e) }
+func (e SchemaErrors) Less(i, j int) bool { return e[i].Line < e[j].Line }
+func (e SchemaErrors) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+func (e SchemaErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// sectionLabel returns the section as written in the config.
+// ex: broker "sango/1"
+func sectionLabel(title, name string) string {
+	if name == "" {
+		return title
+	}
+	return fmt.Sprintf("%s %q", title, name)
+}
+
+// tomlPath returns the toml key of the section. ex: ["broker", "sango/1"]
+func (s ConfigSection) tomlPath() []string {
+	name := s.Name
+	if s.Arg != "" {
+		name += "/" + s.Arg
+	}
+	if name == "" {
+		return []string{s.Title}
+	}
+	return []string{s.Title, name}
+}
+
+func (s ConfigSection) label() string {
+	p := s.tomlPath()
+	if len(p) == 1 {
+		return p[0]
+	}
+	return sectionLabel(p[0], p[1])
+}
+
+// schemaError returns the error of the key of the section.
+func (s ConfigSection) schemaError(key, msg string) SchemaError {
+	return SchemaError{Section: s.label(), Key: key, Msg: msg, path: s.tomlPath()}
+}
+
+// sectionField is a field of the section struct.
+type sectionField struct {
+	index []int
+	typ   reflect.Type
+}
+
+// sectionFields returns the fields of the section struct by the toml tag.
+func sectionFields(t reflect.Type) map[string]sectionField {
+	ret := make(map[string]sectionField)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			for k, sf := range sectionFields(f.Type) {
+				sf.index = append([]int{i}, sf.index...)
+				ret[k] = sf
+			}
+			continue
+		}
+		tag := f.Tag.Get("toml")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		ret[tag] = sectionField{index: []int{i}, typ: f.Type}
+	}
+	return ret
+}
+
+// typeName returns the type of the value in errors.
+func typeName(t reflect.Type) string {
+	switch {
+	case t == secondsType:
+		return "seconds"
+	case t == millisType:
+		return "milliseconds"
+	case t == listType:
+		return "list"
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	case reflect.Bool:
+		return "boolean"
+	}
+	return "string"
+}
+
+// setField parses the value into the field, and returns the value which
+// sections parse as before. Durations are converted into integers of the
+// unit, and hex integers into decimal because most of sections use Atoi.
+func setField(fv reflect.Value, v string) (string, error) {
+	t := fv.Type()
+	switch {
+	case t == secondsType || t == millisType:
+		unit := time.Second
+		if t == millisType {
+			unit = time.Millisecond
+		}
+		if n, err := strconv.Atoi(v); err == nil {
+			fv.SetInt(int64(n))
+			return v, nil
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return v, fmt.Errorf("must be %v or duration like \"30s\"", typeName(t))
+		}
+		if d%unit != 0 {
+			return v, fmt.Errorf("must be whole %v", typeName(t))
+		}
+		fv.SetInt(int64(d / unit))
+		return strconv.FormatInt(int64(d/unit), 10), nil
+	case t == listType:
+		var items List
+		for _, i := range strings.Split(v, ",") {
+			if i = strings.TrimSpace(i); i != "" {
+				items = append(items, i)
+			}
+		}
+		fv.Set(reflect.ValueOf(items))
+		return v, nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		fv.SetString(v)
+		return v, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		s, base := v, 10
+		if l := strings.ToLower(v); strings.HasPrefix(l, "0x") {
+			s, base = l[2:], 16
+		}
+		n, err := strconv.ParseInt(s, base, t.Bits())
+		if err != nil {
+			return v, fmt.Errorf("must be %v", typeName(t))
+		}
+		fv.SetInt(n)
+		return strconv.FormatInt(n, 10), nil
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(v, t.Bits())
+		if err != nil {
+			return v, fmt.Errorf("must be %v", typeName(t))
+		}
+		fv.SetFloat(f)
+		return v, nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return v, fmt.Errorf("must be %v", typeName(t))
+		}
+		fv.SetBool(b)
+		return v, nil
+	}
+	return v, fmt.Errorf("unsupported field type, %v", t)
+}
+
+// decode stores the values into the section struct rv, and returns the
+// normalized values.
+func (s ConfigSection) decode(rv reflect.Value) (ValueMap, SchemaErrors) {
+	fields := sectionFields(rv.Type())
+	keys := make([]string, 0, len(s.Values))
+	for k := range s.Values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var errs SchemaErrors
+	ret := make(ValueMap, len(s.Values))
+	for _, key := range keys {
+		v := s.Values[key]
+		f, ok := fields[key]
+		switch {
+		case !ok:
+			msg := "unknown key"
+			if similar := similarKey(fields, key); similar != "" {
+				msg += fmt.Sprintf(", did you mean %q?", similar)
+			}
+			errs = append(errs, s.schemaError(key, msg))
+		case s.lists[key] && f.typ != listType:
+			errs = append(errs, s.schemaError(key, fmt.Sprintf("must be %v, not array", typeName(f.typ))))
+		default:
+			nv, err := setField(rv.FieldByIndex(f.index), v)
+			if err != nil {
+				errs = append(errs, s.schemaError(key, fmt.Sprintf("%v, %q", err, v)))
+				continue
+			}
+			ret[key] = nv
+		}
+	}
+	return ret, errs
+}
+
+// Decode stores the values of the section into the struct which v points
+// to, ex: *device.DummyDeviceSection. Fields of the keys which are not in
+// the section keep their values, so defaults could be set before.
+func (s ConfigSection) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config: Decode requires a pointer to struct, %T", v)
+	}
+	if _, errs := s.decode(rv.Elem()); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateSection checks keys and values of the section by the registered
+// struct. Durations are converted to integers.
+func validateSection(s *ConfigSection) SchemaErrors {
+	name := sectionTypeName(*s)
+	t, ok := lookupSection(name)
+	if !ok {
+		switch {
+		case s.Type == "device" && s.Values["type"] == "":
+			return SchemaErrors{s.schemaError("", "type is required")}
+		case s.Type == "device":
+			return SchemaErrors{s.schemaError("type", fmt.Sprintf("unknown device type, %q", s.Values["type"]))}
+		default:
+			return SchemaErrors{s.schemaError("", "unknown section type")}
+		}
+	}
+	values, errs := s.decode(reflect.New(t).Elem())
+	if len(errs) > 0 {
+		return errs
+	}
+	s.Values = values
+	return nil
+}
+
+// similarKey returns the key of the fields which is a typo of key.
+func similarKey(fields map[string]sectionField, key string) string {
+	var keys []string
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if editDistance(k, key) <= 2 {
+			return k
+		}
+	}
+	return ""
+}
+
+// editDistance returns Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,273 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type schemaTestSection struct {
+	DeviceSection
+	Rate     float64 `toml:"rate"`
+	Interval Seconds `toml:"interval"`
+	Timeout  Millis  `toml:"timeout"`
+	Fields   List    `toml:"fields"`
+	Started  string  `toml:"started"`
+}
+
+func init() {
+	RegisterSection("device/schematest", schemaTestSection{})
+}
+
+func TestSetField(t *testing.T) {
+	assert := assert.New(t)
+
+	var s struct {
+		Int      int
+		Float    float64
+		Bool     bool
+		Seconds  Seconds
+		Millis   Millis
+		List     List
+		Anything string
+	}
+	rv := reflect.ValueOf(&s).Elem()
+
+	for _, c := range []struct {
+		field string
+		in    string
+		out   string
+		ok    bool
+	}{
+		{"Int", "10", "10", true},
+		{"Int", "0x4c", "76", true},
+		{"Int", "010", "10", true},
+		{"Int", "1.5", "", false},
+		{"Float", "1.5", "1.5", true},
+		{"Float", "fast", "", false},
+		{"Bool", "true", "true", true},
+		{"Bool", "maybe", "", false},
+		{"Seconds", "30", "30", true},
+		{"Seconds", "30s", "30", true},
+		{"Seconds", "1m30s", "90", true},
+		{"Seconds", "1500ms", "", false},
+		{"Seconds", "soon", "", false},
+		{"Millis", "1500ms", "1500", true},
+		{"Millis", "2s", "2000", true},
+		{"List", "a, b,", "a, b,", true},
+		{"Anything", "anything", "anything", true},
+	} {
+		out, err := setField(rv.FieldByName(c.field), c.in)
+		if !c.ok {
+			assert.NotNil(err, c.in)
+			continue
+		}
+		assert.Nil(err, c.in)
+		assert.Equal(c.out, out, c.in)
+	}
+	assert.Equal(Millis(2000), s.Millis)
+	assert.Equal(List{"a", "b"}, s.List)
+}
+
+func TestSchemaValues(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[device."spam"]
+    type = "schematest"
+    broker = "sango"
+    qos = 1
+    rate = 0.5
+    interval = "1m"
+    timeout = "250ms"
+    fields = ["temp", "humidity"]
+    subscribe = true
+`
+	conf, err := LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	assert.Equal(1, len(conf.Sections))
+	values := conf.Sections[0].Values
+	assert.Equal("1", values["qos"])
+	assert.Equal("0.5", values["rate"])
+	assert.Equal("60", values["interval"])
+	assert.Equal("250", values["timeout"])
+	assert.Equal("temp, humidity", values["fields"])
+	assert.Equal("true", values["subscribe"])
+}
+
+func TestSchemaErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[device."spam"]
+    type = "schematest"
+    broker = "sango"
+    intreval = 10
+    qos = "high"
+    rate = [1, 2]
+`
+	_, err := LoadConfigByte([]byte(configStr))
+	errs, ok := err.(SchemaErrors)
+	assert.True(ok)
+	assert.Equal(3, len(errs))
+	assert.Equal(`line 5: device "spam": intreval: unknown key, did you mean "interval"?`, errs[0].Error())
+	assert.Equal(6, errs[1].Line)
+	assert.Equal("qos", errs[1].Key)
+	assert.Equal(7, errs[2].Line)
+	assert.Equal("rate", errs[2].Key)
+}
+
+func TestLoadConfigValueTypes(t *testing.T) {
+	assert := assert.New(t)
+
+	// toml values are stored as strings, and never panic
+	configStr := `
+[device."spam"]
+    type = "schematest"
+    rate = 0.25
+    started = 2015-04-01T00:00:00Z
+    fields = ["a", "b"]
+`
+	conf, err := LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	assert.Equal("0.25", conf.Sections[0].Values["rate"])
+	assert.Equal("2015-04-01T00:00:00Z", conf.Sections[0].Values["started"])
+	assert.Equal("a, b", conf.Sections[0].Values["fields"])
+
+	configStr = `
+[device."spam"]
+    type = "schematest"
+    fields = [[1, 2], [3]]
+`
+	_, err = LoadConfigByte([]byte(configStr))
+	errs, ok := err.(SchemaErrors)
+	assert.True(ok)
+	assert.Equal(1, len(errs))
+	assert.Equal(4, errs[0].Line)
+}
+
+func TestDecode(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[device."spam"]
+    type = "schematest"
+    broker = "sango"
+    qos = 1
+    interval = "1m"
+    fields = ["temp", "humidity"]
+`
+	conf, err := LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	var s schemaTestSection
+	assert.Nil(conf.Sections[0].Decode(&s))
+	assert.Equal("sango", s.Broker)
+	assert.Equal(1, s.QoS)
+	assert.Equal(Seconds(60), s.Interval)
+	assert.Equal(List{"temp", "humidity"}, s.Fields)
+}
+
+func TestUnknownSectionType(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, c := range []struct {
+		configStr string
+		line      int
+		msg       string
+	}{
+		{`
+[device."spam"]
+    broker = "sango"
+`, 2, `device "spam": type is required`},
+		{`
+[device."spam"]
+    type = "unknown"
+`, 3, `device "spam": type: unknown device type, "unknown"`},
+		{`
+[[status."disk"]]
+    path = "/"
+`, 2, `status "disk": unknown section type`},
+		{`
+[devices."spam"]
+    type = "dummy"
+`, 2, `devices: unknown section`},
+	} {
+		_, err := LoadConfigByte([]byte(c.configStr))
+		errs, ok := err.(SchemaErrors)
+		if assert.True(ok, c.msg) && assert.Equal(1, len(errs), c.msg) {
+			assert.Equal(c.line, errs[0].Line, c.msg)
+			assert.Equal(c.msg, errs[0].Error()[len("line 2: "):], c.msg)
+		}
+	}
+}
+
+func TestSchemaErrorLines(t *testing.T) {
+	assert := assert.New(t)
+
+	// lines are not confused by multi-line strings and inline tables
+	// which look like keys and sections
+	configStr := `
+[device."spam"]
+    type = "schematest"
+    payload = """
+[device."egg"]
+qos = 1
+"""
+    qos = "high"
+    fields = { a = 1 }
+`
+	_, err := LoadConfigByte([]byte(configStr))
+	errs, ok := err.(SchemaErrors)
+	if assert.True(ok) && assert.Equal(3, len(errs)) {
+		assert.Equal("payload", errs[0].Key)
+		assert.Equal(4, errs[0].Line)
+		assert.Equal("qos", errs[1].Key)
+		assert.Equal(8, errs[1].Line)
+		assert.Equal("fields", errs[2].Key)
+		assert.Equal(9, errs[2].Line)
+	}
+}
+
+func TestKeyLines(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := `# comment
+[[broker."sango/1"]]
+    host = "192.0.2.10" # [not.a.table]
+    password = '#"'
+[device."spam.egg"]
+    uuids = [
+        "feaa", # ]
+        "fe9f",
+    ]
+    payload = """\
+"""
+    qos = 1
+`
+	lines := keyLines([]byte(conf))
+	assert.Equal(2, lines[keyString([]string{"broker"})])
+	assert.Equal(2, lines[keyString([]string{"broker", "sango/1"})])
+	assert.Equal(3, lines[keyString([]string{"broker", "sango/1", "host"})])
+	assert.Equal(4, lines[keyString([]string{"broker", "sango/1", "password"})])
+	assert.Equal(5, lines[keyString([]string{"device", "spam.egg"})])
+	assert.Equal(6, lines[keyString([]string{"device", "spam.egg", "uuids"})])
+	assert.Equal(10, lines[keyString([]string{"device", "spam.egg", "payload"})])
+	assert.Equal(12, lines[keyString([]string{"device", "spam.egg", "qos"})])
+	_, ok := lines[keyString([]string{"not"})]
+	assert.False(ok)
+}
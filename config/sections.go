@@ -0,0 +1,70 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+// GatewaySection is [gateway].
+type GatewaySection struct {
+	Name                string  `toml:"name"`
+	MaxRetryCount       int     `toml:"max_retry_count"`
+	RetryInterval       Seconds `toml:"retry_interval"`
+	RPCTimeout          Seconds `toml:"rpc_timeout"`
+	ControlBroker       string  `toml:"control_broker"`
+	ControlCommands     List    `toml:"control_commands"`
+	ConfigSecret        string  `toml:"config_secret"`
+	ConfigGracePeriod   Seconds `toml:"config_grace_period"`
+	AvailabilityTimeout Seconds `toml:"availability_timeout"`
+}
+
+// BrokerSection is [[broker."<name>/<priority>"]].
+type BrokerSection struct {
+	Host          string  `toml:"host"`
+	Port          int     `toml:"port"`
+	Username      string  `toml:"username"`
+	Password      string  `toml:"password"`
+	TopicPrefix   string  `toml:"topic_prefix"`
+	RetryInterval Seconds `toml:"retry_interval"`
+	TLS           bool    `toml:"tls"`
+	CACert        string  `toml:"cacert"`
+	ClientCert    string  `toml:"client_cert"`
+	ClientKey     string  `toml:"client_key"`
+
+	WillTopic      string `toml:"will_topic"`
+	WillMessage    string `toml:"will_message"`
+	WillQoS        int    `toml:"will_qos"`
+	WillRetain     bool   `toml:"will_retain"`
+	BirthTopic     string `toml:"birth_topic"`
+	BirthMessage   string `toml:"birth_message"`
+	BirthQoS       int    `toml:"birth_qos"`
+	BirthRetain    bool   `toml:"birth_retain"`
+	OfflineMessage string `toml:"offline_message"`
+	OfflineQoS     int    `toml:"offline_qos"`
+	OfflineRetain  bool   `toml:"offline_retain"`
+}
+
+// DeviceSection is the keys which all devices accept. The section of each
+// device type embeds it, and is registered by the device package.
+type DeviceSection struct {
+	Type                string  `toml:"type"`
+	Broker              string  `toml:"broker"`
+	QoS                 int     `toml:"qos"`
+	Retain              bool    `toml:"retain"`
+	Subscribe           bool    `toml:"subscribe"`
+	AvailabilityTimeout Seconds `toml:"availability_timeout"`
+}
+
+func init() {
+	RegisterSection("gateway", GatewaySection{})
+	RegisterSection("broker", BrokerSection{})
+}
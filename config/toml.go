@@ -42,9 +42,14 @@ type ConfigSection struct {
 	Arg   string
 
 	Values ValueMap
+
+	lists map[string]bool // keys whose value is array
+	file  string          // file which defines the section
 }
 
 type ConfigToml struct {
+	Include []string `toml:"include"`
+
 	Gateway SectionMap `toml:"gateway"`
 	Brokers SectionMap `toml:"broker"`
 	Devices SectionMap `toml:"device"`
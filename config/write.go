@@ -0,0 +1,88 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// PrevSuffix is appended to the config file path to keep the previous
+// config while a new one is applied.
+const PrevSuffix = ".prev"
+
+// writeFileAtomic writes data to a temporary file in the same directory
+// and renames it to path, so that path always has a complete file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, perm); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// WriteConfig replaces the config file with data. The current file is
+// kept as "<path>.prev" to be restored by RestoreConfig.
+func WriteConfig(path string, data []byte) error {
+	perm := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		perm = fi.Mode().Perm()
+	}
+	current, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path+PrevSuffix, current, perm); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, perm)
+}
+
+// RestoreConfig restores the config file from "<path>.prev".
+func RestoreConfig(path string) error {
+	prev, err := ioutil.ReadFile(path + PrevSuffix)
+	if err != nil {
+		return err
+	}
+	perm := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		perm = fi.Mode().Perm()
+	}
+	return writeFileAtomic(path, prev, perm)
+}
@@ -0,0 +1,62 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fuji-config")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.toml")
+	assert.Nil(ioutil.WriteFile(path, []byte("old"), 0600))
+
+	assert.Nil(WriteConfig(path, []byte("new")))
+	b, _ := ioutil.ReadFile(path)
+	assert.Equal("new", string(b))
+	b, _ = ioutil.ReadFile(path + PrevSuffix)
+	assert.Equal("old", string(b))
+	fi, err := os.Stat(path)
+	assert.Nil(err)
+	assert.Equal(os.FileMode(0600), fi.Mode().Perm())
+
+	assert.Nil(RestoreConfig(path))
+	b, _ = ioutil.ReadFile(path)
+	assert.Equal("old", string(b))
+
+	// no temporary files are left
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(2, len(files))
+}
+
+func TestWriteConfigNotExist(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fuji-config")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	assert.NotNil(WriteConfig(filepath.Join(dir, "config.toml"), []byte("new")))
+	assert.NotNil(RestoreConfig(filepath.Join(dir, "config.toml")))
+}
@@ -0,0 +1,638 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	validator "gopkg.in/validator.v2"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+)
+
+const (
+	defaultBLEDedup = 10 // sec
+
+	hciEventPacket       = 0x04
+	hciEventLEMeta       = 0x3e
+	hciLEAdvertingReport = 0x02
+
+	bleCompanyApple     = 0x004c
+	bleEddystoneUUID    = "feaa"
+	bleDedupCleanupSize = 1024
+)
+
+var (
+	reBLEAddress = regexp.MustCompile(`^([0-9a-f]{2}:){5}[0-9a-f]{2}$`)
+
+	eddystoneURLSchemes = []string{"http://www.", "https://www.", "http://", "https://"}
+	eddystoneURLCodes   = []string{
+		".com/", ".org/", ".edu/", ".net/", ".info/", ".biz/", ".gov/",
+		".com", ".org", ".edu", ".net", ".info", ".biz", ".gov",
+	}
+)
+
+// hciReader reads HCI event packets. ReadPacket returns nil packet
+// without error when no packet arrived in a while.
+type hciReader interface {
+	ReadPacket() ([]byte, error)
+	Close() error
+}
+
+// BLEScanDevice publishes BLE advertisements received by a HCI device.
+type BLEScanDevice struct {
+	Name            string `validate:"max=256,regexp=[^/]+,validtopic"`
+	Broker          []*broker.Broker
+	BrokerName      string
+	QoS             byte `validate:"min=0,max=2"`
+	HCI             int  `validate:"min=0,max=65535"`
+	Active          bool
+	Addresses       []string
+	UUIDs           []string
+	ManufacturerIDs []int
+	Dedup           int    `validate:"min=0"`
+	Replay          string `validate:"max=4096"`
+	Type            string `validate:"max=256"`
+	Retain          bool
+	Subscribe       bool
+	DeviceChan      DeviceChannel // GW -> device
+
+	stop chan struct{}
+}
+
+type bleIBeacon struct {
+	UUID    string `json:"uuid"`
+	Major   int    `json:"major"`
+	Minor   int    `json:"minor"`
+	TxPower int    `json:"tx_power"`
+}
+
+type bleEddystone struct {
+	Frame       string  `json:"frame"`
+	TxPower     *int    `json:"tx_power,omitempty"`
+	Namespace   string  `json:"namespace,omitempty"`
+	Instance    string  `json:"instance,omitempty"`
+	URL         string  `json:"url,omitempty"`
+	Battery     int     `json:"battery,omitempty"` // mV
+	Temperature float64 `json:"temperature,omitempty"`
+	AdvCount    uint32  `json:"adv_count,omitempty"`
+	Uptime      float64 `json:"uptime,omitempty"` // sec
+}
+
+// bleAdvertisement is a parsed advertising report.
+type bleAdvertisement struct {
+	Address          string        `json:"address"`
+	AddressType      string        `json:"address_type"`
+	RSSI             int           `json:"rssi"`
+	Name             string        `json:"name,omitempty"`
+	UUIDs            []string      `json:"uuids,omitempty"`
+	ManufacturerID   *int          `json:"manufacturer_id,omitempty"`
+	ManufacturerData string        `json:"manufacturer_data,omitempty"`
+	IBeacon          *bleIBeacon   `json:"ibeacon,omitempty"`
+	Eddystone        *bleEddystone `json:"eddystone,omitempty"`
+	Timestamp        string        `json:"timestamp"`
+
+	data []byte // raw AD structures
+}
+
+func (device BLEScanDevice) String() string {
+	return fmt.Sprintf("%#v", device)
+}
+
+// BLEScanDeviceSection is [device."<name>"] of type "ble_scan".
+type BLEScanDeviceSection struct {
+	config.DeviceSection
+	HCI             int            `toml:"hci"`
+	Active          bool           `toml:"active"`
+	Addresses       config.List    `toml:"addresses"`
+	UUIDs           config.List    `toml:"uuids"`
+	ManufacturerIDs config.List    `toml:"manufacturer_ids"`
+	Dedup           config.Seconds `toml:"dedup"`
+	Replay          string         `toml:"replay"`
+}
+
+func init() {
+	config.RegisterSection("device/ble_scan", BLEScanDeviceSection{})
+}
+
+// NewBLEScanDevice read config.ConfigSection and returnes BLEScanDevice.
+// If config validation failed, return error
+func NewBLEScanDevice(section config.ConfigSection, brokers []*broker.Broker, devChan DeviceChannel) (BLEScanDevice, error) {
+	ret := BLEScanDevice{
+		Name:       section.Name,
+		DeviceChan: devChan,
+		Dedup:      defaultBLEDedup,
+		stop:       make(chan struct{}),
+	}
+	sc := BLEScanDeviceSection{Dedup: defaultBLEDedup}
+	if err := section.Decode(&sc); err != nil {
+		return ret, err
+	}
+	if sc.Broker == "" {
+		return ret, fmt.Errorf("broker does not set")
+	}
+
+	for _, b := range brokers {
+		if b.Name == sc.Broker {
+			ret.Broker = brokers
+		}
+	}
+	if ret.Broker == nil {
+		return ret, fmt.Errorf("broker does not exists: %s", sc.Broker)
+	}
+	ret.BrokerName = sc.Broker
+
+	if _, ok := section.Values["qos"]; !ok {
+		return ret, fmt.Errorf("qos does not set")
+	}
+	ret.QoS = byte(sc.QoS)
+	ret.HCI = sc.HCI
+	ret.Active = sc.Active
+	for _, a := range sc.Addresses {
+		a = strings.ToLower(a)
+		if !reBLEAddress.MatchString(a) {
+			return ret, fmt.Errorf("invalid address, %v", a)
+		}
+		ret.Addresses = append(ret.Addresses, a)
+	}
+	for _, u := range sc.UUIDs {
+		ret.UUIDs = append(ret.UUIDs, strings.ToLower(u))
+	}
+	for _, m := range sc.ManufacturerIDs {
+		// manufacturer id may be written as "0x004c"
+		id, err := strconv.ParseInt(m, 0, 32)
+		if err != nil || id < 0 || id > 0xffff {
+			return ret, fmt.Errorf("invalid manufacturer id, %v", m)
+		}
+		ret.ManufacturerIDs = append(ret.ManufacturerIDs, int(id))
+	}
+	ret.Dedup = int(sc.Dedup)
+	ret.Replay = sc.Replay
+	ret.Type = sc.Type
+	ret.Retain = sc.Retain
+	ret.Subscribe = sc.Subscribe
+
+	if err := ret.Validate(); err != nil {
+		return ret, err
+	}
+
+	return ret, nil
+}
+
+func (device *BLEScanDevice) Validate() error {
+	validator := validator.NewValidator()
+	validator.SetValidationFunc("validtopic", config.ValidMqttPublishTopic)
+	if err := validator.Validate(device); err != nil {
+		return err
+	}
+	return nil
+}
+
+// formatBLEUUID formats little endian UUID in AD structures.
+func formatBLEUUID(b []byte) string {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[i] = b[len(b)-1-i]
+	}
+	if len(r) == 16 {
+		return formatUUID(r)
+	}
+	return hex.EncodeToString(r)
+}
+
+// formatUUID formats big endian 128bit UUID.
+func formatUUID(b []byte) string {
+	s := hex.EncodeToString(b)
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:32]
+}
+
+// parseHCIEvent parses LE advertising reports in a HCI event packet.
+// Other packets are ignored.
+func parseHCIEvent(pkt []byte) ([]bleAdvertisement, error) {
+	if len(pkt) < 5 || pkt[0] != hciEventPacket || pkt[1] != hciEventLEMeta || pkt[3] != hciLEAdvertingReport {
+		return nil, nil
+	}
+	if int(pkt[2]) != len(pkt)-3 {
+		return nil, fmt.Errorf("invalid hci event length")
+	}
+
+	num := int(pkt[4])
+	p := pkt[5:]
+	ret := make([]bleAdvertisement, 0, num)
+	for i := 0; i < num; i++ {
+		// event type, address type, address(6), data length
+		if len(p) < 9 {
+			return nil, fmt.Errorf("advertising report is too short")
+		}
+		ad := bleAdvertisement{AddressType: "public"}
+		if p[1] == 0x01 {
+			ad.AddressType = "random"
+		}
+		addr := make([]string, 6)
+		for j := 0; j < 6; j++ {
+			addr[5-j] = fmt.Sprintf("%02x", p[2+j])
+		}
+		ad.Address = strings.Join(addr, ":")
+		l := int(p[8])
+		if len(p) < 9+l+1 {
+			return nil, fmt.Errorf("advertising data is too short")
+		}
+		ad.data = p[9 : 9+l]
+		ad.RSSI = int(int8(p[9+l]))
+		if err := ad.parseData(); err != nil {
+			return nil, err
+		}
+		ret = append(ret, ad)
+		p = p[9+l+1:]
+	}
+	return ret, nil
+}
+
+// parseData parses AD structures.
+func (ad *bleAdvertisement) parseData() error {
+	p := ad.data
+	for len(p) > 0 {
+		l := int(p[0])
+		if l == 0 {
+			break
+		}
+		if len(p) < l+1 {
+			return fmt.Errorf("invalid ad structure length")
+		}
+		typ, data := p[1], p[2:l+1]
+		p = p[l+1:]
+
+		switch typ {
+		case 0x02, 0x03: // 16bit service UUIDs
+			for i := 0; i+2 <= len(data); i += 2 {
+				ad.addUUID(formatBLEUUID(data[i : i+2]))
+			}
+		case 0x06, 0x07: // 128bit service UUIDs
+			for i := 0; i+16 <= len(data); i += 16 {
+				ad.addUUID(formatBLEUUID(data[i : i+16]))
+			}
+		case 0x08, 0x09: // local name
+			ad.Name = string(data)
+		case 0x16: // service data with 16bit UUID
+			if len(data) < 2 {
+				continue
+			}
+			uuid := formatBLEUUID(data[:2])
+			ad.addUUID(uuid)
+			if uuid == bleEddystoneUUID {
+				ad.Eddystone = parseEddystone(data[2:])
+			}
+		case 0xff: // manufacturer specific data
+			if len(data) < 2 {
+				continue
+			}
+			id := int(binary.LittleEndian.Uint16(data))
+			ad.ManufacturerID = &id
+			ad.ManufacturerData = hex.EncodeToString(data[2:])
+			if id == bleCompanyApple && len(data) == 25 && data[2] == 0x02 && data[3] == 0x15 {
+				ad.IBeacon = &bleIBeacon{
+					UUID:    formatUUID(data[4:20]),
+					Major:   int(binary.BigEndian.Uint16(data[20:])),
+					Minor:   int(binary.BigEndian.Uint16(data[22:])),
+					TxPower: int(int8(data[24])),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (ad *bleAdvertisement) addUUID(uuid string) {
+	for _, u := range ad.UUIDs {
+		if u == uuid {
+			return
+		}
+	}
+	ad.UUIDs = append(ad.UUIDs, uuid)
+}
+
+// parseEddystone parses Eddystone frame. Unknown frames return nil.
+func parseEddystone(data []byte) *bleEddystone {
+	if len(data) < 1 {
+		return nil
+	}
+	switch data[0] {
+	case 0x00:
+		if len(data) < 18 {
+			return nil
+		}
+		tx := int(int8(data[1]))
+		return &bleEddystone{
+			Frame:     "uid",
+			TxPower:   &tx,
+			Namespace: hex.EncodeToString(data[2:12]),
+			Instance:  hex.EncodeToString(data[12:18]),
+		}
+	case 0x10:
+		if len(data) < 3 || int(data[2]) >= len(eddystoneURLSchemes) {
+			return nil
+		}
+		tx := int(int8(data[1]))
+		url := eddystoneURLSchemes[data[2]]
+		for _, c := range data[3:] {
+			if int(c) < len(eddystoneURLCodes) {
+				url += eddystoneURLCodes[c]
+			} else {
+				url += string(c)
+			}
+		}
+		return &bleEddystone{
+			Frame:   "url",
+			TxPower: &tx,
+			URL:     url,
+		}
+	case 0x20:
+		if len(data) < 14 {
+			return nil
+		}
+		return &bleEddystone{
+			Frame:       "tlm",
+			Battery:     int(binary.BigEndian.Uint16(data[2:])),
+			Temperature: float64(int16(binary.BigEndian.Uint16(data[4:]))) / 256,
+			AdvCount:    binary.BigEndian.Uint32(data[6:]),
+			Uptime:      float64(binary.BigEndian.Uint32(data[10:])) / 10,
+		}
+	}
+	return nil
+}
+
+// match returns true when the advertisement passes all configured filters.
+func (device BLEScanDevice) match(ad bleAdvertisement) bool {
+	if len(device.Addresses) > 0 && !contains(device.Addresses, ad.Address) {
+		return false
+	}
+	if len(device.UUIDs) > 0 {
+		found := false
+		for _, u := range device.UUIDs {
+			if contains(ad.UUIDs, u) || (ad.IBeacon != nil && ad.IBeacon.UUID == u) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(device.ManufacturerIDs) > 0 {
+		if ad.ManufacturerID == nil {
+			return false
+		}
+		found := false
+		for _, id := range device.ManufacturerIDs {
+			if id == *ad.ManufacturerID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// bleDeduper suppresses same advertisements within the window.
+type bleDeduper struct {
+	window time.Duration
+	last   map[string]time.Time
+}
+
+func newBLEDeduper(window time.Duration) *bleDeduper {
+	return &bleDeduper{
+		window: window,
+		last:   make(map[string]time.Time),
+	}
+}
+
+// allow returns true when the advertisement should be published.
+func (d *bleDeduper) allow(ad bleAdvertisement, now time.Time) bool {
+	if d.window <= 0 {
+		return true
+	}
+	key := ad.Address + "/" + hex.EncodeToString(ad.data)
+	if t, ok := d.last[key]; ok && now.Sub(t) < d.window {
+		return false
+	}
+	d.last[key] = now
+
+	if len(d.last) > bleDedupCleanupSize {
+		for k, t := range d.last {
+			if now.Sub(t) >= d.window {
+				delete(d.last, k)
+			}
+		}
+	}
+	return true
+}
+
+// hciReplay reads recorded HCI packets. The file has a hex encoded
+// packet per line. Empty lines and lines begin with '#' are ignored.
+type hciReplay struct {
+	packets [][]byte
+}
+
+func openHCIReplay(path string) (*hciReplay, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ret := &hciReplay{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.NewReplacer(" ", "", ":", "").Replace(line)
+		pkt, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid replay packet, %v", err)
+		}
+		ret.packets = append(ret.packets, pkt)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (r *hciReplay) ReadPacket() ([]byte, error) {
+	if len(r.packets) == 0 {
+		return nil, io.EOF
+	}
+	pkt := r.packets[0]
+	r.packets = r.packets[1:]
+	return pkt, nil
+}
+
+func (r *hciReplay) Close() error {
+	return nil
+}
+
+func (device BLEScanDevice) newMessage(ad bleAdvertisement) (message.Message, error) {
+	body, err := json.Marshal(ad)
+	if err != nil {
+		return message.Message{}, err
+	}
+	return message.Message{
+		Sender:     device.Name,
+		Type:       device.Type,
+		QoS:        device.QoS,
+		Retained:   device.Retain,
+		BrokerName: device.BrokerName,
+		Body:       body,
+	}, nil
+}
+
+// scanLoop publishes advertisements read from reader until stop is closed.
+func (device BLEScanDevice) scanLoop(reader hciReader, channel chan message.Message) {
+	packets := make(chan []byte)
+	go func() {
+		defer reader.Close()
+		defer close(packets)
+		for {
+			select {
+			case <-device.stop:
+				return
+			default:
+			}
+			pkt, err := reader.ReadPacket()
+			if err == io.EOF {
+				log.Infof("ble replay finished: %v", device.Name)
+				return
+			}
+			if err != nil {
+				log.Errorf("hci read failed, %v", err)
+				return
+			}
+			if pkt == nil {
+				continue
+			}
+			select {
+			case packets <- pkt:
+			case <-device.stop:
+				return
+			}
+		}
+	}()
+
+	dedup := newBLEDeduper(time.Duration(device.Dedup) * time.Second)
+	for {
+		select {
+		case pkt, ok := <-packets:
+			if !ok {
+				packets = nil
+				continue
+			}
+			ads, err := parseHCIEvent(pkt)
+			if err != nil {
+				log.Warnf("hci event parse failed, %v", err)
+				continue
+			}
+			now := time.Now()
+			for _, ad := range ads {
+				if !device.match(ad) || !dedup.allow(ad, now) {
+					continue
+				}
+				ad.Timestamp = now.Format(time.RFC3339Nano)
+				msg, err := device.newMessage(ad)
+				if err != nil {
+					log.Errorf("json encode error %s", err)
+					continue
+				}
+				channel <- msg
+			}
+		case msg, _ := <-device.DeviceChan.Chan:
+			log.Debugf("msg reached to ble device, ignored, %v", msg)
+		case <-device.stop:
+			return
+		}
+	}
+}
+
+func (device BLEScanDevice) Start(channel chan message.Message) error {
+	var reader hciReader
+	var err error
+	if device.Replay != "" {
+		reader, err = openHCIReplay(device.Replay)
+	} else {
+		reader, err = openHCI(device.HCI, device.Active)
+	}
+	if err != nil {
+		return fmt.Errorf("ble device start failed, %v", err)
+	}
+
+	log.Info("start ble scan device")
+	go device.scanLoop(reader, channel)
+	return nil
+}
+
+func (device BLEScanDevice) Stop() error {
+	log.Infof("closing ble scan: %v", device.Name)
+	select {
+	case <-device.stop:
+	default:
+		close(device.stop)
+	}
+	return nil
+}
+
+func (device BLEScanDevice) DeviceType() string {
+	return "ble_scan"
+}
+
+// DeviceName returns the name of the device.
+func (device BLEScanDevice) DeviceName() string {
+	return device.Name
+}
+
+func (device BLEScanDevice) AddSubscribe() error {
+	if !device.Subscribe {
+		return nil
+	}
+	for _, b := range device.Broker {
+		b.AddSubscribed(device.Name, device.QoS)
+	}
+	return nil
+}
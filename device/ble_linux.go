@@ -0,0 +1,130 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux,!386
+
+package device
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// constants from bluetooth/hci.h
+const (
+	afBluetooth   = 31
+	btprotoHCI    = 1
+	solHCI        = 0
+	hciFilterOpt  = 2
+	hciChannelRaw = 0
+
+	hciCommandPacket = 0x01
+
+	hciLESetScanParameters = 0x200b
+	hciLESetScanEnable     = 0x200c
+
+	hciReadTimeout = time.Second
+)
+
+type sockaddrHCI struct {
+	Family  uint16
+	Dev     uint16
+	Channel uint16
+}
+
+type hciFilter struct {
+	TypeMask  uint32
+	EventMask [2]uint32
+	Opcode    uint16
+}
+
+// hciSocket is a raw HCI socket which receives LE meta events.
+type hciSocket struct {
+	fd int
+}
+
+func openHCI(dev int, active bool) (hciReader, error) {
+	fd, err := syscall.Socket(afBluetooth, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, btprotoHCI)
+	if err != nil {
+		return nil, fmt.Errorf("hci socket failed, %v", err)
+	}
+	s := &hciSocket{fd: fd}
+
+	addr := sockaddrHCI{Family: afBluetooth, Dev: uint16(dev), Channel: hciChannelRaw}
+	_, _, e := syscall.Syscall(syscall.SYS_BIND, uintptr(fd), uintptr(unsafe.Pointer(&addr)), unsafe.Sizeof(addr))
+	if e != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("hci%d bind failed, %v", dev, e)
+	}
+
+	filter := hciFilter{TypeMask: 1 << hciEventPacket}
+	filter.EventMask[hciEventLEMeta/32] = 1 << (hciEventLEMeta % 32)
+	_, _, e = syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd), solHCI, hciFilterOpt,
+		uintptr(unsafe.Pointer(&filter)), unsafe.Sizeof(filter), 0)
+	if e != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("hci filter failed, %v", e)
+	}
+
+	// timeout lets the reader check stop periodically
+	tv := syscall.NsecToTimeval(int64(hciReadTimeout))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	scanType := byte(0x00)
+	if active {
+		scanType = 0x01
+	}
+	// interval and window are 10ms in 0.625ms unit, public own address, accept all
+	if err := s.command(hciLESetScanParameters, []byte{scanType, 0x10, 0x00, 0x10, 0x00, 0x00, 0x00}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	// enable without controller side duplicate filtering
+	if err := s.command(hciLESetScanEnable, []byte{0x01, 0x00}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *hciSocket) command(opcode uint16, params []byte) error {
+	buf := []byte{hciCommandPacket, byte(opcode), byte(opcode >> 8), byte(len(params))}
+	buf = append(buf, params...)
+	if _, err := syscall.Write(s.fd, buf); err != nil {
+		return fmt.Errorf("hci command %04x failed, %v", opcode, err)
+	}
+	return nil
+}
+
+func (s *hciSocket) ReadPacket() ([]byte, error) {
+	buf := make([]byte, 260)
+	n, err := syscall.Read(s.fd, buf)
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (s *hciSocket) Close() error {
+	s.command(hciLESetScanEnable, []byte{0x00, 0x00})
+	return syscall.Close(s.fd)
+}
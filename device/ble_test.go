@@ -0,0 +1,228 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+)
+
+var (
+	// flags, apple iBeacon
+	testIBeaconData, _ = hex.DecodeString("020106" + "1aff4c000215" +
+		"e2c56db5dffb48d2b060d0f5a71096e0" + "0001" + "0002" + "c5")
+	// 16bit UUID list, eddystone URL https://google.com
+	testEddystoneURLData, _ = hex.DecodeString("0303aafe" + "0d16aafe10eb03676f6f676c6507")
+	// eddystone TLM 3000mV 24.5C
+	testEddystoneTLMData, _ = hex.DecodeString("1116aafe20000bb818800000000a00000064")
+)
+
+// hciAdvReport builds a HCI LE advertising report event.
+func hciAdvReport(addr string, data []byte, rssi int8) []byte {
+	a, _ := hex.DecodeString(addr)
+	params := []byte{hciLEAdvertingReport, 1, 0x00, 0x00}
+	for i := len(a) - 1; i >= 0; i-- {
+		params = append(params, a[i])
+	}
+	params = append(params, byte(len(data)))
+	params = append(params, data...)
+	params = append(params, byte(rssi))
+	return append([]byte{hciEventPacket, hciEventLEMeta, byte(len(params))}, params...)
+}
+
+// testBLEScanConfig is the scanner which the tests add filters to.
+const testBLEScanConfig = `
+[device."beacons"]
+    type = "ble_scan"
+    broker = "sango"
+    qos = 0
+`
+
+func TestNewBLEScanDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := NewBLEScanDevice(testDeviceArgs(t, testBLEScanConfig+`
+    hci = 1
+    active = true
+    addresses = "AA:BB:CC:DD:EE:FF"
+    manufacturer_ids = "0x004c, 89"
+    uuids = "FEAA"
+`))
+	assert.Nil(err)
+	assert.Equal(1, d.HCI)
+	assert.True(d.Active)
+	assert.Equal([]string{"aa:bb:cc:dd:ee:ff"}, d.Addresses)
+	assert.Equal([]int{0x004c, 89}, d.ManufacturerIDs)
+	assert.Equal([]string{"feaa"}, d.UUIDs)
+	assert.Equal(10, d.Dedup)
+
+	conf, err := config.LoadConfigByte([]byte(`
+[device."beacons"]
+    type = "ble_scan"
+    broker = "sango"
+    qos = 0
+    addresses = "aa:bb:cc"
+`))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	_, err = NewBLEScanDevice(conf.Sections[0], []*broker.Broker{b1}, NewDeviceChannel())
+	assert.NotNil(err)
+}
+
+func TestParseHCIEventIBeacon(t *testing.T) {
+	assert := assert.New(t)
+
+	ads, err := parseHCIEvent(hciAdvReport("aabbccddeeff", testIBeaconData, -60))
+	assert.Nil(err)
+	assert.Equal(1, len(ads))
+	ad := ads[0]
+	assert.Equal("aa:bb:cc:dd:ee:ff", ad.Address)
+	assert.Equal("public", ad.AddressType)
+	assert.Equal(-60, ad.RSSI)
+	assert.Equal(0x004c, *ad.ManufacturerID)
+	assert.Equal("e2c56db5-dffb-48d2-b060-d0f5a71096e0", ad.IBeacon.UUID)
+	assert.Equal(1, ad.IBeacon.Major)
+	assert.Equal(2, ad.IBeacon.Minor)
+	assert.Equal(-59, ad.IBeacon.TxPower)
+
+	// not an advertising report
+	ads, err = parseHCIEvent([]byte{0x04, 0x0e, 0x04, 0x01, 0x0c, 0x20, 0x00})
+	assert.Nil(err)
+	assert.Nil(ads)
+
+	// truncated
+	pkt := hciAdvReport("aabbccddeeff", testIBeaconData, -60)
+	pkt = pkt[:len(pkt)-5]
+	pkt[2] = byte(len(pkt) - 3)
+	_, err = parseHCIEvent(pkt)
+	assert.NotNil(err)
+}
+
+func TestParseHCIEventEddystone(t *testing.T) {
+	assert := assert.New(t)
+
+	ads, err := parseHCIEvent(hciAdvReport("112233445566", testEddystoneURLData, -70))
+	assert.Nil(err)
+	ad := ads[0]
+	assert.Equal([]string{"feaa"}, ad.UUIDs)
+	assert.Equal("url", ad.Eddystone.Frame)
+	assert.Equal("https://google.com", ad.Eddystone.URL)
+	assert.Equal(-21, *ad.Eddystone.TxPower)
+
+	ads, err = parseHCIEvent(hciAdvReport("112233445566", testEddystoneTLMData, -70))
+	assert.Nil(err)
+	ad = ads[0]
+	assert.Equal("tlm", ad.Eddystone.Frame)
+	assert.Equal(3000, ad.Eddystone.Battery)
+	assert.Equal(24.5, ad.Eddystone.Temperature)
+	assert.Equal(uint32(10), ad.Eddystone.AdvCount)
+	assert.Equal(10.0, ad.Eddystone.Uptime)
+}
+
+func TestBLEScanMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	ibeacon, _ := parseHCIEvent(hciAdvReport("aabbccddeeff", testIBeaconData, -60))
+	eddystone, _ := parseHCIEvent(hciAdvReport("112233445566", testEddystoneURLData, -70))
+
+	d, err := NewBLEScanDevice(testDeviceArgs(t, testBLEScanConfig+`manufacturer_ids = "0x004c"`))
+	assert.Nil(err)
+	assert.True(d.match(ibeacon[0]))
+	assert.False(d.match(eddystone[0]))
+
+	d, err = NewBLEScanDevice(testDeviceArgs(t, testBLEScanConfig+`uuids = "feaa, E2C56DB5-DFFB-48D2-B060-D0F5A71096E0"`))
+	assert.Nil(err)
+	assert.True(d.match(ibeacon[0]))
+	assert.True(d.match(eddystone[0]))
+
+	d, err = NewBLEScanDevice(testDeviceArgs(t, testBLEScanConfig+`addresses = "11:22:33:44:55:66"
+    uuids = "feaa"`))
+	assert.Nil(err)
+	assert.False(d.match(ibeacon[0]))
+	assert.True(d.match(eddystone[0]))
+}
+
+func TestBLEDeduper(t *testing.T) {
+	assert := assert.New(t)
+
+	ads, _ := parseHCIEvent(hciAdvReport("aabbccddeeff", testIBeaconData, -60))
+	d := newBLEDeduper(10 * time.Second)
+	t0 := time.Now()
+	assert.True(d.allow(ads[0], t0))
+	assert.False(d.allow(ads[0], t0.Add(5*time.Second)))
+	assert.True(d.allow(ads[0], t0.Add(11*time.Second)))
+
+	// RSSI changes do not matter, data changes do
+	other, _ := parseHCIEvent(hciAdvReport("aabbccddeeff", testEddystoneURLData, -40))
+	assert.True(d.allow(other[0], t0.Add(12*time.Second)))
+
+	d = newBLEDeduper(0)
+	assert.True(d.allow(ads[0], t0))
+	assert.True(d.allow(ads[0], t0))
+}
+
+func TestBLEScanReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	f, err := ioutil.TempFile("", "fuji-hci")
+	assert.Nil(err)
+	defer os.Remove(f.Name())
+	f.WriteString("# recorded by hcidump\n")
+	f.WriteString(hex.EncodeToString(hciAdvReport("aabbccddeeff", testIBeaconData, -60)) + "\n")
+	f.WriteString(hex.EncodeToString(hciAdvReport("aabbccddeeff", testIBeaconData, -61)) + "\n")
+	f.WriteString("\n04 0e 04 01 0c 20 00\n")
+	f.WriteString(hex.EncodeToString(hciAdvReport("112233445566", testEddystoneURLData, -70)) + "\n")
+	f.Close()
+
+	d, err := NewBLEScanDevice(testDeviceArgs(t, testBLEScanConfig+`replay = "`+f.Name()+`"`))
+	assert.Nil(err)
+	channel := make(chan message.Message, 10)
+	assert.Nil(d.Start(channel))
+	defer d.Stop()
+
+	var ads []bleAdvertisement
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-channel:
+			var ad bleAdvertisement
+			assert.Nil(json.Unmarshal(msg.Body, &ad))
+			assert.Equal("beacons", msg.Sender)
+			assert.NotEqual("", ad.Timestamp)
+			ads = append(ads, ad)
+		case <-time.After(time.Second):
+			t.Fatal("ble message timeout")
+		}
+	}
+	assert.Equal("aa:bb:cc:dd:ee:ff", ads[0].Address)
+	assert.Equal(-60, ads[0].RSSI)
+	assert.Equal("11:22:33:44:55:66", ads[1].Address)
+
+	// duplicated report is suppressed
+	select {
+	case msg := <-channel:
+		t.Fatalf("unexpected message, %s", msg.Body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+	"github.com/shiguredo/fuji/utils"
+)
+
+// busTransactor is an opened I2C or SPI device.
+type busTransactor interface {
+	// Tx writes w and then reads n bytes.
+	Tx(w []byte, n int) ([]byte, error)
+	Close() error
+}
+
+// busField is a field decoded from read bytes.
+// ex: temp:s16be@0>>4*0.01
+type busField struct {
+	Name   string
+	Kind   string
+	Offset int
+	Shift  uint
+	Scale  float64
+}
+
+var reBusField = regexp.MustCompile(`^([A-Za-z0-9_]+):([us](8|16|24|32)(be|le)?)@([0-9]+)(>>([0-9]+))?(\*([-+0-9.eE]+))?$`)
+
+// BusSection is the register transaction of I2C and SPI devices.
+type BusSection struct {
+	Init    config.List `toml:"init"`
+	Command string      `toml:"command"`
+	Read    int         `toml:"read"`
+	Fields  config.List `toml:"fields"`
+	Format  string      `toml:"format"`
+}
+
+// busTransaction is a set of register transactions which is
+// performed by I2C and SPI devices.
+type busTransaction struct {
+	Init    [][]byte // written once at start
+	Command []byte   // written before each read
+	Read    int      `validate:"min=0,max=4096"`
+	Format  string   `validate:"regexp=^(raw|hex|json)$"`
+	Fields  []busField
+}
+
+// parseBusPayloads parses payloads of the init list.
+// ex: \xf2\x01, \xf4\x27
+func parseBusPayloads(items []string) ([][]byte, error) {
+	var ret [][]byte
+	for _, p := range items {
+		b, err := utils.ParsePayload(p)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, b)
+	}
+	return ret, nil
+}
+
+// parseBusFields parses fields setting.
+// ex: ch0:s16be@0*0.000125, press:u24be@0>>4
+func parseBusFields(items []string) ([]busField, error) {
+	var ret []busField
+	for _, f := range items {
+		m := reBusField.FindStringSubmatch(f)
+		if m == nil {
+			return nil, fmt.Errorf("invalid field, %v", f)
+		}
+		if m[3] != "8" && m[4] == "" {
+			return nil, fmt.Errorf("byte order is required, %v", f)
+		}
+		field := busField{
+			Name:  m[1],
+			Kind:  m[2],
+			Scale: 1,
+		}
+		field.Offset, _ = strconv.Atoi(m[5])
+		if m[7] != "" {
+			shift, _ := strconv.Atoi(m[7])
+			field.Shift = uint(shift)
+		}
+		if m[9] != "" {
+			scale, err := strconv.ParseFloat(m[9], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid scale, %v", f)
+			}
+			field.Scale = scale
+		}
+		ret = append(ret, field)
+	}
+	return ret, nil
+}
+
+// size returns byte size of the field.
+func (f busField) size() int {
+	bits, _ := strconv.Atoi(strings.TrimRight(f.Kind[1:], "bel"))
+	return bits / 8
+}
+
+// decode returns the field value from buf.
+func (f busField) decode(buf []byte) (interface{}, error) {
+	size := f.size()
+	if f.Offset+size > len(buf) {
+		return nil, fmt.Errorf("field %s is out of range", f.Name)
+	}
+	b := buf[f.Offset : f.Offset+size]
+
+	var u uint32
+	if strings.HasSuffix(f.Kind, "le") {
+		for i := size - 1; i >= 0; i-- {
+			u = u<<8 | uint32(b[i])
+		}
+	} else {
+		for i := 0; i < size; i++ {
+			u = u<<8 | uint32(b[i])
+		}
+	}
+
+	var v int64
+	if f.Kind[0] == 's' {
+		// sign extension
+		bits := uint(size * 8)
+		v = int64(u<<(32-bits)) << 32 >> (64 - bits)
+	} else {
+		v = int64(u)
+	}
+	v >>= f.Shift
+
+	if f.Scale != 1 {
+		return float64(v) * f.Scale, nil
+	}
+	return v, nil
+}
+
+// newBusTransaction reads transaction settings from the section.
+func newBusTransaction(sc BusSection) (busTransaction, error) {
+	ret := busTransaction{
+		Format: "raw",
+		Read:   sc.Read,
+	}
+	var err error
+	ret.Init, err = parseBusPayloads(sc.Init)
+	if err != nil {
+		return ret, fmt.Errorf("invalid init, %v", err)
+	}
+	if sc.Command != "" {
+		ret.Command, err = utils.ParsePayload(sc.Command)
+		if err != nil {
+			return ret, fmt.Errorf("invalid command, %v", err)
+		}
+	}
+	if len(sc.Fields) > 0 {
+		ret.Fields, err = parseBusFields(sc.Fields)
+		if err != nil {
+			return ret, err
+		}
+		ret.Format = "json"
+	}
+	if sc.Format != "" {
+		ret.Format = sc.Format
+	}
+	if ret.Format == "json" && len(ret.Fields) == 0 {
+		return ret, fmt.Errorf("fields must be set with json format")
+	}
+	return ret, nil
+}
+
+// encode converts read bytes into the message body.
+func (tx busTransaction) encode(buf []byte) ([]byte, error) {
+	switch tx.Format {
+	case "hex":
+		return []byte(hex.EncodeToString(buf)), nil
+	case "json":
+		ret := make(map[string]interface{})
+		for _, f := range tx.Fields {
+			v, err := f.decode(buf)
+			if err != nil {
+				return nil, err
+			}
+			ret[f.Name] = v
+		}
+		return json.Marshal(ret)
+	}
+	return buf, nil
+}
+
+// busLoop performs init transactions and then reads the device by
+// interval until stop is closed.
+func busLoop(bus busTransactor, tx busTransaction, interval int, newMessage func([]byte) message.Message,
+	channel chan message.Message, devChan DeviceChannel, stop chan struct{}) {
+	defer bus.Close()
+
+	for _, w := range tx.Init {
+		if _, err := bus.Tx(w, 0); err != nil {
+			log.Errorf("bus init write failed, %v", err)
+			return
+		}
+	}
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			buf, err := bus.Tx(tx.Command, tx.Read)
+			if err != nil {
+				log.Errorf("bus transaction failed, %v", err)
+				continue
+			}
+			body, err := tx.encode(buf)
+			if err != nil {
+				log.Errorf("bus decode failed, %v, %v", err, buf)
+				continue
+			}
+			channel <- newMessage(body)
+		case msg, _ := <-devChan.Chan:
+			log.Debugf("msg reached to bus device, ignored, %v", msg)
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package device
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// ioctl numbers and flags from linux/i2c-dev.h, linux/i2c.h and
+// linux/spi/spidev.h
+const (
+	i2cSlave  = 0x0703
+	i2cTenBit = 0x0704
+	i2cRdwr   = 0x0707
+
+	i2cMsgRead   = 0x0001
+	i2cMsgTenBit = 0x0010
+
+	spiIocWrMode        = 0x40016b01
+	spiIocWrBitsPerWord = 0x40016b03
+	spiIocWrMaxSpeedHz  = 0x40046b04
+	spiIocMessage1      = 0x40206b00
+)
+
+// ioctlInt is ioctl which takes an integer argument.
+func ioctlInt(fd uintptr, req uintptr, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+type i2cBus struct {
+	f     *os.File
+	addr  uint16
+	flags uint16 // i2cMsgTenBit or 0
+}
+
+// i2cMsg is struct i2c_msg. The pointers are unsafe.Pointer, not
+// uintptr, so that the buffers are kept alive while the kernel uses them.
+type i2cMsg struct {
+	Addr  uint16
+	Flags uint16
+	Len   uint16
+	Buf   unsafe.Pointer
+}
+
+// i2cRdwrData is struct i2c_rdwr_ioctl_data.
+type i2cRdwrData struct {
+	Msgs  unsafe.Pointer
+	Nmsgs uint32
+}
+
+// openI2C opens /dev/i2c-N and selects the slave address.
+func openI2C(path string, address int) (busTransactor, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	b := i2cBus{f: f, addr: uint16(address)}
+	if address > 0x7f {
+		if err := ioctlInt(f.Fd(), i2cTenBit, 1); err != nil {
+			f.Close()
+			return nil, err
+		}
+		b.flags = i2cMsgTenBit
+	}
+	if err := ioctlInt(f.Fd(), i2cSlave, uintptr(address)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// Tx writes w and reads n bytes with a repeated start, without a stop
+// between them, because devices like BME280 expect the register address
+// to be followed by the read in one transaction.
+func (b i2cBus) Tx(w []byte, n int) ([]byte, error) {
+	if len(w) > 0 && n > 0 {
+		return b.rdwr(w, n)
+	}
+	if len(w) > 0 {
+		if _, err := b.f.Write(w); err != nil {
+			return nil, err
+		}
+	}
+	buf := make([]byte, n)
+	if n > 0 {
+		if _, err := io.ReadFull(b.f, buf); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func (b i2cBus) rdwr(w []byte, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	msgs := []i2cMsg{
+		{Addr: b.addr, Flags: b.flags, Len: uint16(len(w)), Buf: unsafe.Pointer(&w[0])},
+		{Addr: b.addr, Flags: b.flags | i2cMsgRead, Len: uint16(n), Buf: unsafe.Pointer(&buf[0])},
+	}
+	data := i2cRdwrData{
+		Msgs:  unsafe.Pointer(&msgs[0]),
+		Nmsgs: uint32(len(msgs)),
+	}
+	if err := ioctl(b.f.Fd(), i2cRdwr, unsafe.Pointer(&data)); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (b i2cBus) Close() error {
+	return b.f.Close()
+}
+
+type spiIocTransfer struct {
+	TxBuf          uint64
+	RxBuf          uint64
+	Len            uint32
+	SpeedHz        uint32
+	DelayUsecs     uint16
+	BitsPerWord    uint8
+	CsChange       uint8
+	TxNbits        uint8
+	RxNbits        uint8
+	WordDelayUsecs uint8
+	Pad            uint8
+}
+
+type spiBus struct {
+	f     *os.File
+	speed uint32
+	bits  uint8
+}
+
+// openSPI opens /dev/spidevX.Y and sets up mode, bits per word and speed.
+func openSPI(path string, mode, speed, bits int) (busTransactor, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	m := uint8(mode)
+	b := uint8(bits)
+	s := uint32(speed)
+	for _, c := range []struct {
+		req uintptr
+		arg unsafe.Pointer
+	}{
+		{spiIocWrMode, unsafe.Pointer(&m)},
+		{spiIocWrBitsPerWord, unsafe.Pointer(&b)},
+		{spiIocWrMaxSpeedHz, unsafe.Pointer(&s)},
+	} {
+		if err := ioctl(f.Fd(), c.req, c.arg); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return spiBus{f: f, speed: s, bits: b}, nil
+}
+
+// Tx clocks out w followed by n dummy bytes in one transfer, and returns
+// the bytes received while the dummy bytes are sent.
+func (b spiBus) Tx(w []byte, n int) ([]byte, error) {
+	size := len(w) + n
+	if size == 0 {
+		return []byte{}, nil
+	}
+	// tx and rx share one buffer, which is referred only by uint64 in
+	// the transfer. It is kept alive by returning a slice of it.
+	buf := make([]byte, 2*size)
+	tx, rx := buf[:size], buf[size:]
+	copy(tx, w)
+	tr := spiIocTransfer{
+		TxBuf:       uint64(uintptr(unsafe.Pointer(&tx[0]))),
+		RxBuf:       uint64(uintptr(unsafe.Pointer(&rx[0]))),
+		Len:         uint32(size),
+		SpeedHz:     b.speed,
+		BitsPerWord: b.bits,
+	}
+	if err := ioctl(b.f.Fd(), spiIocMessage1, unsafe.Pointer(&tr)); err != nil {
+		return nil, err
+	}
+	return buf[size+len(w):], nil
+}
+
+func (b spiBus) Close() error {
+	return b.f.Close()
+}
@@ -0,0 +1,138 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+)
+
+type fakeBus struct {
+	written [][]byte
+	reply   []byte
+}
+
+func (b *fakeBus) Tx(w []byte, n int) ([]byte, error) {
+	b.written = append(b.written, w)
+	return b.reply[:n], nil
+}
+
+func (b *fakeBus) Close() error {
+	return nil
+}
+
+func TestParseBusFields(t *testing.T) {
+	assert := assert.New(t)
+
+	fields, err := parseBusFields([]string{"ch0:s16be@0*0.000125", "press:u24be@2>>4", "flag:u8@5"})
+	assert.Nil(err)
+	assert.Equal([]busField{
+		{Name: "ch0", Kind: "s16be", Offset: 0, Scale: 0.000125},
+		{Name: "press", Kind: "u24be", Offset: 2, Shift: 4, Scale: 1},
+		{Name: "flag", Kind: "u8", Offset: 5, Scale: 1},
+	}, fields)
+
+	for _, f := range []string{"ch0:s16@0", "ch0:f32be@0", "ch0:u8", "c h:u8@0", "ch0:u8@0*x"} {
+		_, err = parseBusFields([]string{f})
+		assert.NotNil(err, f)
+	}
+}
+
+func TestBusFieldDecode(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := []byte{0xff, 0xfe, 0x65, 0x5a, 0xc0, 0x01}
+	for _, c := range []struct {
+		field    string
+		expected interface{}
+	}{
+		{"v:s16be@0", int64(-2)},
+		{"v:u16be@0", int64(0xfffe)},
+		{"v:s16le@0", int64(-257)},
+		{"v:u24be@2>>4", int64(0x655ac0 >> 4)},
+		{"v:s8@4", int64(-64)},
+		{"v:u32le@2", int64(0xc05a65 | 0x01<<24)},
+		{"v:s16be@0*0.5", float64(-1)},
+	} {
+		fields, err := parseBusFields([]string{c.field})
+		assert.Nil(err)
+		v, err := fields[0].decode(buf)
+		assert.Nil(err)
+		assert.Equal(c.expected, v, c.field)
+	}
+
+	fields, _ := parseBusFields([]string{"v:u32be@4"})
+	_, err := fields[0].decode(buf)
+	assert.NotNil(err)
+}
+
+func TestNewBusTransaction(t *testing.T) {
+	assert := assert.New(t)
+
+	tx, err := newBusTransaction(BusSection{
+		Init:    config.List{`\xf2\x01`, `\xf4\x27`},
+		Command: `\xf7`,
+		Read:    8,
+	})
+	assert.Nil(err)
+	assert.Equal([][]byte{{0xf2, 0x01}, {0xf4, 0x27}}, tx.Init)
+	assert.Equal([]byte{0xf7}, tx.Command)
+	assert.Equal(8, tx.Read)
+	assert.Equal("raw", tx.Format)
+
+	tx, err = newBusTransaction(BusSection{Fields: config.List{"ch0:s16be@0"}})
+	assert.Nil(err)
+	assert.Equal("json", tx.Format)
+
+	_, err = newBusTransaction(BusSection{Format: "json"})
+	assert.NotNil(err)
+	_, err = newBusTransaction(BusSection{Init: config.List{`\x0`}})
+	assert.NotNil(err)
+}
+
+func TestBusLoop(t *testing.T) {
+	assert := assert.New(t)
+
+	tx, err := newBusTransaction(BusSection{
+		Init:    config.List{`\x01\x84\x83`},
+		Command: `\x00`,
+		Read:    2,
+		Fields:  config.List{"ch0:s16be@0*0.125"},
+	})
+	assert.Nil(err)
+	bus := &fakeBus{reply: []byte{0x00, 0x10}}
+	channel := make(chan message.Message)
+	devChan := NewDeviceChannel()
+	stop := make(chan struct{})
+	defer close(stop)
+
+	newMessage := func(body []byte) message.Message {
+		return message.Message{Sender: "adc", Body: body}
+	}
+	go busLoop(bus, tx, 1, newMessage, channel, devChan, stop)
+
+	select {
+	case msg := <-channel:
+		assert.Equal(`{"ch0":2}`, string(msg.Body))
+	case <-time.After(3 * time.Second):
+		t.Fatal("bus message timeout")
+	}
+	assert.Equal([][]byte{{0x01, 0x84, 0x83}, {0x00}}, bus.written)
+}
@@ -15,6 +15,9 @@
 package device
 
 import (
+	"fmt"
+	"strings"
+
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/shiguredo/fuji/broker"
@@ -25,45 +28,98 @@ import (
 type Devicer interface {
 	Start(chan message.Message) error
 	DeviceType() string
+	DeviceName() string
 	Stop() error
 	AddSubscribe() error
 }
 
-// NewDevices is a factory method to create various kind of devices from config.Config
+// Caller is a Devicer which handles RPC requests sent to
+// "<prefix>/<gateway>/<device>/rpc". The gateway publishes the returned
+// result or error as the response.
+type Caller interface {
+	Devicer
+	Call(req message.Request) (interface{}, error)
+}
+
+// NewDevices is a factory method to create various kind of devices from config.Config.
+// The device and its channel have the same index. Devices which could
+// not be created are skipped.
 func NewDevices(conf config.Config, brokers []*broker.Broker) ([]Devicer, []DeviceChannel, error) {
 	var ret []Devicer
 	var devChannels []DeviceChannel
 
-	var err error
 	for _, section := range conf.Sections {
 		if section.Type != "device" {
 			continue
 		}
 
-		var device Devicer
-
 		devChan := NewDeviceChannel()
-		devChannels = append(devChannels, devChan)
-
-		switch section.Values["type"] {
-		case "dummy":
-			device, err = NewDummyDevice(section, brokers, devChan)
-			if err != nil {
-				log.Errorf("could not create dummy device, %v", err)
-				continue
-			}
-		case "serial":
-			device, err = NewSerialDevice(section, brokers, devChan)
-			if err != nil {
-				log.Errorf("could not create serial device, %v", err)
-				continue
-			}
-		default:
-			log.Warnf("unknown device type, %v", section.Arg)
+		device, err := NewDevice(section, brokers, devChan)
+		if err != nil {
+			log.Error(err)
 			continue
 		}
 		ret = append(ret, device)
+		devChannels = append(devChannels, devChan)
 	}
 
 	return ret, devChannels, nil
 }
+
+// NewDevice creates the device of the section.
+func NewDevice(section config.ConfigSection, brokers []*broker.Broker, devChan DeviceChannel) (Devicer, error) {
+	var device Devicer
+	var err error
+
+	switch section.Values["type"] {
+	case "dummy":
+		device, err = NewDummyDevice(section, brokers, devChan)
+	case "serial":
+		device, err = NewSerialDevice(section, brokers, devChan)
+	case "file":
+		device, err = NewFileDevice(section, brokers, devChan)
+	case "gpio":
+		device, err = NewGPIODevice(section, brokers, devChan)
+	case "i2c":
+		device, err = NewI2CDevice(section, brokers, devChan)
+	case "spi":
+		device, err = NewSPIDevice(section, brokers, devChan)
+	case "onewire":
+		device, err = NewOneWireDevice(section, brokers, devChan)
+	case "ble_scan":
+		device, err = NewBLEScanDevice(section, brokers, devChan)
+	case "enocean":
+		device, err = NewEnOceanDevice(section, brokers, devChan)
+	case "nmea":
+		device, err = NewNMEADevice(section, brokers, devChan)
+	case "http":
+		device, err = NewHTTPDevice(section, brokers, devChan)
+	case "syslog":
+		device, err = NewSyslogDevice(section, brokers, devChan)
+	case "mqtt_bridge":
+		device, err = NewMQTTBridgeDevice(section, brokers, devChan)
+	default:
+		return nil, fmt.Errorf("unknown device type, %v", section.Values["type"])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not create %v device, %v", section.Values["type"], err)
+	}
+	return device, nil
+}
+
+// offlineMessage returns the message which tells the gateway that the
+// device is offline, ex. its port is lost.
+func offlineMessage(name, brokerName string) message.Message {
+	return message.Message{
+		Sender:     name,
+		Type:       message.TypeAvailability,
+		BrokerName: brokerName,
+		Body:       []byte(message.Offline),
+	}
+}
+
+// subscribedTo reports whether the subscribed message is sent to the device.
+// Subscribed topic is "<prefix>/<gateway>/<device>/subscribe".
+func subscribedTo(msg message.Message, name string) bool {
+	return strings.HasSuffix(msg.Topic, "/"+name+"/subscribe")
+}
@@ -0,0 +1,126 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+)
+
+// testDeviceArgs returns the arguments of the device constructors for the
+// first section of configStr. The section refers to the broker "sango"
+// of the gateway "ham".
+// ex: d, err := NewNMEADevice(testDeviceArgs(t, configStr))
+func testDeviceArgs(t *testing.T, configStr string) (config.ConfigSection, []*broker.Broker, DeviceChannel) {
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	if !assert.Nil(t, err) || len(conf.Sections) == 0 {
+		t.FailNow()
+	}
+	brokers := []*broker.Broker{&broker.Broker{Name: "sango", GatewayName: "ham"}}
+	return conf.Sections[0], brokers, NewDeviceChannel()
+}
+
+func TestNewDevices(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[device."dora"]
+    type = "dummy"
+    qos = 0
+    broker = "sango"
+    interval = 10
+    payload = "Hello world."
+
+[device."nobita"]
+    type = "dummy"
+    qos = 0
+    broker = "sango"
+    interval = -1
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	brokers := []*broker.Broker{&broker.Broker{Name: "sango"}}
+
+	// invalid devices are skipped with their channels
+	devices, channels, err := NewDevices(conf, brokers)
+	assert.Nil(err)
+	assert.Equal(1, len(devices))
+	assert.Equal(1, len(channels))
+	assert.Equal("dora", devices[0].DeviceName())
+	assert.Equal("dummy", devices[0].DeviceType())
+}
+
+func TestNewDeviceUnknownType(t *testing.T) {
+	assert := assert.New(t)
+
+	section := config.ConfigSection{
+		Type:   "device",
+		Name:   "suneo",
+		Values: config.ValueMap{"type": "teleporter", "broker": "sango"},
+	}
+	_, err := NewDevice(section, nil, NewDeviceChannel())
+	assert.NotNil(err)
+}
+
+func TestLoadConfigExample(t *testing.T) {
+	assert := assert.New(t)
+
+	// the shipped example is loadable without any environment. it is
+	// tested here because device sections are registered by this package
+	_, err := config.LoadConfig("../config.toml.example")
+	assert.Nil(err)
+}
+
+func TestSearchBrokerSection(t *testing.T) {
+	assert := assert.New(t)
+
+	conf, err := config.LoadConfig("../tests/testing_conf.toml")
+	assert.Nil(err)
+
+	section := config.SearchSection(&conf.Sections, "broker", "1")
+	assert.NotNil(section)
+
+	section = config.SearchSection(&conf.Sections, "broker", "2")
+	assert.NotNil(section)
+
+	section = config.SearchSection(&conf.Sections, "broker", "3")
+	assert.Nil(section)
+
+}
+
+func TestSearchDeviceType(t *testing.T) {
+	assert := assert.New(t)
+
+	conf, err := config.LoadConfig("../tests/testing_conf.toml")
+	assert.Nil(err)
+
+	section := config.SearchDeviceType(&conf.Sections, "serial")
+	assert.NotNil(section)
+	assert.Equal("device", section.Type)
+	assert.Equal("serial", section.Values["type"])
+
+	section = config.SearchDeviceType(&conf.Sections, "dummy")
+	assert.NotNil(section)
+	assert.Equal("device", section.Type)
+	assert.Equal("dummy", section.Values["type"])
+
+	section = config.SearchDeviceType(&conf.Sections, "notfound")
+	assert.Nil(section)
+
+}
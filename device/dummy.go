@@ -15,7 +15,10 @@
 package device
 
 import (
+	"bufio"
 	"fmt"
+	"math/rand"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -31,17 +34,39 @@ import (
 
 // DummyDevice is an dummy device which outputs only specified payload.
 type DummyDevice struct {
-	Name       string `validate:"max=256,regexp=[^/]+,validtopic"`
-	Broker     []*broker.Broker
-	BrokerName string
-	QoS        byte `validate:"min=0,max=2"`
-	InputPort  InputPortType
-	Interval   int    `validate:"min=1"`
-	Payload    []byte `validate:"max=4096"`
-	Type       string `validate:"max=256"`
-	Retain     bool
-	Subscribe  bool
-	DeviceChan DeviceChannel // GW -> device
+	Name        string `validate:"max=256,regexp=[^/]+,validtopic"`
+	Broker      []*broker.Broker
+	BrokerName  string
+	GatewayName string
+	QoS         byte `validate:"min=0,max=2"`
+	InputPort   InputPortType
+	Interval    int     `validate:"min=1"`
+	Cron        string  `validate:"max=256"`
+	Rate        float64 `validate:"min=0"` // msg/s, used instead of interval if set
+	Burst       int     `validate:"min=1"` // messages per tick
+	Payload     []byte  `validate:"max=4096"`
+	PayloadMin  int     `validate:"min=0,max=1048576"`
+	PayloadMax  int     `validate:"min=0,max=1048576"`
+	Replay      string  `validate:"max=4096"`
+	ReplayLoop  bool
+	Type        string `validate:"max=256"`
+	Retain      bool
+	Subscribe   bool
+	DeviceChan  DeviceChannel // GW -> device
+
+	schedule *utils.CronSchedule
+	payloads []dummyPayload // payload or lines of replay file
+	filler   []byte         // random payload source of payload_size
+	stop     chan struct{}
+}
+
+// maxDummyRate is the max msg/s of a dummy device.
+const maxDummyRate = 100000
+
+// dummyPayload is a static payload or a payload template.
+type dummyPayload struct {
+	raw  []byte
+	tmpl *utils.PayloadTemplate
 }
 
 // String retruns dummy device information
@@ -49,54 +74,106 @@ func (dummyDevice *DummyDevice) String() string {
 	return fmt.Sprintf("%#v", dummyDevice)
 }
 
+// DummyDeviceSection is [device."<name>"] of type "dummy".
+type DummyDeviceSection struct {
+	config.DeviceSection
+	Interval    config.Seconds `toml:"interval"`
+	Cron        string         `toml:"cron"`
+	Rate        float64        `toml:"rate"`
+	Burst       int            `toml:"burst"`
+	Payload     string         `toml:"payload"`
+	PayloadSize string         `toml:"payload_size"`
+	Replay      string         `toml:"replay"`
+	ReplayLoop  bool           `toml:"replay_loop"`
+}
+
+func init() {
+	config.RegisterSection("device/dummy", DummyDeviceSection{})
+}
+
 // NewDummyDevice creates dummy device which outputs specified string/binary payload.
 func NewDummyDevice(section config.ConfigSection, brokers []*broker.Broker, devChan DeviceChannel) (DummyDevice, error) {
 	ret := DummyDevice{
 		Name:       section.Name,
 		DeviceChan: devChan,
+		Burst:      1,
+		stop:       make(chan struct{}),
+	}
+	sc := DummyDeviceSection{Burst: 1}
+	if err := section.Decode(&sc); err != nil {
+		return ret, err
 	}
-	values := section.Values
-	bname, ok := section.Values["broker"]
-	if !ok {
+	if sc.Broker == "" {
 		return ret, fmt.Errorf("broker does not set")
 	}
 
 	for _, b := range brokers {
-		if b.Name == bname {
+		if b.Name == sc.Broker {
 			ret.Broker = brokers
+			ret.GatewayName = b.GatewayName
 		}
 	}
 	if ret.Broker == nil {
-		return ret, fmt.Errorf("broker does not exists: %s", bname)
+		return ret, fmt.Errorf("broker does not exists: %s", sc.Broker)
 	}
-	ret.BrokerName = bname
+	ret.BrokerName = sc.Broker
 
-	qos, err := strconv.Atoi(values["qos"])
-	if err != nil {
-		return ret, fmt.Errorf("qos parse failed, %v", err)
+	if _, ok := section.Values["qos"]; !ok {
+		return ret, fmt.Errorf("qos does not set")
 	}
-	ret.QoS = byte(qos)
+	ret.QoS = byte(sc.QoS)
+	ret.Burst = sc.Burst
 
-	interval, err := strconv.Atoi(values["interval"])
-	if err != nil {
-		return ret, err
+	// cron or rate is used instead of interval if set
+	var err error
+	ret.Cron = sc.Cron
+	if _, ok := section.Values["rate"]; ok {
+		if ret.Cron != "" {
+			return ret, fmt.Errorf("rate and cron could not be set at the same time")
+		}
+		ret.Rate = sc.Rate
+		if ret.Rate <= 0 || ret.Rate > maxDummyRate {
+			return ret, fmt.Errorf("invalid rate, %v", sc.Rate)
+		}
+		ret.Interval = 1
+	} else if ret.Cron != "" {
+		ret.schedule, err = utils.ParseCron(ret.Cron)
+		if err != nil {
+			return ret, err
+		}
+		ret.Interval = 1
 	} else {
-		ret.Interval = int(interval)
-	}
-	ret.Type = values["type"]
-	ret.Payload, err = utils.ParsePayload(values["payload"])
-	if err != nil {
-		log.Warnf("invalid payload, but continue")
+		ret.Interval = int(sc.Interval)
 	}
-	ret.Retain = false
-	if values["retain"] == "true" {
-		ret.Retain = true
+	ret.Type = sc.Type
+	ret.Replay = sc.Replay
+	ret.ReplayLoop = sc.ReplayLoop
+	if ret.Replay != "" {
+		ret.payloads, err = loadDummyReplay(ret.Replay)
+		if err != nil {
+			return ret, err
+		}
+	} else {
+		p, err := newDummyPayload(sc.Payload)
+		if err != nil {
+			return ret, err
+		}
+		ret.Payload = p.raw
+		ret.payloads = []dummyPayload{p}
 	}
-
-	sub, ok := values["subscribe"]
-	if ok && sub == "true" {
-		ret.Subscribe = true
+	// ex: 64-256, 128
+	if sc.PayloadSize != "" {
+		if ret.Replay != "" {
+			return ret, fmt.Errorf("replay and payload_size could not be set at the same time")
+		}
+		ret.PayloadMin, ret.PayloadMax, err = parsePayloadSize(sc.PayloadSize)
+		if err != nil {
+			return ret, err
+		}
+		ret.filler = newDummyFiller(ret.PayloadMax)
 	}
+	ret.Retain = sc.Retain
+	ret.Subscribe = sc.Subscribe
 
 	// Validation
 	if err := ret.Validate(); err != nil {
@@ -114,6 +191,87 @@ func (device *DummyDevice) Validate() error {
 	return nil
 }
 
+// newDummyPayload parses payload setting. Payload which has "{{" is
+// a template, otherwise it is parsed by utils.ParsePayload.
+func newDummyPayload(arg string) (dummyPayload, error) {
+	if utils.IsPayloadTemplate(arg) {
+		tmpl, err := utils.NewPayloadTemplate(arg)
+		if err != nil {
+			return dummyPayload{}, fmt.Errorf("invalid payload template, %v", err)
+		}
+		return dummyPayload{raw: []byte(arg), tmpl: tmpl}, nil
+	}
+	raw, err := utils.ParsePayload(arg)
+	if err != nil {
+		log.Warnf("invalid payload, but continue")
+	}
+	return dummyPayload{raw: raw}, nil
+}
+
+// parsePayloadSize parses "min-max" or "size" in bytes.
+func parsePayloadSize(arg string) (int, int, error) {
+	r := strings.SplitN(arg, "-", 2)
+	min, err := strconv.Atoi(strings.TrimSpace(r[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("payload_size parse failed, %v", arg)
+	}
+	max := min
+	if len(r) == 2 {
+		max, err = strconv.Atoi(strings.TrimSpace(r[1]))
+		if err != nil {
+			return 0, 0, fmt.Errorf("payload_size parse failed, %v", arg)
+		}
+	}
+	if min < 0 || max < min {
+		return 0, 0, fmt.Errorf("invalid payload_size, %v", arg)
+	}
+	return min, max, nil
+}
+
+// newDummyFiller returns random printable bytes. Payloads of
+// payload_size are slices of it to avoid allocations on high rates.
+func newDummyFiller(size int) []byte {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	ret := make([]byte, size)
+	for i := range ret {
+		ret[i] = letters[rand.Intn(len(letters))]
+	}
+	return ret
+}
+
+// loadDummyReplay reads replay file. Each line is a payload.
+func loadDummyReplay(path string) ([]dummyPayload, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("replay file open failed, %v", err)
+	}
+	defer f.Close()
+
+	var ret []dummyPayload
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		p, err := newDummyPayload(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("replay file is empty, %v", path)
+	}
+	return ret, nil
+}
+
+func (p dummyPayload) render(ctx utils.PayloadContext) ([]byte, error) {
+	if p.tmpl == nil {
+		return p.raw, nil
+	}
+	return p.tmpl.Execute(ctx)
+}
+
 // Start starts dummy goroutine
 func (device DummyDevice) Start(channel chan message.Message) error {
 	log.Info("start dummy device")
@@ -122,31 +280,94 @@ func (device DummyDevice) Start(channel chan message.Message) error {
 	return nil
 }
 
+// nextTick returns duration until the next publish.
+func (device DummyDevice) nextTick(now time.Time) time.Duration {
+	if device.Rate > 0 {
+		return time.Duration(float64(device.Burst) / device.Rate * float64(time.Second))
+	}
+	if device.schedule == nil {
+		return time.Duration(device.Interval) * time.Second
+	}
+	next := device.schedule.Next(now)
+	if next.IsZero() {
+		// never fires
+		return time.Duration(1<<63 - 1)
+	}
+	return next.Sub(now)
+}
+
+// newMessage returns seq-th (1 origin) message. ok is false after the
+// replay finished.
+func (device DummyDevice) newMessage(seq uint64, now time.Time) (msg message.Message, ok bool, err error) {
+	idx := (seq - 1) % uint64(len(device.payloads))
+	if !device.ReplayLoop && seq > uint64(len(device.payloads)) && device.Replay != "" {
+		return msg, false, nil
+	}
+	var body []byte
+	if device.filler != nil {
+		body = device.filler[:device.PayloadMin+rand.Intn(device.PayloadMax-device.PayloadMin+1)]
+	} else {
+		body, err = device.payloads[idx].render(utils.PayloadContext{
+			Gateway: device.GatewayName,
+			Device:  device.Name,
+			Seq:     seq,
+			Time:    now,
+		})
+		if err != nil {
+			return msg, true, err
+		}
+	}
+	msg = message.Message{
+		Sender:     device.Name,
+		Type:       device.Type,
+		QoS:        device.QoS,
+		Retained:   device.Retain,
+		Body:       body,
+		BrokerName: device.BrokerName,
+		Created:    now,
+	}
+	return msg, true, nil
+}
+
 // MainLoop is an mainloop of dummy device.
 func (device DummyDevice) MainLoop(channel chan message.Message) error {
-	ticker := time.NewTicker(time.Duration(device.Interval) * time.Second)
+	timer := time.NewTimer(device.nextTick(time.Now()))
+	defer timer.Stop()
 
+	var seq uint64
 	for {
 		select {
-		case <-ticker.C:
-			msg := message.Message{
-				Sender:     device.Name,
-				Type:       device.Type,
-				QoS:        device.QoS,
-				Retained:   device.Retain,
-				Body:       []byte(device.Payload),
-				BrokerName: device.BrokerName,
+		case <-timer.C:
+			timer.Reset(device.nextTick(time.Now()))
+			for i := 0; i < device.Burst; i++ {
+				seq++
+				msg, ok, err := device.newMessage(seq, time.Now())
+				if !ok {
+					log.Infof("replay finished: %v", device.Name)
+					timer.Stop()
+					break
+				}
+				if err != nil {
+					log.Errorf("payload template failed, %v", err)
+					continue
+				}
+				// the gateway may not receive while stopping
+				select {
+				case channel <- msg:
+				case <-device.stop:
+					return nil
+				}
 			}
-			channel <- msg
 		case msg, _ := <-device.DeviceChan.Chan:
-			if !strings.HasSuffix(msg.Topic, device.Name) {
+			if !subscribedTo(msg, device.Name) {
 				continue
 			}
 
 			log.Infof("msg reached to device, %v", msg)
+		case <-device.stop:
+			return nil
 		}
 	}
-	return nil
 }
 
 // DeviceType retunes device type.
@@ -154,8 +375,39 @@ func (device DummyDevice) DeviceType() string {
 	return "dummy"
 }
 
+// DeviceName returns the name of the device.
+func (device DummyDevice) DeviceName() string {
+	return device.Name
+}
+
+// Call handles RPC request.
+// methods:
+//   ping: returns "pong"
+//   get: returns the settings
+func (device DummyDevice) Call(req message.Request) (interface{}, error) {
+	switch req.Method {
+	case "ping":
+		return "pong", nil
+	case "get":
+		return map[string]interface{}{
+			"type":     device.Type,
+			"interval": device.Interval,
+			"cron":     device.Cron,
+			"rate":     device.Rate,
+			"burst":    device.Burst,
+			"payload":  string(device.Payload),
+		}, nil
+	}
+	return nil, message.ErrUnknownMethod
+}
+
 func (device DummyDevice) Stop() error {
 	log.Warnf("closing dummy device: %v", device.Name)
+	select {
+	case <-device.stop:
+	default:
+		close(device.stop)
+	}
 	return nil
 }
 
@@ -15,12 +15,16 @@
 package device
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
 	"github.com/shiguredo/fuji/broker"
 	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
 )
 
 func TestNewDummyDevice(t *testing.T) {
@@ -30,7 +34,6 @@ func TestNewDummyDevice(t *testing.T) {
 [device."dora/dummy"]
     broker = "sango"
     qos = 1
-    dummy = true
     interval = 10
     payload = "Hello world."
 `
@@ -97,3 +100,231 @@ func TestNewDummyDeviceInvalidBroker(t *testing.T) {
 	_, err = NewDummyDevice(conf.Sections[0], brokers, NewDeviceChannel())
 	assert.NotNil(err)
 }
+
+func TestNewDummyDeviceCron(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[device."dora/dummy"]
+    broker = "sango"
+    qos = 1
+    cron = "*/5 * * * *"
+    payload = "{{.Gateway}} {{.Seq}}"
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango", GatewayName: "ham"}
+	brokers := []*broker.Broker{b1}
+	b, err := NewDummyDevice(conf.Sections[0], brokers, NewDeviceChannel())
+	assert.Nil(err)
+	assert.Equal("*/5 * * * *", b.Cron)
+
+	now := time.Date(2015, 10, 9, 12, 3, 0, 0, time.UTC)
+	assert.Equal(2*time.Minute, b.nextTick(now))
+	msg, ok, err := b.newMessage(2, now)
+	assert.True(ok)
+	assert.Nil(err)
+	assert.Equal("ham 2", string(msg.Body))
+
+	section := conf.Sections[0]
+	section.Values["cron"] = "* * *"
+	_, err = NewDummyDevice(section, brokers, NewDeviceChannel())
+	assert.NotNil(err)
+}
+
+func TestDummyDeviceReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	f, err := ioutil.TempFile("", "fuji-replay")
+	assert.Nil(err)
+	defer os.Remove(f.Name())
+	f.WriteString("first\n\\x01\\x02\nseq={{.Seq}}\n")
+	f.Close()
+
+	configStr := `
+[device."dora/dummy"]
+    broker = "sango"
+    qos = 0
+    interval = 1
+    replay = "` + f.Name() + `"
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+	b, err := NewDummyDevice(conf.Sections[0], brokers, NewDeviceChannel())
+	assert.Nil(err)
+
+	now := time.Now()
+	var bodies []string
+	for seq := uint64(1); seq <= 4; seq++ {
+		msg, ok, err := b.newMessage(seq, now)
+		assert.Nil(err)
+		if !ok {
+			break
+		}
+		bodies = append(bodies, string(msg.Body))
+	}
+	assert.Equal([]string{"first", "\x01\x02", "seq=3"}, bodies)
+
+	b.ReplayLoop = true
+	msg, ok, _ := b.newMessage(4, now)
+	assert.True(ok)
+	assert.Equal("first", string(msg.Body))
+}
+
+func TestDummyDeviceStop(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[device."dora/dummy"]
+    broker = "sango"
+    qos = 0
+    interval = 1
+    payload = "hello"
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+	b, err := NewDummyDevice(conf.Sections[0], brokers, NewDeviceChannel())
+	assert.Nil(err)
+
+	done := make(chan error)
+	go func() {
+		done <- b.MainLoop(make(chan message.Message))
+	}()
+	b.Stop()
+	b.Stop()
+	select {
+	case err := <-done:
+		assert.Nil(err)
+	case <-time.After(time.Second):
+		t.Fatal("dummy device does not stop")
+	}
+}
+
+func TestDummyDeviceStopWhileSending(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[device."dora/dummy"]
+    broker = "sango"
+    qos = 0
+    rate = 1000
+    burst = 10
+    payload = "hello"
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+	b, err := NewDummyDevice(conf.Sections[0], brokers, NewDeviceChannel())
+	assert.Nil(err)
+
+	channel := make(chan message.Message)
+	done := make(chan error)
+	go func() {
+		done <- b.MainLoop(channel)
+	}()
+	// the burst is in progress and nobody receives the rest
+	select {
+	case <-channel:
+	case <-time.After(time.Second):
+		t.Fatal("burst not reached")
+	}
+	b.Stop()
+	select {
+	case err := <-done:
+		assert.Nil(err)
+	case <-time.After(time.Second):
+		t.Fatal("dummy device does not stop while sending")
+	}
+}
+
+func TestDummyDeviceRate(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[device."dora/dummy"]
+    broker = "sango"
+    qos = 0
+    rate = 500
+    burst = 50
+    payload_size = "64-256"
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+	b, err := NewDummyDevice(conf.Sections[0], brokers, NewDeviceChannel())
+	assert.Nil(err)
+	assert.Equal(100*time.Millisecond, b.nextTick(time.Now()))
+
+	now := time.Now()
+	for seq := uint64(1); seq <= 100; seq++ {
+		msg, ok, err := b.newMessage(seq, now)
+		assert.True(ok)
+		assert.Nil(err)
+		assert.True(len(msg.Body) >= 64 && len(msg.Body) <= 256)
+		assert.Equal(now, msg.Created)
+	}
+
+	channel := make(chan message.Message)
+	go b.MainLoop(channel)
+	defer b.Stop()
+	for i := 0; i < 50; i++ {
+		select {
+		case <-channel:
+		case <-time.After(time.Second):
+			t.Fatalf("burst not reached, %d", i)
+		}
+	}
+
+	for _, v := range []map[string]string{
+		{"rate": "0"},
+		{"rate": "ham"},
+		{"rate": "10", "cron": "@hourly"},
+		{"burst": "0"},
+		{"payload_size": "256-64"},
+		{"payload_size": "ham"},
+	} {
+		section := config.ConfigSection{Name: "dora", Values: map[string]string{
+			"broker": "sango", "qos": "0", "interval": "1",
+		}}
+		for k, val := range v {
+			section.Values[k] = val
+		}
+		_, err = NewDummyDevice(section, brokers, NewDeviceChannel())
+		assert.NotNil(err, "%v", v)
+	}
+}
+
+func TestDummyDeviceCall(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[device."dora/dummy"]
+    broker = "sango"
+    qos = 0
+    interval = 10
+    payload = "hello"
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	var d Caller
+	d, err = NewDummyDevice(conf.Sections[0], []*broker.Broker{b1}, NewDeviceChannel())
+	assert.Nil(err)
+
+	assert.Equal("dora", d.DeviceName())
+	v, err := d.Call(message.Request{ID: "1", Method: "ping"})
+	assert.Nil(err)
+	assert.Equal("pong", v)
+	v, err = d.Call(message.Request{ID: "2", Method: "get"})
+	assert.Nil(err)
+	assert.Equal(10, v.(map[string]interface{})["interval"])
+	assert.Equal("hello", v.(map[string]interface{})["payload"])
+	_, err = d.Call(message.Request{ID: "3", Method: "reboot"})
+	assert.Equal(message.ErrUnknownMethod, err)
+}
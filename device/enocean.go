@@ -0,0 +1,512 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	validator "gopkg.in/validator.v2"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+)
+
+const (
+	esp3SyncByte   = 0x55
+	esp3HeaderSize = 6 // sync, data length(2), optional length, packet type, header crc
+	esp3RadioERP1  = 0x01
+
+	enoceanRORGRPS = 0xf6
+	enoceanRORG1BS = 0xd5
+	enoceanRORG4BS = 0xa5
+
+	enoceanBroadcastID = "ffffffff"
+)
+
+var (
+	reEnOceanID      = regexp.MustCompile(`^[0-9a-f]{8}$`)
+	reEnOceanProfile = regexp.MustCompile(`^(F6-02-0[12]|D5-00-01|A5-02-(0[1-9]|0A|0B))$`)
+
+	enoceanRockerButtons = []string{"AI", "A0", "BI", "B0"}
+)
+
+// EnOceanDevice decodes EnOcean telegrams received by an ESP3 serial module.
+type EnOceanDevice struct {
+	Name       string `validate:"max=256,regexp=[^/]+,validtopic"`
+	Broker     []*broker.Broker
+	BrokerName string
+	QoS        byte   `validate:"min=0,max=2"`
+	Serial     string `validate:"min=1,max=256"`
+	Baud       int    `validate:"min=0"`
+	Profiles   map[string]string
+	Type       string `validate:"max=256"`
+	Retain     bool
+	Subscribe  bool
+	DeviceChan DeviceChannel // GW -> device
+
+	stop chan struct{}
+}
+
+// esp3Packet is an EnOcean Serial Protocol 3 packet.
+type esp3Packet struct {
+	Type     byte
+	Data     []byte
+	Optional []byte
+}
+
+// enoceanCommand is a subscribed message to send a telegram.
+// Data is sent as is if set, otherwise rocker switch telegram is built.
+type enoceanCommand struct {
+	RORG        string `json:"rorg"`
+	Data        string `json:"data"`
+	Status      string `json:"status"`
+	Sender      string `json:"sender"`
+	Destination string `json:"destination"`
+	Button      string `json:"button"`
+	Pressed     bool   `json:"pressed"`
+}
+
+func (device EnOceanDevice) String() string {
+	return fmt.Sprintf("%#v", device)
+}
+
+// EnOceanDeviceSection is [device."<name>"] of type "enocean".
+type EnOceanDeviceSection struct {
+	config.DeviceSection
+	Serial   string      `toml:"serial"`
+	Baud     int         `toml:"baud"`
+	Profiles config.List `toml:"profiles"`
+}
+
+func init() {
+	config.RegisterSection("device/enocean", EnOceanDeviceSection{})
+}
+
+// NewEnOceanDevice read config.ConfigSection and returnes EnOceanDevice.
+// If config validation failed, return error
+func NewEnOceanDevice(section config.ConfigSection, brokers []*broker.Broker, devChan DeviceChannel) (EnOceanDevice, error) {
+	ret := EnOceanDevice{
+		Name:       section.Name,
+		DeviceChan: devChan,
+		Baud:       57600,
+		Profiles:   make(map[string]string),
+		stop:       make(chan struct{}),
+	}
+	sc := EnOceanDeviceSection{Baud: 57600}
+	if err := section.Decode(&sc); err != nil {
+		return ret, err
+	}
+	if sc.Broker == "" {
+		return ret, fmt.Errorf("broker does not set")
+	}
+
+	for _, b := range brokers {
+		if b.Name == sc.Broker {
+			ret.Broker = brokers
+		}
+	}
+	if ret.Broker == nil {
+		return ret, fmt.Errorf("broker does not exists: %s", sc.Broker)
+	}
+	ret.BrokerName = sc.Broker
+
+	if _, ok := section.Values["qos"]; !ok {
+		return ret, fmt.Errorf("qos does not set")
+	}
+	ret.QoS = byte(sc.QoS)
+	ret.Serial = sc.Serial
+	ret.Baud = sc.Baud
+	// ex: 0180a1b2:A5-02-05, 002a3b4c:F6-02-01
+	for _, p := range sc.Profiles {
+		kv := strings.SplitN(p, ":", 2)
+		if len(kv) != 2 {
+			return ret, fmt.Errorf("invalid profile, %v", p)
+		}
+		id, eep := strings.ToLower(strings.TrimSpace(kv[0])), strings.ToUpper(strings.TrimSpace(kv[1]))
+		if !reEnOceanID.MatchString(id) {
+			return ret, fmt.Errorf("invalid sender id, %v", kv[0])
+		}
+		if !reEnOceanProfile.MatchString(eep) {
+			return ret, fmt.Errorf("unsupported profile, %v", kv[1])
+		}
+		ret.Profiles[id] = eep
+	}
+	ret.Type = sc.Type
+	ret.Retain = sc.Retain
+	ret.Subscribe = sc.Subscribe
+
+	if err := ret.Validate(); err != nil {
+		return ret, err
+	}
+
+	return ret, nil
+}
+
+func (device *EnOceanDevice) Validate() error {
+	validator := validator.NewValidator()
+	validator.SetValidationFunc("validtopic", config.ValidMqttPublishTopic)
+	if err := validator.Validate(device); err != nil {
+		return err
+	}
+	return nil
+}
+
+// crc8 calculates CRC8 (polynomial 0x07) used by ESP3.
+func crc8(buf []byte) byte {
+	var crc byte
+	for _, b := range buf {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// encode returns ESP3 frame of the packet.
+func (p esp3Packet) encode() []byte {
+	header := []byte{byte(len(p.Data) >> 8), byte(len(p.Data)), byte(len(p.Optional)), p.Type}
+	ret := []byte{esp3SyncByte}
+	ret = append(ret, header...)
+	ret = append(ret, crc8(header))
+	body := append(append([]byte{}, p.Data...), p.Optional...)
+	ret = append(ret, body...)
+	return append(ret, crc8(body))
+}
+
+// esp3Parser splits ESP3 packets from the byte stream.
+type esp3Parser struct {
+	buf []byte
+}
+
+// feed appends b and returns completed packets. Broken packets are
+// dropped and the parser resyncs to the next sync byte.
+func (parser *esp3Parser) feed(b []byte) []esp3Packet {
+	parser.buf = append(parser.buf, b...)
+	var ret []esp3Packet
+	for {
+		i := 0
+		for i < len(parser.buf) && parser.buf[i] != esp3SyncByte {
+			i++
+		}
+		parser.buf = parser.buf[i:]
+		if len(parser.buf) < esp3HeaderSize {
+			return ret
+		}
+		header := parser.buf[1:5]
+		if crc8(header) != parser.buf[5] {
+			log.Warnf("esp3 header crc mismatch")
+			parser.buf = parser.buf[1:]
+			continue
+		}
+		dataLen := int(header[0])<<8 | int(header[1])
+		optLen := int(header[2])
+		total := esp3HeaderSize + dataLen + optLen + 1
+		if len(parser.buf) < total {
+			return ret
+		}
+		body := parser.buf[esp3HeaderSize : total-1]
+		if crc8(body) != parser.buf[total-1] {
+			log.Warnf("esp3 data crc mismatch")
+			parser.buf = parser.buf[1:]
+			continue
+		}
+		ret = append(ret, esp3Packet{
+			Type:     header[3],
+			Data:     append([]byte{}, body[:dataLen]...),
+			Optional: append([]byte{}, body[dataLen:]...),
+		})
+		parser.buf = parser.buf[total:]
+	}
+}
+
+// decodeERP1 decodes a radio telegram into a JSON object.
+func (device EnOceanDevice) decodeERP1(p esp3Packet) (map[string]interface{}, error) {
+	// RORG, payload, sender id(4), status
+	if len(p.Data) < 7 {
+		return nil, fmt.Errorf("erp1 telegram is too short")
+	}
+	rorg := p.Data[0]
+	payload := p.Data[1 : len(p.Data)-5]
+	sender := hex.EncodeToString(p.Data[len(p.Data)-5 : len(p.Data)-1])
+	status := p.Data[len(p.Data)-1]
+
+	ret := map[string]interface{}{
+		"sender": sender,
+		"rorg":   fmt.Sprintf("%02x", rorg),
+		"data":   hex.EncodeToString(payload),
+		"status": fmt.Sprintf("%02x", status),
+	}
+	// optional: subtelegram number, destination id(4), dBm, security level
+	if len(p.Optional) >= 6 {
+		ret["destination"] = hex.EncodeToString(p.Optional[1:5])
+		ret["dbm"] = -int(p.Optional[5])
+	}
+
+	profile, ok := device.Profiles[sender]
+	if !ok {
+		switch rorg {
+		case enoceanRORGRPS:
+			profile = "F6-02-01"
+		case enoceanRORG1BS:
+			profile = "D5-00-01"
+		}
+	}
+	if profile == "" || fmt.Sprintf("%02X", rorg) != profile[:2] {
+		return ret, nil
+	}
+	ret["profile"] = profile
+
+	switch rorg {
+	case enoceanRORGRPS:
+		if len(payload) != 1 {
+			return nil, fmt.Errorf("invalid rps telegram length")
+		}
+		ret["pressed"] = payload[0]&0x10 != 0
+		// NU bit means R1 holds the button number
+		if status&0x10 != 0 {
+			ret["button"] = enoceanRockerButtons[payload[0]>>5&0x03]
+		}
+	case enoceanRORG1BS:
+		if len(payload) != 1 {
+			return nil, fmt.Errorf("invalid 1bs telegram length")
+		}
+		if payload[0]&0x08 == 0 {
+			ret["teach_in"] = true
+			break
+		}
+		if payload[0]&0x01 != 0 {
+			ret["contact"] = "closed"
+		} else {
+			ret["contact"] = "open"
+		}
+	case enoceanRORG4BS:
+		if len(payload) != 4 {
+			return nil, fmt.Errorf("invalid 4bs telegram length")
+		}
+		if payload[3]&0x08 == 0 {
+			ret["teach_in"] = true
+			break
+		}
+		// A5-02-01 is -40..0 and each next profile is shifted by 10 degrees
+		n, _ := strconv.ParseInt(profile[6:], 16, 32)
+		min := float64(-40 + (n-1)*10)
+		ret["temperature"] = min + float64(255-int(payload[2]))*40/255
+	}
+	return ret, nil
+}
+
+// encodeCommand builds ERP1 packet from the subscribed message.
+func encodeEnOceanCommand(body []byte) (esp3Packet, error) {
+	var cmd enoceanCommand
+	if err := json.Unmarshal(body, &cmd); err != nil {
+		return esp3Packet{}, err
+	}
+	if cmd.Sender == "" {
+		// transceiver uses its chip ID
+		cmd.Sender = "00000000"
+	}
+	if cmd.Destination == "" {
+		cmd.Destination = enoceanBroadcastID
+	}
+
+	var rorg, status byte
+	var payload []byte
+	if cmd.Data != "" {
+		r, err := strconv.ParseUint(cmd.RORG, 16, 8)
+		if err != nil {
+			return esp3Packet{}, fmt.Errorf("invalid rorg, %v", cmd.RORG)
+		}
+		rorg = byte(r)
+		payload, err = hex.DecodeString(cmd.Data)
+		if err != nil {
+			return esp3Packet{}, fmt.Errorf("invalid data, %v", cmd.Data)
+		}
+		if cmd.Status != "" {
+			s, err := strconv.ParseUint(cmd.Status, 16, 8)
+			if err != nil {
+				return esp3Packet{}, fmt.Errorf("invalid status, %v", cmd.Status)
+			}
+			status = byte(s)
+		}
+	} else {
+		button := -1
+		for i, b := range enoceanRockerButtons {
+			if b == strings.ToUpper(cmd.Button) {
+				button = i
+			}
+		}
+		if button < 0 {
+			return esp3Packet{}, fmt.Errorf("invalid button, %v", cmd.Button)
+		}
+		rorg = enoceanRORGRPS
+		status = 0x20 // T21
+		b := byte(button) << 5
+		if cmd.Pressed {
+			b |= 0x10
+			status |= 0x10 // NU
+		}
+		payload = []byte{b}
+	}
+
+	sender, err := hex.DecodeString(cmd.Sender)
+	if err != nil || len(sender) != 4 {
+		return esp3Packet{}, fmt.Errorf("invalid sender, %v", cmd.Sender)
+	}
+	dest, err := hex.DecodeString(cmd.Destination)
+	if err != nil || len(dest) != 4 {
+		return esp3Packet{}, fmt.Errorf("invalid destination, %v", cmd.Destination)
+	}
+
+	data := append([]byte{rorg}, payload...)
+	data = append(data, sender...)
+	data = append(data, status)
+	// send case: subtelegram 3, destination, dBm 0xff, no security
+	opt := append([]byte{0x03}, dest...)
+	opt = append(opt, 0xff, 0x00)
+	return esp3Packet{Type: esp3RadioERP1, Data: data, Optional: opt}, nil
+}
+
+func (device EnOceanDevice) newMessage(p esp3Packet) (message.Message, error) {
+	values, err := device.decodeERP1(p)
+	if err != nil {
+		return message.Message{}, err
+	}
+	body, err := json.Marshal(values)
+	if err != nil {
+		return message.Message{}, err
+	}
+	return message.Message{
+		Sender:     device.Name,
+		Type:       device.Type,
+		QoS:        device.QoS,
+		Retained:   device.Retain,
+		BrokerName: device.BrokerName,
+		Body:       body,
+	}, nil
+}
+
+// loop decodes telegrams read from port and writes subscribed telegrams.
+func (device EnOceanDevice) loop(port io.ReadWriteCloser, channel chan message.Message) {
+	defer port.Close()
+
+	readPipe := make(chan []byte)
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			num, err := port.Read(buf)
+			if err == io.EOF {
+				continue
+			}
+			if err != nil {
+				log.Debugf("enocean read finished, %v", err)
+				return
+			}
+			if num == 0 {
+				continue
+			}
+			select {
+			case readPipe <- append([]byte{}, buf[:num]...):
+			case <-device.stop:
+				return
+			}
+		}
+	}()
+
+	parser := &esp3Parser{}
+	for {
+		select {
+		case b := <-readPipe:
+			for _, p := range parser.feed(b) {
+				if p.Type != esp3RadioERP1 {
+					log.Debugf("esp3 packet type %d ignored", p.Type)
+					continue
+				}
+				msg, err := device.newMessage(p)
+				if err != nil {
+					log.Warnf("enocean decode failed, %v", err)
+					continue
+				}
+				channel <- msg
+			}
+		case msg, _ := <-device.DeviceChan.Chan:
+			if !subscribedTo(msg, device.Name) {
+				continue
+			}
+			p, err := encodeEnOceanCommand(msg.Body)
+			if err != nil {
+				log.Warnf("enocean command is invalid, %v", err)
+				continue
+			}
+			if _, err := port.Write(p.encode()); err != nil {
+				log.Errorf("enocean write failed, %v", err)
+			}
+		case <-device.stop:
+			return
+		}
+	}
+}
+
+func (device EnOceanDevice) Start(channel chan message.Message) error {
+	port, err := openSerialPort(device.Serial, device.Baud, defaultSerialParams)
+	if err != nil {
+		return fmt.Errorf("enocean device start failed, %v", err)
+	}
+
+	log.Info("start enocean device")
+	go device.loop(port, channel)
+	return nil
+}
+
+func (device EnOceanDevice) Stop() error {
+	log.Infof("closing enocean: %v", device.Name)
+	select {
+	case <-device.stop:
+	default:
+		close(device.stop)
+	}
+	return nil
+}
+
+func (device EnOceanDevice) DeviceType() string {
+	return "enocean"
+}
+
+// DeviceName returns the name of the device.
+func (device EnOceanDevice) DeviceName() string {
+	return device.Name
+}
+
+func (device EnOceanDevice) AddSubscribe() error {
+	if !device.Subscribe {
+		return nil
+	}
+	for _, b := range device.Broker {
+		b.AddSubscribed(device.Name, device.QoS)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+)
+
+// rocker switch A0 pressed from 002ee1bd, -58dBm
+var testEnOceanRocker, _ = hex.DecodeString("55000707017a" + "f630002ee1bd30" + "01ffffffff3a00" + "cd")
+
+// testEnOceanConfig is the receiver on /dev/ttyUSB0 without profiles.
+const testEnOceanConfig = `
+[device."enocean"]
+    type = "enocean"
+    broker = "sango"
+    qos = 0
+    serial = "/dev/ttyUSB0"
+`
+
+func decodeEnOceanBody(t *testing.T, msg message.Message) map[string]interface{} {
+	var ret map[string]interface{}
+	assert.Nil(t, json.Unmarshal(msg.Body, &ret))
+	return ret
+}
+
+func TestNewEnOceanDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := NewEnOceanDevice(testDeviceArgs(t, testEnOceanConfig+`    profiles = "0180A1B2:a5-02-05, 01234567:F6-02-01"`))
+	assert.Nil(err)
+	assert.Equal(57600, d.Baud)
+	assert.Equal(map[string]string{"0180a1b2": "A5-02-05", "01234567": "F6-02-01"}, d.Profiles)
+
+	for _, p := range []string{"0180a1b2", "0180a1:A5-02-05", "0180a1b2:A5-20-01"} {
+		conf, err := config.LoadConfigByte([]byte(`
+[device."enocean"]
+    type = "enocean"
+    broker = "sango"
+    qos = 0
+    serial = "/dev/ttyUSB0"
+    profiles = "` + p + `"`))
+		assert.Nil(err)
+		b1 := &broker.Broker{Name: "sango"}
+		_, err = NewEnOceanDevice(conf.Sections[0], []*broker.Broker{b1}, NewDeviceChannel())
+		assert.NotNil(err, p)
+	}
+}
+
+func TestESP3Parser(t *testing.T) {
+	assert := assert.New(t)
+
+	parser := &esp3Parser{}
+	// garbage, broken header, then the packet split in two
+	broken := append([]byte{}, testEnOceanRocker...)
+	broken[5] = 0x00
+	assert.Nil(parser.feed([]byte{0x00, 0x12}))
+	assert.Nil(parser.feed(broken[:8]))
+	assert.Nil(parser.feed(testEnOceanRocker[:10]))
+	packets := parser.feed(testEnOceanRocker[10:])
+	assert.Equal(1, len(packets))
+	assert.Equal(byte(esp3RadioERP1), packets[0].Type)
+	assert.Equal(7, len(packets[0].Data))
+	assert.Equal(7, len(packets[0].Optional))
+	assert.Equal(testEnOceanRocker, packets[0].encode())
+
+	// data crc mismatch
+	broken = append([]byte{}, testEnOceanRocker...)
+	broken[len(broken)-1] = 0x00
+	assert.Nil(parser.feed(broken))
+	packets = parser.feed(testEnOceanRocker)
+	assert.Equal(1, len(packets))
+}
+
+func TestEnOceanDecode(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := NewEnOceanDevice(testDeviceArgs(t, testEnOceanConfig+`    profiles = "0180a1b2:A5-02-05"`))
+	assert.Nil(err)
+
+	p := (&esp3Parser{}).feed(testEnOceanRocker)[0]
+	v, err := d.decodeERP1(p)
+	assert.Nil(err)
+	assert.Equal("002ee1bd", v["sender"])
+	assert.Equal("F6-02-01", v["profile"])
+	assert.Equal("A0", v["button"])
+	assert.Equal(true, v["pressed"])
+	assert.Equal(-58, v["dbm"])
+
+	// temperature, DB1 = 0x80
+	v, err = d.decodeERP1(esp3Packet{Type: esp3RadioERP1, Data: []byte{0xa5, 0x00, 0x00, 0x80, 0x08, 0x01, 0x80, 0xa1, 0xb2, 0x00}})
+	assert.Nil(err)
+	assert.Equal("A5-02-05", v["profile"])
+	assert.InDelta(19.92, v["temperature"], 0.01)
+
+	// 4BS without profile is not decoded
+	v, err = d.decodeERP1(esp3Packet{Type: esp3RadioERP1, Data: []byte{0xa5, 0x00, 0x00, 0x80, 0x08, 0x01, 0x80, 0xa1, 0xb3, 0x00}})
+	assert.Nil(err)
+	assert.Nil(v["profile"])
+	assert.Equal("00008008", v["data"])
+
+	// contact closed
+	v, err = d.decodeERP1(esp3Packet{Type: esp3RadioERP1, Data: []byte{0xd5, 0x09, 0x01, 0x02, 0x03, 0x04, 0x00}})
+	assert.Nil(err)
+	assert.Equal("closed", v["contact"])
+
+	_, err = d.decodeERP1(esp3Packet{Type: esp3RadioERP1, Data: []byte{0xd5, 0x09}})
+	assert.NotNil(err)
+}
+
+func TestEncodeEnOceanCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := encodeEnOceanCommand([]byte(`{"button": "b0", "pressed": true, "sender": "ff800001"}`))
+	assert.Nil(err)
+	assert.Equal([]byte{0xf6, 0x70, 0xff, 0x80, 0x00, 0x01, 0x30}, p.Data)
+	assert.Equal([]byte{0x03, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00}, p.Optional)
+
+	p, err = encodeEnOceanCommand([]byte(`{"rorg": "d5", "data": "09", "destination": "01020304"}`))
+	assert.Nil(err)
+	assert.Equal([]byte{0xd5, 0x09, 0x00, 0x00, 0x00, 0x00, 0x00}, p.Data)
+	assert.Equal([]byte{0x03, 0x01, 0x02, 0x03, 0x04, 0xff, 0x00}, p.Optional)
+
+	for _, body := range []string{`{"button": "C0"}`, `{"rorg": "xx", "data": "09"}`, `{"button": "A0", "sender": "0102"}`, `[]`} {
+		_, err = encodeEnOceanCommand([]byte(body))
+		assert.NotNil(err, body)
+	}
+}
+
+func TestEnOceanLoop(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := NewEnOceanDevice(testDeviceArgs(t, testEnOceanConfig))
+	assert.Nil(err)
+	port, module := net.Pipe()
+	channel := make(chan message.Message, 10)
+	go d.loop(port, channel)
+	defer d.Stop()
+
+	go module.Write(testEnOceanRocker)
+	select {
+	case msg := <-channel:
+		v := decodeEnOceanBody(t, msg)
+		assert.Equal("enocean", msg.Sender)
+		assert.Equal("002ee1bd", v["sender"])
+		assert.Equal("A0", v["button"])
+	case <-time.After(time.Second):
+		t.Fatal("enocean message timeout")
+	}
+
+	d.DeviceChan.Chan <- message.Message{Topic: "pre/ham/enocean/subscribe", Body: []byte(`{"button": "A0", "pressed": true}`)}
+	buf := make([]byte, 64)
+	module.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := module.Read(buf)
+	assert.Nil(err)
+	packets := (&esp3Parser{}).feed(buf[:n])
+	assert.Equal(1, len(packets))
+	assert.Equal(byte(enoceanRORGRPS), packets[0].Data[0])
+}
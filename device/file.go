@@ -0,0 +1,517 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	validator "gopkg.in/validator.v2"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+	"github.com/shiguredo/fuji/utils"
+)
+
+const (
+	filePollInterval = 500 * time.Millisecond
+	fileReadBufSize  = 4096
+)
+
+// FileDevice follows a file like "tail -F" or reads a named pipe,
+// and publishes each record as a message.
+type FileDevice struct {
+	Name       string `validate:"max=256,regexp=[^/]+,validtopic"`
+	Broker     []*broker.Broker
+	BrokerName string
+	QoS        byte   `validate:"min=0,max=2"`
+	Path       string `validate:"min=1,max=4096"`
+	OffsetPath string `validate:"max=4096"`
+	Delimiter  []byte `validate:"min=1,max=16"`
+	FromStart  bool
+	Type       string `validate:"max=256"`
+	Retain     bool
+	Subscribe  bool
+	DeviceChan DeviceChannel // GW -> device
+
+	stop chan struct{}
+}
+
+func (device FileDevice) String() string {
+	return fmt.Sprintf("%#v", device)
+}
+
+// FileDeviceSection is [device."<name>"] of type "file".
+type FileDeviceSection struct {
+	config.DeviceSection
+	Path       string `toml:"path"`
+	OffsetPath string `toml:"offset_path"`
+	Delimiter  string `toml:"delimiter"`
+	FromStart  bool   `toml:"from_start"`
+}
+
+func init() {
+	config.RegisterSection("device/file", FileDeviceSection{})
+}
+
+// NewFileDevice read config.ConfigSection and returnes FileDevice.
+// If config validation failed, return error
+func NewFileDevice(section config.ConfigSection, brokers []*broker.Broker, devChan DeviceChannel) (FileDevice, error) {
+	ret := FileDevice{
+		Name:       section.Name,
+		DeviceChan: devChan,
+		Delimiter:  []byte("\n"),
+		stop:       make(chan struct{}),
+	}
+	sc := FileDeviceSection{}
+	if err := section.Decode(&sc); err != nil {
+		return ret, err
+	}
+	if sc.Broker == "" {
+		return ret, fmt.Errorf("broker does not set")
+	}
+
+	for _, b := range brokers {
+		if b.Name == sc.Broker {
+			ret.Broker = brokers
+		}
+	}
+	if ret.Broker == nil {
+		return ret, fmt.Errorf("broker does not exists: %s", sc.Broker)
+	}
+	ret.BrokerName = sc.Broker
+
+	if _, ok := section.Values["qos"]; !ok {
+		return ret, fmt.Errorf("qos does not set")
+	}
+	ret.QoS = byte(sc.QoS)
+	ret.Path = sc.Path
+	ret.OffsetPath = sc.OffsetPath
+	if sc.Delimiter != "" {
+		var err error
+		ret.Delimiter, err = utils.ParsePayload(sc.Delimiter)
+		if err != nil {
+			return ret, fmt.Errorf("invalid delimiter, %v", err)
+		}
+	}
+	ret.FromStart = sc.FromStart
+	ret.Type = sc.Type
+	ret.Retain = sc.Retain
+	ret.Subscribe = sc.Subscribe
+
+	if err := ret.Validate(); err != nil {
+		return ret, err
+	}
+
+	return ret, nil
+}
+
+func (device *FileDevice) Validate() error {
+	validator := validator.NewValidator()
+	validator.SetValidationFunc("validtopic", config.ValidMqttPublishTopic)
+	if err := validator.Validate(device); err != nil {
+		return err
+	}
+	return nil
+}
+
+// splitRecords splits buf by delim and returns complete records and
+// the remaining partial record.
+func splitRecords(buf, delim []byte) ([][]byte, []byte) {
+	var records [][]byte
+	for {
+		i := bytes.Index(buf, delim)
+		if i < 0 {
+			return records, buf
+		}
+		record := make([]byte, i)
+		copy(record, buf[:i])
+		records = append(records, record)
+		buf = buf[i+len(delim):]
+	}
+}
+
+// fileTailer reads records appended to a regular file. It reopens the
+// file when it is rotated and starts over when it is truncated.
+type fileTailer struct {
+	path  string
+	delim []byte
+
+	file   *os.File
+	offset int64       // offset just after the last complete record
+	buf    []byte      // partial record read after offset
+	saved  *fileOffset // checked against the file at the first open
+}
+
+// newFileTailer returns fileTailer which starts reading from offset.
+// Negative offset means the end of the file at the first open.
+func newFileTailer(path string, delim []byte, offset int64) *fileTailer {
+	return &fileTailer{
+		path:   path,
+		delim:  delim,
+		offset: offset,
+	}
+}
+
+func (t *fileTailer) open() error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if t.saved != nil {
+		if !t.saved.sameFile(fi) {
+			log.Warnf("file %s is not the one of saved offset, read from the start", t.path)
+			t.offset = 0
+		}
+		t.saved = nil
+	}
+	if t.offset < 0 {
+		t.offset = fi.Size()
+	}
+	if t.offset > fi.Size() {
+		log.Warnf("file %s is shorter than saved offset %d, read from the start", t.path, t.offset)
+		t.offset = 0
+	}
+	if _, err := f.Seek(t.offset, os.SEEK_SET); err != nil {
+		f.Close()
+		return err
+	}
+	t.file = f
+	t.buf = nil
+	return nil
+}
+
+func (t *fileTailer) readRecords() ([][]byte, error) {
+	var records [][]byte
+	readBuf := make([]byte, fileReadBufSize)
+	for {
+		num, err := t.file.Read(readBuf)
+		if num > 0 {
+			t.buf = append(t.buf, readBuf[:num]...)
+			var rs [][]byte
+			rs, t.buf = splitRecords(t.buf, t.delim)
+			for _, r := range rs {
+				t.offset += int64(len(r) + len(t.delim))
+			}
+			records = append(records, rs...)
+		}
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+	}
+}
+
+// poll returns records appended since the last call.
+func (t *fileTailer) poll() ([][]byte, error) {
+	if t.file == nil {
+		if err := t.open(); err != nil {
+			if os.IsNotExist(err) {
+				// wait for the file to be created
+				return nil, nil
+			}
+			return nil, err
+		}
+	}
+
+	records, err := t.readRecords()
+	if err != nil {
+		return records, err
+	}
+
+	cur, err := os.Stat(t.path)
+	if os.IsNotExist(err) {
+		// rotated and new file is not created yet
+		return records, nil
+	}
+	if err != nil {
+		return records, err
+	}
+	opened, err := t.file.Stat()
+	if err != nil {
+		return records, err
+	}
+
+	switch {
+	case !os.SameFile(opened, cur):
+		log.Infof("file %s is rotated, reopen", t.path)
+		if len(t.buf) > 0 {
+			log.Warnf("partial record discarded, %v", t.buf)
+		}
+		t.close()
+		t.offset = 0
+		if err := t.open(); err != nil {
+			return records, err
+		}
+		rs, err := t.readRecords()
+		return append(records, rs...), err
+	case cur.Size() < t.offset+int64(len(t.buf)):
+		log.Infof("file %s is truncated, read from the start", t.path)
+		t.offset = 0
+		t.buf = nil
+		if _, err := t.file.Seek(0, os.SEEK_SET); err != nil {
+			return records, err
+		}
+		rs, err := t.readRecords()
+		return append(records, rs...), err
+	}
+	return records, nil
+}
+
+// position returns the offset with the file which is read now.
+func (t *fileTailer) position() (fileOffset, error) {
+	ret := fileOffset{Offset: t.offset}
+	if t.file == nil {
+		return ret, fmt.Errorf("file %s is not opened", t.path)
+	}
+	fi, err := t.file.Stat()
+	if err != nil {
+		return ret, err
+	}
+	ret.Dev, ret.Inode, _ = fileID(fi)
+	ret.Size = fi.Size()
+	return ret, nil
+}
+
+func (t *fileTailer) close() {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+}
+
+// fileOffset is the offset saved in offset_path. The file is identified
+// by its device and inode numbers, and its size, because the offset is
+// meaningless for the file which replaced it while fuji was stopped.
+type fileOffset struct {
+	Offset int64  `json:"offset"`
+	Dev    uint64 `json:"dev"`
+	Inode  uint64 `json:"inode"`
+	Size   int64  `json:"size"`
+}
+
+// sameFile reports whether fi is the file where the offset was saved.
+// A file smaller than it was is regarded as truncated.
+func (o fileOffset) sameFile(fi os.FileInfo) bool {
+	if dev, ino, ok := fileID(fi); ok && (o.Dev != 0 || o.Inode != 0) {
+		if dev != o.Dev || ino != o.Inode {
+			return false
+		}
+	}
+	return fi.Size() >= o.Size
+}
+
+// loadOffset returns the offset saved in path. The offset written only
+// as a number by the older version is also accepted.
+func loadOffset(path string) (fileOffset, error) {
+	var ret fileOffset
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ret, err
+	}
+	if offset, err := strconv.ParseInt(strings.TrimSpace(string(dat)), 10, 64); err == nil {
+		ret.Offset = offset
+		return ret, nil
+	}
+	err = json.Unmarshal(dat, &ret)
+	return ret, err
+}
+
+// saveOffset writes offset to path. The file is replaced atomically so
+// that a crash while writing never leaves a broken offset.
+func saveOffset(path string, offset fileOffset) error {
+	dat, err := json.Marshal(offset)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, dat, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (device FileDevice) newMessage(body []byte) message.Message {
+	return message.Message{
+		Sender:     device.Name,
+		Type:       device.Type,
+		QoS:        device.QoS,
+		Retained:   device.Retain,
+		BrokerName: device.BrokerName,
+		Body:       body,
+	}
+}
+
+func (device FileDevice) Start(channel chan message.Message) error {
+	fi, err := os.Stat(device.Path)
+	if err == nil && fi.Mode()&os.ModeNamedPipe != 0 {
+		log.Info("start file device (named pipe)")
+		go device.pipeLoop(channel)
+		return nil
+	}
+
+	offset := int64(-1)
+	if device.FromStart {
+		offset = 0
+	}
+	var saved *fileOffset
+	if device.OffsetPath != "" {
+		o, err := loadOffset(device.OffsetPath)
+		switch {
+		case err == nil:
+			offset = o.Offset
+			saved = &o
+		case os.IsNotExist(err):
+			// first run
+		default:
+			log.Warnf("could not load offset from %s, %v", device.OffsetPath, err)
+		}
+	}
+
+	log.Info("start file device")
+	tailer := newFileTailer(device.Path, device.Delimiter, offset)
+	tailer.saved = saved
+	go device.tailLoop(tailer, channel)
+	return nil
+}
+
+func (device FileDevice) tailLoop(tailer *fileTailer, channel chan message.Message) {
+	ticker := time.NewTicker(filePollInterval)
+	defer ticker.Stop()
+	defer tailer.close()
+
+	for {
+		select {
+		case <-ticker.C:
+			records, err := tailer.poll()
+			if err != nil {
+				log.Errorf("file read error, %v", err)
+			}
+			if len(records) == 0 {
+				continue
+			}
+			for _, r := range records {
+				channel <- device.newMessage(r)
+			}
+			if device.OffsetPath != "" {
+				pos, err := tailer.position()
+				if err == nil {
+					err = saveOffset(device.OffsetPath, pos)
+				}
+				if err != nil {
+					log.Errorf("could not save offset to %s, %v", device.OffsetPath, err)
+				}
+			}
+		case msg, _ := <-device.DeviceChan.Chan:
+			log.Debugf("msg reached to file device, ignored, %v", msg)
+		case <-device.stop:
+			return
+		}
+	}
+}
+
+// pipeLoop reads records from the named pipe. The pipe is opened for
+// reading and writing so that it does not reach EOF when writers close it.
+func (device FileDevice) pipeLoop(channel chan message.Message) {
+	pipe, err := os.OpenFile(device.Path, os.O_RDWR, 0)
+	if err != nil {
+		log.Errorf("could not open named pipe %s, %v", device.Path, err)
+		return
+	}
+
+	readPipe := make(chan []byte)
+	go func() {
+		readBuf := make([]byte, fileReadBufSize)
+		var buf []byte
+		for {
+			num, err := pipe.Read(readBuf)
+			if err != nil {
+				close(readPipe)
+				return
+			}
+			buf = append(buf, readBuf[:num]...)
+			var records [][]byte
+			records, buf = splitRecords(buf, device.Delimiter)
+			for _, r := range records {
+				select {
+				case readPipe <- r:
+				case <-device.stop:
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		select {
+		case r, ok := <-readPipe:
+			if !ok {
+				log.Errorf("named pipe %s closed", device.Path)
+				return
+			}
+			channel <- device.newMessage(r)
+		case msg, _ := <-device.DeviceChan.Chan:
+			log.Debugf("msg reached to file device, ignored, %v", msg)
+		case <-device.stop:
+			pipe.Close()
+			return
+		}
+	}
+}
+
+func (device FileDevice) Stop() error {
+	log.Infof("closing file: %v", device.Name)
+	select {
+	case <-device.stop:
+	default:
+		close(device.stop)
+	}
+	return nil
+}
+
+func (device FileDevice) DeviceType() string {
+	return "file"
+}
+
+// DeviceName returns the name of the device.
+func (device FileDevice) DeviceName() string {
+	return device.Name
+}
+
+func (device FileDevice) AddSubscribe() error {
+	if !device.Subscribe {
+		return nil
+	}
+	for _, b := range device.Broker {
+		b.AddSubscribed(device.Name, device.QoS)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package device
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/message"
+)
+
+// receiveRecords returns the bodies of n messages from channel.
+func receiveRecords(t *testing.T, channel chan message.Message, n int) []string {
+	var ret []string
+	for len(ret) < n {
+		select {
+		case msg := <-channel:
+			ret = append(ret, string(msg.Body))
+		case <-time.After(3 * time.Second):
+			t.Fatalf("records not received, got %v", ret)
+		}
+	}
+	return ret
+}
+
+func TestFileDeviceRotateWhileStopped(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fuji-file")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.log")
+	offsetPath := filepath.Join(dir, "test.offset")
+	assert.Nil(appendFile(path, "one\ntwo\n"))
+
+	newDevice := func() FileDevice {
+		return FileDevice{
+			Name:       "logger",
+			Path:       path,
+			OffsetPath: offsetPath,
+			Delimiter:  []byte("\n"),
+			FromStart:  true,
+			DeviceChan: NewDeviceChannel(),
+			stop:       make(chan struct{}),
+		}
+	}
+
+	channel := make(chan message.Message)
+	first := newDevice()
+	assert.Nil(first.Start(channel))
+	assert.Equal([]string{"one", "two"}, receiveRecords(t, channel, 2))
+	// the offset is saved after the records are sent
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		saved, err := loadOffset(offsetPath)
+		if err == nil && saved.Offset == 8 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("offset is not saved, %v, %v", saved, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Nil(first.Stop())
+
+	// rotated to the file longer than the saved offset
+	assert.Nil(os.Rename(path, path+".1"))
+	assert.Nil(appendFile(path, "three\nfour\nfive\n"))
+
+	second := newDevice()
+	assert.Nil(second.Start(channel))
+	defer second.Stop()
+	assert.Equal([]string{"three", "four", "five"}, receiveRecords(t, channel, 3))
+}
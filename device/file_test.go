@@ -0,0 +1,215 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+)
+
+func TestNewFileDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[device."logger"]
+    type = "file"
+    broker = "sango"
+    qos = 1
+    path = "/var/log/logger.log"
+    offset_path = "/var/lib/fuji-gw/logger.offset"
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+	f, err := NewFileDevice(conf.Sections[0], brokers, NewDeviceChannel())
+	assert.Nil(err)
+	assert.Equal("logger", f.Name)
+	assert.Equal("/var/log/logger.log", f.Path)
+	assert.Equal("/var/lib/fuji-gw/logger.offset", f.OffsetPath)
+	assert.Equal([]byte("\n"), f.Delimiter)
+	assert.False(f.FromStart)
+	assert.Equal("file", f.Type)
+}
+
+func TestNewFileDeviceDelimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[device."logger"]
+    type = "file"
+    broker = "sango"
+    qos = 0
+    path = "/var/log/logger.log"
+    delimiter = "\\x0d\\x0a"
+    from_start = true
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+	f, err := NewFileDevice(conf.Sections[0], brokers, NewDeviceChannel())
+	assert.Nil(err)
+	assert.Equal([]byte("\r\n"), f.Delimiter)
+	assert.True(f.FromStart)
+}
+
+func TestNewFileDeviceInvalidPath(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[device."logger"]
+    type = "file"
+    broker = "sango"
+    qos = 0
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+	_, err = NewFileDevice(conf.Sections[0], brokers, NewDeviceChannel())
+	assert.NotNil(err)
+}
+
+func TestSplitRecords(t *testing.T) {
+	assert := assert.New(t)
+
+	records, rest := splitRecords([]byte("a\nbc\nd"), []byte("\n"))
+	assert.Equal([][]byte{[]byte("a"), []byte("bc")}, records)
+	assert.Equal([]byte("d"), rest)
+
+	records, rest = splitRecords([]byte("a\r\n\r\nb"), []byte("\r\n"))
+	assert.Equal([][]byte{[]byte("a"), []byte("")}, records)
+	assert.Equal([]byte("b"), rest)
+}
+
+func appendFile(path, s string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(s)
+	return err
+}
+
+func TestFileTailerAppend(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fuji-file")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.log")
+	assert.Nil(appendFile(path, "old\n"))
+
+	// start from the end of the file
+	tailer := newFileTailer(path, []byte("\n"), -1)
+	defer tailer.close()
+	records, err := tailer.poll()
+	assert.Nil(err)
+	assert.Equal(0, len(records))
+
+	assert.Nil(appendFile(path, "first\nsec"))
+	records, err = tailer.poll()
+	assert.Nil(err)
+	assert.Equal([][]byte{[]byte("first")}, records)
+	assert.Equal(int64(10), tailer.offset)
+
+	// partial record is published after its delimiter comes
+	assert.Nil(appendFile(path, "ond\n"))
+	records, err = tailer.poll()
+	assert.Nil(err)
+	assert.Equal([][]byte{[]byte("second")}, records)
+	assert.Equal(int64(17), tailer.offset)
+}
+
+func TestFileTailerTruncate(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fuji-file")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.log")
+	assert.Nil(appendFile(path, "one\ntwo\n"))
+
+	tailer := newFileTailer(path, []byte("\n"), 0)
+	defer tailer.close()
+	records, err := tailer.poll()
+	assert.Nil(err)
+	assert.Equal(2, len(records))
+
+	assert.Nil(ioutil.WriteFile(path, []byte("x\n"), 0644))
+	records, err = tailer.poll()
+	assert.Nil(err)
+	assert.Equal([][]byte{[]byte("x")}, records)
+	assert.Equal(int64(2), tailer.offset)
+}
+
+func TestFileTailerRotate(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fuji-file")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.log")
+	assert.Nil(appendFile(path, "one\n"))
+
+	tailer := newFileTailer(path, []byte("\n"), 0)
+	defer tailer.close()
+	records, err := tailer.poll()
+	assert.Nil(err)
+	assert.Equal(1, len(records))
+
+	// lines written just before rotation are not lost
+	assert.Nil(appendFile(path, "two\n"))
+	assert.Nil(os.Rename(path, path+".1"))
+	assert.Nil(appendFile(path, "three\n"))
+
+	records, err = tailer.poll()
+	assert.Nil(err)
+	assert.Equal([][]byte{[]byte("two"), []byte("three")}, records)
+	assert.Equal(int64(6), tailer.offset)
+}
+
+func TestFileOffset(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fuji-file")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.offset")
+
+	_, err = loadOffset(path)
+	assert.True(os.IsNotExist(err))
+
+	saved := fileOffset{Offset: 1234, Dev: 2049, Inode: 42, Size: 2000}
+	assert.Nil(saveOffset(path, saved))
+	offset, err := loadOffset(path)
+	assert.Nil(err)
+	assert.Equal(saved, offset)
+
+	// written by the older version
+	assert.Nil(ioutil.WriteFile(path, []byte("1234"), 0644))
+	offset, err = loadOffset(path)
+	assert.Nil(err)
+	assert.Equal(fileOffset{Offset: 1234}, offset)
+}
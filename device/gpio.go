@@ -0,0 +1,555 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	validator "gopkg.in/validator.v2"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+)
+
+const (
+	defaultGPIOChip       = "/dev/gpiochip0"
+	gpioConsumerLabel     = "fuji-gw"
+	sysfsGPIORoot         = "/sys/class/gpio"
+	sysfsEdgePollInterval = 10 * time.Millisecond
+)
+
+// gpioEvent is an edge detected on an input line.
+type gpioEvent struct {
+	Rising bool
+	Time   time.Time
+}
+
+// gpioLine is a line requested from gpioChip.
+type gpioLine interface {
+	Value() (int, error)
+	SetValue(value int) error
+	// WaitEvent blocks until an edge is detected on the input line.
+	WaitEvent() (gpioEvent, error)
+	Close() error
+}
+
+// gpioChip is a GPIO controller. It is implemented by the Linux GPIO
+// character device, sysfs and a fake chip in tests.
+type gpioChip interface {
+	RequestInput(offset int, edge string, activeLow bool) (gpioLine, error)
+	RequestOutput(offset int, initial int, activeLow bool) (gpioLine, error)
+	Close() error
+}
+
+// openGPIOChip opens the character device. If it is not available,
+// falls back to sysfs interface.
+func openGPIOChip(path string) (gpioChip, error) {
+	if path == "sysfs" {
+		return sysfsGPIOChip{root: sysfsGPIORoot}, nil
+	}
+	chip, err := openCdevGPIOChip(path)
+	if err == nil {
+		return chip, nil
+	}
+	if _, serr := os.Stat(sysfsGPIORoot); serr != nil {
+		return nil, err
+	}
+	log.Warnf("could not open %s, fallback to sysfs, %v", path, err)
+	return newSysfsGPIOChip(sysfsGPIORoot, path)
+}
+
+// sysfsGPIOChip uses deprecated /sys/class/gpio interface.
+// The global GPIO number is base + offset. base is 0 if the chip is
+// "sysfs", so that offset is used as a global GPIO number.
+type sysfsGPIOChip struct {
+	root string
+	base int
+}
+
+type sysfsGPIOLine struct {
+	dir  string
+	edge string
+	last int
+}
+
+// newSysfsGPIOChip returns the sysfs chip of the character device like
+// /dev/gpiochip0, whose base is read from <root>/gpiochip0/base.
+func newSysfsGPIOChip(root, path string) (gpioChip, error) {
+	name := filepath.Base(path)
+	dat, err := ioutil.ReadFile(filepath.Join(root, name, "base"))
+	if err != nil {
+		return nil, fmt.Errorf("%s base could not be read, %v", name, err)
+	}
+	base, err := strconv.Atoi(strings.TrimSpace(string(dat)))
+	if err != nil {
+		return nil, fmt.Errorf("%s base parse failed, %v", name, err)
+	}
+	return sysfsGPIOChip{root: root, base: base}, nil
+}
+
+func (c sysfsGPIOChip) export(offset int, direction string, activeLow bool) (*sysfsGPIOLine, error) {
+	gpio := c.base + offset
+	dir := filepath.Join(c.root, fmt.Sprintf("gpio%d", gpio))
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		err := ioutil.WriteFile(filepath.Join(c.root, "export"), []byte(strconv.Itoa(gpio)), 0200)
+		if err != nil {
+			return nil, fmt.Errorf("gpio%d export failed, %v", gpio, err)
+		}
+	}
+	al := "0"
+	if activeLow {
+		al = "1"
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "active_low"), []byte(al), 0644); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "direction"), []byte(direction), 0644); err != nil {
+		return nil, err
+	}
+	return &sysfsGPIOLine{dir: dir}, nil
+}
+
+func (c sysfsGPIOChip) RequestInput(offset int, edge string, activeLow bool) (gpioLine, error) {
+	l, err := c.export(offset, "in", activeLow)
+	if err != nil {
+		return nil, err
+	}
+	l.edge = edge
+	l.last, err = l.Value()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (c sysfsGPIOChip) RequestOutput(offset int, initial int, activeLow bool) (gpioLine, error) {
+	direction := "low"
+	if initial != 0 {
+		direction = "high"
+	}
+	return c.export(offset, direction, activeLow)
+}
+
+func (c sysfsGPIOChip) Close() error {
+	return nil
+}
+
+func (l *sysfsGPIOLine) Value() (int, error) {
+	dat, err := ioutil.ReadFile(filepath.Join(l.dir, "value"))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(dat)))
+}
+
+func (l *sysfsGPIOLine) SetValue(value int) error {
+	return ioutil.WriteFile(filepath.Join(l.dir, "value"), []byte(strconv.Itoa(value)), 0644)
+}
+
+// WaitEvent detects edges by sampling the value, because waiting
+// POLLPRI on the value file is not portable across boards.
+func (l *sysfsGPIOLine) WaitEvent() (gpioEvent, error) {
+	if l.edge == "none" {
+		return gpioEvent{}, fmt.Errorf("edge detection is not enabled")
+	}
+	for {
+		time.Sleep(sysfsEdgePollInterval)
+		v, err := l.Value()
+		if err != nil {
+			return gpioEvent{}, err
+		}
+		if v == l.last {
+			continue
+		}
+		l.last = v
+		rising := v == 1
+		if (rising && l.edge == "falling") || (!rising && l.edge == "rising") {
+			continue
+		}
+		return gpioEvent{Rising: rising, Time: time.Now()}, nil
+	}
+}
+
+func (l *sysfsGPIOLine) Close() error {
+	return nil
+}
+
+// GPIODevice publishes level and edges of an input line, or drives an
+// output line by subscribed messages.
+type GPIODevice struct {
+	Name       string `validate:"max=256,regexp=[^/]+,validtopic"`
+	Broker     []*broker.Broker
+	BrokerName string
+	QoS        byte   `validate:"min=0,max=2"`
+	Chip       string `validate:"min=1,max=256"`
+	Line       int    `validate:"min=0"`
+	Direction  string `validate:"regexp=^(in|out)$"`
+	Edge       string `validate:"regexp=^(none|rising|falling|both)$"`
+	ActiveLow  bool
+	Debounce   int    `validate:"min=0"` // msec
+	Interval   int    `validate:"min=0"` // sec, 0 means no polling
+	Initial    int    `validate:"min=0,max=1"`
+	Type       string `validate:"max=256"`
+	Retain     bool
+	Subscribe  bool
+	DeviceChan DeviceChannel // GW -> device
+
+	stop chan struct{}
+}
+
+// gpioState is a payload of GPIO device.
+type gpioState struct {
+	Line      int    `json:"line"`
+	Value     int    `json:"value"`
+	Edge      string `json:"edge,omitempty"`
+	Timestamp string `json:"timestamp"`
+}
+
+func (device GPIODevice) String() string {
+	return fmt.Sprintf("%#v", device)
+}
+
+// GPIODeviceSection is [device."<name>"] of type "gpio".
+type GPIODeviceSection struct {
+	config.DeviceSection
+	Chip      string         `toml:"chip"`
+	Line      int            `toml:"line"`
+	Direction string         `toml:"direction"`
+	Edge      string         `toml:"edge"`
+	ActiveLow bool           `toml:"active_low"`
+	Debounce  config.Millis  `toml:"debounce"`
+	Interval  config.Seconds `toml:"interval"`
+	Initial   int            `toml:"initial"`
+}
+
+func init() {
+	config.RegisterSection("device/gpio", GPIODeviceSection{})
+}
+
+// NewGPIODevice read config.ConfigSection and returnes GPIODevice.
+// If config validation failed, return error
+func NewGPIODevice(section config.ConfigSection, brokers []*broker.Broker, devChan DeviceChannel) (GPIODevice, error) {
+	ret := GPIODevice{
+		Name:       section.Name,
+		DeviceChan: devChan,
+		Chip:       defaultGPIOChip,
+		Direction:  "in",
+		Edge:       "both",
+		stop:       make(chan struct{}),
+	}
+	sc := GPIODeviceSection{}
+	if err := section.Decode(&sc); err != nil {
+		return ret, err
+	}
+	if sc.Broker == "" {
+		return ret, fmt.Errorf("broker does not set")
+	}
+
+	for _, b := range brokers {
+		if b.Name == sc.Broker {
+			ret.Broker = brokers
+		}
+	}
+	if ret.Broker == nil {
+		return ret, fmt.Errorf("broker does not exists: %s", sc.Broker)
+	}
+	ret.BrokerName = sc.Broker
+
+	if _, ok := section.Values["qos"]; !ok {
+		return ret, fmt.Errorf("qos does not set")
+	}
+	ret.QoS = byte(sc.QoS)
+	if sc.Chip != "" {
+		ret.Chip = sc.Chip
+	}
+	if _, ok := section.Values["line"]; !ok {
+		return ret, fmt.Errorf("line does not set")
+	}
+	ret.Line = sc.Line
+	if sc.Direction != "" {
+		ret.Direction = sc.Direction
+	}
+	if sc.Edge != "" {
+		ret.Edge = sc.Edge
+	}
+	ret.ActiveLow = sc.ActiveLow
+	ret.Debounce = int(sc.Debounce)
+	ret.Interval = int(sc.Interval)
+	ret.Initial = sc.Initial
+	ret.Type = sc.Type
+	ret.Retain = sc.Retain
+	ret.Subscribe = sc.Subscribe
+	if ret.Direction == "out" {
+		// outputs are driven by subscribed messages
+		ret.Subscribe = true
+	}
+
+	if err := ret.Validate(); err != nil {
+		return ret, err
+	}
+
+	return ret, nil
+}
+
+func (device *GPIODevice) Validate() error {
+	validator := validator.NewValidator()
+	validator.SetValidationFunc("validtopic", config.ValidMqttPublishTopic)
+	if err := validator.Validate(device); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (device GPIODevice) newMessage(value int, edge string, t time.Time) message.Message {
+	body, err := json.Marshal(gpioState{
+		Line:      device.Line,
+		Value:     value,
+		Edge:      edge,
+		Timestamp: t.Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		log.Errorf("json encode error %s", err)
+	}
+	return message.Message{
+		Sender:     device.Name,
+		Type:       device.Type,
+		QoS:        device.QoS,
+		Retained:   device.Retain,
+		BrokerName: device.BrokerName,
+		Body:       body,
+	}
+}
+
+func (device GPIODevice) Start(channel chan message.Message) error {
+	chip, err := openGPIOChip(device.Chip)
+	if err != nil {
+		return fmt.Errorf("gpio device start failed, %v", err)
+	}
+
+	var line gpioLine
+	if device.Direction == "out" {
+		line, err = chip.RequestOutput(device.Line, device.Initial, device.ActiveLow)
+	} else {
+		line, err = chip.RequestInput(device.Line, device.Edge, device.ActiveLow)
+	}
+	if err != nil {
+		chip.Close()
+		return fmt.Errorf("gpio line %d request failed, %v", device.Line, err)
+	}
+
+	log.Info("start gpio device")
+	go func() {
+		if device.Direction == "out" {
+			device.outputLoop(line, channel)
+		} else {
+			device.inputLoop(line, channel)
+		}
+		line.Close()
+		chip.Close()
+	}()
+	return nil
+}
+
+// tickerChan returns ticker channel of the polling interval.
+// If polling is disabled, returns nil which blocks forever.
+func (device GPIODevice) tickerChan() (<-chan time.Time, func()) {
+	if device.Interval <= 0 {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(time.Duration(device.Interval) * time.Second)
+	return ticker.C, ticker.Stop
+}
+
+func (device GPIODevice) inputLoop(line gpioLine, channel chan message.Message) {
+	events := make(chan gpioEvent)
+	if device.Edge != "none" {
+		go func() {
+			for {
+				ev, err := line.WaitEvent()
+				if err != nil {
+					select {
+					case <-device.stop:
+					default:
+						log.Errorf("gpio event error, %v", err)
+					}
+					return
+				}
+				select {
+				case events <- ev:
+				case <-device.stop:
+					return
+				}
+			}
+		}()
+	}
+
+	tick, stopTicker := device.tickerChan()
+	defer stopTicker()
+
+	// edges in the debounce window after the last published edge are not
+	// published. The value is read again when the window expires, and
+	// published if it is settled to another value.
+	debounce := time.Duration(device.Debounce) * time.Millisecond
+	var last time.Time
+	lastValue := -1
+	var settle <-chan time.Time
+	for {
+		select {
+		case ev := <-events:
+			if !last.IsZero() && ev.Time.Sub(last) < debounce {
+				log.Debugf("gpio edge ignored by debounce, %v", ev)
+				if settle == nil {
+					settle = time.After(debounce - ev.Time.Sub(last))
+				}
+				continue
+			}
+			settle = nil
+			last = ev.Time
+			value, edge := 0, "falling"
+			if ev.Rising {
+				value, edge = 1, "rising"
+			}
+			lastValue = value
+			channel <- device.newMessage(value, edge, ev.Time)
+		case <-settle:
+			settle = nil
+			value, err := line.Value()
+			if err != nil {
+				log.Errorf("gpio read error, %v", err)
+				continue
+			}
+			if value == lastValue {
+				continue
+			}
+			edge := "falling"
+			if value == 1 {
+				edge = "rising"
+			}
+			if device.Edge != "both" && device.Edge != edge {
+				continue
+			}
+			last = time.Now()
+			lastValue = value
+			channel <- device.newMessage(value, edge, last)
+		case <-tick:
+			value, err := line.Value()
+			if err != nil {
+				log.Errorf("gpio read error, %v", err)
+				continue
+			}
+			channel <- device.newMessage(value, "", time.Now())
+		case msg, _ := <-device.DeviceChan.Chan:
+			log.Debugf("msg reached to gpio input, ignored, %v", msg)
+		case <-device.stop:
+			return
+		}
+	}
+}
+
+// parseGPIOValue parses subscribed message body like "1", "off" or
+// {"value": 1}.
+func parseGPIOValue(body []byte) (int, error) {
+	s := strings.ToLower(strings.TrimSpace(string(body)))
+	if strings.HasPrefix(s, "{") {
+		var v struct {
+			Value *int `json:"value"`
+		}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return 0, err
+		}
+		if v.Value == nil || (*v.Value != 0 && *v.Value != 1) {
+			return 0, fmt.Errorf("invalid gpio value, %s", s)
+		}
+		return *v.Value, nil
+	}
+	switch s {
+	case "1", "on", "true", "high":
+		return 1, nil
+	case "0", "off", "false", "low":
+		return 0, nil
+	}
+	return 0, fmt.Errorf("invalid gpio value, %s", s)
+}
+
+func (device GPIODevice) outputLoop(line gpioLine, channel chan message.Message) {
+	tick, stopTicker := device.tickerChan()
+	defer stopTicker()
+
+	for {
+		select {
+		case msg, _ := <-device.DeviceChan.Chan:
+			if !subscribedTo(msg, device.Name) {
+				continue
+			}
+			value, err := parseGPIOValue(msg.Body)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			if err := line.SetValue(value); err != nil {
+				log.Errorf("gpio write error, %v", err)
+				continue
+			}
+			channel <- device.newMessage(value, "", time.Now())
+		case <-tick:
+			value, err := line.Value()
+			if err != nil {
+				log.Errorf("gpio read error, %v", err)
+				continue
+			}
+			channel <- device.newMessage(value, "", time.Now())
+		case <-device.stop:
+			return
+		}
+	}
+}
+
+func (device GPIODevice) Stop() error {
+	log.Infof("closing gpio: %v", device.Name)
+	select {
+	case <-device.stop:
+	default:
+		close(device.stop)
+	}
+	return nil
+}
+
+func (device GPIODevice) DeviceType() string {
+	return "gpio"
+}
+
+// DeviceName returns the name of the device.
+func (device GPIODevice) DeviceName() string {
+	return device.Name
+}
+
+func (device GPIODevice) AddSubscribe() error {
+	if !device.Subscribe {
+		return nil
+	}
+	for _, b := range device.Broker {
+		b.AddSubscribed(device.Name, device.QoS)
+	}
+	return nil
+}
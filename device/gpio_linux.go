@@ -0,0 +1,242 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// ioctl numbers and flags from linux/gpio.h (ABI v1).
+const (
+	gpioGetLineHandleIoctl       = 0xc16cb403
+	gpioGetLineEventIoctl        = 0xc030b404
+	gpioHandleGetLineValuesIoctl = 0xc040b408
+	gpioHandleSetLineValuesIoctl = 0xc040b409
+
+	gpioHandleRequestInput     = 1 << 0
+	gpioHandleRequestOutput    = 1 << 1
+	gpioHandleRequestActiveLow = 1 << 2
+
+	gpioEventRequestRisingEdge  = 1 << 0
+	gpioEventRequestFallingEdge = 1 << 1
+
+	gpioEventRisingEdge = 0x01
+	gpioEventDataSize   = 16
+)
+
+var errGPIOLineClosed = errors.New("gpio line closed")
+
+type gpioHandleRequest struct {
+	LineOffsets   [64]uint32
+	Flags         uint32
+	DefaultValues [64]uint8
+	ConsumerLabel [32]byte
+	Lines         uint32
+	Fd            int32
+}
+
+type gpioEventRequest struct {
+	LineOffset    uint32
+	HandleFlags   uint32
+	EventFlags    uint32
+	ConsumerLabel [32]byte
+	Fd            int32
+}
+
+type gpioHandleData struct {
+	Values [64]uint8
+}
+
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// fileIoctl is ioctl on the file. The ioctls of GPIO do not block.
+func fileIoctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	return ioctl(f.Fd(), req, arg)
+}
+
+// gpioEventPollInterval is how often WaitEvent checks whether the line is
+// closed, because closing the file does not wake up the blocked read.
+const gpioEventPollInterval = 100 * time.Millisecond
+
+const pollIn = 0x1
+
+type pollFd struct {
+	Fd      int32
+	Events  int16
+	Revents int16
+}
+
+// waitReadable returns true if the fd becomes readable in the timeout.
+func waitReadable(fd uintptr, timeout time.Duration) (bool, error) {
+	pfd := pollFd{Fd: int32(fd), Events: pollIn}
+	ts := syscall.NsecToTimespec(int64(timeout))
+	n, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&pfd)), 1,
+		uintptr(unsafe.Pointer(&ts)), 0, 0, 0)
+	if errno == syscall.EINTR {
+		return false, nil
+	}
+	if errno != 0 {
+		return false, errno
+	}
+	return n > 0, nil
+}
+
+// cdevGPIOChip is a GPIO chip of the Linux character device interface.
+type cdevGPIOChip struct {
+	f *os.File
+}
+
+type cdevGPIOLine struct {
+	f      *os.File
+	mu     sync.Mutex // not to close the file while WaitEvent uses it
+	closed bool
+}
+
+func openCdevGPIOChip(path string) (gpioChip, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return cdevGPIOChip{f: f}, nil
+}
+
+func (c cdevGPIOChip) RequestInput(offset int, edge string, activeLow bool) (gpioLine, error) {
+	handleFlags := uint32(gpioHandleRequestInput)
+	if activeLow {
+		handleFlags |= gpioHandleRequestActiveLow
+	}
+
+	var eventFlags uint32
+	switch edge {
+	case "rising":
+		eventFlags = gpioEventRequestRisingEdge
+	case "falling":
+		eventFlags = gpioEventRequestFallingEdge
+	case "both":
+		eventFlags = gpioEventRequestRisingEdge | gpioEventRequestFallingEdge
+	default:
+		return c.requestHandle(offset, handleFlags, 0)
+	}
+
+	req := gpioEventRequest{
+		LineOffset:  uint32(offset),
+		HandleFlags: handleFlags,
+		EventFlags:  eventFlags,
+	}
+	copy(req.ConsumerLabel[:], gpioConsumerLabel)
+	if err := fileIoctl(c.f, gpioGetLineEventIoctl, unsafe.Pointer(&req)); err != nil {
+		return nil, fmt.Errorf("line event request failed, %v", err)
+	}
+	return newCdevGPIOLine(int(req.Fd))
+}
+
+func (c cdevGPIOChip) RequestOutput(offset int, initial int, activeLow bool) (gpioLine, error) {
+	flags := uint32(gpioHandleRequestOutput)
+	if activeLow {
+		flags |= gpioHandleRequestActiveLow
+	}
+	return c.requestHandle(offset, flags, uint8(initial))
+}
+
+func (c cdevGPIOChip) requestHandle(offset int, flags uint32, initial uint8) (gpioLine, error) {
+	req := gpioHandleRequest{
+		Flags: flags,
+		Lines: 1,
+	}
+	req.LineOffsets[0] = uint32(offset)
+	req.DefaultValues[0] = initial
+	copy(req.ConsumerLabel[:], gpioConsumerLabel)
+	if err := fileIoctl(c.f, gpioGetLineHandleIoctl, unsafe.Pointer(&req)); err != nil {
+		return nil, fmt.Errorf("line handle request failed, %v", err)
+	}
+	return newCdevGPIOLine(int(req.Fd))
+}
+
+func (c cdevGPIOChip) Close() error {
+	return c.f.Close()
+}
+
+func newCdevGPIOLine(fd int) (gpioLine, error) {
+	return &cdevGPIOLine{f: os.NewFile(uintptr(fd), "gpio-line")}, nil
+}
+
+func (l *cdevGPIOLine) Value() (int, error) {
+	var data gpioHandleData
+	if err := fileIoctl(l.f, gpioHandleGetLineValuesIoctl, unsafe.Pointer(&data)); err != nil {
+		return 0, err
+	}
+	return int(data.Values[0]), nil
+}
+
+func (l *cdevGPIOLine) SetValue(value int) error {
+	var data gpioHandleData
+	data.Values[0] = uint8(value)
+	return fileIoctl(l.f, gpioHandleSetLineValuesIoctl, unsafe.Pointer(&data))
+}
+
+// WaitEvent polls the line, so that Close stops it in
+// gpioEventPollInterval.
+func (l *cdevGPIOLine) WaitEvent() (gpioEvent, error) {
+	buf := make([]byte, gpioEventDataSize)
+	for {
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			return gpioEvent{}, errGPIOLineClosed
+		}
+		ready, err := waitReadable(l.f.Fd(), gpioEventPollInterval)
+		if err == nil && ready {
+			_, err = l.f.Read(buf)
+		}
+		l.mu.Unlock()
+		if err != nil {
+			return gpioEvent{}, err
+		}
+		if ready {
+			break
+		}
+	}
+	// kernel timestamp clock differs by kernel version, use wall clock.
+	id := binary.LittleEndian.Uint32(buf[8:12])
+	return gpioEvent{
+		Rising: id == gpioEventRisingEdge,
+		Time:   time.Now(),
+	}, nil
+}
+
+func (l *cdevGPIOLine) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	return l.f.Close()
+}
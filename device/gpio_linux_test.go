@@ -0,0 +1,61 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package device
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCdevGPIOLineWaitEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	// a pipe stands for the event fd of the line
+	var p [2]int
+	assert.Nil(syscall.Pipe(p[:]))
+	defer syscall.Close(p[1])
+	line, err := newCdevGPIOLine(p[0])
+	assert.Nil(err)
+
+	ev := make([]byte, gpioEventDataSize)
+	ev[8] = gpioEventRisingEdge
+	_, err = syscall.Write(p[1], ev)
+	assert.Nil(err)
+	e, err := line.WaitEvent()
+	assert.Nil(err)
+	assert.True(e.Rising)
+
+	done := make(chan error)
+	go func() {
+		_, err := line.WaitEvent()
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(line.Close())
+
+	// Close stops the blocked WaitEvent
+	select {
+	case err := <-done:
+		assert.Equal(errGPIOLineClosed, err)
+	case <-time.After(time.Second):
+		t.Fatal("WaitEvent is not stopped by Close")
+	}
+	assert.Nil(line.Close())
+}
@@ -0,0 +1,304 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+)
+
+// fakeGPIOChip is a gpioChip which lines are controlled by tests.
+type fakeGPIOChip struct {
+	lines map[int]*fakeGPIOLine
+}
+
+type fakeGPIOLine struct {
+	sync.Mutex
+	value  int
+	events chan gpioEvent
+	closed chan struct{}
+}
+
+func newFakeGPIOChip() *fakeGPIOChip {
+	return &fakeGPIOChip{lines: make(map[int]*fakeGPIOLine)}
+}
+
+func (c *fakeGPIOChip) line(offset int, value int) *fakeGPIOLine {
+	l := &fakeGPIOLine{
+		value:  value,
+		events: make(chan gpioEvent),
+		closed: make(chan struct{}),
+	}
+	c.lines[offset] = l
+	return l
+}
+
+func (c *fakeGPIOChip) RequestInput(offset int, edge string, activeLow bool) (gpioLine, error) {
+	return c.line(offset, 0), nil
+}
+
+func (c *fakeGPIOChip) RequestOutput(offset int, initial int, activeLow bool) (gpioLine, error) {
+	return c.line(offset, initial), nil
+}
+
+func (c *fakeGPIOChip) Close() error {
+	return nil
+}
+
+func (l *fakeGPIOLine) Value() (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.value, nil
+}
+
+func (l *fakeGPIOLine) SetValue(value int) error {
+	l.Lock()
+	defer l.Unlock()
+	l.value = value
+	return nil
+}
+
+func (l *fakeGPIOLine) WaitEvent() (gpioEvent, error) {
+	select {
+	case ev := <-l.events:
+		return ev, nil
+	case <-l.closed:
+		return gpioEvent{}, fmt.Errorf("closed")
+	}
+}
+
+func (l *fakeGPIOLine) Close() error {
+	close(l.closed)
+	return nil
+}
+
+func receiveGPIOState(t *testing.T, channel chan message.Message) gpioState {
+	var st gpioState
+	select {
+	case msg := <-channel:
+		assert.Nil(t, json.Unmarshal(msg.Body, &st))
+	case <-time.After(time.Second):
+		t.Fatal("gpio message timeout")
+	}
+	return st
+}
+
+func TestNewGPIODevice(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := NewGPIODevice(testDeviceArgs(t, `
+[device."door"]
+    type = "gpio"
+    broker = "sango"
+    qos = 1
+    line = 17
+    edge = "falling"
+    debounce = 50
+    active_low = true
+`))
+	assert.Nil(err)
+	assert.Equal("door", d.Name)
+	assert.Equal("/dev/gpiochip0", d.Chip)
+	assert.Equal(17, d.Line)
+	assert.Equal("in", d.Direction)
+	assert.Equal("falling", d.Edge)
+	assert.Equal(50, d.Debounce)
+	assert.True(d.ActiveLow)
+	assert.False(d.Subscribe)
+}
+
+func TestNewGPIODeviceOutput(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := NewGPIODevice(testDeviceArgs(t, `
+[device."relay"]
+    type = "gpio"
+    broker = "sango"
+    qos = 0
+    chip = "sysfs"
+    line = 4
+    direction = "out"
+    initial = 1
+`))
+	assert.Nil(err)
+	assert.Equal("sysfs", d.Chip)
+	assert.Equal("out", d.Direction)
+	assert.Equal(1, d.Initial)
+	assert.True(d.Subscribe)
+}
+
+func TestNewGPIODeviceInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, c := range []string{
+		`line = 1
+    direction = "inout"`,
+		`line = 1
+    edge = "up"`,
+		`line = -1`,
+		`direction = "in"`,
+	} {
+		configStr := `
+[device."door"]
+    type = "gpio"
+    broker = "sango"
+    qos = 0
+    ` + c
+		conf, err := config.LoadConfigByte([]byte(configStr))
+		assert.Nil(err)
+		b1 := &broker.Broker{Name: "sango"}
+		brokers := []*broker.Broker{b1}
+		_, err = NewGPIODevice(conf.Sections[0], brokers, NewDeviceChannel())
+		assert.NotNil(err, c)
+	}
+}
+
+func TestParseGPIOValue(t *testing.T) {
+	assert := assert.New(t)
+
+	for body, expected := range map[string]int{
+		"1": 1, " on\n": 1, "HIGH": 1, `{"value": 1}`: 1,
+		"0": 0, "off": 0, "false": 0, `{"value": 0}`: 0,
+	} {
+		v, err := parseGPIOValue([]byte(body))
+		assert.Nil(err, body)
+		assert.Equal(expected, v, body)
+	}
+	for _, body := range []string{"2", "", "toggle", `{"value": 2}`, `{}`} {
+		_, err := parseGPIOValue([]byte(body))
+		assert.NotNil(err, body)
+	}
+}
+
+func TestGPIOInputDebounce(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := NewGPIODevice(testDeviceArgs(t, `
+[device."door"]
+    type = "gpio"
+    broker = "sango"
+    qos = 0
+    line = 17
+    debounce = 50
+`))
+	assert.Nil(err)
+	chip := newFakeGPIOChip()
+	line, _ := chip.RequestInput(17, "both", false)
+	channel := make(chan message.Message, 10)
+	go d.inputLoop(line, channel)
+	defer d.Stop()
+
+	fake := chip.lines[17]
+	t0 := time.Now()
+	fake.SetValue(1)
+	fake.events <- gpioEvent{Rising: true, Time: t0}
+	fake.events <- gpioEvent{Rising: false, Time: t0.Add(10 * time.Millisecond)} // bounce
+	fake.events <- gpioEvent{Rising: true, Time: t0.Add(20 * time.Millisecond)}  // bounce
+
+	st := receiveGPIOState(t, channel)
+	assert.Equal(17, st.Line)
+	assert.Equal(1, st.Value)
+	assert.Equal("rising", st.Edge)
+	assert.Equal(t0.Format(time.RFC3339Nano), st.Timestamp)
+
+	// settled to the same value
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(0, len(channel))
+
+	// the last edge in the window is published after the window
+	t1 := time.Now()
+	fake.SetValue(0)
+	fake.events <- gpioEvent{Rising: false, Time: t1}
+	fake.SetValue(1)
+	fake.events <- gpioEvent{Rising: true, Time: t1.Add(10 * time.Millisecond)}
+
+	st = receiveGPIOState(t, channel)
+	assert.Equal(0, st.Value)
+	assert.Equal("falling", st.Edge)
+	st = receiveGPIOState(t, channel)
+	assert.Equal(1, st.Value)
+	assert.Equal("rising", st.Edge)
+	assert.Equal(0, len(channel))
+}
+
+func TestSysfsGPIOChipBase(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "fuji-gpio")
+	assert.Nil(err)
+	defer os.RemoveAll(root)
+	assert.Nil(os.MkdirAll(filepath.Join(root, "gpiochip32"), 0755))
+	assert.Nil(ioutil.WriteFile(filepath.Join(root, "gpiochip32", "base"), []byte("32\n"), 0644))
+	assert.Nil(ioutil.WriteFile(filepath.Join(root, "export"), nil, 0644))
+
+	chip, err := newSysfsGPIOChip(root, "/dev/gpiochip32")
+	assert.Nil(err)
+
+	// the global number is exported, not the offset on the chip
+	_, err = chip.RequestOutput(5, 0, false)
+	assert.NotNil(err) // gpio37 is not created by the kernel in the test
+	dat, _ := ioutil.ReadFile(filepath.Join(root, "export"))
+	assert.Equal("37", string(dat))
+
+	assert.Nil(os.MkdirAll(filepath.Join(root, "gpio37"), 0755))
+	_, err = chip.RequestOutput(5, 1, false)
+	assert.Nil(err)
+	dat, _ = ioutil.ReadFile(filepath.Join(root, "gpio37", "direction"))
+	assert.Equal("high", string(dat))
+
+	_, err = newSysfsGPIOChip(root, "/dev/gpiochip0")
+	assert.NotNil(err)
+}
+
+func TestGPIOOutput(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := NewGPIODevice(testDeviceArgs(t, `
+[device."relay"]
+    type = "gpio"
+    broker = "sango"
+    qos = 0
+    line = 4
+    direction = "out"
+`))
+	assert.Nil(err)
+	chip := newFakeGPIOChip()
+	line, _ := chip.RequestOutput(4, 0, false)
+	channel := make(chan message.Message, 10)
+	go d.outputLoop(line, channel)
+	defer d.Stop()
+
+	// message to another device is ignored
+	d.DeviceChan.Chan <- message.Message{Topic: "pre/ham/pump/subscribe", Body: []byte("1")}
+	d.DeviceChan.Chan <- message.Message{Topic: "pre/ham/relay/subscribe", Body: []byte("on")}
+
+	st := receiveGPIOState(t, channel)
+	assert.Equal(4, st.Line)
+	assert.Equal(1, st.Value)
+	v, _ := line.Value()
+	assert.Equal(1, v)
+}
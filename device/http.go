@@ -0,0 +1,342 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	validator "gopkg.in/validator.v2"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+)
+
+const (
+	defaultHTTPMaxBody = 65536
+	defaultHTTPTimeout = 5 // sec
+
+	// slow clients could not hold connections longer than this to send
+	// the header and the body
+	httpReadTimeout = 30 * time.Second
+)
+
+// HTTPDevice publishes bodies of HTTP requests posted to the listener.
+type HTTPDevice struct {
+	Name       string `validate:"max=256,regexp=[^/]+,validtopic"`
+	Broker     []*broker.Broker
+	BrokerName string
+	QoS        byte   `validate:"min=0,max=2"`
+	Listen     string `validate:"min=1,max=256"`
+	Path       string `validate:"min=1,max=1024,regexp=^/"`
+	Paths      map[string]string
+	Auth       string `validate:"regexp=^(token|basic|none)$"`
+	Token      string `validate:"max=1024"`
+	Username   string `validate:"max=256"`
+	Password   string `validate:"max=256"`
+	MaxBody    int    `validate:"min=1"`
+	Timeout    int    `validate:"min=1"`
+	Type       string `validate:"max=256"`
+	Retain     bool
+	Subscribe  bool
+	DeviceChan DeviceChannel // GW -> device
+
+	stop chan struct{}
+}
+
+func (device HTTPDevice) String() string {
+	return fmt.Sprintf("%#v", device)
+}
+
+// HTTPDeviceSection is [device."<name>"] of type "http".
+type HTTPDeviceSection struct {
+	config.DeviceSection
+	Listen   string         `toml:"listen"`
+	Path     string         `toml:"path"`
+	Paths    config.List    `toml:"paths"`
+	Auth     string         `toml:"auth"`
+	Token    string         `toml:"token"`
+	Username string         `toml:"username"`
+	Password string         `toml:"password"`
+	MaxBody  int            `toml:"max_body"`
+	Timeout  config.Seconds `toml:"timeout"`
+}
+
+func init() {
+	config.RegisterSection("device/http", HTTPDeviceSection{})
+}
+
+// NewHTTPDevice read config.ConfigSection and returnes HTTPDevice.
+// If config validation failed, return error
+func NewHTTPDevice(section config.ConfigSection, brokers []*broker.Broker, devChan DeviceChannel) (HTTPDevice, error) {
+	ret := HTTPDevice{
+		Name:       section.Name,
+		DeviceChan: devChan,
+		Path:       "/",
+		Paths:      make(map[string]string),
+		MaxBody:    defaultHTTPMaxBody,
+		Timeout:    defaultHTTPTimeout,
+		stop:       make(chan struct{}),
+	}
+	sc := HTTPDeviceSection{
+		MaxBody: defaultHTTPMaxBody,
+		Timeout: defaultHTTPTimeout,
+	}
+	if err := section.Decode(&sc); err != nil {
+		return ret, err
+	}
+	if sc.Broker == "" {
+		return ret, fmt.Errorf("broker does not set")
+	}
+
+	for _, b := range brokers {
+		if b.Name == sc.Broker {
+			ret.Broker = brokers
+		}
+	}
+	if ret.Broker == nil {
+		return ret, fmt.Errorf("broker does not exists: %s", sc.Broker)
+	}
+	ret.BrokerName = sc.Broker
+
+	if _, ok := section.Values["qos"]; !ok {
+		return ret, fmt.Errorf("qos does not set")
+	}
+	ret.QoS = byte(sc.QoS)
+	ret.Listen = sc.Listen
+	if sc.Path != "" {
+		ret.Path = sc.Path
+	}
+	// ex: /hooks/temp:temperature, /hooks/door:door
+	for _, p := range sc.Paths {
+		i := strings.LastIndex(p, ":")
+		if i < 0 || !strings.HasPrefix(p, "/") {
+			return ret, fmt.Errorf("invalid paths, %v", p)
+		}
+		path, typ := strings.TrimSpace(p[:i]), strings.TrimSpace(p[i+1:])
+		if err := config.ValidMqttPublishTopic(typ, ""); err != nil || typ == "" || strings.Contains(typ, "/") {
+			return ret, fmt.Errorf("invalid type in paths, %v", p)
+		}
+		ret.Paths[path] = typ
+	}
+	ret.Token = sc.Token
+	ret.Username = sc.Username
+	ret.Password = sc.Password
+	if ret.Token != "" && ret.Username != "" {
+		return ret, fmt.Errorf("token and username could not be set at the same time")
+	}
+	// requests are not accepted without credentials unless auth = "none"
+	ret.Auth = sc.Auth
+	if ret.Auth == "" {
+		switch {
+		case ret.Token != "":
+			ret.Auth = "token"
+		case ret.Username != "":
+			ret.Auth = "basic"
+		default:
+			return ret, fmt.Errorf(`token or username is required, or set auth = "none"`)
+		}
+	}
+	switch ret.Auth {
+	case "token":
+		if ret.Token == "" {
+			return ret, fmt.Errorf(`token is required by auth = "token"`)
+		}
+	case "basic":
+		if ret.Username == "" || ret.Password == "" {
+			return ret, fmt.Errorf(`username and password are required by auth = "basic"`)
+		}
+	case "none":
+		if ret.Token != "" || ret.Username != "" {
+			return ret, fmt.Errorf(`token and username could not be set with auth = "none"`)
+		}
+	}
+	ret.MaxBody = sc.MaxBody
+	ret.Timeout = int(sc.Timeout)
+	ret.Type = sc.Type
+	ret.Retain = sc.Retain
+	ret.Subscribe = sc.Subscribe
+
+	if err := ret.Validate(); err != nil {
+		return ret, err
+	}
+
+	return ret, nil
+}
+
+func (device *HTTPDevice) Validate() error {
+	validator := validator.NewValidator()
+	validator.SetValidationFunc("validtopic", config.ValidMqttPublishTopic)
+	if err := validator.Validate(device); err != nil {
+		return err
+	}
+	return nil
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// authorized checks the shared token or basic auth of the request.
+func (device HTTPDevice) authorized(r *http.Request) bool {
+	switch device.Auth {
+	case "token":
+		auth := r.Header.Get("Authorization")
+		return strings.HasPrefix(auth, "Bearer ") && secureEqual(auth[len("Bearer "):], device.Token)
+	case "basic":
+		user, pass, ok := r.BasicAuth()
+		return ok && secureEqual(user, device.Username) && secureEqual(pass, device.Password)
+	case "none":
+		return true
+	}
+	return false
+}
+
+// messageType returns Type of the message for the request path.
+func (device HTTPDevice) messageType(path string) (string, bool) {
+	if typ, ok := device.Paths[path]; ok {
+		return typ, true
+	}
+	if path == device.Path {
+		return device.Type, true
+	}
+	// path ends with "/" accepts the subtree
+	if strings.HasSuffix(device.Path, "/") && strings.HasPrefix(path, device.Path) {
+		return device.Type, true
+	}
+	return "", false
+}
+
+// handler returns http.Handler which passes request bodies to channel.
+func (device HTTPDevice) handler(channel chan message.Message) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		typ, ok := device.messageType(r.URL.Path)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != "POST" && r.Method != "PUT" {
+			w.Header().Set("Allow", "POST, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !device.authorized(r) {
+			if device.Auth == "basic" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="fuji"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// read one more byte to know the body is too large
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(device.MaxBody)+1))
+		if err != nil {
+			http.Error(w, "could not read request body", http.StatusBadRequest)
+			return
+		}
+		if len(body) > device.MaxBody {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		msg := message.Message{
+			Sender:     device.Name,
+			Type:       typ,
+			QoS:        device.QoS,
+			Retained:   device.Retain,
+			BrokerName: device.BrokerName,
+			Body:       body,
+		}
+		select {
+		case channel <- msg:
+			w.WriteHeader(http.StatusAccepted)
+		case <-time.After(time.Duration(device.Timeout) * time.Second):
+			log.Warnf("http request discarded, gateway queue is full: %v", device.Name)
+			http.Error(w, "queue is full", http.StatusServiceUnavailable)
+		case <-device.stop:
+			http.Error(w, "device stopped", http.StatusServiceUnavailable)
+		}
+	})
+}
+
+func (device HTTPDevice) Start(channel chan message.Message) error {
+	listener, err := net.Listen("tcp", device.Listen)
+	if err != nil {
+		return fmt.Errorf("http device start failed, %v", err)
+	}
+
+	log.Infof("start http device, %v", listener.Addr())
+	server := &http.Server{
+		Handler:     device.handler(channel),
+		ReadTimeout: httpReadTimeout,
+	}
+	go func() {
+		err := server.Serve(listener)
+		select {
+		case <-device.stop:
+		default:
+			log.Errorf("http server stopped, %v", err)
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case msg, _ := <-device.DeviceChan.Chan:
+				log.Debugf("msg reached to http device, ignored, %v", msg)
+			case <-device.stop:
+				listener.Close()
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (device HTTPDevice) Stop() error {
+	log.Infof("closing http: %v", device.Name)
+	select {
+	case <-device.stop:
+	default:
+		close(device.stop)
+	}
+	return nil
+}
+
+func (device HTTPDevice) DeviceType() string {
+	return "http"
+}
+
+// DeviceName returns the name of the device.
+func (device HTTPDevice) DeviceName() string {
+	return device.Name
+}
+
+func (device HTTPDevice) AddSubscribe() error {
+	if !device.Subscribe {
+		return nil
+	}
+	for _, b := range device.Broker {
+		b.AddSubscribed(device.Name, device.QoS)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/message"
+)
+
+// testHTTPConfig listens on a free port. Tests add the auth settings.
+const testHTTPConfig = `
+[device."webhook"]
+    type = "http"
+    broker = "sango"
+    qos = 0
+    listen = "127.0.0.1:0"
+`
+
+func postHTTPDevice(h http.Handler, method, path, body string, header map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, "http://localhost"+path, strings.NewReader(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestNewHTTPDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := NewHTTPDevice(testDeviceArgs(t, testHTTPConfig+`
+    path = "/hooks/"
+    paths = "/hooks/temp:temperature, /hooks/door:door"
+    token = "secret"
+`))
+	assert.Nil(err)
+	assert.Equal("/hooks/", d.Path)
+	assert.Equal(map[string]string{"/hooks/temp": "temperature", "/hooks/door": "door"}, d.Paths)
+	assert.Equal(65536, d.MaxBody)
+	assert.Equal("token", d.Auth)
+
+	d, err = NewHTTPDevice(testDeviceArgs(t, testHTTPConfig+`
+    username = "fuji"
+    password = "pass"
+`))
+	assert.Nil(err)
+	assert.Equal("basic", d.Auth)
+
+	// open to anyone only by the explicit opt-out
+	d, err = NewHTTPDevice(testDeviceArgs(t, testHTTPConfig+`auth = "none"`))
+	assert.Nil(err)
+	assert.Equal("none", d.Auth)
+
+	for _, c := range []string{
+		`path = "hooks"`,
+		`paths = "/hooks/temp"`,
+		`paths = "/hooks/temp:a/b"`,
+		`paths = "/hooks/temp:#"`,
+		`token = "secret"
+    username = "fuji"`,
+		`path = "/hooks/"`,
+		`username = "fuji"`,
+		`username = "fuji"
+    password = ""`,
+		`auth = "token"`,
+		`auth = "basic"
+    token = "secret"`,
+		`auth = "none"
+    token = "secret"`,
+		`auth = "digest"
+    token = "secret"`,
+	} {
+		_, err := NewHTTPDevice(testDeviceArgs(t, testHTTPConfig+c))
+		assert.NotNil(err, c)
+	}
+}
+
+func TestHTTPDeviceHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := NewHTTPDevice(testDeviceArgs(t, testHTTPConfig+`
+    path = "/hooks/"
+    paths = "/hooks/temp:temperature"
+    token = "secret"
+    max_body = 16
+`))
+	assert.Nil(err)
+	channel := make(chan message.Message, 1)
+	h := d.handler(channel)
+	auth := map[string]string{"Authorization": "Bearer secret"}
+
+	w := postHTTPDevice(h, "POST", "/hooks/temp", "21.5", auth)
+	assert.Equal(http.StatusAccepted, w.Code)
+	msg := <-channel
+	assert.Equal("webhook", msg.Sender)
+	assert.Equal("temperature", msg.Type)
+	assert.Equal("21.5", string(msg.Body))
+
+	w = postHTTPDevice(h, "PUT", "/hooks/other", "on", auth)
+	assert.Equal(http.StatusAccepted, w.Code)
+	msg = <-channel
+	assert.Equal("http", msg.Type)
+
+	assert.Equal(http.StatusUnauthorized, postHTTPDevice(h, "POST", "/hooks/temp", "1", nil).Code)
+	assert.Equal(http.StatusUnauthorized, postHTTPDevice(h, "POST", "/hooks/temp", "1",
+		map[string]string{"Authorization": "Bearer wrong"}).Code)
+	assert.Equal(http.StatusMethodNotAllowed, postHTTPDevice(h, "GET", "/hooks/temp", "", auth).Code)
+	assert.Equal(http.StatusNotFound, postHTTPDevice(h, "POST", "/other", "1", auth).Code)
+	assert.Equal(http.StatusRequestEntityTooLarge, postHTTPDevice(h, "POST", "/hooks/temp", strings.Repeat("x", 17), auth).Code)
+	assert.Equal(0, len(channel))
+	assert.Equal(http.StatusAccepted, postHTTPDevice(h, "POST", "/hooks/temp", strings.Repeat("x", 16), auth).Code)
+	msg = <-channel
+	assert.Equal(16, len(msg.Body))
+
+	// the client went away while sending the body
+	req, _ := http.NewRequest("POST", "http://localhost/hooks/temp", errReader{})
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Equal(0, len(channel))
+}
+
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("connection reset")
+}
+
+func TestHTTPDeviceBasicAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := NewHTTPDevice(testDeviceArgs(t, testHTTPConfig+`
+    path = "/webhook"
+    username = "fuji"
+    password = "pass"
+    timeout = 1
+`))
+	assert.Nil(err)
+	channel := make(chan message.Message)
+	h := d.handler(channel)
+
+	req, _ := http.NewRequest("POST", "http://localhost/webhook", strings.NewReader("1"))
+	req.SetBasicAuth("fuji", "wrong")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+	assert.NotEqual("", w.Header().Get("WWW-Authenticate"))
+
+	// nobody receives the message
+	req, _ = http.NewRequest("POST", "http://localhost/webhook", strings.NewReader("1"))
+	req.SetBasicAuth("fuji", "pass")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+}
@@ -0,0 +1,174 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	validator "gopkg.in/validator.v2"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+)
+
+// I2CDevice reads registers of an I2C slave by interval.
+type I2CDevice struct {
+	Name        string `validate:"max=256,regexp=[^/]+,validtopic"`
+	Broker      []*broker.Broker
+	BrokerName  string
+	QoS         byte   `validate:"min=0,max=2"`
+	Bus         string `validate:"min=1,max=256"`
+	Address     int    `validate:"min=0,max=1023"`
+	Interval    int    `validate:"min=1"`
+	Transaction busTransaction
+	Type        string `validate:"max=256"`
+	Retain      bool
+	Subscribe   bool
+	DeviceChan  DeviceChannel // GW -> device
+
+	stop chan struct{}
+}
+
+func (device I2CDevice) String() string {
+	return fmt.Sprintf("%#v", device)
+}
+
+// I2CDeviceSection is [device."<name>"] of type "i2c".
+type I2CDeviceSection struct {
+	config.DeviceSection
+	BusSection
+	Bus      string         `toml:"bus"`
+	Address  int            `toml:"address"`
+	Interval config.Seconds `toml:"interval"`
+}
+
+func init() {
+	config.RegisterSection("device/i2c", I2CDeviceSection{})
+}
+
+// NewI2CDevice read config.ConfigSection and returnes I2CDevice.
+// If config validation failed, return error
+func NewI2CDevice(section config.ConfigSection, brokers []*broker.Broker, devChan DeviceChannel) (I2CDevice, error) {
+	ret := I2CDevice{
+		Name:       section.Name,
+		DeviceChan: devChan,
+		stop:       make(chan struct{}),
+	}
+	sc := I2CDeviceSection{}
+	if err := section.Decode(&sc); err != nil {
+		return ret, err
+	}
+	if sc.Broker == "" {
+		return ret, fmt.Errorf("broker does not set")
+	}
+
+	for _, b := range brokers {
+		if b.Name == sc.Broker {
+			ret.Broker = brokers
+		}
+	}
+	if ret.Broker == nil {
+		return ret, fmt.Errorf("broker does not exists: %s", sc.Broker)
+	}
+	ret.BrokerName = sc.Broker
+
+	if _, ok := section.Values["qos"]; !ok {
+		return ret, fmt.Errorf("qos does not set")
+	}
+	ret.QoS = byte(sc.QoS)
+	ret.Bus = sc.Bus
+	// address may be written as "0x76"
+	if _, ok := section.Values["address"]; !ok {
+		return ret, fmt.Errorf("address does not set")
+	}
+	ret.Address = sc.Address
+	ret.Interval = int(sc.Interval)
+	var err error
+	ret.Transaction, err = newBusTransaction(sc.BusSection)
+	if err != nil {
+		return ret, err
+	}
+	ret.Type = sc.Type
+	ret.Retain = sc.Retain
+	ret.Subscribe = sc.Subscribe
+
+	if err := ret.Validate(); err != nil {
+		return ret, err
+	}
+
+	return ret, nil
+}
+
+func (device *I2CDevice) Validate() error {
+	validator := validator.NewValidator()
+	validator.SetValidationFunc("validtopic", config.ValidMqttPublishTopic)
+	if err := validator.Validate(device); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (device I2CDevice) newMessage(body []byte) message.Message {
+	return message.Message{
+		Sender:     device.Name,
+		Type:       device.Type,
+		QoS:        device.QoS,
+		Retained:   device.Retain,
+		BrokerName: device.BrokerName,
+		Body:       body,
+	}
+}
+
+func (device I2CDevice) Start(channel chan message.Message) error {
+	bus, err := openI2C(device.Bus, device.Address)
+	if err != nil {
+		return fmt.Errorf("i2c device start failed, %v", err)
+	}
+
+	log.Info("start i2c device")
+	go busLoop(bus, device.Transaction, device.Interval, device.newMessage, channel, device.DeviceChan, device.stop)
+	return nil
+}
+
+func (device I2CDevice) Stop() error {
+	log.Infof("closing i2c: %v", device.Name)
+	select {
+	case <-device.stop:
+	default:
+		close(device.stop)
+	}
+	return nil
+}
+
+func (device I2CDevice) DeviceType() string {
+	return "i2c"
+}
+
+// DeviceName returns the name of the device.
+func (device I2CDevice) DeviceName() string {
+	return device.Name
+}
+
+func (device I2CDevice) AddSubscribe() error {
+	if !device.Subscribe {
+		return nil
+	}
+	for _, b := range device.Broker {
+		b.AddSubscribed(device.Name, device.QoS)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+)
+
+func TestNewI2CDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[device."bme280"]
+    type = "i2c"
+    broker = "sango"
+    qos = 0
+    bus = "/dev/i2c-1"
+    address = "0x76"
+    interval = 10
+    init = "\\xf2\\x01, \\xf4\\x27"
+    command = "\\xf7"
+    read = 8
+    fields = "raw_press:u24be@0>>4, raw_temp:u24be@3>>4, raw_hum:u16be@6"
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+	d, err := NewI2CDevice(conf.Sections[0], brokers, NewDeviceChannel())
+	assert.Nil(err)
+	assert.Equal("bme280", d.Name)
+	assert.Equal("/dev/i2c-1", d.Bus)
+	assert.Equal(0x76, d.Address)
+	assert.Equal(10, d.Interval)
+	assert.Equal(2, len(d.Transaction.Init))
+	assert.Equal(8, d.Transaction.Read)
+	assert.Equal(3, len(d.Transaction.Fields))
+	assert.Equal("json", d.Transaction.Format)
+	assert.Equal("i2c", d.Type)
+}
+
+func TestNewI2CDeviceInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, c := range []string{
+		`address = "0x76"`,
+		`address = "zz"
+    interval = 10`,
+		`address = 72
+    interval = 0`,
+		`address = 72
+    interval = 10
+    format = "base64"`,
+	} {
+		configStr := `
+[device."adc"]
+    type = "i2c"
+    broker = "sango"
+    qos = 0
+    bus = "/dev/i2c-1"
+    ` + c
+		// rejected by the config schema or by the device
+		conf, err := config.LoadConfigByte([]byte(configStr))
+		if err == nil {
+			b1 := &broker.Broker{Name: "sango"}
+			brokers := []*broker.Broker{b1}
+			_, err = NewI2CDevice(conf.Sections[0], brokers, NewDeviceChannel())
+		}
+		assert.NotNil(err, c)
+	}
+}
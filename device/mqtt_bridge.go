@@ -0,0 +1,378 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	validator "gopkg.in/validator.v2"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+)
+
+const defaultBridgeRetryInterval = 10 // sec
+
+// MQTTBridgeDevice forwards messages between a local MQTT broker and
+// the gateway.
+type MQTTBridgeDevice struct {
+	Name           string `validate:"max=256,regexp=[^/]+,validtopic"`
+	Broker         []*broker.Broker
+	BrokerName     string
+	QoS            byte `validate:"min=0,max=2"`
+	Local          *broker.Broker
+	Filters        []string `validate:"min=1"`
+	RewritePattern *regexp.Regexp
+	RewriteReplace string
+	LocalTopic     string `validate:"max=256,validtopic"`
+	RetryInterval  int    `validate:"min=1"`
+	Type           string `validate:"max=256"`
+	Retain         bool
+	Subscribe      bool
+	DeviceChan     DeviceChannel // GW -> device
+
+	localChan chan message.Message // local broker -> device
+	localMu   *sync.Mutex          // guards the client of Local
+	stop      chan struct{}
+}
+
+func (device MQTTBridgeDevice) String() string {
+	return fmt.Sprintf("%#v", device)
+}
+
+// MQTTBridgeDeviceSection is [device."<name>"] of type "mqtt_bridge".
+type MQTTBridgeDeviceSection struct {
+	config.DeviceSection
+	Host           string         `toml:"host"`
+	Port           int            `toml:"port"`
+	Username       string         `toml:"username"`
+	Password       string         `toml:"password"`
+	TLS            bool           `toml:"tls"`
+	CACert         string         `toml:"cacert"`
+	ClientCert     string         `toml:"client_cert"`
+	ClientKey      string         `toml:"client_key"`
+	Filters        config.List    `toml:"filters"`
+	LocalTopic     string         `toml:"local_topic"`
+	RewritePattern string         `toml:"rewrite_pattern"`
+	RewriteReplace string         `toml:"rewrite_replace"`
+	RetryInterval  config.Seconds `toml:"retry_interval"`
+}
+
+func init() {
+	config.RegisterSection("device/mqtt_bridge", MQTTBridgeDeviceSection{})
+}
+
+// NewMQTTBridgeDevice read config.ConfigSection and returnes MQTTBridgeDevice.
+// If config validation failed, return error
+func NewMQTTBridgeDevice(section config.ConfigSection, brokers []*broker.Broker, devChan DeviceChannel) (MQTTBridgeDevice, error) {
+	ret := MQTTBridgeDevice{
+		Name:          section.Name,
+		DeviceChan:    devChan,
+		RetryInterval: defaultBridgeRetryInterval,
+		localChan:     make(chan message.Message),
+		localMu:       &sync.Mutex{},
+		stop:          make(chan struct{}),
+	}
+	sc := MQTTBridgeDeviceSection{
+		Port:          1883,
+		RetryInterval: defaultBridgeRetryInterval,
+	}
+	if err := section.Decode(&sc); err != nil {
+		return ret, err
+	}
+	if sc.Broker == "" {
+		return ret, fmt.Errorf("broker does not set")
+	}
+
+	gwName := ""
+	for _, b := range brokers {
+		if b.Name == sc.Broker {
+			ret.Broker = brokers
+			gwName = b.GatewayName
+		}
+	}
+	if ret.Broker == nil {
+		return ret, fmt.Errorf("broker does not exists: %s", sc.Broker)
+	}
+	ret.BrokerName = sc.Broker
+
+	if _, ok := section.Values["qos"]; !ok {
+		return ret, fmt.Errorf("qos does not set")
+	}
+	ret.QoS = byte(sc.QoS)
+
+	var err error
+	ret.Local, err = newLocalBroker(gwName, section.Name, sc, ret.localChan)
+	if err != nil {
+		return ret, err
+	}
+	ret.Filters = sc.Filters
+	for _, f := range ret.Filters {
+		if err := validMQTTFilter(f); err != nil {
+			return ret, err
+		}
+		ret.Local.Subscribed.Add(f, ret.QoS)
+	}
+	if sc.RewritePattern != "" {
+		ret.RewritePattern, err = regexp.Compile(sc.RewritePattern)
+		if err != nil {
+			return ret, fmt.Errorf("rewrite_pattern compile failed, %v", err)
+		}
+		ret.RewriteReplace = sc.RewriteReplace
+	}
+	ret.LocalTopic = sc.LocalTopic
+	for _, f := range ret.Filters {
+		if ret.LocalTopic != "" && matchMQTTTopic(f, ret.LocalTopic) {
+			return ret, fmt.Errorf("local_topic %v matches filter %v, messages would loop", ret.LocalTopic, f)
+		}
+	}
+	ret.RetryInterval = int(sc.RetryInterval)
+	ret.Type = sc.Type
+	ret.Retain = sc.Retain
+	ret.Subscribe = sc.Subscribe
+	// cloud messages are forwarded only when the destination is known
+	if ret.LocalTopic != "" {
+		ret.Subscribe = true
+	}
+
+	if err := ret.Validate(); err != nil {
+		return ret, err
+	}
+
+	return ret, nil
+}
+
+func (device *MQTTBridgeDevice) Validate() error {
+	validator := validator.NewValidator()
+	validator.SetValidationFunc("validtopic", config.ValidMqttPublishTopic)
+	if err := validator.Validate(device); err != nil {
+		return err
+	}
+	return nil
+}
+
+// newLocalBroker returns broker.Broker for the local MQTT broker. Its
+// connection settings use the same keys as the broker section.
+func newLocalBroker(gwName, name string, sc MQTTBridgeDeviceSection, localChan chan message.Message) (*broker.Broker, error) {
+	b := &broker.Broker{
+		GatewayName: gwName,
+		Name:        name,
+		Priority:    1,
+		Host:        sc.Host,
+		Port:        sc.Port,
+		Username:    sc.Username,
+		Password:    sc.Password,
+		Subscribed:  broker.NewSubscribed(),
+		GwChan:      localChan,
+	}
+	if b.Host == "" {
+		b.Host = "localhost"
+	}
+	if sc.TLS {
+		if sc.CACert == "" {
+			return nil, fmt.Errorf("cacert must be set")
+		}
+		b.Tls = true
+		b.CaCert = sc.CACert
+		b.ClientCert = sc.ClientCert
+		b.ClientKey = sc.ClientKey
+
+		var err error
+		b.TLSConfig, err = broker.NewTLSConfig(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// validMQTTFilter checks wildcards of the subscription filter.
+func validMQTTFilter(filter string) error {
+	if filter == "" {
+		return fmt.Errorf("empty filter")
+	}
+	levels := strings.Split(filter, "/")
+	for i, l := range levels {
+		if strings.Contains(l, "#") && (l != "#" || i != len(levels)-1) {
+			return fmt.Errorf("invalid filter, %v", filter)
+		}
+		if strings.Contains(l, "+") && l != "+" {
+			return fmt.Errorf("invalid filter, %v", filter)
+		}
+	}
+	return nil
+}
+
+// matchMQTTTopic returns true if the topic matches the filter.
+func matchMQTTTopic(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, l := range f {
+		if l == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if l != "+" && l != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// forward converts the message from the local broker to the gateway.
+// Type is the local topic after rewriting, and keeps its slashes, so
+// "sensors/room1/temp" is published to
+// <topic_prefix>/<gateway>/<device>/sensors/room1/temp/publish. The
+// types used by the gateway itself, like "availability", are rejected.
+func (device MQTTBridgeDevice) forward(msg message.Message) (message.Message, error) {
+	typ := msg.Topic
+	if device.RewritePattern != nil {
+		typ = device.RewritePattern.ReplaceAllString(typ, device.RewriteReplace)
+	}
+	typ = strings.Trim(typ, "/")
+	if typ == "" {
+		return message.Message{}, fmt.Errorf("topic %v is rewritten to empty", msg.Topic)
+	}
+	if err := config.ValidMqttPublishTopic(typ, ""); err != nil {
+		return message.Message{}, err
+	}
+	switch typ {
+	case message.TypeSubscribed, message.TypeAvailability, message.TypeRPC:
+		return message.Message{}, fmt.Errorf("topic %v is rewritten to reserved type %v", msg.Topic, typ)
+	}
+	return message.Message{
+		Sender:     device.Name,
+		Type:       typ,
+		QoS:        device.QoS,
+		Retained:   device.Retain,
+		BrokerName: device.BrokerName,
+		Body:       msg.Body,
+	}, nil
+}
+
+// connect connects to the local broker until it succeeds or the device
+// is stopped. Messages are subscribed by the local broker on connect.
+// The client is set up with localMu held, so that it is closed after
+// the loop in Start even if the device is stopped while connecting.
+func (device MQTTBridgeDevice) connect() {
+	for {
+		device.localMu.Lock()
+		select {
+		case <-device.stop:
+			device.localMu.Unlock()
+			return
+		default:
+		}
+		err := device.Local.MQTTClientSetup(device.Local.GatewayName + "-" + device.Name)
+		device.localMu.Unlock()
+		if err == nil {
+			return
+		}
+		log.Warnf("local broker connect failed, retry after %d sec, %v", device.RetryInterval, err)
+		select {
+		case <-time.After(time.Duration(device.RetryInterval) * time.Second):
+		case <-device.stop:
+			return
+		}
+	}
+}
+
+// publishLocal publishes body to the local broker.
+func (device MQTTBridgeDevice) publishLocal(topic string, body []byte) error {
+	device.localMu.Lock()
+	defer device.localMu.Unlock()
+	if !device.Local.IsConnected() {
+		return fmt.Errorf("local broker is not connected")
+	}
+	token := device.Local.MQTTClient.Publish(topic, device.QoS, device.Retain, body)
+	token.Wait()
+	return token.Error()
+}
+
+// loop forwards messages in both directions until stop is closed.
+func (device MQTTBridgeDevice) loop(channel chan message.Message, publishLocal func(string, []byte) error) {
+	for {
+		select {
+		case msg := <-device.localChan:
+			if msg.Type != message.TypeSubscribed {
+				continue
+			}
+			m, err := device.forward(msg)
+			if err != nil {
+				log.Warnf("local message discarded, %v", err)
+				continue
+			}
+			channel <- m
+		case msg, _ := <-device.DeviceChan.Chan:
+			if device.LocalTopic == "" || !subscribedTo(msg, device.Name) {
+				continue
+			}
+			if err := publishLocal(device.LocalTopic, msg.Body); err != nil {
+				log.Errorf("local publish failed, %v", err)
+			}
+		case <-device.stop:
+			return
+		}
+	}
+}
+
+func (device MQTTBridgeDevice) Start(channel chan message.Message) error {
+	log.Info("start mqtt bridge device")
+	go device.connect()
+	go func() {
+		device.loop(channel, device.publishLocal)
+		device.localMu.Lock()
+		device.Local.Close()
+		device.localMu.Unlock()
+	}()
+	return nil
+}
+
+func (device MQTTBridgeDevice) Stop() error {
+	log.Infof("closing mqtt bridge: %v", device.Name)
+	select {
+	case <-device.stop:
+	default:
+		close(device.stop)
+	}
+	return nil
+}
+
+func (device MQTTBridgeDevice) DeviceType() string {
+	return "mqtt_bridge"
+}
+
+// DeviceName returns the name of the device.
+func (device MQTTBridgeDevice) DeviceName() string {
+	return device.Name
+}
+
+func (device MQTTBridgeDevice) AddSubscribe() error {
+	if !device.Subscribe {
+		return nil
+	}
+	for _, b := range device.Broker {
+		b.AddSubscribed(device.Name, device.QoS)
+	}
+	return nil
+}
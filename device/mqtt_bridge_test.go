@@ -0,0 +1,237 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/message"
+)
+
+// testMQTTBridgeConfig is the bridge without the local broker settings.
+const testMQTTBridgeConfig = `
+[device."mosquitto"]
+    type = "mqtt_bridge"
+    broker = "sango"
+    qos = 1
+`
+
+func TestNewMQTTBridgeDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := NewMQTTBridgeDevice(testDeviceArgs(t, testMQTTBridgeConfig+`
+    port = 11883
+    username = "fuji"
+    filters = "sensors/#, alarms/+"
+    local_topic = "fuji/commands"
+`))
+	assert.Nil(err)
+	assert.Equal("localhost", d.Local.Host)
+	assert.Equal(11883, d.Local.Port)
+	assert.Equal("fuji", d.Local.Username)
+	assert.Equal("ham", d.Local.GatewayName)
+	assert.Equal(map[string]byte{"sensors/#": 1, "alarms/+": 1}, d.Local.Subscribed.List())
+	assert.True(d.Subscribe)
+
+	for _, c := range []string{
+		``,
+		`filters = "sensors/#/x"`,
+		`filters = "sensors/a+"`,
+		`filters = "sensors/#"
+    rewrite_pattern = "("`,
+		`filters = "fuji/#"
+    local_topic = "fuji/commands"`,
+		`filters = "sensors/#"
+    tls = true`,
+	} {
+		_, err := NewMQTTBridgeDevice(testDeviceArgs(t, testMQTTBridgeConfig+c))
+		assert.NotNil(err, c)
+	}
+}
+
+func TestMatchMQTTTopic(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(matchMQTTTopic("sensors/#", "sensors/room1/temp"))
+	assert.True(matchMQTTTopic("sensors/#", "sensors"))
+	assert.True(matchMQTTTopic("sensors/+/temp", "sensors/room1/temp"))
+	assert.True(matchMQTTTopic("a/b", "a/b"))
+	assert.False(matchMQTTTopic("sensors/+", "sensors/room1/temp"))
+	assert.False(matchMQTTTopic("sensors/+/temp", "sensors/room1"))
+	assert.False(matchMQTTTopic("a/b", "a/c"))
+}
+
+func TestMQTTBridgeForward(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := NewMQTTBridgeDevice(testDeviceArgs(t, testMQTTBridgeConfig+`
+    filters = "sensors/#"
+    rewrite_pattern = "^sensors/(.+)/(.+)$"
+    rewrite_replace = "$2/$1"
+    local_topic = "fuji/commands"
+`))
+	assert.Nil(err)
+
+	m, err := d.forward(message.Message{Topic: "sensors/room1/temp", Body: []byte("21.5")})
+	assert.Nil(err)
+	assert.Equal("mosquitto", m.Sender)
+	assert.Equal("temp/room1", m.Type)
+	assert.Equal("sango", m.BrokerName)
+	assert.Equal(byte(1), m.QoS)
+
+	d, _ = NewMQTTBridgeDevice(testDeviceArgs(t, testMQTTBridgeConfig+`filters = "sensors/#"`))
+	m, err = d.forward(message.Message{Topic: "sensors/room1", Body: []byte("21.5")})
+	assert.Nil(err)
+	assert.Equal("sensors/room1", m.Type)
+
+	// types of the gateway itself
+	d, _ = NewMQTTBridgeDevice(testDeviceArgs(t, testMQTTBridgeConfig+`filters = "#"`))
+	for _, topic := range []string{"availability", "rpc", "subscribed"} {
+		_, err = d.forward(message.Message{Topic: topic, Body: []byte("online")})
+		assert.NotNil(err, topic)
+	}
+}
+
+// serveFakeMQTT accepts MQTT clients on listener and acknowledges
+// CONNECT, SUBSCRIBE, PUBLISH with QoS 1 and PINGREQ. Published
+// messages are sent to published.
+func serveFakeMQTT(listener net.Listener, published chan []byte) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for {
+				header, err := r.ReadByte()
+				if err != nil {
+					return
+				}
+				// remaining length
+				length, shift := 0, uint(0)
+				for {
+					b, err := r.ReadByte()
+					if err != nil {
+						return
+					}
+					length |= int(b&0x7f) << shift
+					shift += 7
+					if b&0x80 == 0 {
+						break
+					}
+				}
+				body := make([]byte, length)
+				if _, err := io.ReadFull(r, body); err != nil {
+					return
+				}
+				switch header >> 4 {
+				case 1: // CONNECT
+					conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+				case 3: // PUBLISH
+					n := int(body[0])<<8 | int(body[1])
+					if header&0x06 != 0 {
+						conn.Write([]byte{0x40, 0x02, body[2+n], body[3+n]})
+						body = body[2:]
+					}
+					published <- body[2+n:]
+				case 8: // SUBSCRIBE
+					conn.Write([]byte{0x90, 0x03, body[0], body[1], 0x01})
+				case 12: // PINGREQ
+					conn.Write([]byte{0xd0, 0x00})
+				}
+			}
+		}()
+	}
+}
+
+func TestMQTTBridgeStartStop(t *testing.T) {
+	assert := assert.New(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer listener.Close()
+	published := make(chan []byte, 10)
+	go serveFakeMQTT(listener, published)
+
+	d, err := NewMQTTBridgeDevice(testDeviceArgs(t, testMQTTBridgeConfig+fmt.Sprintf(`
+    filters = "sensors/#"
+    local_topic = "fuji/commands"
+    host = "127.0.0.1"
+    port = %d
+`, listener.Addr().(*net.TCPAddr).Port)))
+	assert.Nil(err)
+	channel := make(chan message.Message, 10)
+	assert.Nil(d.Start(channel))
+	defer d.Stop()
+
+	// publishing while connecting does not race with the client setup
+	// nor fails after it
+	cmd := message.Message{Topic: "pre/ham/mosquitto/subscribe", Body: []byte("reboot")}
+	deadline := time.After(3 * time.Second)
+	for {
+		d.DeviceChan.Chan <- cmd
+		select {
+		case body := <-published:
+			assert.Equal("reboot", string(body))
+			return
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("local publish timeout")
+		}
+	}
+}
+
+func TestMQTTBridgeLoop(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := NewMQTTBridgeDevice(testDeviceArgs(t, testMQTTBridgeConfig+`
+    filters = "sensors/#"
+    local_topic = "fuji/commands"
+`))
+	assert.Nil(err)
+	channel := make(chan message.Message, 10)
+	published := make(chan string, 10)
+	go d.loop(channel, func(topic string, body []byte) error {
+		published <- topic + " " + string(body)
+		return nil
+	})
+	defer d.Stop()
+
+	d.localChan <- message.Message{Type: message.TypeSubscribed, Topic: "sensors/room1", Body: []byte("21.5")}
+	select {
+	case msg := <-channel:
+		assert.Equal("sensors/room1", msg.Type)
+	case <-time.After(time.Second):
+		t.Fatal("bridge message timeout")
+	}
+
+	d.DeviceChan.Chan <- message.Message{Topic: "pre/ham/other/subscribe", Body: []byte("ignored")}
+	d.DeviceChan.Chan <- message.Message{Topic: "pre/ham/mosquitto/subscribe", Body: []byte("reboot")}
+	select {
+	case p := <-published:
+		assert.Equal("fuji/commands reboot", p)
+	case <-time.After(time.Second):
+		t.Fatal("local publish timeout")
+	}
+}
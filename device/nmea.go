@@ -0,0 +1,572 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	validator "gopkg.in/validator.v2"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+)
+
+const knotToKmh = 1.852
+
+// NMEADevice reads position from a GPS receiver on the serial port.
+type NMEADevice struct {
+	Name        string `validate:"max=256,regexp=[^/]+,validtopic"`
+	Broker      []*broker.Broker
+	BrokerName  string
+	QoS         byte   `validate:"min=0,max=2"`
+	Serial      string `validate:"min=1,max=256"`
+	Baud        int    `validate:"min=0"`
+	Interval    int    `validate:"min=1"`
+	Stamp       bool
+	StampExpire int    `validate:"min=1"` // seconds
+	Type        string `validate:"max=256"`
+	Retain      bool
+	Subscribe   bool
+	DeviceChan  DeviceChannel // GW -> device
+
+	RetryInterval    int `validate:"min=1"` // seconds
+	MaxRetryInterval int `validate:"min=1"` // seconds
+
+	openPort func() (io.ReadCloser, error) // replaced in tests
+	stop     chan struct{}
+}
+
+// nmeaFix is the position built from GGA, RMC and VTG sentences.
+type nmeaFix struct {
+	Valid      bool    `json:"valid"`
+	Latitude   float64 `json:"latitude"`
+	Longitude  float64 `json:"longitude"`
+	Altitude   float64 `json:"altitude"`
+	Quality    int     `json:"quality"`
+	Satellites int     `json:"satellites"`
+	HDOP       float64 `json:"hdop"`
+	Speed      float64 `json:"speed"`  // km/h
+	Course     float64 `json:"course"` // degree
+	Time       string  `json:"time,omitempty"`
+}
+
+// Position is the last known position which is stamped to messages
+// of other devices.
+type Position struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude"`
+	Time      string  `json:"time,omitempty"`
+}
+
+var positionStore struct {
+	sync.RWMutex
+	source   string // name of the stamping device
+	position *Position
+	expire   time.Duration // the position older than this is not stamped
+	updated  time.Time
+}
+
+func (device NMEADevice) String() string {
+	return fmt.Sprintf("%#v", device)
+}
+
+// NMEADeviceSection is [device."<name>"] of type "nmea".
+type NMEADeviceSection struct {
+	config.DeviceSection
+	Serial      string         `toml:"serial"`
+	Baud        int            `toml:"baud"`
+	Interval    config.Seconds `toml:"interval"`
+	Stamp       bool           `toml:"stamp"`
+	StampExpire config.Seconds `toml:"stamp_expire"`
+
+	RetryInterval    config.Seconds `toml:"retry_interval"`
+	MaxRetryInterval config.Seconds `toml:"max_retry_interval"`
+}
+
+func init() {
+	config.RegisterSection("device/nmea", NMEADeviceSection{})
+}
+
+// NewNMEADevice read config.ConfigSection and returnes NMEADevice.
+// If config validation failed, return error
+func NewNMEADevice(section config.ConfigSection, brokers []*broker.Broker, devChan DeviceChannel) (NMEADevice, error) {
+	ret := NMEADevice{
+		Name:        section.Name,
+		DeviceChan:  devChan,
+		Baud:        4800,
+		Interval:    1,
+		StampExpire: 10,
+		stop:        make(chan struct{}),
+	}
+	sc := NMEADeviceSection{
+		Baud:             4800,
+		Interval:         1,
+		StampExpire:      10,
+		RetryInterval:    defaultSerialRetryInterval,
+		MaxRetryInterval: defaultSerialMaxRetryInterval,
+	}
+	if err := section.Decode(&sc); err != nil {
+		return ret, err
+	}
+	if sc.Broker == "" {
+		return ret, fmt.Errorf("broker does not set")
+	}
+
+	for _, b := range brokers {
+		if b.Name == sc.Broker {
+			ret.Broker = brokers
+		}
+	}
+	if ret.Broker == nil {
+		return ret, fmt.Errorf("broker does not exists: %s", sc.Broker)
+	}
+	ret.BrokerName = sc.Broker
+
+	if _, ok := section.Values["qos"]; !ok {
+		return ret, fmt.Errorf("qos does not set")
+	}
+	ret.QoS = byte(sc.QoS)
+	ret.Serial = sc.Serial
+	ret.Baud = sc.Baud
+	ret.Interval = int(sc.Interval)
+	ret.Stamp = sc.Stamp
+	ret.StampExpire = int(sc.StampExpire)
+	ret.RetryInterval = int(sc.RetryInterval)
+	ret.MaxRetryInterval = int(sc.MaxRetryInterval)
+	if ret.MaxRetryInterval < ret.RetryInterval {
+		ret.MaxRetryInterval = ret.RetryInterval
+	}
+	ret.Type = sc.Type
+	ret.Retain = sc.Retain
+	ret.Subscribe = sc.Subscribe
+
+	if err := ret.Validate(); err != nil {
+		return ret, err
+	}
+
+	return ret, nil
+}
+
+func (device *NMEADevice) Validate() error {
+	validator := validator.NewValidator()
+	validator.SetValidationFunc("validtopic", config.ValidMqttPublishTopic)
+	if err := validator.Validate(device); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseNMEASentence verifies the checksum and returns comma separated fields.
+// ex: $GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47
+func parseNMEASentence(line string) ([]string, error) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "$") {
+		return nil, fmt.Errorf("not a nmea sentence, %q", line)
+	}
+	i := strings.LastIndex(line, "*")
+	if i < 0 || len(line) != i+3 {
+		return nil, fmt.Errorf("checksum not found, %q", line)
+	}
+	var sum byte
+	for _, c := range []byte(line[1:i]) {
+		sum ^= c
+	}
+	expected, err := strconv.ParseUint(line[i+1:], 16, 8)
+	if err != nil || byte(expected) != sum {
+		return nil, fmt.Errorf("checksum mismatch, %q", line)
+	}
+	fields := strings.Split(line[1:i], ",")
+	if len(fields[0]) != 5 {
+		return nil, fmt.Errorf("invalid sentence id, %q", fields[0])
+	}
+	return fields, nil
+}
+
+// parseNMEACoordinate converts ddmm.mmmm and hemisphere into degree.
+func parseNMEACoordinate(v, hemi string) (float64, error) {
+	i := strings.Index(v, ".")
+	if i < 0 {
+		i = len(v)
+	}
+	if i < 3 {
+		return 0, fmt.Errorf("invalid coordinate, %q", v)
+	}
+	deg, err := strconv.ParseFloat(v[:i-2], 64)
+	if err != nil {
+		return 0, err
+	}
+	min, err := strconv.ParseFloat(v[i-2:], 64)
+	if err != nil {
+		return 0, err
+	}
+	ret := deg + min/60
+	switch hemi {
+	case "S", "W":
+		ret = -ret
+	case "N", "E":
+	default:
+		return 0, fmt.Errorf("invalid hemisphere, %q", hemi)
+	}
+	return ret, nil
+}
+
+func parseNMEAFloat(v string) float64 {
+	f, _ := strconv.ParseFloat(v, 64)
+	return f
+}
+
+// update applies the sentence to the fix. Unknown sentences are ignored.
+func (fix *nmeaFix) update(fields []string) error {
+	switch fields[0][2:] {
+	case "GGA":
+		if len(fields) < 10 {
+			return fmt.Errorf("too short GGA")
+		}
+		fix.Quality, _ = strconv.Atoi(fields[6])
+		fix.Satellites, _ = strconv.Atoi(fields[7])
+		fix.HDOP = parseNMEAFloat(fields[8])
+		fix.Valid = fix.Quality > 0
+		if !fix.Valid {
+			return nil
+		}
+		if err := fix.setCoordinate(fields[2], fields[3], fields[4], fields[5]); err != nil {
+			return err
+		}
+		fix.Altitude = parseNMEAFloat(fields[9])
+	case "RMC":
+		if len(fields) < 10 {
+			return fmt.Errorf("too short RMC")
+		}
+		fix.Valid = fields[2] == "A"
+		if !fix.Valid {
+			return nil
+		}
+		if err := fix.setCoordinate(fields[3], fields[4], fields[5], fields[6]); err != nil {
+			return err
+		}
+		fix.Speed = parseNMEAFloat(fields[7]) * knotToKmh
+		fix.Course = parseNMEAFloat(fields[8])
+		// hhmmss.ss and ddmmyy
+		if len(fields[1]) >= 6 && len(fields[9]) == 6 {
+			t, err := time.Parse("020106150405", fields[9]+fields[1][:6])
+			if err == nil {
+				fix.Time = t.Format(time.RFC3339)
+			}
+		}
+	case "VTG":
+		if len(fields) < 8 {
+			return fmt.Errorf("too short VTG")
+		}
+		fix.Course = parseNMEAFloat(fields[1])
+		fix.Speed = parseNMEAFloat(fields[7])
+	}
+	return nil
+}
+
+func (fix *nmeaFix) setCoordinate(lat, ns, lon, ew string) error {
+	var err error
+	fix.Latitude, err = parseNMEACoordinate(lat, ns)
+	if err != nil {
+		return err
+	}
+	fix.Longitude, err = parseNMEACoordinate(lon, ew)
+	return err
+}
+
+// setStampSource makes the device a source of stamped position.
+func setStampSource(name string, expire time.Duration) {
+	positionStore.Lock()
+	defer positionStore.Unlock()
+	positionStore.source = name
+	positionStore.position = nil
+	positionStore.expire = expire
+}
+
+// clearStampSource forgets the position if the device is the source,
+// so that the position is not stamped after the device is stopped.
+func clearStampSource(name string) {
+	positionStore.Lock()
+	defer positionStore.Unlock()
+	if positionStore.source != name {
+		return
+	}
+	positionStore.source = ""
+	positionStore.position = nil
+}
+
+func storePosition(fix nmeaFix) {
+	positionStore.Lock()
+	defer positionStore.Unlock()
+	positionStore.position = &Position{
+		Latitude:  fix.Latitude,
+		Longitude: fix.Longitude,
+		Altitude:  fix.Altitude,
+		Time:      fix.Time,
+	}
+	positionStore.updated = time.Now()
+}
+
+// StampPosition adds the last known position to the JSON object body of
+// the message. Messages which are not JSON object or sent by the NMEA
+// device itself are returned as is, and so are all messages while the
+// position is older than stamp_expire.
+func StampPosition(msg message.Message) message.Message {
+	positionStore.RLock()
+	source, position := positionStore.source, positionStore.position
+	stale := time.Since(positionStore.updated) > positionStore.expire
+	positionStore.RUnlock()
+	if position == nil || stale || msg.Sender == source {
+		return msg
+	}
+
+	body := bytes.TrimSpace(msg.Body)
+	if len(body) < 2 || body[0] != '{' {
+		return msg
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return msg
+	}
+	if _, ok := obj["position"]; ok {
+		return msg
+	}
+	p, err := json.Marshal(position)
+	if err != nil {
+		return msg
+	}
+
+	// keep the original key order
+	stamped := append([]byte{}, body[:len(body)-1]...)
+	if len(obj) > 0 {
+		stamped = append(stamped, ',')
+	}
+	stamped = append(stamped, `"position":`...)
+	stamped = append(stamped, p...)
+	stamped = append(stamped, '}')
+	msg.Body = stamped
+	return msg
+}
+
+func (device NMEADevice) newMessage(fix nmeaFix) (message.Message, error) {
+	body, err := json.Marshal(fix)
+	if err != nil {
+		return message.Message{}, err
+	}
+	return message.Message{
+		Sender:     device.Name,
+		Type:       device.Type,
+		QoS:        device.QoS,
+		Retained:   device.Retain,
+		BrokerName: device.BrokerName,
+		Body:       body,
+	}, nil
+}
+
+// loop parses sentences read from port and publishes the fix by
+// interval. It returns nil if the device is stopped, or error if the
+// port is lost.
+func (device NMEADevice) loop(port io.Reader, channel chan message.Message) error {
+	readPipe := make(chan []byte)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			num, err := port.Read(buf)
+			if err == io.EOF {
+				continue
+			}
+			if err != nil {
+				readErr <- err
+				return
+			}
+			if num == 0 {
+				continue
+			}
+			select {
+			case readPipe <- append([]byte{}, buf[:num]...):
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(time.Duration(device.Interval) * time.Second)
+	defer ticker.Stop()
+
+	var fix nmeaFix
+	var rest []byte
+	updated := false
+	for {
+		select {
+		case b := <-readPipe:
+			var lines [][]byte
+			lines, rest = splitRecords(append(rest, b...), []byte("\n"))
+			for _, line := range lines {
+				fields, err := parseNMEASentence(string(line))
+				if err != nil {
+					log.Debugf("nmea sentence ignored, %v", err)
+					continue
+				}
+				if err := fix.update(fields); err != nil {
+					log.Warnf("nmea parse failed, %v", err)
+					continue
+				}
+				updated = true
+				if device.Stamp && fix.Valid {
+					storePosition(fix)
+				}
+			}
+		case <-ticker.C:
+			if !updated {
+				continue
+			}
+			updated = false
+			msg, err := device.newMessage(fix)
+			if err != nil {
+				log.Errorf("json encode error %s", err)
+				continue
+			}
+			channel <- msg
+		case err := <-readErr:
+			return fmt.Errorf("nmea read failed, %v", err)
+		case msg, _ := <-device.DeviceChan.Chan:
+			log.Debugf("msg reached to nmea device, ignored, %v", msg)
+		case <-device.stop:
+			return nil
+		}
+	}
+}
+
+// open opens the serial port of the receiver.
+func (device NMEADevice) open() (io.ReadCloser, error) {
+	if device.openPort != nil {
+		return device.openPort()
+	}
+	port, err := openSerialPort(device.Serial, device.Baud, defaultSerialParams)
+	if err != nil {
+		return nil, err
+	}
+	// the unplugged receiver may keep returning io.EOF
+	return &serialWatcher{ReadWriteCloser: port, path: device.Serial}, nil
+}
+
+// supervise runs loop on port. The port is reopened with backoff when it
+// is lost until the device is stopped, and the device is offline while
+// it is lost.
+func (device NMEADevice) supervise(port io.ReadCloser, channel chan message.Message) {
+	backoff := time.Duration(device.RetryInterval) * time.Second
+	maxBackoff := time.Duration(device.MaxRetryInterval) * time.Second
+	for {
+		err := device.loop(port, channel)
+		port.Close()
+		if err == nil {
+			return
+		}
+		log.Errorf("nmea port lost: %v, %v", device.Serial, err)
+		channel <- offlineMessage(device.Name, device.BrokerName)
+
+		wait := backoff
+		for {
+			if !device.wait(wait) {
+				return
+			}
+			port, err = device.open()
+			if err == nil {
+				break
+			}
+			wait *= 2
+			if wait > maxBackoff {
+				wait = maxBackoff
+			}
+			log.Warnf("nmea port open failed, retry after %v, %v", wait, err)
+		}
+		log.Infof("nmea port reopened: %v", device.Serial)
+	}
+}
+
+// wait waits d while discarding messages to the device. It returns false
+// if the device is stopped.
+func (device NMEADevice) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case msg, _ := <-device.DeviceChan.Chan:
+			log.Debugf("msg reached to nmea device, ignored, %v", msg)
+		case <-device.stop:
+			return false
+		}
+	}
+}
+
+func (device NMEADevice) Start(channel chan message.Message) error {
+	port, err := device.open()
+	if err != nil {
+		return fmt.Errorf("nmea device start failed, %v", err)
+	}
+	if device.Stamp {
+		setStampSource(device.Name, time.Duration(device.StampExpire)*time.Second)
+	}
+
+	log.Info("start nmea device")
+	go device.supervise(port, channel)
+	return nil
+}
+
+func (device NMEADevice) Stop() error {
+	log.Infof("closing nmea: %v", device.Name)
+	select {
+	case <-device.stop:
+	default:
+		close(device.stop)
+	}
+	if device.Stamp {
+		clearStampSource(device.Name)
+	}
+	return nil
+}
+
+func (device NMEADevice) DeviceType() string {
+	return "nmea"
+}
+
+// DeviceName returns the name of the device.
+func (device NMEADevice) DeviceName() string {
+	return device.Name
+}
+
+func (device NMEADevice) AddSubscribe() error {
+	if !device.Subscribe {
+		return nil
+	}
+	for _, b := range device.Broker {
+		b.AddSubscribed(device.Name, device.QoS)
+	}
+	return nil
+}
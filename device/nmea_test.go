@@ -0,0 +1,248 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/message"
+)
+
+const (
+	testGGA = "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47"
+	testRMC = "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A"
+	testVTG = "$GPVTG,054.7,T,034.4,M,005.5,N,010.2,K*48"
+)
+
+// testNMEAConfig is the GPS receiver on /dev/ttyUSB1.
+const testNMEAConfig = `
+[device."gps"]
+    type = "nmea"
+    broker = "sango"
+    qos = 0
+    serial = "/dev/ttyUSB1"
+`
+
+func TestNewNMEADevice(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := NewNMEADevice(testDeviceArgs(t, testNMEAConfig+`
+    interval = 5
+    stamp = true
+`))
+	assert.Nil(err)
+	assert.Equal(4800, d.Baud)
+	assert.Equal(5, d.Interval)
+	assert.True(d.Stamp)
+	assert.Equal(10, d.StampExpire)
+
+	d, err = NewNMEADevice(testDeviceArgs(t, testNMEAConfig+`
+    stamp = true
+    stamp_expire = 30
+`))
+	assert.Nil(err)
+	assert.Equal(30, d.StampExpire)
+}
+
+func TestParseNMEASentence(t *testing.T) {
+	assert := assert.New(t)
+
+	fields, err := parseNMEASentence(testGGA + "\r")
+	assert.Nil(err)
+	assert.Equal("GPGGA", fields[0])
+	assert.Equal(15, len(fields))
+
+	for _, line := range []string{
+		"$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*48",
+		"$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,",
+		"GPGGA,123519*47",
+		"",
+	} {
+		_, err := parseNMEASentence(line)
+		assert.NotNil(err, line)
+	}
+}
+
+func TestNMEAFix(t *testing.T) {
+	assert := assert.New(t)
+
+	var fix nmeaFix
+	for _, line := range []string{testGGA, testRMC} {
+		fields, err := parseNMEASentence(line)
+		assert.Nil(err)
+		assert.Nil(fix.update(fields))
+	}
+	assert.True(fix.Valid)
+	assert.InDelta(48.1173, fix.Latitude, 0.0001)
+	assert.InDelta(11.5167, fix.Longitude, 0.0001)
+	assert.Equal(545.4, fix.Altitude)
+	assert.Equal(1, fix.Quality)
+	assert.Equal(8, fix.Satellites)
+	assert.Equal(0.9, fix.HDOP)
+	assert.InDelta(41.48, fix.Speed, 0.01)
+	assert.Equal(84.4, fix.Course)
+	assert.Equal("1994-03-23T12:35:19Z", fix.Time)
+
+	fields, _ := parseNMEASentence(testVTG)
+	assert.Nil(fix.update(fields))
+	assert.Equal(10.2, fix.Speed)
+	assert.Equal(54.7, fix.Course)
+
+	// no fix
+	fields, _ = parseNMEASentence("$GPRMC,123520,V,,,,,,,230394,,*39")
+	assert.Nil(fix.update(fields))
+	assert.False(fix.Valid)
+
+	lat, err := parseNMEACoordinate("3345.678", "S")
+	assert.Nil(err)
+	assert.InDelta(-33.7613, lat, 0.0001)
+	_, err = parseNMEACoordinate("3345.678", "X")
+	assert.NotNil(err)
+}
+
+func TestStampPosition(t *testing.T) {
+	assert := assert.New(t)
+
+	setStampSource("gps", time.Minute)
+	defer clearStampSource("gps")
+
+	msg := message.Message{Sender: "thermo", Body: []byte(`{"temp":21.5}`)}
+	// not stamped before the first fix
+	assert.Equal(msg, StampPosition(msg))
+
+	storePosition(nmeaFix{Latitude: 35.0, Longitude: 139.0, Altitude: 10})
+	stamped := StampPosition(msg)
+	assert.Equal(`{"temp":21.5,"position":{"latitude":35,"longitude":139,"altitude":10}}`, string(stamped.Body))
+
+	stamped = StampPosition(message.Message{Sender: "thermo", Body: []byte(" {} ")})
+	assert.Equal(`{"position":{"latitude":35,"longitude":139,"altitude":10}}`, string(stamped.Body))
+
+	for _, m := range []message.Message{
+		{Sender: "thermo", Body: []byte("21.5")},
+		{Sender: "thermo", Body: []byte(`[1, 2]`)},
+		{Sender: "thermo", Body: []byte(`{"position": "home"}`)},
+		{Sender: "gps", Body: []byte(`{"valid": true}`)},
+	} {
+		assert.Equal(m, StampPosition(m))
+	}
+}
+
+func TestStampPositionExpire(t *testing.T) {
+	assert := assert.New(t)
+
+	setStampSource("gps", time.Minute)
+	defer clearStampSource("gps")
+
+	msg := message.Message{Sender: "thermo", Body: []byte(`{"temp":21.5}`)}
+	storePosition(nmeaFix{Latitude: 35.0, Longitude: 139.0, Altitude: 10})
+	assert.NotEqual(msg, StampPosition(msg))
+
+	// the receiver lost the fix a while ago
+	positionStore.Lock()
+	positionStore.updated = time.Now().Add(-2 * time.Minute)
+	positionStore.Unlock()
+	assert.Equal(msg, StampPosition(msg))
+}
+
+func TestNMEAStopClearsPosition(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := message.Message{Sender: "thermo", Body: []byte(`{"temp":21.5}`)}
+	gps := NMEADevice{Name: "gps", Stamp: true, stop: make(chan struct{})}
+	other := NMEADevice{Name: "other", Stamp: true, stop: make(chan struct{})}
+
+	setStampSource("gps", time.Minute)
+	storePosition(nmeaFix{Latitude: 35.0, Longitude: 139.0, Altitude: 10})
+	// only the source clears the position
+	assert.Nil(other.Stop())
+	assert.NotEqual(msg, StampPosition(msg))
+
+	assert.Nil(gps.Stop())
+	assert.Equal(msg, StampPosition(msg))
+}
+
+func TestNMEALoop(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := NewNMEADevice(testDeviceArgs(t, testNMEAConfig))
+	assert.Nil(err)
+	port, receiver := net.Pipe()
+	channel := make(chan message.Message, 10)
+	go d.loop(port, channel)
+	defer d.Stop()
+
+	go func() {
+		receiver.Write([]byte(testGGA + "\r\n" + testRMC[:20]))
+		receiver.Write([]byte(testRMC[20:] + "\r\n"))
+	}()
+	select {
+	case msg := <-channel:
+		var fix nmeaFix
+		assert.Nil(json.Unmarshal(msg.Body, &fix))
+		assert.Equal("gps", msg.Sender)
+		assert.True(fix.Valid)
+		assert.Equal(545.4, fix.Altitude)
+	case <-time.After(2 * time.Second):
+		t.Fatal("nmea message timeout")
+	}
+}
+
+func TestNMEAReconnect(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := NewNMEADevice(testDeviceArgs(t, testNMEAConfig))
+	assert.Nil(err)
+	ports := make(chan [2]net.Conn, 2)
+	d.openPort = func() (io.ReadCloser, error) {
+		port, receiver := net.Pipe()
+		ports <- [2]net.Conn{port, receiver}
+		return port, nil
+	}
+	channel := make(chan message.Message, 10)
+	assert.Nil(d.Start(channel))
+	defer d.Stop()
+
+	// the port is lost, reading it fails
+	p := <-ports
+	p[0].Close()
+	select {
+	case msg := <-channel:
+		assert.Equal(message.TypeAvailability, msg.Type)
+		assert.Equal(message.Offline, string(msg.Body))
+	case <-time.After(2 * time.Second):
+		t.Fatal("offline message timeout")
+	}
+
+	// and reopened after retry_interval
+	select {
+	case p = <-ports:
+	case <-time.After(3 * time.Second):
+		t.Fatal("nmea port is not reopened")
+	}
+	go p[1].Write([]byte(testGGA + "\r\n"))
+	select {
+	case msg := <-channel:
+		assert.Equal("gps", msg.Sender)
+		assert.Contains(string(msg.Body), `"altitude":545.4`)
+	case <-time.After(2 * time.Second):
+		t.Fatal("nmea message timeout")
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	validator "gopkg.in/validator.v2"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+)
+
+const (
+	defaultOneWireRoot  = "/sys/bus/w1/devices"
+	defaultOneWireRetry = 3
+	// DS18B20 returns 85.000 until the first conversion completes
+	oneWirePowerOnValue = 85000
+)
+
+var (
+	// family codes of temperature sensors: DS18S20, DS1822, DS18B20, DS1825, DS28EA00
+	reOneWireSensor = regexp.MustCompile(`^(10|22|28|3b|42)-[0-9a-f]{12}$`)
+
+	errOneWireCRC = errors.New("crc check failed")
+)
+
+// OneWireDevice reads temperature sensors under the Linux w1 subsystem.
+type OneWireDevice struct {
+	Name       string `validate:"max=256,regexp=[^/]+,validtopic"`
+	Broker     []*broker.Broker
+	BrokerName string
+	QoS        byte   `validate:"min=0,max=2"`
+	Root       string `validate:"min=1,max=4096"`
+	Sensors    []string
+	Interval   int    `validate:"min=1"`
+	Retry      int    `validate:"min=0,max=10"`
+	Format     string `validate:"regexp=^(separate|json)$"`
+	Type       string `validate:"max=256"`
+	Retain     bool
+	Subscribe  bool
+	DeviceChan DeviceChannel // GW -> device
+
+	stop chan struct{}
+}
+
+func (device OneWireDevice) String() string {
+	return fmt.Sprintf("%#v", device)
+}
+
+// OneWireDeviceSection is [device."<name>"] of type "onewire".
+type OneWireDeviceSection struct {
+	config.DeviceSection
+	Root     string         `toml:"root"`
+	Sensors  config.List    `toml:"sensors"`
+	Interval config.Seconds `toml:"interval"`
+	Retry    int            `toml:"retry"`
+	Format   string         `toml:"format"`
+}
+
+func init() {
+	config.RegisterSection("device/onewire", OneWireDeviceSection{})
+}
+
+// NewOneWireDevice read config.ConfigSection and returnes OneWireDevice.
+// If config validation failed, return error
+func NewOneWireDevice(section config.ConfigSection, brokers []*broker.Broker, devChan DeviceChannel) (OneWireDevice, error) {
+	ret := OneWireDevice{
+		Name:       section.Name,
+		DeviceChan: devChan,
+		Root:       defaultOneWireRoot,
+		Retry:      defaultOneWireRetry,
+		Format:     "separate",
+		stop:       make(chan struct{}),
+	}
+	sc := OneWireDeviceSection{Retry: defaultOneWireRetry}
+	if err := section.Decode(&sc); err != nil {
+		return ret, err
+	}
+	if sc.Broker == "" {
+		return ret, fmt.Errorf("broker does not set")
+	}
+
+	for _, b := range brokers {
+		if b.Name == sc.Broker {
+			ret.Broker = brokers
+		}
+	}
+	if ret.Broker == nil {
+		return ret, fmt.Errorf("broker does not exists: %s", sc.Broker)
+	}
+	ret.BrokerName = sc.Broker
+
+	if _, ok := section.Values["qos"]; !ok {
+		return ret, fmt.Errorf("qos does not set")
+	}
+	ret.QoS = byte(sc.QoS)
+	if sc.Root != "" {
+		ret.Root = sc.Root
+	}
+	ret.Sensors = sc.Sensors
+	for _, s := range ret.Sensors {
+		if !reOneWireSensor.MatchString(s) {
+			return ret, fmt.Errorf("invalid sensor id, %v", s)
+		}
+	}
+	ret.Interval = int(sc.Interval)
+	ret.Retry = sc.Retry
+	if sc.Format != "" {
+		ret.Format = sc.Format
+	}
+	ret.Type = sc.Type
+	ret.Retain = sc.Retain
+	ret.Subscribe = sc.Subscribe
+
+	if err := ret.Validate(); err != nil {
+		return ret, err
+	}
+
+	return ret, nil
+}
+
+func (device *OneWireDevice) Validate() error {
+	validator := validator.NewValidator()
+	validator.SetValidationFunc("validtopic", config.ValidMqttPublishTopic)
+	if err := validator.Validate(device); err != nil {
+		return err
+	}
+	return nil
+}
+
+// discoverOneWireSensors returns IDs of temperature sensors under root.
+func discoverOneWireSensors(root string) ([]string, error) {
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	ret := []string{}
+	for _, e := range entries {
+		if reOneWireSensor.MatchString(e.Name()) {
+			ret = append(ret, e.Name())
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// readOneWireSlave parses w1_slave file and returns temperature in Celsius.
+// The first line ends with the CRC result (YES or NO) and the second line
+// holds the temperature in millidegrees, ex: "... t=23125".
+func readOneWireSlave(path string) (float64, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(dat)), "\n")
+	if len(lines) != 2 {
+		return 0, fmt.Errorf("unexpected w1_slave format, %q", dat)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(lines[0]), "YES") {
+		return 0, errOneWireCRC
+	}
+	i := strings.LastIndex(lines[1], "t=")
+	if i < 0 {
+		return 0, fmt.Errorf("temperature not found, %q", lines[1])
+	}
+	milli, err := strconv.Atoi(strings.TrimSpace(lines[1][i+2:]))
+	if err != nil {
+		return 0, err
+	}
+	if milli == oneWirePowerOnValue {
+		return 0, fmt.Errorf("power-on reset value")
+	}
+	return float64(milli) / 1000, nil
+}
+
+// read returns temperatures of the sensors. Sensors which could not be
+// read after retries are omitted.
+func (device OneWireDevice) read() map[string]float64 {
+	sensors := device.Sensors
+	if len(sensors) == 0 {
+		var err error
+		sensors, err = discoverOneWireSensors(device.Root)
+		if err != nil {
+			log.Errorf("1-wire discovery failed, %v", err)
+			return nil
+		}
+	}
+
+	ret := make(map[string]float64)
+	for _, id := range sensors {
+		// each conversion takes about 750 msec
+		select {
+		case <-device.stop:
+			return ret
+		default:
+		}
+		path := filepath.Join(device.Root, id, "w1_slave")
+		var err error
+		for i := 0; i <= device.Retry; i++ {
+			var t float64
+			t, err = readOneWireSlave(path)
+			if err == nil {
+				ret[id] = t
+				break
+			}
+		}
+		if err != nil {
+			log.Warnf("1-wire sensor %s read failed, %v", id, err)
+		}
+	}
+	return ret
+}
+
+func (device OneWireDevice) newMessages(temps map[string]float64) []message.Message {
+	msgs := []message.Message{}
+	if len(temps) == 0 {
+		return msgs
+	}
+
+	msg := message.Message{
+		Sender:     device.Name,
+		Type:       device.Type,
+		QoS:        device.QoS,
+		Retained:   device.Retain,
+		BrokerName: device.BrokerName,
+	}
+	if device.Format == "json" {
+		body, err := json.Marshal(temps)
+		if err != nil {
+			log.Errorf("json encode error %s", err)
+			return msgs
+		}
+		msg.Body = body
+		return append(msgs, msg)
+	}
+
+	ids := make([]string, 0, len(temps))
+	for id := range temps {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		m := msg
+		m.Type = id
+		m.Body = []byte(strconv.FormatFloat(temps[id], 'f', -1, 64))
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+func (device OneWireDevice) Start(channel chan message.Message) error {
+	log.Info("start 1-wire device")
+	go func() {
+		ticker := time.NewTicker(time.Duration(device.Interval) * time.Second)
+		defer ticker.Stop()
+
+		// sensors are read in another goroutine not to block the
+		// device channel and stop
+		results := make(chan map[string]float64, 1)
+		reading := false
+		for {
+			select {
+			case <-ticker.C:
+				if reading {
+					log.Warnf("1-wire read is slower than interval, skipped: %v", device.Name)
+					continue
+				}
+				reading = true
+				go func() {
+					results <- device.read()
+				}()
+			case temps := <-results:
+				reading = false
+				for _, msg := range device.newMessages(temps) {
+					select {
+					case channel <- msg:
+					case <-device.stop:
+						return
+					}
+				}
+			case msg, _ := <-device.DeviceChan.Chan:
+				log.Debugf("msg reached to 1-wire device, ignored, %v", msg)
+			case <-device.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (device OneWireDevice) Stop() error {
+	log.Infof("closing 1-wire: %v", device.Name)
+	select {
+	case <-device.stop:
+	default:
+		close(device.stop)
+	}
+	return nil
+}
+
+func (device OneWireDevice) DeviceType() string {
+	return "onewire"
+}
+
+// DeviceName returns the name of the device.
+func (device OneWireDevice) DeviceName() string {
+	return device.Name
+}
+
+func (device OneWireDevice) AddSubscribe() error {
+	if !device.Subscribe {
+		return nil
+	}
+	for _, b := range device.Broker {
+		b.AddSubscribed(device.Name, device.QoS)
+	}
+	return nil
+}
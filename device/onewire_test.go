@@ -0,0 +1,163 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+)
+
+// newFakeOneWireRoot creates fake /sys/bus/w1/devices tree.
+func newFakeOneWireRoot(t *testing.T, slaves map[string]string) string {
+	root, err := ioutil.TempDir("", "fuji-w1")
+	assert.Nil(t, err)
+	// bus master is not a sensor
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "w1_bus_master1"), 0755))
+	for id, content := range slaves {
+		assert.Nil(t, os.MkdirAll(filepath.Join(root, id), 0755))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(root, id, "w1_slave"), []byte(content), 0644))
+	}
+	return root
+}
+
+// testOneWireConfig is the device without root, which is the fake
+// sysfs directory made by the test.
+const testOneWireConfig = `
+[device."coldchain"]
+    type = "onewire"
+    broker = "sango"
+    qos = 0
+    interval = 30
+`
+
+func TestNewOneWireDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[device."coldchain"]
+    type = "onewire"
+    broker = "sango"
+    qos = 0
+    interval = 30
+    sensors = "28-000005e2fdc3, 28-000005e2fdc4"
+    format = "json"
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+	d, err := NewOneWireDevice(conf.Sections[0], brokers, NewDeviceChannel())
+	assert.Nil(err)
+	assert.Equal("/sys/bus/w1/devices", d.Root)
+	assert.Equal([]string{"28-000005e2fdc3", "28-000005e2fdc4"}, d.Sensors)
+	assert.Equal(30, d.Interval)
+	assert.Equal(3, d.Retry)
+	assert.Equal("json", d.Format)
+
+	section := conf.Sections[0]
+	section.Values["sensors"] = "28-xyz"
+	_, err = NewOneWireDevice(section, brokers, NewDeviceChannel())
+	assert.NotNil(err)
+}
+
+func TestReadOneWireSlave(t *testing.T) {
+	assert := assert.New(t)
+
+	root := newFakeOneWireRoot(t, map[string]string{
+		"28-000005e2fdc3": "72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n72 01 4b 46 7f ff 0e 10 57 t=23125\n",
+		"28-000005e2fdc4": "72 01 4b 46 7f ff 0e 10 57 : crc=00 NO\n72 01 4b 46 7f ff 0e 10 57 t=23125\n",
+		"28-000005e2fdc5": "50 05 4b 46 7f ff 0c 10 1c : crc=1c YES\n50 05 4b 46 7f ff 0c 10 1c t=85000\n",
+		"28-000005e2fdc6": "5e ff 4b 46 7f ff 02 10 e7 : crc=e7 YES\n5e ff 4b 46 7f ff 02 10 e7 t=-10125\n",
+	})
+	defer os.RemoveAll(root)
+
+	v, err := readOneWireSlave(filepath.Join(root, "28-000005e2fdc3", "w1_slave"))
+	assert.Nil(err)
+	assert.Equal(23.125, v)
+
+	_, err = readOneWireSlave(filepath.Join(root, "28-000005e2fdc4", "w1_slave"))
+	assert.Equal(errOneWireCRC, err)
+
+	_, err = readOneWireSlave(filepath.Join(root, "28-000005e2fdc5", "w1_slave"))
+	assert.NotNil(err)
+
+	v, err = readOneWireSlave(filepath.Join(root, "28-000005e2fdc6", "w1_slave"))
+	assert.Nil(err)
+	assert.Equal(-10.125, v)
+
+	ids, err := discoverOneWireSensors(root)
+	assert.Nil(err)
+	assert.Equal([]string{"28-000005e2fdc3", "28-000005e2fdc4", "28-000005e2fdc5", "28-000005e2fdc6"}, ids)
+}
+
+func TestOneWireMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	root := newFakeOneWireRoot(t, map[string]string{
+		"28-000005e2fdc3": "72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n72 01 4b 46 7f ff 0e 10 57 t=23125\n",
+		"10-000802b4c1a2": "2d 00 4b 46 ff ff 0c 10 7f : crc=7f YES\n2d 00 4b 46 ff ff 0c 10 7f t=22500\n",
+		"28-000005e2fdc4": "72 01 4b 46 7f ff 0e 10 57 : crc=00 NO\n72 01 4b 46 7f ff 0e 10 57 t=23125\n",
+	})
+	defer os.RemoveAll(root)
+
+	d, err := NewOneWireDevice(testDeviceArgs(t, testOneWireConfig+`
+    root = "`+root+`"
+`))
+	assert.Nil(err)
+	msgs := d.newMessages(d.read())
+	assert.Equal(2, len(msgs))
+	assert.Equal("10-000802b4c1a2", msgs[0].Type)
+	assert.Equal("22.5", string(msgs[0].Body))
+	assert.Equal("28-000005e2fdc3", msgs[1].Type)
+	assert.Equal("23.125", string(msgs[1].Body))
+	assert.Equal("coldchain", msgs[1].Sender)
+
+	d, err = NewOneWireDevice(testDeviceArgs(t, testOneWireConfig+`
+    root = "`+root+`"
+    format = "json"
+    sensors = "28-000005e2fdc3"
+`))
+	assert.Nil(err)
+	msgs = d.newMessages(d.read())
+	assert.Equal(1, len(msgs))
+	assert.Equal("onewire", msgs[0].Type)
+	assert.Equal(`{"28-000005e2fdc3":23.125}`, string(msgs[0].Body))
+}
+
+func TestOneWireReadStopped(t *testing.T) {
+	assert := assert.New(t)
+
+	root := newFakeOneWireRoot(t, map[string]string{
+		"28-000005e2fdc3": "72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n72 01 4b 46 7f ff 0e 10 57 t=23125\n",
+	})
+	defer os.RemoveAll(root)
+
+	d, err := NewOneWireDevice(testDeviceArgs(t, testOneWireConfig+`
+    root = "`+root+`"
+`))
+	assert.Nil(err)
+	assert.Equal(1, len(d.read()))
+
+	// sensors are not read after the device is stopped
+	assert.Nil(d.Stop())
+	assert.Equal(0, len(d.read()))
+}
@@ -15,35 +15,127 @@
 package device
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
-	"strconv"
+	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	serial "github.com/tarm/serial"
 	validator "gopkg.in/validator.v2"
 
 	"github.com/shiguredo/fuji/broker"
 	"github.com/shiguredo/fuji/config"
 	"github.com/shiguredo/fuji/message"
+	"github.com/shiguredo/fuji/utils"
 )
 
+const (
+	defaultSerialRetryInterval    = 1  // sec
+	defaultSerialMaxRetryInterval = 60 // sec
+	defaultSerialStatusType       = "status"
+	defaultSerialTimeout          = 500 // msec, shorter than the default interval
+
+	// maxSerialFrame is the max length of a frame waiting the terminator.
+	maxSerialFrame = 4096
+
+	// serialCheckInterval is the interval to check the device node
+	// still exists while nothing is read.
+	serialCheckInterval = time.Second
+)
+
+// SerialParams is the line settings of the serial port other than baud.
+type SerialParams struct {
+	DataBits         int    `validate:"min=5,max=8"`
+	Parity           string `validate:"regexp=^(none|odd|even)$"`
+	StopBits         int    `validate:"min=1,max=2"`
+	RTSCTS           bool
+	RS485            bool
+	RS485DelayBefore int `validate:"min=0,max=1000"` // msec
+	RS485DelayAfter  int `validate:"min=0,max=1000"` // msec
+}
+
+// defaultSerialParams is 8N1 without flow control.
+var defaultSerialParams = SerialParams{DataBits: 8, Parity: "none", StopBits: 1}
+
+// parseSerialParams reads line settings of the serial port.
+// ex:
+//   data_bits = 7
+//   parity = "even"
+//   stop_bits = 1
+//   flow_control = "rtscts"
+//   rs485 = true
+func parseSerialParams(sc SerialDeviceSection) (SerialParams, error) {
+	ret := defaultSerialParams
+	if sc.DataBits != 0 {
+		ret.DataBits = sc.DataBits
+	}
+	if sc.StopBits != 0 {
+		ret.StopBits = sc.StopBits
+	}
+	ret.RS485DelayBefore = int(sc.RS485DelayBefore)
+	ret.RS485DelayAfter = int(sc.RS485DelayAfter)
+	if sc.Parity != "" {
+		ret.Parity = strings.ToLower(sc.Parity)
+	}
+	switch sc.FlowControl {
+	case "", "none":
+	case "rtscts":
+		ret.RTSCTS = true
+	default:
+		return ret, fmt.Errorf("invalid flow_control, %v", sc.FlowControl)
+	}
+	ret.RS485 = sc.RS485
+	if ret.RS485 && ret.RTSCTS {
+		// RTS is used for the direction of RS-485
+		return ret, fmt.Errorf("rs485 and rtscts flow control could not be set at the same time")
+	}
+	return ret, nil
+}
+
 type SerialDevice struct {
-	Name       string `validate:"max=256,regexp=[^/]+,validtopic"`
-	Broker     []*broker.Broker
-	BrokerName string
-	QoS        byte `validate:"min=0,max=2"`
-	InputPort  InputPortType
-	Serial     string `validate:"max=256"`
-	Baud       int    `validate:"min=0"`
-	Size       int    `validate:"min=0,max=256"`
-	Type       string `validate:"max=256"`
-	Interval   int    `validate:"min=0"`
-	Retain     bool
-	Subscribe  bool
-	DeviceChan DeviceChannel // GW -> device
+	Name             string `validate:"max=256,regexp=[^/]+,validtopic"`
+	Broker           []*broker.Broker
+	BrokerName       string
+	QoS              byte `validate:"min=0,max=2"`
+	InputPort        InputPortType
+	Serial           string `validate:"max=256"`
+	USB              USBMatch
+	Params           SerialParams
+	Baud             int    `validate:"min=0"`
+	Size             int    `validate:"min=0,max=256"`
+	Type             string `validate:"max=256"`
+	Interval         int    `validate:"min=0"`
+	Query            []byte `validate:"max=4096"`
+	Terminator       []byte `validate:"max=16"`
+	Timeout          int    `validate:"min=1"` // msec
+	Command          SerialCommand
+	RetryInterval    int    `validate:"min=1"`
+	MaxRetryInterval int    `validate:"min=1"`
+	StatusType       string `validate:"max=256,validtopic"`
+	Retain           bool
+	Subscribe        bool
+	DeviceChan       DeviceChannel // GW -> device
+
+	openPort func(name string) (io.ReadWriteCloser, error) // replaced in tests
+	timeouts *uint64                                       // number of queries without response
+	calls    chan serialCall                               // RPC -> serve
+	stop     chan struct{}
+}
+
+// serialCall is the RPC request written to the port. The reply or
+// error is always sent to reply.
+type serialCall struct {
+	data  []byte
+	reply chan serialReply
+}
+
+type serialReply struct {
+	data []byte
+	err  error
 }
 
 func (device SerialDevice) String() string {
@@ -54,66 +146,141 @@ func (device SerialDevice) String() string {
 	return fmt.Sprintf("%#v", device)
 }
 
+// SerialDeviceSection is [device."<name>"] of type "serial".
+type SerialDeviceSection struct {
+	config.DeviceSection
+	Serial           string         `toml:"serial"`
+	Baud             int            `toml:"baud"`
+	Size             int            `toml:"size"`
+	Interval         config.Seconds `toml:"interval"`
+	Query            string         `toml:"query"`
+	Terminator       string         `toml:"terminator"`
+	Timeout          config.Millis  `toml:"timeout"`
+	RetryInterval    config.Seconds `toml:"retry_interval"`
+	MaxRetryInterval config.Seconds `toml:"max_retry_interval"`
+	StatusType       string         `toml:"status_type"`
+	USBVendor        string         `toml:"usb_vendor"`
+	USBProduct       string         `toml:"usb_product"`
+	USBSerial        string         `toml:"usb_serial"`
+	DataBits         int            `toml:"data_bits"`
+	Parity           string         `toml:"parity"`
+	StopBits         int            `toml:"stop_bits"`
+	FlowControl      string         `toml:"flow_control"`
+	RS485            bool           `toml:"rs485"`
+	RS485DelayBefore config.Millis  `toml:"rs485_delay_before"`
+	RS485DelayAfter  config.Millis  `toml:"rs485_delay_after"`
+	WriteEncoding    string         `toml:"write_encoding"`
+	WriteField       string         `toml:"write_field"`
+	WriteTerminator  string         `toml:"write_terminator"`
+	WriteChecksum    string         `toml:"write_checksum"`
+	ReplyTimeout     config.Millis  `toml:"reply_timeout"`
+	ReplyType        string         `toml:"reply_type"`
+}
+
+func init() {
+	config.RegisterSection("device/serial", SerialDeviceSection{})
+}
+
 // NewSerialDevice read config.ConfigSection and returnes SerialDevice.
 // If config validation failed, return error
 func NewSerialDevice(section config.ConfigSection, brokers []*broker.Broker, devChan DeviceChannel) (SerialDevice, error) {
 	ret := SerialDevice{
-		Name:       section.Name,
-		DeviceChan: devChan,
-		Interval:   1,
+		Name:             section.Name,
+		DeviceChan:       devChan,
+		Interval:         1,
+		RetryInterval:    defaultSerialRetryInterval,
+		MaxRetryInterval: defaultSerialMaxRetryInterval,
+		StatusType:       defaultSerialStatusType,
+		Timeout:          defaultSerialTimeout,
+		timeouts:         new(uint64),
+		calls:            make(chan serialCall),
+		stop:             make(chan struct{}),
+	}
+	sc := SerialDeviceSection{
+		Interval:         1,
+		Timeout:          defaultSerialTimeout,
+		RetryInterval:    defaultSerialRetryInterval,
+		MaxRetryInterval: defaultSerialMaxRetryInterval,
+		StatusType:       defaultSerialStatusType,
 	}
-	values := section.Values
-	bname, ok := section.Values["broker"]
-	if !ok {
+	if err := section.Decode(&sc); err != nil {
+		return ret, err
+	}
+	if sc.Broker == "" {
 		return ret, fmt.Errorf("broker does not set")
 	}
 
 	for _, b := range brokers {
-		if b.Name == bname {
+		if b.Name == sc.Broker {
 			ret.Broker = brokers
 		}
 	}
 	if ret.Broker == nil {
-		return ret, fmt.Errorf("broker does not exists: %s", bname)
+		return ret, fmt.Errorf("broker does not exists: %s", sc.Broker)
 	}
-	ret.BrokerName = bname
+	ret.BrokerName = sc.Broker
 
-	qos, err := strconv.Atoi(values["qos"])
-	if err != nil {
-		return ret, err
-	} else {
-		ret.QoS = byte(qos)
+	if _, ok := section.Values["qos"]; !ok {
+		return ret, fmt.Errorf("qos does not set")
 	}
+	ret.QoS = byte(sc.QoS)
 	// TODO: check it is true or not
 	// ret.InputPort = InputPortType(INPUT_PORT_SERIAL)
 	ret.InputPort = InputPortType(INPUT_PORT_DUMMY)
-	ret.Serial = values["serial"]
-	baud, err := strconv.Atoi(values["baud"])
+	ret.Serial = sc.Serial
+	ret.USB = USBMatch{
+		Vendor:  sc.USBVendor,
+		Product: sc.USBProduct,
+		Serial:  sc.USBSerial,
+	}
+	if ret.Serial == "" && ret.USB.IsZero() {
+		return ret, fmt.Errorf("serial or usb_vendor/usb_product/usb_serial must be set")
+	}
+	if _, ok := section.Values["baud"]; !ok {
+		return ret, fmt.Errorf("baud does not set")
+	}
+	ret.Baud = sc.Baud
+	ret.Size = sc.Size
+
+	var err error
+	ret.Params, err = parseSerialParams(sc)
 	if err != nil {
 		return ret, err
-	} else {
-		ret.Baud = int(baud)
 	}
-	if values["size"] == "" {
-		ret.Size = 0
-	} else {
-		sizev, err := strconv.Atoi(values["size"])
+	ret.Command, err = parseSerialCommand(sc)
+	if err != nil {
+		return ret, err
+	}
+	if sc.Terminator != "" {
+		if ret.Size > 0 {
+			return ret, fmt.Errorf("size and terminator could not be set at the same time")
+		}
+		ret.Terminator, err = utils.ParsePayload(sc.Terminator)
 		if err != nil {
-			return ret, err
-		} else {
-			ret.Size = int(sizev)
+			return ret, fmt.Errorf("terminator parse failed, %v", err)
 		}
 	}
-	ret.Type = values["type"]
-	ret.Retain = false
-	if values["retain"] == "true" {
-		ret.Retain = true
+	// polling mode
+	if sc.Query != "" {
+		ret.Query, err = utils.ParsePayload(sc.Query)
+		if err != nil {
+			return ret, fmt.Errorf("query parse failed, %v", err)
+		}
 	}
-
-	sub, ok := values["subscribe"]
-	if ok && sub == "true" {
-		ret.Subscribe = true
+	ret.Interval = int(sc.Interval)
+	ret.Timeout = int(sc.Timeout)
+	if ret.Query != nil && (ret.Interval < 1 || ret.Timeout >= ret.Interval*1000) {
+		return ret, fmt.Errorf("timeout must be shorter than interval, timeout: %d msec, interval: %d sec", ret.Timeout, ret.Interval)
 	}
+	ret.RetryInterval = int(sc.RetryInterval)
+	ret.MaxRetryInterval = int(sc.MaxRetryInterval)
+	if ret.MaxRetryInterval < ret.RetryInterval {
+		ret.MaxRetryInterval = ret.RetryInterval
+	}
+	ret.StatusType = sc.StatusType
+	ret.Type = sc.Type
+	ret.Retain = sc.Retain
+	ret.Subscribe = sc.Subscribe
 
 	if err := ret.Validate(); err != nil {
 		return ret, err
@@ -131,7 +298,7 @@ func (device *SerialDevice) Validate() error {
 	return nil
 }
 
-func readSizedSerialPortLoop(bufSize int, port *serial.Port, readpipe chan []byte) error {
+func readSizedSerialPortLoop(bufSize int, port io.Reader, readpipe chan []byte, done chan struct{}) error {
 	readBuf := make([]byte, 512)
 	var sumBuf = []byte{}
 	var renewBuf = []byte{}
@@ -143,7 +310,7 @@ func readSizedSerialPortLoop(bufSize int, port *serial.Port, readpipe chan []byt
 			continue
 		}
 		if err != nil {
-			return fmt.Errorf("cannnot open serial port: serialPort: %v, Error: %v", port, err)
+			return fmt.Errorf("serial port read failed, %v", err)
 		}
 		if num > 0 {
 			log.Debugf("readBuf: %v, len: %v", readBuf, len(readBuf))
@@ -152,7 +319,11 @@ func readSizedSerialPortLoop(bufSize int, port *serial.Port, readpipe chan []byt
 			}
 			for len(sumBuf) >= bufSize {
 				sendBuf = sumBuf[:bufSize]
-				readpipe <- sendBuf
+				select {
+				case readpipe <- sendBuf:
+				case <-done:
+					return nil
+				}
 
 				// Truncate sumBuf by Size
 				log.Debugf("sumBuf: %v, len: %v", sumBuf, len(sumBuf))
@@ -167,21 +338,23 @@ func readSizedSerialPortLoop(bufSize int, port *serial.Port, readpipe chan []byt
 	}
 }
 
-func readFreesizedSerialPortLoop(port *serial.Port, readpipe chan []byte) error {
+func readFreesizedSerialPortLoop(port io.Reader, readpipe chan []byte, done chan struct{}) error {
 	readBuf := make([]byte, 256)
 	var sumBuf = []byte{}
 
 	readPointer := 0
 
-	defer port.Close()
-
 	for {
 		num, err := port.Read(readBuf)
 		if err == io.EOF {
 			// No more data comes
 			if readPointer > 0 {
 				log.Debugf("read data to send: %v", sumBuf)
-				readpipe <- sumBuf
+				select {
+				case readpipe <- sumBuf:
+				case <-done:
+					return nil
+				}
 				readPointer = 0
 				sumBuf = []byte{}
 				log.Debugf("sumBuf cleared: %v", sumBuf)
@@ -189,7 +362,7 @@ func readFreesizedSerialPortLoop(port *serial.Port, readpipe chan []byte) error
 			continue
 		}
 		if err != nil {
-			return fmt.Errorf("cannnot open serial port: serialPort: %v, Error: %v", port, err)
+			return fmt.Errorf("serial port read failed, %v", err)
 		}
 		if num > 0 {
 			readPointer += num
@@ -202,61 +375,402 @@ func readFreesizedSerialPortLoop(port *serial.Port, readpipe chan []byte) error
 	}
 }
 
-func (device SerialDevice) Start(channel chan message.Message) error {
-	serialConfig := &serial.Config{Name: device.Serial, Baud: device.Baud, ReadTimeout: time.Millisecond * 50}
-	serialPort, err := serial.OpenPort(serialConfig)
-	if err != nil {
-		return fmt.Errorf("serial device start failed, serialConfig: %v, serialPort: %v, Error: %v", serialConfig, serialPort, err)
+// readTerminatedSerialPortLoop sends frames which end with term. The
+// terminator is removed from the frame.
+func readTerminatedSerialPortLoop(term []byte, port io.Reader, readpipe chan []byte, done chan struct{}) error {
+	readBuf := make([]byte, 256)
+	var sumBuf []byte
+
+	for {
+		num, err := port.Read(readBuf)
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("serial port read failed, %v", err)
+		}
+		sumBuf = append(sumBuf, readBuf[:num]...)
+		for {
+			i := bytes.Index(sumBuf, term)
+			if i < 0 {
+				break
+			}
+			frame := make([]byte, i)
+			copy(frame, sumBuf[:i])
+			sumBuf = sumBuf[i+len(term):]
+			select {
+			case readpipe <- frame:
+			case <-done:
+				return nil
+			}
+		}
+		if len(sumBuf) > maxSerialFrame {
+			log.Warnf("terminator not found in %d bytes, discarded", len(sumBuf))
+			sumBuf = nil
+		}
 	}
+}
 
-	readPipe := make(chan []byte)
+// serialWatcher detects loss of the port. Some drivers keep returning
+// io.EOF after the adapter is unplugged, so the device node is checked
+// while nothing is read.
+type serialWatcher struct {
+	io.ReadWriteCloser
+	path    string
+	checked time.Time
+}
 
-	if device.Size > 0 {
-		go readSizedSerialPortLoop(device.Size, serialPort, readPipe)
+func (w *serialWatcher) Read(b []byte) (int, error) {
+	n, err := w.ReadWriteCloser.Read(b)
+	if err == io.EOF && time.Since(w.checked) >= serialCheckInterval {
+		w.checked = time.Now()
+		if _, serr := os.Stat(w.path); serr != nil {
+			return n, fmt.Errorf("serial port disappeared, %v", w.path)
+		}
+	}
+	return n, err
+}
+
+// portName returns the device node to open.
+func (device SerialDevice) portName() (string, error) {
+	if device.USB.IsZero() {
+		return device.Serial, nil
+	}
+	return findUSBSerialPort(device.USB)
+}
+
+// open resolves and opens the port.
+func (device SerialDevice) open() (io.ReadWriteCloser, string, error) {
+	name, err := device.portName()
+	if err != nil {
+		return nil, "", err
+	}
+	var port io.ReadWriteCloser
+	if device.openPort != nil {
+		port, err = device.openPort(name)
 	} else {
-		go readFreesizedSerialPortLoop(serialPort, readPipe)
+		port, err = openSerialPort(name, device.Baud, device.Params)
+	}
+	if err != nil {
+		return nil, name, err
+	}
+	return &serialWatcher{ReadWriteCloser: port, path: name}, name, nil
+}
+
+// statusMessage returns the message which notifies the port state.
+func (device SerialDevice) statusMessage(state, port string, cause error) message.Message {
+	body := fmt.Sprintf(`{"status":%q,"port":%q}`, state, port)
+	if cause != nil {
+		body = fmt.Sprintf(`{"status":%q,"port":%q,"error":%q}`, state, port, cause.Error())
+	}
+	return message.Message{
+		Sender:     device.Name,
+		Type:       device.StatusType,
+		QoS:        device.QoS,
+		Retained:   device.Retain,
+		BrokerName: device.BrokerName,
+		Body:       []byte(body),
 	}
+}
 
-	log.Info("start serial device")
+// timeoutMessage returns the message which notifies the query timeout.
+func (device SerialDevice) timeoutMessage(timeouts uint64) message.Message {
+	return message.Message{
+		Sender:     device.Name,
+		Type:       device.StatusType,
+		QoS:        device.QoS,
+		Retained:   device.Retain,
+		BrokerName: device.BrokerName,
+		Body:       []byte(fmt.Sprintf(`{"status":"timeout","timeouts":%d}`, timeouts)),
+	}
+}
 
-	writeBuf := make([]byte, 256)
-	msgBuf := make([]byte, 256)
+// replyMessage returns the message of the reply to the command.
+func (device SerialDevice) replyMessage(id interface{}, data []byte, cause error) message.Message {
+	return message.Message{
+		Sender:     device.Name,
+		Type:       device.Command.ReplyType,
+		QoS:        device.QoS,
+		Retained:   false,
+		BrokerName: device.BrokerName,
+		Body:       device.Command.reply(id, data, cause),
+	}
+}
 
-	go func() error {
-		for {
-			select {
-			case msgBuf = <-readPipe:
-				log.Debugf("msgBuf to send: %v", msgBuf)
-				msg := message.Message{
-					Sender:     device.Name,
-					Type:       device.Type,
-					QoS:        device.QoS,
-					Retained:   device.Retain,
-					BrokerName: device.BrokerName,
-					Body:       msgBuf,
+// callTimeout returns how long RPC waits the reply.
+func (device SerialDevice) callTimeout() time.Duration {
+	if device.Command.ReplyTimeout > 0 {
+		return time.Duration(device.Command.ReplyTimeout) * time.Millisecond
+	}
+	return time.Duration(device.Timeout) * time.Millisecond
+}
+
+// DeviceName returns the name of the device.
+func (device SerialDevice) DeviceName() string {
+	return device.Name
+}
+
+// Call handles RPC request.
+// methods:
+//   ping: returns "pong"
+//   status: returns the number of query timeouts
+//   write: writes params.data in \x.. syntax and returns the reply
+func (device SerialDevice) Call(req message.Request) (interface{}, error) {
+	switch req.Method {
+	case "ping":
+		return "pong", nil
+	case "status":
+		return map[string]interface{}{"timeouts": device.Timeouts()}, nil
+	case "write":
+		var params struct {
+			Data string `json:"data"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, fmt.Errorf("invalid params, %v", err)
+		}
+		data, err := utils.ParsePayload(params.Data)
+		if err != nil {
+			return nil, err
+		}
+		c := serialCall{data: data, reply: make(chan serialReply, 1)}
+		select {
+		case device.calls <- c:
+		case <-time.After(device.callTimeout()):
+			return nil, fmt.Errorf("serial port is not opened")
+		}
+		r := <-c.reply
+		if r.err != nil {
+			return nil, r.err
+		}
+		return map[string]string{"data": device.Command.encode(r.data)}, nil
+	}
+	return nil, message.ErrUnknownMethod
+}
+
+// Timeouts returns the number of queries which got no response.
+func (device SerialDevice) Timeouts() uint64 {
+	return atomic.LoadUint64(device.timeouts)
+}
+
+// wait waits d while discarding messages to the device. It returns false
+// if the device is stopped.
+func (device SerialDevice) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case msg, _ := <-device.DeviceChan.Chan:
+			if subscribedTo(msg, device.Name) {
+				log.Warnf("serial port is not opened, msg discarded: %v", device.Name)
+			}
+		case <-device.stop:
+			return false
+		}
+	}
+}
+
+// supervise opens the port and serves it. The port is reopened with
+// backoff when it is lost until the device is stopped.
+func (device SerialDevice) supervise(channel chan message.Message) {
+	backoff := time.Duration(device.RetryInterval) * time.Second
+	maxBackoff := time.Duration(device.MaxRetryInterval) * time.Second
+	wait := backoff
+	for {
+		port, name, err := device.open()
+		if err != nil {
+			log.Warnf("serial port open failed, retry after %v, %v", wait, err)
+			if !device.wait(wait) {
+				return
+			}
+			wait *= 2
+			if wait > maxBackoff {
+				wait = maxBackoff
+			}
+			continue
+		}
+		wait = backoff
+
+		log.Infof("serial port opened: %v", name)
+		channel <- device.statusMessage("connected", name, nil)
+		err = device.serve(port, channel)
+		port.Close()
+		if err == nil {
+			return
+		}
+		log.Errorf("serial port lost: %v, %v", name, err)
+		channel <- device.statusMessage("disconnected", name, err)
+		channel <- offlineMessage(device.Name, device.BrokerName)
+	}
+}
+
+// serve reads from and writes to the port. It returns nil if the device
+// is stopped, or error if the port is lost.
+func (device SerialDevice) serve(port io.ReadWriter, channel chan message.Message) error {
+	readPipe := make(chan []byte)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		switch {
+		case device.Size > 0:
+			readErr <- readSizedSerialPortLoop(device.Size, port, readPipe, done)
+		case device.Terminator != nil:
+			readErr <- readTerminatedSerialPortLoop(device.Terminator, port, readPipe, done)
+		default:
+			readErr <- readFreesizedSerialPortLoop(port, readPipe, done)
+		}
+	}()
+
+	// polling mode sends the query every interval and waits the response
+	var tick, timeout <-chan time.Time
+	awaiting := false
+	// the reply of the command is waited if reply_timeout is set
+	var replyTimeout <-chan time.Time
+	var replyID interface{}
+	var replyCall chan serialReply // reply is returned to RPC if set
+	replying := false
+	defer func() {
+		if replyCall != nil {
+			replyCall <- serialReply{err: fmt.Errorf("serial port closed")}
+		}
+	}()
+
+	poll := func() error {
+		if awaiting || replying {
+			return nil
+		}
+		if _, err := port.Write(device.Query); err != nil {
+			return err
+		}
+		awaiting = true
+		timeout = time.After(time.Duration(device.Timeout) * time.Millisecond)
+		return nil
+	}
+	if device.Query != nil {
+		ticker := time.NewTicker(time.Duration(device.Interval) * time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+		if err := poll(); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-tick:
+			if err := poll(); err != nil {
+				return err
+			}
+		case <-timeout:
+			awaiting = false
+			timeout = nil
+			n := atomic.AddUint64(device.timeouts, 1)
+			log.Warnf("serial query timeout: %v, %d times", device.Name, n)
+			channel <- device.timeoutMessage(n)
+		case <-replyTimeout:
+			replying = false
+			replyTimeout = nil
+			log.Warnf("serial reply timeout: %v", device.Name)
+			if replyCall != nil {
+				replyCall <- serialReply{err: errSerialReplyTimeout}
+				replyCall = nil
+				continue
+			}
+			channel <- device.replyMessage(replyID, nil, errSerialReplyTimeout)
+		case msgBuf := <-readPipe:
+			if replying {
+				replying = false
+				replyTimeout = nil
+				if replyCall != nil {
+					replyCall <- serialReply{data: msgBuf}
+					replyCall = nil
+					continue
 				}
-				channel <- msg
-			case msg, _ := <-device.DeviceChan.Chan:
-				log.Infof("msg topic:, %v / %v", msg.Topic, device.Name)
-				if !strings.HasSuffix(msg.Topic, device.Name) {
+				channel <- device.replyMessage(replyID, msgBuf, nil)
+				continue
+			}
+			if device.Query != nil {
+				if !awaiting {
+					log.Debugf("unexpected response discarded: %v", msgBuf)
 					continue
 				}
-				log.Infof("msg reached to device, %v", msg)
-				writeBuf = msg.Body
-				num, err := serialPort.Write(writeBuf)
-				if err != nil {
-					log.Error(err)
-					return err
+				awaiting = false
+				timeout = nil
+			}
+			log.Debugf("msgBuf to send: %v", msgBuf)
+			msg := message.Message{
+				Sender:     device.Name,
+				Type:       device.Type,
+				QoS:        device.QoS,
+				Retained:   device.Retain,
+				BrokerName: device.BrokerName,
+				Body:       msgBuf,
+			}
+			channel <- msg
+		case err := <-readErr:
+			return err
+		case c := <-device.calls:
+			if replying || awaiting {
+				c.reply <- serialReply{err: errSerialBusy}
+				continue
+			}
+			if _, err := port.Write(device.Command.frame(c.data)); err != nil {
+				c.reply <- serialReply{err: err}
+				return err
+			}
+			replying = true
+			replyCall = c.reply
+			replyTimeout = time.After(device.callTimeout())
+		case msg, _ := <-device.DeviceChan.Chan:
+			if !subscribedTo(msg, device.Name) {
+				continue
+			}
+			log.Infof("msg reached to device, %v", msg)
+			data, id, err := device.Command.decode(msg.Body)
+			// like RPC, the response of the query must not be taken
+			// as the reply
+			if err == nil && (replying || awaiting) {
+				err = errSerialBusy
+			}
+			if err != nil {
+				log.Warnf("serial command discarded, %v", err)
+				if device.Command.ReplyTimeout > 0 {
+					channel <- device.replyMessage(id, nil, err)
 				}
-				log.Infof("written length: %d", num)
+				continue
 			}
+			num, err := port.Write(device.Command.frame(data))
+			if err != nil {
+				return err
+			}
+			log.Infof("written length: %d", num)
+			if device.Command.ReplyTimeout > 0 {
+				replying = true
+				replyID = id
+				replyTimeout = time.After(time.Duration(device.Command.ReplyTimeout) * time.Millisecond)
+			}
+		case <-device.stop:
+			return nil
 		}
-	}()
+	}
+}
+
+func (device SerialDevice) Start(channel chan message.Message) error {
+	log.Info("start serial device")
+	go device.supervise(channel)
 	return nil
 }
 
 func (device SerialDevice) Stop() error {
 	log.Infof("closing serial: %v", device.Name)
+	select {
+	case <-device.stop:
+	default:
+		close(device.stop)
+	}
 	return nil
 }
 
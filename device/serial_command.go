@@ -0,0 +1,180 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/shiguredo/fuji/utils"
+)
+
+const (
+	defaultSerialReplyType   = "response"
+	defaultSerialWriteField  = "data"
+	defaultSerialWriteEncode = "raw"
+)
+
+var (
+	errSerialReplyTimeout = errors.New("reply timeout")
+	errSerialBusy         = errors.New("waiting reply of the previous query or command")
+)
+
+// SerialCommand is how subscribed messages are written to the serial port.
+type SerialCommand struct {
+	Encoding     string `validate:"regexp=^(raw|hex|base64|escape|json)$"`
+	Field        string `validate:"max=256"`
+	Terminator   []byte `validate:"max=16"`
+	Checksum     string `validate:"regexp=^(none|sum8|xor8|crc16)$"`
+	ReplyTimeout int    `validate:"min=0"` // msec, 0 does not wait reply
+	ReplyType    string `validate:"max=256,validtopic"`
+}
+
+// parseSerialCommand reads write settings of the serial device.
+// ex:
+//   write_encoding = "json"
+//   write_checksum = "crc16"
+//   write_terminator = "\r\n"
+//   reply_timeout = 500
+func parseSerialCommand(sc SerialDeviceSection) (SerialCommand, error) {
+	ret := SerialCommand{
+		Encoding:     defaultSerialWriteEncode,
+		Field:        defaultSerialWriteField,
+		Checksum:     "none",
+		ReplyTimeout: int(sc.ReplyTimeout),
+		ReplyType:    defaultSerialReplyType,
+	}
+	if sc.WriteEncoding != "" {
+		ret.Encoding = sc.WriteEncoding
+	}
+	if sc.WriteField != "" {
+		ret.Field = sc.WriteField
+	}
+	if sc.WriteChecksum != "" {
+		ret.Checksum = sc.WriteChecksum
+	}
+	if sc.WriteTerminator != "" {
+		var err error
+		ret.Terminator, err = utils.ParsePayload(sc.WriteTerminator)
+		if err != nil {
+			return ret, fmt.Errorf("write_terminator parse failed, %v", err)
+		}
+	}
+	if sc.ReplyType != "" {
+		ret.ReplyType = sc.ReplyType
+	}
+	return ret, nil
+}
+
+// decode returns bytes to write from the subscribed message body. id is
+// the correlation id of json encoding, which is returned in the reply.
+// ex of json:
+//   {"id": "42", "data": "\x01\x03\x00\x00"}
+func (c SerialCommand) decode(body []byte) (data []byte, id interface{}, err error) {
+	switch c.Encoding {
+	case "hex":
+		data, err = hex.DecodeString(strings.TrimSpace(string(body)))
+	case "base64":
+		data, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+	case "escape":
+		data, err = utils.ParsePayload(string(body))
+	case "json":
+		var v map[string]interface{}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return nil, nil, err
+		}
+		id = v["id"]
+		s, ok := v[c.Field].(string)
+		if !ok {
+			return nil, id, fmt.Errorf("%v is not a string", c.Field)
+		}
+		data, err = utils.ParsePayload(s)
+	default:
+		data = body
+	}
+	return data, id, err
+}
+
+// frame appends the checksum and the terminator.
+func (c SerialCommand) frame(data []byte) []byte {
+	ret := make([]byte, 0, len(data)+2+len(c.Terminator))
+	ret = append(ret, data...)
+	ret = append(ret, serialChecksum(c.Checksum, data)...)
+	return append(ret, c.Terminator...)
+}
+
+// encode returns the reply data for the json reply.
+func (c SerialCommand) encode(data []byte) string {
+	switch c.Encoding {
+	case "hex":
+		return hex.EncodeToString(data)
+	case "base64":
+		return base64.StdEncoding.EncodeToString(data)
+	}
+	return string(data)
+}
+
+// reply returns the body of the reply. The body is the raw reply unless
+// the command has correlation id or failed.
+func (c SerialCommand) reply(id interface{}, data []byte, cause error) []byte {
+	if id == nil && cause == nil {
+		return data
+	}
+	v := map[string]interface{}{"id": id}
+	if cause != nil {
+		v["error"] = cause.Error()
+	} else {
+		v["data"] = c.encode(data)
+	}
+	ret, _ := json.Marshal(v)
+	return ret
+}
+
+// serialChecksum returns the checksum bytes of data.
+func serialChecksum(kind string, data []byte) []byte {
+	switch kind {
+	case "sum8":
+		var sum byte
+		for _, b := range data {
+			sum += b
+		}
+		return []byte{sum}
+	case "xor8":
+		var x byte
+		for _, b := range data {
+			x ^= b
+		}
+		return []byte{x}
+	case "crc16":
+		// modbus, low byte first
+		crc := uint16(0xffff)
+		for _, b := range data {
+			crc ^= uint16(b)
+			for i := 0; i < 8; i++ {
+				if crc&1 != 0 {
+					crc = crc>>1 ^ 0xa001
+				} else {
+					crc >>= 1
+				}
+			}
+		}
+		return []byte{byte(crc), byte(crc >> 8)}
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+)
+
+func TestSerialCommandDecode(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		encoding string
+		body     string
+		data     []byte
+		id       interface{}
+	}{
+		{"raw", "hello", []byte("hello"), nil},
+		{"hex", "0103ff\n", []byte{0x01, 0x03, 0xff}, nil},
+		{"base64", "AQP/", []byte{0x01, 0x03, 0xff}, nil},
+		{"escape", `\x01\x03\xff`, []byte{0x01, 0x03, 0xff}, nil},
+		{"json", `{"id": "a1", "data": "\\x01\\x03"}`, []byte{0x01, 0x03}, "a1"},
+		{"json", `{"id": 7, "data": "on"}`, []byte("on"), 7.0},
+	}
+	for _, c := range cases {
+		cmd := SerialCommand{Encoding: c.encoding, Field: "data"}
+		data, id, err := cmd.decode([]byte(c.body))
+		assert.Nil(err, c.body)
+		assert.Equal(c.data, data, c.body)
+		assert.Equal(c.id, id, c.body)
+	}
+
+	for _, c := range []SerialCommand{
+		{Encoding: "hex"},
+		{Encoding: "json", Field: "data"},
+		{Encoding: "json", Field: "value"},
+	} {
+		_, _, err := c.decode([]byte(`{"data": "zz"}x`))
+		assert.NotNil(err, c.Encoding)
+	}
+}
+
+func TestSerialCommandFrame(t *testing.T) {
+	assert := assert.New(t)
+
+	data := []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x02}
+	assert.Equal([]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x02, 0xc4, 0x0b},
+		SerialCommand{Checksum: "crc16"}.frame(data))
+	assert.Equal([]byte{0x01, 0x02, 0x03, '\r'},
+		SerialCommand{Checksum: "sum8", Terminator: []byte("\r")}.frame([]byte{0x01, 0x02}))
+	assert.Equal([]byte{0x01, 0x03, 0x02},
+		SerialCommand{Checksum: "xor8"}.frame([]byte{0x01, 0x03}))
+	assert.Equal([]byte("ping\r\n"),
+		SerialCommand{Checksum: "none", Terminator: []byte("\r\n")}.frame([]byte("ping")))
+}
+
+func TestSerialCommandReply(t *testing.T) {
+	assert := assert.New(t)
+
+	c := SerialCommand{Encoding: "hex"}
+	assert.Equal([]byte{0x06}, c.reply(nil, []byte{0x06}, nil))
+	assert.Equal(`{"data":"0601","id":"a1"}`, string(c.reply("a1", []byte{0x06, 0x01}, nil)))
+	assert.Equal(`{"error":"reply timeout","id":"a1"}`, string(c.reply("a1", nil, errSerialReplyTimeout)))
+}
+
+func TestSerialDeviceCommandReply(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[device."dora"]
+    type = "serial"
+    broker = "sango"
+    qos = 0
+    serial = "/dev/fuji-not-exist"
+    baud = 9600
+    terminator = "\n"
+    write_encoding = "json"
+    write_terminator = "\n"
+    reply_timeout = 200
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	d, err := NewSerialDevice(conf.Sections[0], []*broker.Broker{b1}, NewDeviceChannel())
+	assert.Nil(err)
+
+	port, adapter := net.Pipe()
+	d.openPort = func(name string) (io.ReadWriteCloser, error) {
+		return port, nil
+	}
+	channel := make(chan message.Message, 10)
+	assert.Nil(d.Start(channel))
+	defer d.Stop()
+
+	next := func() message.Message {
+		select {
+		case msg := <-channel:
+			return msg
+		case <-time.After(3 * time.Second):
+			t.Fatal("message not reached")
+		}
+		return message.Message{}
+	}
+	assert.Equal("status", next().Type)
+
+	topic := "pre/ham/dora/subscribe"
+	d.DeviceChan.Chan <- message.Message{Topic: topic, Body: []byte(`{"id": "r1", "data": "get"}`)}
+	buf := make([]byte, 16)
+	n, _ := adapter.Read(buf)
+	assert.Equal("get\n", string(buf[:n]))
+	adapter.Write([]byte("25.1\n"))
+	msg := next()
+	assert.Equal("response", msg.Type)
+	assert.Equal(`{"data":"25.1","id":"r1"}`, string(msg.Body))
+
+	// no reply
+	d.DeviceChan.Chan <- message.Message{Topic: topic, Body: []byte(`{"id": "r2", "data": "get"}`)}
+	adapter.Read(buf)
+	msg = next()
+	assert.Equal(`{"error":"reply timeout","id":"r2"}`, string(msg.Body))
+
+	// invalid command
+	d.DeviceChan.Chan <- message.Message{Topic: topic, Body: []byte(`{"id": "r3"}`)}
+	msg = next()
+	assert.Equal(`{"error":"data is not a string","id":"r3"}`, string(msg.Body))
+
+	// other device
+	d.DeviceChan.Chan <- message.Message{Topic: "pre/ham/nobita/subscribe", Body: []byte(`{"data": "get"}`)}
+	select {
+	case msg := <-channel:
+		t.Fatalf("unexpected message, %v", msg)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	for _, v := range []map[string]string{
+		{"write_encoding": "xml"},
+		{"write_checksum": "md5"},
+		{"reply_timeout": "-1"},
+		{"write_terminator": "\\x0"},
+	} {
+		section := config.ConfigSection{Name: "dora", Values: map[string]string{
+			"broker": "sango", "qos": "0", "serial": "/dev/ttyUSB0", "baud": "9600",
+		}}
+		for k, val := range v {
+			section.Values[k] = val
+		}
+		_, err = NewSerialDevice(section, []*broker.Broker{b1}, NewDeviceChannel())
+		assert.NotNil(err, "%v", v)
+	}
+}
+
+func TestSerialDeviceCall(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[device."dora"]
+    type = "serial"
+    broker = "sango"
+    qos = 0
+    serial = "/dev/fuji-not-exist"
+    baud = 9600
+    terminator = "\n"
+    write_encoding = "hex"
+    write_checksum = "xor8"
+    reply_timeout = 200
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	d, err := NewSerialDevice(conf.Sections[0], []*broker.Broker{b1}, NewDeviceChannel())
+	assert.Nil(err)
+
+	// port is not opened
+	_, err = d.Call(message.Request{ID: "1", Method: "write", Params: []byte(`{"data": "\\x01"}`)})
+	assert.NotNil(err)
+
+	port, adapter := net.Pipe()
+	d.openPort = func(name string) (io.ReadWriteCloser, error) {
+		return port, nil
+	}
+	channel := make(chan message.Message, 10)
+	assert.Nil(d.Start(channel))
+	defer d.Stop()
+	<-channel // connected
+
+	go func() {
+		buf := make([]byte, 16)
+		n, _ := adapter.Read(buf)
+		assert.Equal([]byte{0x01, 0x03, 0x02}, buf[:n])
+		adapter.Write([]byte{0x06, '\n'})
+	}()
+	v, err := d.Call(message.Request{ID: "2", Method: "write", Params: []byte(`{"data": "\\x01\\x03"}`)})
+	assert.Nil(err)
+	assert.Equal(map[string]string{"data": "06"}, v)
+
+	// no reply
+	go adapter.Read(make([]byte, 16))
+	_, err = d.Call(message.Request{ID: "3", Method: "write", Params: []byte(`{"data": "\\x01"}`)})
+	assert.Equal(errSerialReplyTimeout, err)
+
+	v, err = d.Call(message.Request{ID: "4", Method: "status"})
+	assert.Nil(err)
+	assert.Equal(map[string]interface{}{"timeouts": uint64(0)}, v)
+	_, err = d.Call(message.Request{ID: "5", Method: "write", Params: []byte(`[]`)})
+	assert.NotNil(err)
+	select {
+	case msg := <-channel:
+		t.Fatalf("rpc reply should not be published, %v", msg)
+	default:
+	}
+}
+
+func TestSerialDeviceCommandWhilePolling(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[device."dora"]
+    type = "serial"
+    broker = "sango"
+    qos = 0
+    serial = "/dev/fuji-not-exist"
+    baud = 9600
+    query = "?"
+    terminator = "\n"
+    interval = 60
+    timeout = 1000
+    write_encoding = "json"
+    write_terminator = "\n"
+    reply_timeout = 1000
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	d, err := NewSerialDevice(conf.Sections[0], []*broker.Broker{b1}, NewDeviceChannel())
+	assert.Nil(err)
+
+	port, adapter := net.Pipe()
+	d.openPort = func(name string) (io.ReadWriteCloser, error) {
+		return port, nil
+	}
+	channel := make(chan message.Message, 10)
+	assert.Nil(d.Start(channel))
+	defer d.Stop()
+
+	next := func() message.Message {
+		select {
+		case msg := <-channel:
+			return msg
+		case <-time.After(3 * time.Second):
+			t.Fatal("message not reached")
+		}
+		return message.Message{}
+	}
+	assert.Equal("status", next().Type)
+	buf := make([]byte, 16)
+	n, _ := adapter.Read(buf)
+	assert.Equal("?", string(buf[:n]))
+
+	// the response of the query is pending
+	topic := "pre/ham/dora/subscribe"
+	d.DeviceChan.Chan <- message.Message{Topic: topic, Body: []byte(`{"id": "r1", "data": "get"}`)}
+	msg := next()
+	assert.Equal("response", msg.Type)
+	assert.Equal(`{"error":"waiting reply of the previous query or command","id":"r1"}`, string(msg.Body))
+
+	adapter.Write([]byte("42\n"))
+	msg = next()
+	assert.Equal("serial", msg.Type)
+	assert.Equal("42", string(msg.Body))
+
+	d.DeviceChan.Chan <- message.Message{Topic: topic, Body: []byte(`{"id": "r2", "data": "get"}`)}
+	n, _ = adapter.Read(buf)
+	assert.Equal("get\n", string(buf[:n]))
+	adapter.Write([]byte("25.1\n"))
+	msg = next()
+	assert.Equal("response", msg.Type)
+	assert.Equal(`{"data":"25.1","id":"r2"}`, string(msg.Body))
+}
@@ -0,0 +1,205 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux,386 linux,amd64 linux,arm linux,arm64
+
+package device
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// termios values of asm-generic, which x86 and arm use.
+const (
+	ioctlTCGETS     = 0x5401
+	ioctlTCSETS     = 0x5402
+	ioctlTCSBRK     = 0x5409
+	ioctlTCFLSH     = 0x540b
+	ioctlTIOCMBIS   = 0x5416
+	ioctlTIOCMBIC   = 0x5417
+	ioctlTIOCSRS485 = 0x542f
+
+	tiocmRTS  = 0x4
+	tcioflush = 0x2
+
+	termiosCSTOPB  = 0x40
+	termiosCREAD   = 0x80
+	termiosPARENB  = 0x100
+	termiosPARODD  = 0x200
+	termiosCLOCAL  = 0x800
+	termiosCRTSCTS = 0x80000000
+	termiosINPCK   = 0x10
+	termiosVTIME   = 5
+	termiosVMIN    = 6
+
+	rs485Enabled      = 0x1
+	rs485RTSOnSend    = 0x2
+)
+
+var termiosBauds = map[int]uint32{
+	300:     0x7,
+	600:     0x8,
+	1200:    0x9,
+	1800:    0xa,
+	2400:    0xb,
+	4800:    0xc,
+	9600:    0xd,
+	19200:   0xe,
+	38400:   0xf,
+	57600:   0x1001,
+	115200:  0x1002,
+	230400:  0x1003,
+	460800:  0x1004,
+	500000:  0x1005,
+	576000:  0x1006,
+	921600:  0x1007,
+	1000000: 0x1008,
+}
+
+var termiosDataBits = map[int]uint32{5: 0x0, 6: 0x10, 7: 0x20, 8: 0x30}
+
+// termios is struct termios of the kernel.
+type termios struct {
+	Iflag, Oflag, Cflag, Lflag uint32
+	Line                       uint8
+	Cc                         [19]uint8
+}
+
+// setRaw sets raw mode with the line settings.
+func (t *termios) setRaw(speed uint32, params SerialParams) {
+	t.Iflag = 0
+	t.Oflag = 0
+	t.Lflag = 0
+	t.Cflag = speed | termiosDataBits[params.DataBits] | termiosCREAD | termiosCLOCAL
+	switch params.Parity {
+	case "odd":
+		t.Cflag |= termiosPARENB | termiosPARODD
+		t.Iflag |= termiosINPCK
+	case "even":
+		t.Cflag |= termiosPARENB
+		t.Iflag |= termiosINPCK
+	}
+	if params.StopBits == 2 {
+		t.Cflag |= termiosCSTOPB
+	}
+	if params.RTSCTS {
+		t.Cflag |= termiosCRTSCTS
+	}
+	t.Cc[termiosVMIN] = 0
+	t.Cc[termiosVTIME] = 1 // 100 msec
+}
+
+// serialRS485 is struct serial_rs485 of the kernel.
+type serialRS485 struct {
+	Flags              uint32
+	DelayRTSBeforeSend uint32
+	DelayRTSAfterSend  uint32
+	padding            [5]uint32
+}
+
+// serialPort is a tty configured in raw mode. RTS is toggled around
+// writes if the driver does not support RS-485 mode.
+type serialPort struct {
+	*os.File
+	softRS485 bool
+	params    SerialParams
+}
+
+func (p *serialPort) setRTS(on bool) error {
+	bits := uint32(tiocmRTS)
+	req := uintptr(ioctlTIOCMBIC)
+	if on {
+		req = ioctlTIOCMBIS
+	}
+	return ioctl(p.Fd(), req, unsafe.Pointer(&bits))
+}
+
+func (p *serialPort) Write(b []byte) (int, error) {
+	if !p.softRS485 {
+		return p.File.Write(b)
+	}
+	if err := p.setRTS(true); err != nil {
+		return 0, err
+	}
+	time.Sleep(time.Duration(p.params.RS485DelayBefore) * time.Millisecond)
+	n, err := p.File.Write(b)
+	// wait until all output is transmitted
+	if derr := ioctlInt(p.Fd(), ioctlTCSBRK, 1); derr != nil && err == nil {
+		err = derr
+	}
+	time.Sleep(time.Duration(p.params.RS485DelayAfter) * time.Millisecond)
+	if rerr := p.setRTS(false); rerr != nil && err == nil {
+		err = rerr
+	}
+	return n, err
+}
+
+// setRS485 enables RS-485 mode of the driver. It returns false if the
+// driver does not support it.
+func setRS485(fd int, params SerialParams) bool {
+	rs := serialRS485{
+		Flags:              rs485Enabled | rs485RTSOnSend,
+		DelayRTSBeforeSend: uint32(params.RS485DelayBefore),
+		DelayRTSAfterSend:  uint32(params.RS485DelayAfter),
+	}
+	return ioctl(uintptr(fd), ioctlTIOCSRS485, unsafe.Pointer(&rs)) == nil
+}
+
+// openSerialPort opens the serial port in raw mode with the params.
+// Read returns io.EOF if nothing comes in 100 msec.
+func openSerialPort(name string, baud int, params SerialParams) (io.ReadWriteCloser, error) {
+	speed, ok := termiosBauds[baud]
+	if !ok {
+		return nil, fmt.Errorf("unsupported baud rate, %v", baud)
+	}
+	fd, err := syscall.Open(name, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("serial port open failed, %v: %v", name, err)
+	}
+
+	var t termios
+	if err := ioctl(uintptr(fd), ioctlTCGETS, unsafe.Pointer(&t)); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("%v is not a tty, %v", name, err)
+	}
+	t.setRaw(speed, params)
+	if err := ioctl(uintptr(fd), ioctlTCSETS, unsafe.Pointer(&t)); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("serial port setting failed, %v: %v", name, err)
+	}
+	ioctlInt(uintptr(fd), ioctlTCFLSH, tcioflush)
+
+	port := &serialPort{params: params}
+	if params.RS485 && !setRS485(fd, params) {
+		// fall back to toggle RTS by ourselves
+		bits := uint32(tiocmRTS)
+		if err := ioctl(uintptr(fd), ioctlTIOCMBIC, unsafe.Pointer(&bits)); err != nil {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("rs485 is not supported by %v, %v", name, err)
+		}
+		port.softRS485 = true
+	}
+
+	if err := syscall.SetNonblock(fd, false); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	port.File = os.NewFile(uintptr(fd), name)
+	return port, nil
+}
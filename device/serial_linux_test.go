@@ -0,0 +1,153 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux,386 linux,amd64 linux,arm linux,arm64
+
+package device
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+)
+
+const (
+	ioctlTIOCGPTN   = 0x80045430
+	ioctlTIOCSPTLCK = 0x40045431
+)
+
+// openTestPty opens a pseudo terminal. The slave is used as the serial
+// port and the master is the other end of the wire.
+func openTestPty(t *testing.T) (*os.File, string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("pty is not available, %v", err)
+	}
+	var unlock int32
+	if err := ioctl(master.Fd(), ioctlTIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		master.Close()
+		t.Skipf("pty unlock failed, %v", err)
+	}
+	var n uint32
+	if err := ioctl(master.Fd(), ioctlTIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		master.Close()
+		t.Skipf("pty number failed, %v", err)
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+func TestTermiosSetRaw(t *testing.T) {
+	assert := assert.New(t)
+
+	tio := termios{Lflag: 0x8a3b}
+	tio.setRaw(termiosBauds[9600], SerialParams{DataBits: 7, Parity: "even", StopBits: 1})
+	assert.Equal(uint32(0xd|0x20|termiosCREAD|termiosCLOCAL|termiosPARENB), tio.Cflag)
+	assert.Equal(uint32(termiosINPCK), tio.Iflag)
+	assert.Equal(uint32(0), tio.Lflag)
+
+	tio.setRaw(termiosBauds[115200], SerialParams{DataBits: 8, Parity: "odd", StopBits: 2, RTSCTS: true})
+	assert.Equal(uint32(0x1002|0x30|termiosCREAD|termiosCLOCAL|termiosPARENB|termiosPARODD|termiosCSTOPB|termiosCRTSCTS), tio.Cflag)
+	assert.Equal(uint8(1), tio.Cc[termiosVTIME])
+}
+
+func TestOpenSerialPortParams(t *testing.T) {
+	assert := assert.New(t)
+
+	master, slave := openTestPty(t)
+	defer master.Close()
+
+	params := SerialParams{DataBits: 7, Parity: "even", StopBits: 2, RTSCTS: true}
+	port, err := openSerialPort(slave, 9600, params)
+	assert.Nil(err)
+	defer port.Close()
+
+	var tio termios
+	assert.Nil(ioctl(port.(*serialPort).Fd(), ioctlTCGETS, unsafe.Pointer(&tio)))
+	// pty keeps only CS8 without parity
+	assert.NotEqual(uint32(0), tio.Cflag&termiosCSTOPB)
+	assert.NotEqual(uint32(0), tio.Cflag&termiosCRTSCTS)
+	assert.Equal(uint32(0), tio.Lflag)
+
+	_, err = openSerialPort(slave, 12345, defaultSerialParams)
+	assert.NotNil(err)
+}
+
+func TestSerialDevicePty(t *testing.T) {
+	assert := assert.New(t)
+
+	master, slave := openTestPty(t)
+	defer master.Close()
+
+	configStr := `
+[device."dora"]
+    type = "serial"
+    broker = "sango"
+    qos = 0
+    serial = "` + slave + `"
+    baud = 19200
+    size = 4
+    data_bits = 7
+    parity = "even"
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	d, err := NewSerialDevice(conf.Sections[0], []*broker.Broker{b1}, NewDeviceChannel())
+	assert.Nil(err)
+	assert.Equal(7, d.Params.DataBits)
+
+	channel := make(chan message.Message, 10)
+	assert.Nil(d.Start(channel))
+	defer d.Stop()
+
+	next := func() message.Message {
+		select {
+		case msg := <-channel:
+			return msg
+		case <-time.After(3 * time.Second):
+			t.Fatal("message not reached")
+		}
+		return message.Message{}
+	}
+	assert.Equal("status", next().Type)
+
+	// read path
+	master.Write([]byte("abcdefgh"))
+	assert.Equal("abcd", string(next().Body))
+	assert.Equal("efgh", string(next().Body))
+
+	// write path
+	d.DeviceChan.Chan <- message.Message{Topic: "pre/ham/dora/subscribe", Body: []byte("ping")}
+	read := make(chan string)
+	go func() {
+		buf := make([]byte, 16)
+		n, _ := master.Read(buf)
+		read <- string(buf[:n])
+	}()
+	select {
+	case s := <-read:
+		assert.Equal("ping", s)
+	case <-time.After(3 * time.Second):
+		t.Fatal("written data not reached")
+	}
+}
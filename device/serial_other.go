@@ -0,0 +1,39 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux linux,!386,!amd64,!arm,!arm64
+
+package device
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	serial "github.com/tarm/serial"
+)
+
+// openSerialPort opens the serial port with short read timeout.
+// Only 8N1 without flow control is supported on this platform.
+func openSerialPort(name string, baud int, params SerialParams) (io.ReadWriteCloser, error) {
+	if params != defaultSerialParams {
+		return nil, fmt.Errorf("serial parameters other than 8N1 are not supported on this platform, %v", params)
+	}
+	serialConfig := &serial.Config{Name: name, Baud: baud, ReadTimeout: time.Millisecond * 50}
+	serialPort, err := serial.OpenPort(serialConfig)
+	if err != nil {
+		return nil, fmt.Errorf("serialConfig: %v, serialPort: %v, Error: %v", serialConfig, serialPort, err)
+	}
+	return serialPort, nil
+}
@@ -15,12 +15,20 @@
 package device
 
 import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
 	"github.com/shiguredo/fuji/broker"
 	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
 )
 
 func TestNewSerialDevice(t *testing.T) {
@@ -135,4 +143,241 @@ func TestNewSerialDeviceInvalidBaud(t *testing.T) {
 	assert.NotNil(err)
 }
 
+func TestFindUSBSerialPort(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "fuji-sys")
+	assert.Nil(err)
+	defer os.RemoveAll(root)
+
+	// sys/devices/.../1-1/1-1:1.0/ttyUSB0 and sys/class/tty/ttyUSB0/device
+	adapters := []struct {
+		tty, vendor, product, serial string
+	}{
+		{"ttyUSB0", "0403", "6001", "A50285BI"},
+		{"ttyUSB1", "10c4", "ea60", "0001"},
+	}
+	for i, a := range adapters {
+		usb := filepath.Join(root, "devices", fmt.Sprintf("1-%d", i))
+		intf := filepath.Join(usb, fmt.Sprintf("1-%d:1.0", i))
+		assert.Nil(os.MkdirAll(filepath.Join(intf, a.tty), 0755))
+		ioutil.WriteFile(filepath.Join(usb, "idVendor"), []byte(a.vendor+"\n"), 0644)
+		ioutil.WriteFile(filepath.Join(usb, "idProduct"), []byte(a.product+"\n"), 0644)
+		ioutil.WriteFile(filepath.Join(usb, "serial"), []byte(a.serial+"\n"), 0644)
+		assert.Nil(os.MkdirAll(filepath.Join(root, "class", "tty", a.tty), 0755))
+		assert.Nil(os.Symlink(intf, filepath.Join(root, "class", "tty", a.tty, "device")))
+	}
+	// no device link
+	assert.Nil(os.MkdirAll(filepath.Join(root, "class", "tty", "tty0"), 0755))
+
+	origSys, origDev := sysTTYRoot, devRoot
+	sysTTYRoot, devRoot = filepath.Join(root, "class", "tty"), "/dev"
+	defer func() { sysTTYRoot, devRoot = origSys, origDev }()
+
+	name, err := findUSBSerialPort(USBMatch{Vendor: "10C4", Product: "ea60"})
+	assert.Nil(err)
+	assert.Equal("/dev/ttyUSB1", name)
+	name, err = findUSBSerialPort(USBMatch{Serial: "A50285BI"})
+	assert.Nil(err)
+	assert.Equal("/dev/ttyUSB0", name)
+	_, err = findUSBSerialPort(USBMatch{Vendor: "0403", Serial: "0001"})
+	assert.NotNil(err)
+}
+
+func TestSerialDeviceReconnect(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[device."dora"]
+    type = "serial"
+    broker = "sango"
+    qos = 0
+    serial = "/dev/fuji-not-exist"
+    baud = 9600
+    size = 4
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	d, err := NewSerialDevice(conf.Sections[0], []*broker.Broker{b1}, NewDeviceChannel())
+	assert.Nil(err)
+
+	adapters := make(chan net.Conn, 2)
+	d.openPort = func(name string) (io.ReadWriteCloser, error) {
+		port, adapter := net.Pipe()
+		adapters <- adapter
+		return port, nil
+	}
+	channel := make(chan message.Message, 10)
+	assert.Nil(d.Start(channel))
+	defer d.Stop()
+
+	next := func() message.Message {
+		select {
+		case msg := <-channel:
+			return msg
+		case <-time.After(3 * time.Second):
+			t.Fatal("message not reached")
+		}
+		return message.Message{}
+	}
+
+	msg := next()
+	assert.Equal("status", msg.Type)
+	assert.Contains(string(msg.Body), `"connected"`)
+	adapter := <-adapters
+	go adapter.Write([]byte("abcd"))
+	assert.Equal("abcd", string(next().Body))
+
+	// unplugged
+	adapter.Close()
+	msg = next()
+	assert.Equal("status", msg.Type)
+	assert.Contains(string(msg.Body), `"disconnected"`)
+	msg = next()
+	assert.Equal(message.TypeAvailability, msg.Type)
+	assert.Equal(message.Offline, string(msg.Body))
+	assert.Contains(string(next().Body), `"connected"`)
+
+	adapter = <-adapters
+	go adapter.Write([]byte("efgh"))
+	assert.Equal("efgh", string(next().Body))
+}
+
+func TestParseSerialParams(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := parseSerialParams(SerialDeviceSection{})
+	assert.Nil(err)
+	assert.Equal(defaultSerialParams, p)
+
+	p, err = parseSerialParams(SerialDeviceSection{
+		DataBits: 7, Parity: "Even", StopBits: 1, RS485: true, RS485DelayAfter: 2,
+	})
+	assert.Nil(err)
+	assert.Equal(SerialParams{DataBits: 7, Parity: "even", StopBits: 1, RS485: true, RS485DelayAfter: 2}, p)
+
+	_, err = parseSerialParams(SerialDeviceSection{FlowControl: "xonxoff"})
+	assert.NotNil(err)
+	_, err = parseSerialParams(SerialDeviceSection{FlowControl: "rtscts", RS485: true})
+	assert.NotNil(err)
+
+	for _, v := range []map[string]string{
+		{"data_bits": "9"},
+		{"parity": "mark"},
+		{"stop_bits": "3"},
+		{"data_bits": "eight"},
+	} {
+		section := config.ConfigSection{Name: "dora", Values: map[string]string{
+			"broker": "sango", "qos": "0", "serial": "/dev/ttyUSB0", "baud": "9600",
+		}}
+		for k, val := range v {
+			section.Values[k] = val
+		}
+		_, err = NewSerialDevice(section, []*broker.Broker{{Name: "sango"}}, NewDeviceChannel())
+		assert.NotNil(err, "%v", v)
+	}
+}
+
+func TestSerialDevicePolling(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[device."dora"]
+    type = "serial"
+    broker = "sango"
+    qos = 0
+    serial = "/dev/fuji-not-exist"
+    baud = 9600
+    query = "\\x01\\x03"
+    terminator = "\r\n"
+    interval = 1
+    timeout = 200
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	d, err := NewSerialDevice(conf.Sections[0], []*broker.Broker{b1}, NewDeviceChannel())
+	assert.Nil(err)
+	assert.Equal([]byte{0x01, 0x03}, d.Query)
+	assert.Equal([]byte("\r\n"), d.Terminator)
+
+	port, adapter := net.Pipe()
+	d.openPort = func(name string) (io.ReadWriteCloser, error) {
+		return port, nil
+	}
+	channel := make(chan message.Message, 10)
+	assert.Nil(d.Start(channel))
+	defer d.Stop()
+
+	next := func() message.Message {
+		select {
+		case msg := <-channel:
+			return msg
+		case <-time.After(3 * time.Second):
+			t.Fatal("message not reached")
+		}
+		return message.Message{}
+	}
+	query := func() []byte {
+		buf := make([]byte, 16)
+		n, err := adapter.Read(buf)
+		assert.Nil(err)
+		return buf[:n]
+	}
+
+	assert.Equal("status", next().Type)
+	assert.Equal([]byte{0x01, 0x03}, query())
+	adapter.Write([]byte("42\r\n"))
+	msg := next()
+	assert.Equal("serial", msg.Type)
+	assert.Equal("42", string(msg.Body))
+
+	// no response to the next query
+	assert.Equal([]byte{0x01, 0x03}, query())
+	msg = next()
+	assert.Equal("status", msg.Type)
+	assert.Equal(`{"status":"timeout","timeouts":1}`, string(msg.Body))
+	assert.Equal(uint64(1), d.Timeouts())
+
+	for _, v := range []map[string]string{
+		{"query": "\\x01", "timeout": "1000"},
+		{"query": "\\x01", "interval": "0"},
+		{"query": "\\x0"},
+		{"terminator": "\n", "size": "4"},
+	} {
+		section := config.ConfigSection{Name: "dora", Values: map[string]string{
+			"broker": "sango", "qos": "0", "serial": "/dev/ttyUSB0", "baud": "9600", "interval": "1",
+		}}
+		for k, val := range v {
+			section.Values[k] = val
+		}
+		_, err = NewSerialDevice(section, []*broker.Broker{b1}, NewDeviceChannel())
+		assert.NotNil(err, "%v", v)
+	}
+}
+
+func TestNewSerialDeviceQueryDefaults(t *testing.T) {
+	assert := assert.New(t)
+
+	// interval and timeout are not set
+	configStr := `
+[device."dora"]
+    type = "serial"
+    broker = "sango"
+    qos = 0
+    serial = "/dev/fuji-not-exist"
+    baud = 9600
+    query = "\\x01\\x03"
+    terminator = "\r\n"
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	d, err := NewSerialDevice(conf.Sections[0], []*broker.Broker{b1}, NewDeviceChannel())
+	assert.Nil(err)
+	assert.Equal(1, d.Interval)
+	assert.Equal(500, d.Timeout)
+}
+
 // TODO: TestIniBadDeviceWithUnknownInterface
@@ -0,0 +1,91 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// sysTTYRoot and devRoot are variables for tests.
+	sysTTYRoot = "/sys/class/tty"
+	devRoot    = "/dev"
+)
+
+// USBMatch selects a USB serial adapter by the attributes which udev
+// exposes. Empty fields match anything.
+type USBMatch struct {
+	Vendor  string `validate:"max=4"`
+	Product string `validate:"max=4"`
+	Serial  string `validate:"max=256"`
+}
+
+func (m USBMatch) IsZero() bool {
+	return m.Vendor == "" && m.Product == "" && m.Serial == ""
+}
+
+func readSysAttr(dir, name string) string {
+	b, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// usbDeviceDir returns the USB device directory which the tty belongs
+// to, that is the nearest ancestor having idVendor.
+func usbDeviceDir(tty string) (string, error) {
+	dir, err := filepath.EvalSymlinks(filepath.Join(sysTTYRoot, tty, "device"))
+	if err != nil {
+		return "", err
+	}
+	// tty -> interface -> usb device, some drivers have one more level
+	for i := 0; i < 4 && dir != "/"; i++ {
+		if _, err := os.Stat(filepath.Join(dir, "idVendor")); err == nil {
+			return dir, nil
+		}
+		dir = filepath.Dir(dir)
+	}
+	return "", fmt.Errorf("%v is not an usb device", tty)
+}
+
+// findUSBSerialPort returns the device node of the tty which matches.
+func findUSBSerialPort(m USBMatch) (string, error) {
+	entries, err := ioutil.ReadDir(sysTTYRoot)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		dir, err := usbDeviceDir(e.Name())
+		if err != nil {
+			continue
+		}
+		if m.Vendor != "" && !strings.EqualFold(readSysAttr(dir, "idVendor"), m.Vendor) {
+			continue
+		}
+		if m.Product != "" && !strings.EqualFold(readSysAttr(dir, "idProduct"), m.Product) {
+			continue
+		}
+		if m.Serial != "" && readSysAttr(dir, "serial") != m.Serial {
+			continue
+		}
+		return filepath.Join(devRoot, e.Name()), nil
+	}
+	return "", fmt.Errorf("usb serial port not found, vendor: %v, product: %v, serial: %v", m.Vendor, m.Product, m.Serial)
+}
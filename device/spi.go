@@ -0,0 +1,186 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	validator "gopkg.in/validator.v2"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+)
+
+const (
+	defaultSPISpeed = 1000000 // Hz
+	defaultSPIBits  = 8
+)
+
+// SPIDevice reads registers of a SPI slave by interval.
+type SPIDevice struct {
+	Name        string `validate:"max=256,regexp=[^/]+,validtopic"`
+	Broker      []*broker.Broker
+	BrokerName  string
+	QoS         byte   `validate:"min=0,max=2"`
+	Bus         string `validate:"min=1,max=256"`
+	Mode        int    `validate:"min=0,max=3"`
+	Speed       int    `validate:"min=1"`
+	Bits        int    `validate:"min=1,max=32"`
+	Interval    int    `validate:"min=1"`
+	Transaction busTransaction
+	Type        string `validate:"max=256"`
+	Retain      bool
+	Subscribe   bool
+	DeviceChan  DeviceChannel // GW -> device
+
+	stop chan struct{}
+}
+
+func (device SPIDevice) String() string {
+	return fmt.Sprintf("%#v", device)
+}
+
+// SPIDeviceSection is [device."<name>"] of type "spi".
+type SPIDeviceSection struct {
+	config.DeviceSection
+	BusSection
+	Bus      string         `toml:"bus"`
+	Mode     int            `toml:"mode"`
+	Speed    int            `toml:"speed"`
+	Bits     int            `toml:"bits"`
+	Interval config.Seconds `toml:"interval"`
+}
+
+func init() {
+	config.RegisterSection("device/spi", SPIDeviceSection{})
+}
+
+// NewSPIDevice read config.ConfigSection and returnes SPIDevice.
+// If config validation failed, return error
+func NewSPIDevice(section config.ConfigSection, brokers []*broker.Broker, devChan DeviceChannel) (SPIDevice, error) {
+	ret := SPIDevice{
+		Name:       section.Name,
+		DeviceChan: devChan,
+		Speed:      defaultSPISpeed,
+		Bits:       defaultSPIBits,
+		stop:       make(chan struct{}),
+	}
+	sc := SPIDeviceSection{
+		Speed: defaultSPISpeed,
+		Bits:  defaultSPIBits,
+	}
+	if err := section.Decode(&sc); err != nil {
+		return ret, err
+	}
+	if sc.Broker == "" {
+		return ret, fmt.Errorf("broker does not set")
+	}
+
+	for _, b := range brokers {
+		if b.Name == sc.Broker {
+			ret.Broker = brokers
+		}
+	}
+	if ret.Broker == nil {
+		return ret, fmt.Errorf("broker does not exists: %s", sc.Broker)
+	}
+	ret.BrokerName = sc.Broker
+
+	if _, ok := section.Values["qos"]; !ok {
+		return ret, fmt.Errorf("qos does not set")
+	}
+	ret.QoS = byte(sc.QoS)
+	ret.Bus = sc.Bus
+	ret.Mode = sc.Mode
+	ret.Speed = sc.Speed
+	ret.Bits = sc.Bits
+	ret.Interval = int(sc.Interval)
+	var err error
+	ret.Transaction, err = newBusTransaction(sc.BusSection)
+	if err != nil {
+		return ret, err
+	}
+	ret.Type = sc.Type
+	ret.Retain = sc.Retain
+	ret.Subscribe = sc.Subscribe
+
+	if err := ret.Validate(); err != nil {
+		return ret, err
+	}
+
+	return ret, nil
+}
+
+func (device *SPIDevice) Validate() error {
+	validator := validator.NewValidator()
+	validator.SetValidationFunc("validtopic", config.ValidMqttPublishTopic)
+	if err := validator.Validate(device); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (device SPIDevice) newMessage(body []byte) message.Message {
+	return message.Message{
+		Sender:     device.Name,
+		Type:       device.Type,
+		QoS:        device.QoS,
+		Retained:   device.Retain,
+		BrokerName: device.BrokerName,
+		Body:       body,
+	}
+}
+
+func (device SPIDevice) Start(channel chan message.Message) error {
+	bus, err := openSPI(device.Bus, device.Mode, device.Speed, device.Bits)
+	if err != nil {
+		return fmt.Errorf("spi device start failed, %v", err)
+	}
+
+	log.Info("start spi device")
+	go busLoop(bus, device.Transaction, device.Interval, device.newMessage, channel, device.DeviceChan, device.stop)
+	return nil
+}
+
+func (device SPIDevice) Stop() error {
+	log.Infof("closing spi: %v", device.Name)
+	select {
+	case <-device.stop:
+	default:
+		close(device.stop)
+	}
+	return nil
+}
+
+func (device SPIDevice) DeviceType() string {
+	return "spi"
+}
+
+// DeviceName returns the name of the device.
+func (device SPIDevice) DeviceName() string {
+	return device.Name
+}
+
+func (device SPIDevice) AddSubscribe() error {
+	if !device.Subscribe {
+		return nil
+	}
+	for _, b := range device.Broker {
+		b.AddSubscribed(device.Name, device.QoS)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+)
+
+func TestNewSPIDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[device."mcp3008"]
+    type = "spi"
+    broker = "sango"
+    qos = 0
+    bus = "/dev/spidev0.0"
+    speed = 500000
+    interval = 5
+    command = "\\x01\\x80"
+    read = 1
+    format = "hex"
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+	d, err := NewSPIDevice(conf.Sections[0], brokers, NewDeviceChannel())
+	assert.Nil(err)
+	assert.Equal("mcp3008", d.Name)
+	assert.Equal("/dev/spidev0.0", d.Bus)
+	assert.Equal(0, d.Mode)
+	assert.Equal(500000, d.Speed)
+	assert.Equal(8, d.Bits)
+	assert.Equal([]byte{0x01, 0x80}, d.Transaction.Command)
+	assert.Equal("hex", d.Transaction.Format)
+	assert.Equal("spi", d.Type)
+}
+
+func TestNewSPIDeviceInvalidMode(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[device."mcp3008"]
+    type = "spi"
+    broker = "sango"
+    qos = 0
+    bus = "/dev/spidev0.0"
+    mode = 4
+    interval = 5
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+	_, err = NewSPIDevice(conf.Sections[0], brokers, NewDeviceChannel())
+	assert.NotNil(err)
+}
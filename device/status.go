@@ -222,6 +222,34 @@ func (i IpAddressStatus) Get() []message.Message {
 	return ret
 }
 
+// StatusSection is [status].
+type StatusSection struct {
+	Broker   string         `toml:"broker"`
+	Interval config.Seconds `toml:"interval"`
+}
+
+// CPUStatusSection is [[status."cpu"]].
+type CPUStatusSection struct {
+	CPUTimes config.List `toml:"cpu_times"`
+}
+
+// MemoryStatusSection is [[status."memory"]].
+type MemoryStatusSection struct {
+	VirtualMemory config.List `toml:"virtual_memory"`
+}
+
+// IPAddressStatusSection is [[status."ip_address"]].
+type IPAddressStatusSection struct {
+	Interface config.List `toml:"interface"`
+}
+
+func init() {
+	config.RegisterSection("status", StatusSection{})
+	config.RegisterSection("status/cpu", CPUStatusSection{})
+	config.RegisterSection("status/memory", MemoryStatusSection{})
+	config.RegisterSection("status/ip_address", IPAddressStatusSection{})
+}
+
 // NewStatus returnes status from config file, not config.Sections.
 func NewStatus(conf config.Config) (Devicer, error) {
 	ret := Status{
@@ -238,25 +266,23 @@ func NewStatus(conf config.Config) (Devicer, error) {
 		if section.Name != "" { // skip if status child group
 			continue
 		}
-		bname, ok := section.Values["broker"]
-		if !ok {
+		var sc StatusSection
+		if err := section.Decode(&sc); err != nil {
+			return ret, err
+		}
+		if sc.Broker == "" {
 			return ret, fmt.Errorf("status does not have broker name")
 		}
 
 		for _, b := range conf.BrokerNames {
-			if b == bname {
+			if b == sc.Broker {
 				ret.BrokerName = b
 			}
 		}
 		if ret.BrokerName == "" {
-			return ret, fmt.Errorf("broker does not exists: %s", section.Name)
-		}
-		interval, err := strconv.Atoi(section.Values["interval"])
-		if err != nil {
-			return ret, err
-		} else {
-			ret.Interval = int(interval)
+			return ret, fmt.Errorf("broker does not exists: %s", sc.Broker)
 		}
+		ret.Interval = int(sc.Interval)
 	}
 
 	// status-wide settings done. now walk to childs
@@ -266,37 +292,46 @@ func NewStatus(conf config.Config) (Devicer, error) {
 		}
 		switch section.Name {
 		case "cpu":
-			cpu_times := parseStatus(section.Values["cpu_times"])
+			var sc CPUStatusSection
+			if err := section.Decode(&sc); err != nil {
+				return ret, err
+			}
 
 			cpu := CPUStatus{
 				GatewayName: conf.GatewayName,
 				BrokerName:  ret.BrokerName,
 			}
-			if len(cpu_times) > 0 {
-				cpu.CpuTimes = cpu_times
+			if len(sc.CPUTimes) > 0 {
+				cpu.CpuTimes = sc.CPUTimes
 			}
 
 			ret.CPU = cpu
 		case "memory":
-			virtual_memory := parseStatus(section.Values["virtual_memory"])
+			var sc MemoryStatusSection
+			if err := section.Decode(&sc); err != nil {
+				return ret, err
+			}
 
 			mem := MemoryStatus{
 				GatewayName: conf.GatewayName,
 				BrokerName:  ret.BrokerName,
 			}
-			if len(virtual_memory) > 0 {
-				mem.VirtualMemory = virtual_memory
+			if len(sc.VirtualMemory) > 0 {
+				mem.VirtualMemory = sc.VirtualMemory
 			}
 			ret.Memory = mem
 
 		case "ip_address":
-			interfaces := parseStatus(section.Values["interface"])
+			var sc IPAddressStatusSection
+			if err := section.Decode(&sc); err != nil {
+				return ret, err
+			}
 			ip_address := IpAddressStatus{
 				GatewayName: conf.GatewayName,
 				BrokerName:  ret.BrokerName,
 			}
-			if len(interfaces) > 0 {
-				ip_address.Interfaces = interfaces
+			if len(sc.Interface) > 0 {
+				ip_address.Interfaces = sc.Interface
 			}
 			ret.IpAddress = ip_address
 		default:
@@ -352,6 +387,31 @@ func (device Status) Stop() error {
 	return nil
 }
 
+// DeviceName returns the name of the device.
+func (device Status) DeviceName() string {
+	return device.Name
+}
+
+// Call handles RPC request.
+// methods:
+//   ping: returns "pong"
+//   get: returns current status by topic
+func (device Status) Call(req message.Request) (interface{}, error) {
+	switch req.Method {
+	case "ping":
+		return "pong", nil
+	case "get":
+		ret := make(map[string]string)
+		msgs := append(device.CPU.Get(), device.Memory.Get()...)
+		msgs = append(msgs, device.IpAddress.Get()...)
+		for _, msg := range msgs {
+			ret[msg.Topic] = string(msg.Body)
+		}
+		return ret, nil
+	}
+	return nil, message.ErrUnknownMethod
+}
+
 func (device Status) DeviceType() string {
 	return "status"
 }
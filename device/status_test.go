@@ -20,6 +20,7 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
 )
 
 func TestParseStatus(t *testing.T) {
@@ -164,3 +165,34 @@ func TestIpAddressLoGet(t *testing.T) {
 	msgs := i.Get()
 	assert.True(len(msgs) > 0)
 }
+
+func TestStatusCall(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[[broker."sango"]]
+  host = "192.168.1.20"
+  port = 1033
+[[status."memory"]]
+  virtual_memory = "total"
+[status]
+  broker = "sango"
+  interval = 10
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	tt, err := NewStatus(conf)
+	assert.Nil(err)
+	c, ok := tt.(Caller)
+	assert.True(ok)
+	assert.Equal("status", c.DeviceName())
+
+	v, err := c.Call(message.Request{ID: "1", Method: "ping"})
+	assert.Nil(err)
+	assert.Equal("pong", v)
+	v, err = c.Call(message.Request{ID: "2", Method: "get"})
+	assert.Nil(err)
+	assert.Len(v, 1)
+	_, err = c.Call(message.Request{ID: "3", Method: "reboot"})
+	assert.Equal(message.ErrUnknownMethod, err)
+}
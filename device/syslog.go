@@ -0,0 +1,501 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	validator "gopkg.in/validator.v2"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+)
+
+const (
+	defaultSyslogListen = ":514"
+	syslogMaxSize       = 65536
+)
+
+var (
+	syslogFacilities = []string{
+		"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+		"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+		"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+	}
+	syslogSeverities = []string{
+		"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+	}
+)
+
+// SyslogDevice receives syslog messages and publishes them as JSON.
+type SyslogDevice struct {
+	Name       string `validate:"max=256,regexp=[^/]+,validtopic"`
+	Broker     []*broker.Broker
+	BrokerName string
+	QoS        byte   `validate:"min=0,max=2"`
+	Listen     string `validate:"min=1,max=256"`
+	Protocol   string `validate:"regexp=^(udp|tcp|both)$"`
+	Type       string `validate:"max=256"`
+	Retain     bool
+	Subscribe  bool
+	DeviceChan DeviceChannel // GW -> device
+
+	stop chan struct{}
+}
+
+// syslogEntry is a parsed syslog message.
+type syslogEntry struct {
+	Format         string                       `json:"format"`
+	Priority       int                          `json:"priority"`
+	Facility       string                       `json:"facility"`
+	Severity       string                       `json:"severity"`
+	Timestamp      string                       `json:"timestamp,omitempty"`
+	Hostname       string                       `json:"hostname,omitempty"`
+	AppName        string                       `json:"app_name,omitempty"`
+	ProcID         string                       `json:"proc_id,omitempty"`
+	MsgID          string                       `json:"msg_id,omitempty"`
+	StructuredData map[string]map[string]string `json:"structured_data,omitempty"`
+	Message        string                       `json:"message"`
+	Source         string                       `json:"source,omitempty"`
+}
+
+func (device SyslogDevice) String() string {
+	return fmt.Sprintf("%#v", device)
+}
+
+// SyslogDeviceSection is [device."<name>"] of type "syslog".
+type SyslogDeviceSection struct {
+	config.DeviceSection
+	Listen   string `toml:"listen"`
+	Protocol string `toml:"protocol"`
+}
+
+func init() {
+	config.RegisterSection("device/syslog", SyslogDeviceSection{})
+}
+
+// NewSyslogDevice read config.ConfigSection and returnes SyslogDevice.
+// If config validation failed, return error
+func NewSyslogDevice(section config.ConfigSection, brokers []*broker.Broker, devChan DeviceChannel) (SyslogDevice, error) {
+	ret := SyslogDevice{
+		Name:       section.Name,
+		DeviceChan: devChan,
+		Listen:     defaultSyslogListen,
+		Protocol:   "udp",
+		stop:       make(chan struct{}),
+	}
+	sc := SyslogDeviceSection{}
+	if err := section.Decode(&sc); err != nil {
+		return ret, err
+	}
+	if sc.Broker == "" {
+		return ret, fmt.Errorf("broker does not set")
+	}
+
+	for _, b := range brokers {
+		if b.Name == sc.Broker {
+			ret.Broker = brokers
+		}
+	}
+	if ret.Broker == nil {
+		return ret, fmt.Errorf("broker does not exists: %s", sc.Broker)
+	}
+	ret.BrokerName = sc.Broker
+
+	if _, ok := section.Values["qos"]; !ok {
+		return ret, fmt.Errorf("qos does not set")
+	}
+	ret.QoS = byte(sc.QoS)
+	if sc.Listen != "" {
+		ret.Listen = sc.Listen
+	}
+	if sc.Protocol != "" {
+		ret.Protocol = sc.Protocol
+	}
+	ret.Type = sc.Type
+	ret.Retain = sc.Retain
+	ret.Subscribe = sc.Subscribe
+
+	if err := ret.Validate(); err != nil {
+		return ret, err
+	}
+
+	return ret, nil
+}
+
+func (device *SyslogDevice) Validate() error {
+	validator := validator.NewValidator()
+	validator.SetValidationFunc("validtopic", config.ValidMqttPublishTopic)
+	if err := validator.Validate(device); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseSyslog parses RFC 5424 or RFC 3164 message.
+func parseSyslog(buf []byte, now time.Time) (syslogEntry, error) {
+	s := strings.TrimRight(string(buf), "\r\n\x00")
+	if !strings.HasPrefix(s, "<") {
+		return syslogEntry{}, fmt.Errorf("priority not found")
+	}
+	i := strings.Index(s, ">")
+	if i < 2 || i > 4 {
+		return syslogEntry{}, fmt.Errorf("invalid priority")
+	}
+	pri, err := strconv.Atoi(s[1:i])
+	if err != nil || pri < 0 || pri > 191 {
+		return syslogEntry{}, fmt.Errorf("invalid priority, %v", s[1:i])
+	}
+	entry := syslogEntry{
+		Priority: pri,
+		Facility: syslogFacilities[pri/8],
+		Severity: syslogSeverities[pri%8],
+	}
+	s = s[i+1:]
+
+	if strings.HasPrefix(s, "1 ") {
+		entry.Format = "rfc5424"
+		err = entry.parse5424(s[2:])
+	} else {
+		entry.Format = "rfc3164"
+		entry.parse3164(s, now)
+	}
+	return entry, err
+}
+
+// nextSyslogField splits a space separated field. "-" means nil value.
+func nextSyslogField(s string) (string, string) {
+	i := strings.Index(s, " ")
+	if i < 0 {
+		i = len(s)
+	}
+	f, rest := s[:i], strings.TrimPrefix(s[i:], " ")
+	if f == "-" {
+		f = ""
+	}
+	return f, rest
+}
+
+// parse5424 parses after the version.
+// ex: 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3"] message
+func (entry *syslogEntry) parse5424(s string) error {
+	entry.Timestamp, s = nextSyslogField(s)
+	entry.Hostname, s = nextSyslogField(s)
+	entry.AppName, s = nextSyslogField(s)
+	entry.ProcID, s = nextSyslogField(s)
+	entry.MsgID, s = nextSyslogField(s)
+
+	if strings.HasPrefix(s, "-") {
+		s = strings.TrimPrefix(s[1:], " ")
+	} else {
+		sd, rest, err := parseStructuredData(s)
+		if err != nil {
+			return err
+		}
+		entry.StructuredData = sd
+		s = strings.TrimPrefix(rest, " ")
+	}
+	entry.Message = strings.TrimPrefix(s, "\xef\xbb\xbf")
+	return nil
+}
+
+// parseStructuredData parses SD-ELEMENTs and returns the rest.
+func parseStructuredData(s string) (map[string]map[string]string, string, error) {
+	ret := make(map[string]map[string]string)
+	for strings.HasPrefix(s, "[") {
+		s = s[1:]
+		i := strings.IndexAny(s, " ]")
+		if i < 1 {
+			return nil, "", fmt.Errorf("invalid structured data id")
+		}
+		params := make(map[string]string)
+		ret[s[:i]] = params
+		s = s[i:]
+		for {
+			s = strings.TrimLeft(s, " ")
+			if strings.HasPrefix(s, "]") {
+				s = s[1:]
+				break
+			}
+			eq := strings.Index(s, "=\"")
+			if eq < 1 {
+				return nil, "", fmt.Errorf("invalid structured data param")
+			}
+			name := s[:eq]
+			s = s[eq+2:]
+			var value []byte
+			for {
+				if len(s) == 0 {
+					return nil, "", fmt.Errorf("unterminated structured data value")
+				}
+				c := s[0]
+				s = s[1:]
+				if c == '"' {
+					break
+				}
+				if c == '\\' && len(s) > 0 && (s[0] == '"' || s[0] == '\\' || s[0] == ']') {
+					c = s[0]
+					s = s[1:]
+				}
+				value = append(value, c)
+			}
+			params[name] = string(value)
+		}
+	}
+	return ret, s, nil
+}
+
+// parse3164 parses after the priority.
+// ex: Oct 11 22:14:15 mymachine su[123]: 'su root' failed
+func (entry *syslogEntry) parse3164(s string, now time.Time) {
+	if len(s) >= 16 && s[15] == ' ' {
+		t, err := time.ParseInLocation(time.Stamp, s[:15], now.Location())
+		if err == nil {
+			t = t.AddDate(now.Year(), 0, 0)
+			// message of last december received in january
+			if t.After(now.AddDate(0, 1, 0)) {
+				t = t.AddDate(-1, 0, 0)
+			}
+			entry.Timestamp = t.Format(time.RFC3339)
+			entry.Hostname, s = nextSyslogField(s[16:])
+		}
+	}
+
+	// TAG is alphanumeric up to 32 chars and may have [pid]
+	i := strings.IndexAny(s, ":[ ")
+	if i > 0 && i <= 32 {
+		tag, rest := s[:i], s[i:]
+		if strings.HasPrefix(rest, "[") {
+			if j := strings.Index(rest, "]"); j > 0 {
+				entry.ProcID = rest[1:j]
+				rest = rest[j+1:]
+			}
+		}
+		if strings.HasPrefix(rest, ":") {
+			entry.AppName = tag
+			s = strings.TrimPrefix(rest[1:], " ")
+		}
+	}
+	entry.Message = s
+}
+
+// readSyslogFrame reads a message from TCP stream. Both octet counting
+// and LF delimited framing (RFC 6587) are supported. Frames longer than
+// syslogMaxSize are errors, so that a client could not make the reader
+// buffer without limit.
+func readSyslogFrame(r *bufio.Reader) ([]byte, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] >= '0' && b[0] <= '9' {
+		// digits of syslogMaxSize and a space
+		l, err := readSyslogUntil(r, ' ', len(strconv.Itoa(syslogMaxSize))+1)
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(string(l)))
+		if err != nil || n <= 0 || n > syslogMaxSize {
+			return nil, fmt.Errorf("invalid octet count, %q", l)
+		}
+		buf := make([]byte, n)
+		_, err = io.ReadFull(r, buf)
+		return buf, err
+	}
+	line, err := readSyslogUntil(r, '\n', syslogMaxSize+len("\r\n"))
+	if err != nil && len(line) == 0 {
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+// readSyslogUntil reads until delim like ReadBytes, but returns an error
+// if delim is not found in max bytes.
+func readSyslogUntil(r *bufio.Reader, delim byte, max int) ([]byte, error) {
+	var ret []byte
+	for {
+		b, err := r.ReadSlice(delim)
+		if len(ret)+len(b) > max {
+			return nil, fmt.Errorf("syslog frame is longer than %d bytes", max)
+		}
+		ret = append(ret, b...)
+		if err != bufio.ErrBufferFull {
+			return ret, err
+		}
+	}
+}
+
+// publish parses the message and sends it to channel.
+func (device SyslogDevice) publish(buf []byte, source string, channel chan message.Message) {
+	if len(bytes.TrimSpace(buf)) == 0 {
+		return
+	}
+	entry, err := parseSyslog(buf, time.Now())
+	if err != nil {
+		log.Warnf("syslog parse failed, %v, %q", err, buf)
+		return
+	}
+	entry.Source = source
+	body, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("json encode error %s", err)
+		return
+	}
+	msg := message.Message{
+		Sender:     device.Name,
+		Type:       device.Type,
+		QoS:        device.QoS,
+		Retained:   device.Retain,
+		BrokerName: device.BrokerName,
+		Body:       body,
+	}
+	select {
+	case channel <- msg:
+	case <-device.stop:
+	}
+}
+
+func (device SyslogDevice) serveUDP(conn net.PacketConn, channel chan message.Message) {
+	buf := make([]byte, syslogMaxSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-device.stop:
+			default:
+				log.Errorf("syslog udp read failed, %v", err)
+			}
+			return
+		}
+		host, _, _ := net.SplitHostPort(addr.String())
+		device.publish(buf[:n], host, channel)
+	}
+}
+
+func (device SyslogDevice) serveTCP(listener net.Listener, channel chan message.Message) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-device.stop:
+			default:
+				log.Errorf("syslog tcp accept failed, %v", err)
+			}
+			return
+		}
+		go func(conn net.Conn) {
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				select {
+				case <-device.stop:
+				case <-done:
+				}
+				conn.Close()
+			}()
+
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			r := bufio.NewReader(conn)
+			for {
+				frame, err := readSyslogFrame(r)
+				if err != nil {
+					if err != io.EOF {
+						log.Debugf("syslog tcp connection closed, %v", err)
+					}
+					return
+				}
+				device.publish(frame, host, channel)
+			}
+		}(conn)
+	}
+}
+
+func (device SyslogDevice) Start(channel chan message.Message) error {
+	var closers []io.Closer
+	if device.Protocol == "udp" || device.Protocol == "both" {
+		conn, err := net.ListenPacket("udp", device.Listen)
+		if err != nil {
+			return fmt.Errorf("syslog device start failed, %v", err)
+		}
+		closers = append(closers, conn)
+		go device.serveUDP(conn, channel)
+	}
+	if device.Protocol == "tcp" || device.Protocol == "both" {
+		listener, err := net.Listen("tcp", device.Listen)
+		if err != nil {
+			for _, c := range closers {
+				c.Close()
+			}
+			return fmt.Errorf("syslog device start failed, %v", err)
+		}
+		closers = append(closers, listener)
+		go device.serveTCP(listener, channel)
+	}
+
+	log.Info("start syslog device")
+	go func() {
+		for {
+			select {
+			case msg, _ := <-device.DeviceChan.Chan:
+				log.Debugf("msg reached to syslog device, ignored, %v", msg)
+			case <-device.stop:
+				for _, c := range closers {
+					c.Close()
+				}
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (device SyslogDevice) Stop() error {
+	log.Infof("closing syslog: %v", device.Name)
+	select {
+	case <-device.stop:
+	default:
+		close(device.stop)
+	}
+	return nil
+}
+
+func (device SyslogDevice) DeviceType() string {
+	return "syslog"
+}
+
+// DeviceName returns the name of the device.
+func (device SyslogDevice) DeviceName() string {
+	return device.Name
+}
+
+func (device SyslogDevice) AddSubscribe() error {
+	if !device.Subscribe {
+		return nil
+	}
+	for _, b := range device.Broker {
+		b.AddSubscribed(device.Name, device.QoS)
+	}
+	return nil
+}
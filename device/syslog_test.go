@@ -0,0 +1,196 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+)
+
+// testSyslogConfig is the device with the default listen and protocol.
+const testSyslogConfig = `
+[device."netlog"]
+    type = "syslog"
+    broker = "sango"
+    qos = 0
+`
+
+func receiveSyslogEntry(t *testing.T, channel chan message.Message) syslogEntry {
+	var entry syslogEntry
+	select {
+	case msg := <-channel:
+		assert.Nil(t, json.Unmarshal(msg.Body, &entry))
+	case <-time.After(time.Second):
+		t.Fatal("syslog message timeout")
+	}
+	return entry
+}
+
+func TestNewSyslogDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := NewSyslogDevice(testDeviceArgs(t, testSyslogConfig))
+	assert.Nil(err)
+	assert.Equal(":514", d.Listen)
+	assert.Equal("udp", d.Protocol)
+
+	conf, err := config.LoadConfigByte([]byte(`
+[device."netlog"]
+    type = "syslog"
+    broker = "sango"
+    qos = 0
+    protocol = "sctp"
+`))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	_, err = NewSyslogDevice(conf.Sections[0], []*broker.Broker{b1}, NewDeviceChannel())
+	assert.NotNil(err)
+}
+
+func TestParseSyslog5424(t *testing.T) {
+	assert := assert.New(t)
+
+	entry, err := parseSyslog([]byte(`<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"][examplePriority@32473 class="high \"x\""] `+"\xef\xbb\xbf"+`An application event log entry...`), time.Now())
+	assert.Nil(err)
+	assert.Equal("rfc5424", entry.Format)
+	assert.Equal(165, entry.Priority)
+	assert.Equal("local4", entry.Facility)
+	assert.Equal("notice", entry.Severity)
+	assert.Equal("2003-10-11T22:14:15.003Z", entry.Timestamp)
+	assert.Equal("mymachine.example.com", entry.Hostname)
+	assert.Equal("evntslog", entry.AppName)
+	assert.Equal("", entry.ProcID)
+	assert.Equal("ID47", entry.MsgID)
+	assert.Equal("1011", entry.StructuredData["exampleSDID@32473"]["eventID"])
+	assert.Equal(`high "x"`, entry.StructuredData["examplePriority@32473"]["class"])
+	assert.Equal("An application event log entry...", entry.Message)
+
+	entry, err = parseSyslog([]byte("<34>1 2003-10-11T22:14:15.003Z host su 123 - - 'su root' failed\n"), time.Now())
+	assert.Nil(err)
+	assert.Equal("123", entry.ProcID)
+	assert.Nil(entry.StructuredData)
+	assert.Equal("'su root' failed", entry.Message)
+
+	_, err = parseSyslog([]byte(`<34>1 - host su - - [broken`), time.Now())
+	assert.NotNil(err)
+}
+
+func TestParseSyslog3164(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2015, 10, 12, 0, 0, 0, 0, time.UTC)
+	entry, err := parseSyslog([]byte("<34>Oct 11 22:14:15 mymachine su[123]: 'su root' failed for lonvick on /dev/pts/8"), now)
+	assert.Nil(err)
+	assert.Equal("rfc3164", entry.Format)
+	assert.Equal("auth", entry.Facility)
+	assert.Equal("crit", entry.Severity)
+	assert.Equal("2015-10-11T22:14:15Z", entry.Timestamp)
+	assert.Equal("mymachine", entry.Hostname)
+	assert.Equal("su", entry.AppName)
+	assert.Equal("123", entry.ProcID)
+	assert.Equal("'su root' failed for lonvick on /dev/pts/8", entry.Message)
+
+	// december message received in january
+	now = time.Date(2016, 1, 1, 0, 0, 10, 0, time.UTC)
+	entry, err = parseSyslog([]byte("<13>Dec 31 23:59:59 router kernel: link down"), now)
+	assert.Nil(err)
+	assert.Equal("2015-12-31T23:59:59Z", entry.Timestamp)
+
+	entry, err = parseSyslog([]byte("<13>just a message"), now)
+	assert.Nil(err)
+	assert.Equal("", entry.Timestamp)
+	assert.Equal("just a message", entry.Message)
+
+	for _, s := range []string{"no priority", "<192>Oct 11 22:14:15 host msg", "<x>msg"} {
+		_, err = parseSyslog([]byte(s), now)
+		assert.NotNil(err, s)
+	}
+}
+
+func TestReadSyslogFrame(t *testing.T) {
+	assert := assert.New(t)
+
+	r := bufio.NewReader(strings.NewReader("10 <13>hello\n\n<13>world\r\n<13>last"))
+	for _, expected := range []string{"<13>hello\n", "", "<13>world", "<13>last"} {
+		frame, err := readSyslogFrame(r)
+		assert.Nil(err)
+		assert.Equal(expected, string(frame))
+	}
+	_, err := readSyslogFrame(r)
+	assert.NotNil(err)
+
+	r = bufio.NewReader(strings.NewReader("99999999 <13>hello"))
+	_, err = readSyslogFrame(r)
+	assert.NotNil(err)
+
+	// never ending count and line are not buffered
+	for _, s := range []string{
+		strings.Repeat("9", syslogMaxSize*2),
+		"<13>" + strings.Repeat("x", syslogMaxSize*2) + "\n",
+	} {
+		_, err = readSyslogFrame(bufio.NewReader(strings.NewReader(s)))
+		assert.NotNil(err)
+	}
+
+	// the longest line
+	line := "<13>" + strings.Repeat("x", syslogMaxSize-4)
+	frame, err := readSyslogFrame(bufio.NewReader(strings.NewReader(line + "\r\n")))
+	assert.Nil(err)
+	assert.Equal(line, string(frame))
+}
+
+func TestSyslogServe(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := NewSyslogDevice(testDeviceArgs(t, testSyslogConfig))
+	assert.Nil(err)
+	channel := make(chan message.Message, 10)
+	defer d.Stop()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer pc.Close()
+	go d.serveUDP(pc, channel)
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	assert.Nil(err)
+	conn.Write([]byte("<13>Oct 11 22:14:15 switch1 lldp: neighbor changed"))
+	conn.Close()
+	entry := receiveSyslogEntry(t, channel)
+	assert.Equal("switch1", entry.Hostname)
+	assert.Equal("127.0.0.1", entry.Source)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer l.Close()
+	go d.serveTCP(l, channel)
+
+	conn, err = net.Dial("tcp", l.Addr().String())
+	assert.Nil(err)
+	defer conn.Close()
+	conn.Write([]byte("<13>1 - host1 app - - - first\n" + "30 <13>1 - host2 app - - - second"))
+	assert.Equal("first", receiveSyslogEntry(t, channel).Message)
+	assert.Equal("second", receiveSyslogEntry(t, channel).Message)
+}
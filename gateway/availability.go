@@ -0,0 +1,220 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+)
+
+// availabilityCheckInterval is the interval to check silent devices.
+const availabilityCheckInterval = time.Second
+
+// DeviceAvailability is whether the device is online. The device becomes
+// online when it sends data, and offline if it is silent for Timeout or
+// its port is lost. The state is published as the retained message to
+// "<prefix>/<gateway>/<device>/availability".
+//
+// MQTT has only one will per connection, so the state is published by
+// the own connection of the device, whose will is the retained offline.
+// The states are also reset to offline when the gateway starts or is
+// closed.
+type DeviceAvailability struct {
+	Timeout    time.Duration
+	BrokerName string
+
+	online   bool
+	lastSeen time.Time
+	brokers  broker.Brokers // ordered by Priority
+}
+
+// parseAvailability returns the availability of the devices which have
+// availability_timeout, or all devices if the gateway section has it.
+// ex:
+//   [gateway]
+//       availability_timeout = 300
+//   [device."spam"]
+//       availability_timeout = 60
+func parseAvailability(conf config.Config, defaultTimeout string) (map[string]*DeviceAvailability, error) {
+	ret := make(map[string]*DeviceAvailability)
+	for _, section := range conf.Sections {
+		if section.Type != "device" {
+			continue
+		}
+		v := section.Values["availability_timeout"]
+		if v == "" {
+			v = defaultTimeout
+		}
+		if v == "" {
+			continue
+		}
+		timeout, err := strconv.Atoi(v)
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("invalid availability_timeout: %s", v)
+		}
+		if timeout == 0 {
+			continue
+		}
+		ret[section.Name] = &DeviceAvailability{
+			Timeout:    time.Duration(timeout) * time.Second,
+			BrokerName: section.Values["broker"],
+		}
+	}
+	return ret, nil
+}
+
+func (gw *Gateway) availabilityMessage(name string, a *DeviceAvailability) message.Message {
+	body := message.Offline
+	if a.online {
+		body = message.Online
+	}
+	return message.Message{
+		Sender:     name,
+		Type:       message.TypeAvailability,
+		QoS:        1,
+		Retained:   true,
+		BrokerName: a.BrokerName,
+		Body:       []byte(body),
+		Created:    time.Now(),
+	}
+}
+
+// seen marks the device online. It returns true if the state is changed.
+func (gw *Gateway) seen(name string, now time.Time) bool {
+	a, ok := gw.Availability[name]
+	if !ok {
+		return false
+	}
+	a.lastSeen = now
+	if a.online {
+		return false
+	}
+	a.online = true
+	log.Infof("device online: %v", name)
+	go gw.publishAvailability(gw.availabilityMessage(name, a), a)
+	return true
+}
+
+// setOffline marks the device offline. It returns true if the state is
+// changed.
+func (gw *Gateway) setOffline(name string) bool {
+	a, ok := gw.Availability[name]
+	if !ok || !a.online {
+		return false
+	}
+	a.online = false
+	log.Warnf("device offline: %v", name)
+	go gw.publishAvailability(gw.availabilityMessage(name, a), a)
+	return true
+}
+
+// checkAvailability marks the silent devices offline, and returns them.
+func (gw *Gateway) checkAvailability(now time.Time) []string {
+	var ret []string
+	for name, a := range gw.Availability {
+		if a.online && now.Sub(a.lastSeen) >= a.Timeout {
+			gw.setOffline(name)
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+// ConnectAvailability connects to the brokers of the devices which have
+// availability. The connections are closed by closeAvailability.
+func (gw *Gateway) ConnectAvailability() {
+	for name, a := range gw.Availability {
+		for _, b := range gw.Brokers {
+			if b.Name != a.BrokerName {
+				continue
+			}
+			ab, err := broker.NewAvailabilityBroker(b, name)
+			if err != nil {
+				log.Errorf("availability broker create error, %v", err)
+				continue
+			}
+			if err := ab.MQTTClientSetup(gw.Name + "-" + name + "-availability"); err != nil {
+				log.Errorf("availability broker connect failed, %v", err)
+				continue
+			}
+			a.brokers = append(a.brokers, ab)
+		}
+	}
+}
+
+// closeAvailability closes the connections of the devices.
+func (gw *Gateway) closeAvailability() {
+	for _, a := range gw.Availability {
+		for _, b := range a.brokers {
+			b.Close()
+		}
+		a.brokers = nil
+	}
+}
+
+// publishAvailability publishes the state to the first connected broker
+// of the device, like Publish.
+func (gw *Gateway) publishAvailability(msg message.Message, a *DeviceAvailability) {
+	for _, b := range a.brokers {
+		if !b.IsConnected() {
+			continue
+		}
+		err := b.Publish(&msg)
+		if err == nil {
+			return
+		}
+		log.Warnf("availability publish failed, %v", err)
+	}
+	log.Errorf("availability discarded, broker: %v, sender: %v", msg.BrokerName, msg.Sender)
+}
+
+// resetAvailability publishes offline of all devices to all connected
+// brokers. It does not retry, not to block starting or closing.
+func (gw *Gateway) resetAvailability() {
+	for name, a := range gw.Availability {
+		a.online = false
+		msg := gw.availabilityMessage(name, a)
+		for _, b := range a.brokers {
+			if !b.IsConnected() {
+				continue
+			}
+			if err := b.Publish(&msg); err != nil {
+				log.Warnf("availability publish failed, %v", err)
+			}
+		}
+	}
+}
+
+// handleAvailability updates the availability by the message from the
+// device. It returns true if the message is not data but availability.
+func (gw *Gateway) handleAvailability(msg message.Message) bool {
+	if msg.Type != message.TypeAvailability {
+		gw.seen(msg.Sender, time.Now())
+		return false
+	}
+	if string(msg.Body) == message.Offline {
+		gw.setOffline(msg.Sender)
+	} else {
+		gw.seen(msg.Sender, time.Now())
+	}
+	return true
+}
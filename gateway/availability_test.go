@@ -0,0 +1,141 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+)
+
+func TestParseAvailability(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[gateway]
+    name = "ham"
+    availability_timeout = 300
+
+[device."dora"]
+    type = "dummy"
+    broker = "sango"
+
+[device."nobita"]
+    type = "serial"
+    broker = "akane"
+    availability_timeout = 60
+
+[device."suneo"]
+    type = "dummy"
+    broker = "sango"
+    availability_timeout = 0
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	gw, err := NewGateway(conf)
+	assert.Nil(err)
+
+	assert.Equal(2, len(gw.Availability))
+	assert.Equal(300*time.Second, gw.Availability["dora"].Timeout)
+	assert.Equal("sango", gw.Availability["dora"].BrokerName)
+	assert.Equal(60*time.Second, gw.Availability["nobita"].Timeout)
+	assert.Equal("akane", gw.Availability["nobita"].BrokerName)
+
+	_, err = parseAvailability(conf, "-1")
+	assert.NotNil(err)
+}
+
+func TestAvailability(t *testing.T) {
+	assert := assert.New(t)
+
+	gw := &Gateway{
+		Name: "ham",
+		Availability: map[string]*DeviceAvailability{
+			"dora": &DeviceAvailability{Timeout: 10 * time.Second, BrokerName: "sango"},
+		},
+	}
+	now := time.Now()
+
+	// online when the device sends data
+	assert.True(gw.seen("dora", now))
+	assert.False(gw.seen("dora", now.Add(5*time.Second)))
+	assert.False(gw.seen("nobita", now))
+
+	// offline after the silence
+	assert.Nil(gw.checkAvailability(now.Add(14 * time.Second)))
+	assert.Equal([]string{"dora"}, gw.checkAvailability(now.Add(15*time.Second)))
+	assert.Nil(gw.checkAvailability(now.Add(30 * time.Second)))
+
+	// offline when the port is lost
+	assert.False(gw.handleAvailability(message.Message{Sender: "dora", Type: "status"}))
+	assert.True(gw.Availability["dora"].online)
+	assert.True(gw.handleAvailability(message.Message{
+		Sender: "dora",
+		Type:   message.TypeAvailability,
+		Body:   []byte(message.Offline),
+	}))
+	assert.False(gw.Availability["dora"].online)
+
+	msg := gw.availabilityMessage("dora", gw.Availability["dora"])
+	assert.Equal(message.TypeAvailability, msg.Type)
+	assert.Equal("sango", msg.BrokerName)
+	assert.True(msg.Retained)
+	assert.Equal([]byte("offline"), msg.Body)
+}
+
+func TestAvailabilityUngraceful(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[gateway]
+    name = "ham"
+    availability_timeout = 10
+
+[[broker."sango/1"]]
+    host = "192.168.1.22"
+    port = 1883
+    will_message = "offline"
+
+[device."dora"]
+    type = "dummy"
+    broker = "sango"
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	gw, err := NewGateway(conf)
+	assert.Nil(err)
+	brokers, err := broker.NewBrokers(conf, gw.BrokerChan)
+	assert.Nil(err)
+
+	// the device connects with its own will, so the broker replaces the
+	// retained online by the offline when the gateway crashes
+	a := gw.Availability["dora"]
+	ab, err := broker.NewAvailabilityBroker(brokers[0], "dora")
+	assert.Nil(err)
+	assert.True(ab.Will.Retain)
+
+	assert.True(gw.seen("dora", time.Now()))
+	online := gw.availabilityMessage("dora", a)
+	assert.Equal([]byte("online"), online.Body)
+	assert.True(online.Retained)
+	topic, err := ab.GenerateTopic(&online)
+	assert.Nil(err)
+	assert.Equal(ab.Will.Topic, topic.Str)
+}
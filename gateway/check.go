@@ -0,0 +1,94 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"fmt"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/device"
+	"github.com/shiguredo/fuji/message"
+)
+
+// sectionName returns the section name as written in the config.
+// ex: broker "sango/1"
+func sectionName(s config.ConfigSection) string {
+	name := s.Name
+	if s.Arg != "" {
+		name += "/" + s.Arg
+	}
+	if name == "" {
+		return s.Type
+	}
+	return fmt.Sprintf("%s %q", s.Type, name)
+}
+
+// CheckConfig creates the gateway, brokers, devices and status from the
+// config without connecting anywhere, and returns all errors with the
+// section names.
+func CheckConfig(conf config.Config) []error {
+	var errs []error
+
+	if _, err := NewGateway(conf); err != nil {
+		errs = append(errs, fmt.Errorf("gateway: %v", err))
+	}
+
+	// brokers one by one, to find all invalid brokers
+	var brokers broker.Brokers
+	for _, section := range conf.Sections {
+		if section.Type != "broker" {
+			continue
+		}
+		c := config.Config{
+			GatewayName: conf.GatewayName,
+			BrokerNames: conf.BrokerNames,
+			Sections:    []config.ConfigSection{section},
+		}
+		bs, err := broker.NewBrokers(c, make(chan message.Message))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", sectionName(section), err))
+			continue
+		}
+		brokers = append(brokers, bs...)
+	}
+	if len(conf.BrokerNames) == 0 {
+		errs = append(errs, fmt.Errorf("config does not have broker"))
+	}
+
+	for _, section := range conf.Sections {
+		if section.Type != "device" {
+			continue
+		}
+		if _, err := device.NewDevice(section, brokers, device.NewDeviceChannel()); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", sectionName(section), err))
+		}
+	}
+
+	if config.SearchSection(&conf.Sections, "status", "") != nil {
+		if _, err := device.NewStatus(conf); err != nil {
+			errs = append(errs, fmt.Errorf("status: %v", err))
+		}
+	}
+	return errs
+}
+
+// ValidateConfig returns the first error of CheckConfig.
+func ValidateConfig(conf config.Config) error {
+	if errs := CheckConfig(conf); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
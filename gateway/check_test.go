@@ -0,0 +1,110 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/config"
+)
+
+func TestCheckConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[gateway]
+    name = "ham"
+    rpc_timeout = 0
+
+[[broker."sango/1"]]
+    host = "localhost"
+    port = 1883
+
+[[broker."akane/2"]]
+    host = "localhost"
+    port = 8883
+    tls = true
+    cacert = "/fuji-not-exist/ca.pem"
+
+[device."dora"]
+    type = "dummy"
+    broker = "sango"
+    qos = 0
+    interval = -1
+
+[device."nobita"]
+    type = "dummy"
+    broker = "sango"
+    qos = 0
+    interval = 10
+    payload = "Hello world."
+
+[status]
+    broker = "suneo"
+    interval = 10
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+
+	errs := CheckConfig(conf)
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	assert.Equal(4, len(msgs), msgs)
+	assert.Contains(msgs[0], "gateway: ")
+	assert.Contains(msgs[1], `broker "akane/2": `)
+	assert.Contains(msgs[2], `device "dora": `)
+	assert.Equal("status: broker does not exists: suneo", msgs[3])
+
+	assert.Equal(errs[0], ValidateConfig(conf))
+}
+
+func TestCheckConfigValid(t *testing.T) {
+	assert := assert.New(t)
+
+	conf, err := config.LoadConfigByte([]byte(pushedConfig))
+	assert.Nil(err)
+	assert.Nil(CheckConfig(conf))
+	assert.Nil(ValidateConfig(conf))
+}
+
+func TestValidateConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	conf, err := config.LoadConfigByte([]byte(pushedConfig))
+	assert.Nil(err)
+	assert.Nil(ValidateConfig(conf))
+
+	// invalid device is not skipped
+	conf, err = config.LoadConfigByte([]byte(pushedConfig + `
+[device."nobita"]
+    type = "dummy"
+    broker = "sango"
+    qos = 0
+    interval = -1
+`))
+	assert.Nil(err)
+	assert.NotNil(ValidateConfig(conf))
+
+	conf, err = config.LoadConfigByte([]byte(`
+[gateway]
+    name = "ham"
+`))
+	assert.Nil(err)
+	assert.NotNil(ValidateConfig(conf))
+}
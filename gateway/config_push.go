@@ -0,0 +1,169 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+)
+
+const DefaultConfigGracePeriod = 30 // sec
+
+var (
+	// ErrConfigPushed is returned by MainLoop when the gateway is closed
+	// to apply the pushed config.
+	ErrConfigPushed = errors.New("pushed config is written")
+	// ErrConfigRolledBack is returned by MainLoop when the gateway is
+	// closed to reload the restored config.
+	ErrConfigRolledBack = errors.New("config is rolled back")
+)
+
+// signConfig returns HMAC-SHA256 of the config in hex.
+func signConfig(secret string, data []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// pushConfig validates the pushed config and writes it to ConfigPath.
+// signature is required if ConfigSecret is set.
+// ex of params:
+//   {"config": "[gateway]\n    name = \"ham\"\n...", "signature": "5d41..."}
+func (gw *Gateway) pushConfig(params json.RawMessage) error {
+	var p struct {
+		Config    string `json:"config"`
+		Signature string `json:"signature"`
+	}
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &p); err != nil {
+			return fmt.Errorf("invalid params, %v", err)
+		}
+	}
+	if gw.ConfigPath == "" {
+		return fmt.Errorf("config file is unknown")
+	}
+	data := []byte(p.Config)
+	if gw.ConfigSecret != "" {
+		sig, err := hex.DecodeString(p.Signature)
+		expected, _ := hex.DecodeString(signConfig(gw.ConfigSecret, data))
+		if err != nil || !hmac.Equal(sig, expected) {
+			return fmt.Errorf("invalid signature")
+		}
+	}
+	conf, err := config.LoadConfigByteFrom(data, gw.ConfigPath)
+	if err != nil {
+		return err
+	}
+	if err := ValidateConfig(conf); err != nil {
+		return err
+	}
+	if err := config.WriteConfig(gw.ConfigPath, data); err != nil {
+		return err
+	}
+	log.Warnf("pushed config is written: %v", gw.ConfigPath)
+	return nil
+}
+
+// waitConnected waits until all brokers are connected. It returns false
+// if they are not connected within d.
+func (gw *Gateway) waitConnected(d time.Duration) bool {
+	deadline := time.Now().Add(d)
+	for {
+		connected := true
+		for _, b := range gw.Brokers {
+			if !b.IsConnected() {
+				connected = false
+			}
+		}
+		if connected {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// publishConfigStatus publishes the outcome of the config push to
+// "<prefix>/<gateway>/$control/push-config/status" on ControlBroker.
+// ex:
+//   {"status": "rolled_back", "error": "brokers are not connected in 30 sec", "time": "2015-06-01T12:00:00Z"}
+func (gw *Gateway) publishConfigStatus(status string, cause error) {
+	v := map[string]string{
+		"status": status,
+		"time":   time.Now().UTC().Format(time.RFC3339),
+	}
+	if cause != nil {
+		v["error"] = cause.Error()
+	}
+	body, _ := json.Marshal(v)
+	log.Infof("config status: %s", body)
+
+	for _, b := range gw.Brokers {
+		if b.Name != gw.ControlBroker {
+			continue
+		}
+		gw.Publish(message.Message{
+			Sender:     ControlTopic,
+			Type:       message.TypeRPC,
+			QoS:        1,
+			Retained:   true,
+			BrokerName: b.Name,
+			Topic:      strings.Join([]string{b.TopicPrefix, gw.Name, ControlTopic, "push-config", "status"}, "/"),
+			Body:       body,
+			Created:    time.Now(),
+		})
+		return
+	}
+}
+
+// ConfirmConfig is invoked after the pushed config is applied. The
+// previous config is restored and reloaded if brokers are not connected
+// within ConfigGracePeriod.
+func (gw *Gateway) ConfirmConfig() {
+	grace := time.Duration(gw.ConfigGracePeriod) * time.Second
+	if gw.waitConnected(grace) {
+		gw.publishConfigStatus("applied", nil)
+		return
+	}
+	log.Errorf("brokers are not connected in %v with the pushed config, rolling back", grace)
+	if err := config.RestoreConfig(gw.ConfigPath); err != nil {
+		log.Errorf("config restore failed, %v", err)
+		return
+	}
+	gw.CmdChan <- "rollback-config"
+}
+
+// ReportRollback publishes that the pushed config is rolled back after
+// brokers are connected with the previous config.
+func (gw *Gateway) ReportRollback() {
+	grace := time.Duration(gw.ConfigGracePeriod) * time.Second
+	if !gw.waitConnected(grace) {
+		log.Errorf("brokers are not connected in %v with the previous config", grace)
+	}
+	gw.publishConfigStatus("rolled_back", fmt.Errorf("brokers were not connected in %v", grace))
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+)
+
+const pushedConfig = `
+[gateway]
+    name = "ham"
+
+[[broker."sango/1"]]
+    host = "localhost"
+    port = 1883
+
+[device."dora"]
+    type = "dummy"
+    broker = "sango"
+    qos = 0
+    interval = 10
+    payload = "Hello world."
+`
+
+func newPushTestGateway(t *testing.T) (*Gateway, string) {
+	dir, err := ioutil.TempDir("", "fuji-push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.toml")
+	if err := ioutil.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gw := &Gateway{
+		Name:              "ham",
+		ConfigPath:        path,
+		ConfigSecret:      "dorayaki",
+		ConfigGracePeriod: 1,
+		CmdChan:           make(chan string, 1),
+	}
+	return gw, dir
+}
+
+func TestPushConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	gw, dir := newPushTestGateway(t)
+	defer os.RemoveAll(dir)
+
+	params := func(conf, sig string) json.RawMessage {
+		b, _ := json.Marshal(map[string]string{"config": conf, "signature": sig})
+		return b
+	}
+
+	// invalid signature
+	assert.NotNil(gw.pushConfig(params(pushedConfig, signConfig("anpan", []byte(pushedConfig)))))
+	assert.NotNil(gw.pushConfig(params(pushedConfig, "")))
+	// invalid config
+	assert.NotNil(gw.pushConfig(params("[gateway", signConfig("dorayaki", []byte("[gateway")))))
+	b, _ := ioutil.ReadFile(gw.ConfigPath)
+	assert.Equal("old", string(b))
+
+	assert.Nil(gw.pushConfig(params(pushedConfig, signConfig("dorayaki", []byte(pushedConfig)))))
+	b, _ = ioutil.ReadFile(gw.ConfigPath)
+	assert.Equal(pushedConfig, string(b))
+	b, _ = ioutil.ReadFile(gw.ConfigPath + config.PrevSuffix)
+	assert.Equal("old", string(b))
+
+	// without secret, authorised by the control topic only
+	gw.ConfigSecret = ""
+	assert.Nil(gw.pushConfig(params(pushedConfig, "")))
+}
+
+func TestConfirmConfigRollback(t *testing.T) {
+	assert := assert.New(t)
+
+	gw, dir := newPushTestGateway(t)
+	defer os.RemoveAll(dir)
+	assert.Nil(config.WriteConfig(gw.ConfigPath, []byte(pushedConfig)))
+
+	// never connected
+	gw.Brokers = broker.Brokers{&broker.Broker{Name: "sango"}}
+	gw.ConfirmConfig()
+
+	select {
+	case cmd := <-gw.CmdChan:
+		assert.Equal("rollback-config", cmd)
+	case <-time.After(time.Second):
+		assert.Fail("rollback-config is not sent")
+	}
+	b, _ := ioutil.ReadFile(gw.ConfigPath)
+	assert.Equal("old", string(b))
+}
+
+func TestWaitConnected(t *testing.T) {
+	assert := assert.New(t)
+
+	gw := &Gateway{}
+	assert.True(gw.waitConnected(0))
+	gw.Brokers = broker.Brokers{&broker.Broker{Name: "sango"}}
+	assert.False(gw.waitConnected(200 * time.Millisecond))
+}
@@ -0,0 +1,239 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/message"
+)
+
+const (
+	// ControlTopic is the topic level of remote control commands,
+	// "<prefix>/<gateway>/$control/<command>".
+	ControlTopic = "$control"
+
+	DefaultControlCommands = "ping,get-config"
+	redactedValue          = "********"
+)
+
+// controlCommands are the commands which can be sent to ControlTopic.
+var controlCommands = map[string]bool{
+	"ping":           true,
+	"get-config":     true,
+	"set-log-level":  true,
+	"restart-device": true,
+	"reload-config":  true,
+	"shutdown":       true,
+	"push-config":    true,
+}
+
+// secretKeys are substrings of config keys whose values are redacted.
+var secretKeys = []string{"password", "secret", "token", "passphrase", "_key"}
+
+// parseControlCommands parses the allow-list of remote control commands.
+// ex:
+//   control_commands = "ping, get-config, restart-device"
+func parseControlCommands(value string) ([]string, error) {
+	if value == "" {
+		value = DefaultControlCommands
+	}
+	var ret []string
+	for _, c := range strings.Split(value, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !controlCommands[c] {
+			return nil, fmt.Errorf("invalid control_commands: %s", c)
+		}
+		ret = append(ret, c)
+	}
+	return ret, nil
+}
+
+// controlCommand returns the command of the topic
+// "<prefix>/<gateway>/$control/<command>". isControl is true for all
+// topics under ControlTopic of the gateway, including the replies.
+func (gw *Gateway) controlCommand(topic string) (command string, isControl bool) {
+	levels := strings.Split(topic, "/")
+	for i := 1; i < len(levels); i++ {
+		if levels[i] != ControlTopic || levels[i-1] != gw.Name {
+			continue
+		}
+		if i == len(levels)-2 {
+			return levels[i+1], true
+		}
+		return "", true
+	}
+	return "", false
+}
+
+func (gw *Gateway) permitted(command string) bool {
+	for _, c := range gw.ControlCommands {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+// controlSection is a config section returned by get-config.
+type controlSection struct {
+	Type   string            `json:"type"`
+	Name   string            `json:"name,omitempty"`
+	Arg    string            `json:"arg,omitempty"`
+	Values map[string]string `json:"values"`
+}
+
+// redactedConfig returns the config sections without secrets.
+func (gw *Gateway) redactedConfig() []controlSection {
+	var ret []controlSection
+	for _, s := range gw.Config.Sections {
+		values := make(map[string]string, len(s.Values))
+		for k, v := range s.Values {
+			values[k] = v
+			for _, secret := range secretKeys {
+				if strings.Contains(strings.ToLower(k), secret) {
+					values[k] = redactedValue
+					break
+				}
+			}
+		}
+		ret = append(ret, controlSection{Type: s.Type, Name: s.Name, Arg: s.Arg, Values: values})
+	}
+	return ret
+}
+
+// control executes the command. cmd is sent to CmdChan after the
+// response is published.
+func (gw *Gateway) control(command string, params json.RawMessage) (result interface{}, cmd string, err error) {
+	var p struct {
+		Level  string `json:"level"`
+		Device string `json:"device"`
+	}
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, "", fmt.Errorf("invalid params, %v", err)
+		}
+	}
+
+	switch command {
+	case "ping":
+		return "pong", "", nil
+	case "get-config":
+		return gw.redactedConfig(), "", nil
+	case "set-log-level":
+		level, err := log.ParseLevel(p.Level)
+		if err != nil {
+			return nil, "", err
+		}
+		log.SetLevel(level)
+		return level.String(), "", nil
+	case "restart-device":
+		for _, d := range gw.Devices {
+			if d.DeviceName() == p.Device {
+				return "accepted", "restart-device " + p.Device, nil
+			}
+		}
+		return nil, "", fmt.Errorf("device not found, %v", p.Device)
+	case "reload-config":
+		return "accepted", "reload", nil
+	case "shutdown":
+		return "accepted", "close", nil
+	case "push-config":
+		if err := gw.pushConfig(params); err != nil {
+			go gw.publishConfigStatus("rejected", err)
+			return nil, "", err
+		}
+		return "accepted", "apply-config", nil
+	}
+	return nil, "", message.ErrUnknownMethod
+}
+
+// HandleControl executes the remote control command if the subscribed
+// message is sent to ControlTopic on ControlBroker, and publishes the
+// response to "<topic>/reply" or reply_to of the request.
+// ex:
+//   topic: pre/ham/$control/restart-device
+//   body:  {"id": "42", "params": {"device": "dora"}}
+// It returns false if the message is not a control command.
+func (gw *Gateway) HandleControl(msg message.Message) bool {
+	if gw.ControlBroker == "" || msg.Sender != gw.ControlBroker {
+		return false
+	}
+	command, ok := gw.controlCommand(msg.Topic)
+	if !ok {
+		return false
+	}
+	if command == "" {
+		// replies or unknown topics under ControlTopic
+		return true
+	}
+
+	var req message.Request
+	var res message.Response
+	var cmd string
+	if len(msg.Body) > 0 {
+		if err := json.Unmarshal(msg.Body, &req); err != nil {
+			log.Warnf("control command discarded, %v", err)
+			return true
+		}
+	}
+	switch {
+	case req.ReplyTo != "" && config.ValidMqttPublishTopic(req.ReplyTo, "") != nil:
+		log.Warnf("control command discarded, invalid reply_to: %v", req.ReplyTo)
+		return true
+	case !gw.permitted(command):
+		log.Warnf("control command not permitted: %v", command)
+		res = message.NewResponse(req.ID, nil, fmt.Errorf("not permitted"))
+	default:
+		log.Infof("control command: %v", command)
+		var result interface{}
+		var err error
+		result, cmd, err = gw.control(command, req.Params)
+		res = message.NewResponse(req.ID, result, err)
+	}
+
+	topic := req.ReplyTo
+	if topic == "" {
+		topic = msg.Topic + "/reply"
+	}
+	go func() {
+		body, err := json.Marshal(res)
+		if err != nil {
+			body, _ = json.Marshal(message.NewResponse(req.ID, nil, err))
+		}
+		gw.Publish(message.Message{
+			Sender:     ControlTopic,
+			Type:       message.TypeRPC,
+			QoS:        1,
+			BrokerName: msg.Sender,
+			Topic:      topic,
+			Body:       body,
+			Created:    time.Now(),
+		})
+		if cmd != "" {
+			gw.CmdChan <- cmd
+		}
+	}()
+	return true
+}
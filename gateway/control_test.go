@@ -0,0 +1,181 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"encoding/json"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/device"
+	"github.com/shiguredo/fuji/message"
+)
+
+func TestParseControlCommands(t *testing.T) {
+	assert := assert.New(t)
+
+	commands, err := parseControlCommands("")
+	assert.Nil(err)
+	assert.Equal([]string{"ping", "get-config"}, commands)
+
+	commands, err = parseControlCommands("ping, restart-device,shutdown")
+	assert.Nil(err)
+	assert.Equal([]string{"ping", "restart-device", "shutdown"}, commands)
+
+	_, err = parseControlCommands("ping, rm-rf")
+	assert.NotNil(err)
+}
+
+func TestControlCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	gw := &Gateway{Name: "ham"}
+	command, ok := gw.controlCommand("pre/ham/$control/ping")
+	assert.True(ok)
+	assert.Equal("ping", command)
+
+	// replies are control topics without command
+	command, ok = gw.controlCommand("pre/ham/$control/ping/reply")
+	assert.True(ok)
+	assert.Equal("", command)
+
+	for _, topic := range []string{
+		"pre/spam/$control/ping",
+		"pre/ham/dora/subscribe",
+		"$control/ping",
+	} {
+		_, ok = gw.controlCommand(topic)
+		assert.False(ok, topic)
+	}
+}
+
+func TestRedactedConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[gateway]
+    name = "ham"
+
+[[broker."sango/1"]]
+    host = "localhost"
+    port = 1883
+    username = "dora"
+    password = "dorayaki"
+    client_key = "/etc/fuji/client.key"
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	gw := &Gateway{Name: "ham", Config: conf}
+
+	for _, s := range gw.redactedConfig() {
+		if s.Type != "broker" {
+			continue
+		}
+		assert.Equal("sango", s.Name)
+		assert.Equal("dora", s.Values["username"])
+		assert.Equal(redactedValue, s.Values["password"])
+		assert.Equal(redactedValue, s.Values["client_key"])
+	}
+	// config itself is not changed
+	assert.Equal("dorayaki", conf.Sections[1].Values["password"])
+}
+
+func TestControl(t *testing.T) {
+	assert := assert.New(t)
+
+	gw := &Gateway{
+		Name:    "ham",
+		Devices: []device.Devicer{testCaller{name: "dora"}},
+	}
+	defer log.SetLevel(log.GetLevel())
+
+	result, cmd, err := gw.control("ping", nil)
+	assert.Nil(err)
+	assert.Equal("pong", result)
+	assert.Equal("", cmd)
+
+	result, _, err = gw.control("set-log-level", json.RawMessage(`{"level": "debug"}`))
+	assert.Nil(err)
+	assert.Equal("debug", result)
+	assert.Equal(log.DebugLevel, log.GetLevel())
+	_, _, err = gw.control("set-log-level", json.RawMessage(`{"level": "loud"}`))
+	assert.NotNil(err)
+
+	_, cmd, err = gw.control("restart-device", json.RawMessage(`{"device": "dora"}`))
+	assert.Nil(err)
+	assert.Equal("restart-device dora", cmd)
+	_, _, err = gw.control("restart-device", json.RawMessage(`{"device": "nobita"}`))
+	assert.NotNil(err)
+
+	_, cmd, err = gw.control("reload-config", nil)
+	assert.Nil(err)
+	assert.Equal("reload", cmd)
+	_, cmd, err = gw.control("shutdown", nil)
+	assert.Nil(err)
+	assert.Equal("close", cmd)
+}
+
+func TestHandleControl(t *testing.T) {
+	assert := assert.New(t)
+
+	gw := &Gateway{Name: "ham", ControlCommands: []string{"ping"}}
+	msg := message.Message{Sender: "sango", Topic: "pre/ham/$control/ping"}
+
+	// disabled without control broker
+	assert.False(gw.HandleControl(msg))
+
+	gw.ControlBroker = "sango"
+	assert.True(gw.HandleControl(message.Message{Sender: "sango", Topic: "pre/ham/$control/ping/reply"}))
+	assert.False(gw.HandleControl(message.Message{Sender: "sango", Topic: "pre/ham/dora/subscribe"}))
+	assert.False(gw.HandleControl(message.Message{Sender: "akane", Topic: "pre/ham/$control/ping"}))
+
+	assert.True(gw.permitted("ping"))
+	assert.False(gw.permitted("shutdown"))
+}
+
+func TestRestartDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	configStr := `
+[gateway]
+    name = "ham"
+
+[device."dora"]
+    type = "dummy"
+    qos = 0
+    broker = "sango"
+    interval = 10
+    payload = "Hello world."
+`
+	conf, err := config.LoadConfigByte([]byte(configStr))
+	assert.Nil(err)
+	gw, err := NewGateway(conf)
+	assert.Nil(err)
+	gw.Brokers = broker.Brokers{&broker.Broker{Name: "sango"}}
+	gw.Devices, gw.DeviceChannels, err = device.NewDevices(conf, gw.Brokers)
+	assert.Nil(err)
+	old := gw.Devices[0]
+
+	assert.Nil(gw.RestartDevice("dora"))
+	assert.Equal("dora", gw.Devices[0].DeviceName())
+	assert.NotEqual(old, gw.Devices[0])
+	gw.Devices[0].Stop()
+
+	assert.NotNil(gw.RestartDevice("nobita"))
+}
@@ -16,10 +16,12 @@
 package gateway
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -45,6 +47,19 @@ type Gateway struct {
 
 	MaxRetryCount int `validate:"min=1"`
 	RetryInterval int `validate:"min=1"`
+	RPCTimeout    int `validate:"min=1"`
+
+	ControlBroker   string `validate:"max=256"` // empty disables remote control
+	ControlCommands []string
+
+	Config            config.Config
+	ConfigPath        string // where pushed config is written
+	ConfigSecret      string `validate:"max=256"` // HMAC key of pushed config
+	ConfigGracePeriod int    `validate:"min=1"`
+
+	Availability map[string]*DeviceAvailability // by device name
+
+	Stats *Stats // nil unless benchmarking
 }
 
 const (
@@ -54,6 +69,10 @@ const (
 	MaxBrokerChanBufferSize = 20
 )
 
+// ErrReload is returned by MainLoop when the gateway is closed to
+// reload the config.
+var ErrReload = errors.New("reload requested")
+
 func init() {
 	validator.SetValidationFunc("validtopic", config.ValidMqttPublishTopic)
 }
@@ -82,6 +101,10 @@ func NewGateway(conf config.Config) (*Gateway, error) {
 		CmdChan:        make(chan string),
 		MaxRetryCount:  DefaultMaxRetryCount,
 		RetryInterval:  DefaultRetryInterval,
+		RPCTimeout:     DefaultRPCTimeout,
+		Config:         conf,
+
+		ConfigGracePeriod: DefaultConfigGracePeriod,
 	}
 
 	if m, ok := section.Values["max_retry_count"]; ok {
@@ -100,6 +123,34 @@ func NewGateway(conf config.Config) (*Gateway, error) {
 			return nil, fmt.Errorf("invalid retry_interval: %s", m)
 		}
 	}
+	if m, ok := section.Values["rpc_timeout"]; ok {
+		timeout, err := strconv.Atoi(m)
+		if err == nil {
+			gw.RPCTimeout = timeout
+		} else {
+			return nil, fmt.Errorf("invalid rpc_timeout: %s", m)
+		}
+	}
+	gw.ControlBroker = section.Values["control_broker"]
+	commands, err := parseControlCommands(section.Values["control_commands"])
+	if err != nil {
+		return nil, err
+	}
+	gw.ControlCommands = commands
+	availability, err := parseAvailability(conf, section.Values["availability_timeout"])
+	if err != nil {
+		return nil, err
+	}
+	gw.Availability = availability
+	gw.ConfigSecret = section.Values["config_secret"]
+	if m, ok := section.Values["config_grace_period"]; ok {
+		grace, err := strconv.Atoi(m)
+		if err == nil {
+			gw.ConfigGracePeriod = grace
+		} else {
+			return nil, fmt.Errorf("invalid config_grace_period: %s", m)
+		}
+	}
 
 	// Validation
 	if err := gw.Validate(); err != nil {
@@ -120,8 +171,17 @@ func (gw *Gateway) Stop() {
 	gw.CmdChan <- "close"
 }
 
-// Publish pass the message to a Broker which is connected
+// Publish pass the message to a Broker which is connected. It does not
+// block, the message is published in another goroutine.
 func (gw *Gateway) Publish(msg message.Message) {
+	go gw.publish(msg)
+}
+
+// publish publishes the message to the first broker which is connected
+// and accepts it. The latency is measured here, after the broker
+// acknowledged. The message is counted as dropped in Stats if no broker
+// accepts it.
+func (gw *Gateway) publish(msg message.Message) {
 	// Brokers are orderd by Priority
 	for _, b := range gw.Brokers {
 		if msg.BrokerName != b.Name {
@@ -130,19 +190,34 @@ func (gw *Gateway) Publish(msg message.Message) {
 
 		for i := 0; i < gw.MaxRetryCount; i++ {
 			if b.IsConnected() {
-				go b.Publish(&msg)
-				return
+				break
 			}
 			time.Sleep(time.Duration(gw.RetryInterval) * time.Second)
 		}
+		if err := b.Publish(&msg); err != nil {
+			log.Warnf("publish failed, try next broker, %v", err)
+			continue
+		}
+		gw.Stats.published(time.Since(msg.Created))
+		return
 	}
-	log.Errorf("retry failed. msg discarded: %v, topic: %s", msg.BrokerName)
+	gw.Stats.dropped()
+	log.Errorf("retry failed. msg discarded, broker: %v, sender: %v", msg.BrokerName, msg.Sender)
 }
 
 // MainLoop loops forever.
 func (gw *Gateway) MainLoop() error {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT)
+	defer signal.Stop(sigChan)
+
+	var availabilityTick <-chan time.Time
+	if len(gw.Availability) > 0 {
+		gw.resetAvailability()
+		ticker := time.NewTicker(availabilityCheckInterval)
+		defer ticker.Stop()
+		availabilityTick = ticker.C
+	}
 
 MAINLOOP:
 	for {
@@ -153,8 +228,13 @@ MAINLOOP:
 				log.Error("msg from msgChan closed")
 				break MAINLOOP
 			}
-			// use goroutine to avoid blocking
-			go gw.Publish(msg)
+			if gw.handleAvailability(msg) {
+				continue
+			}
+			if msg.Created.IsZero() {
+				msg.Created = time.Now()
+			}
+			gw.Publish(device.StampPosition(msg))
 
 		case msg, ok := <-gw.BrokerChan:
 			// brokerChan: messages from brokers
@@ -165,10 +245,18 @@ MAINLOOP:
 			if msg.Type != message.TypeSubscribed {
 				continue
 			}
+			if gw.HandleControl(msg) {
+				continue
+			}
+			if gw.HandleRPC(msg) {
+				continue
+			}
 			// send to all device
 			for _, dc := range gw.DeviceChannels {
 				dc.Chan <- msg
 			}
+		case now := <-availabilityTick:
+			gw.checkAvailability(now)
 		case signal, _ := <-sigChan:
 			// sigChan: signals
 			switch signal {
@@ -182,20 +270,76 @@ MAINLOOP:
 			}
 		case cmd, _ := <-gw.CmdChan:
 			// cmdChan: messages from command line or ever
-			switch cmd {
-			case "close":
+			switch {
+			case cmd == "close":
 				log.Warn("close command comes. will be shutdown")
-				for _, b := range gw.Brokers {
-					b.Close()
-				}
-				for _, d := range gw.Devices {
-					d.Stop()
-				}
+				gw.close()
 				return nil
+			case cmd == "reload":
+				log.Warn("reload command comes. will be restarted")
+				gw.close()
+				return ErrReload
+			case cmd == "apply-config":
+				log.Warn("pushed config comes. will be restarted")
+				gw.close()
+				return ErrConfigPushed
+			case cmd == "rollback-config":
+				log.Warn("config is restored. will be restarted")
+				gw.close()
+				return ErrConfigRolledBack
+			case strings.HasPrefix(cmd, "restart-device "):
+				name := strings.TrimPrefix(cmd, "restart-device ")
+				if err := gw.RestartDevice(name); err != nil {
+					log.Errorf("restart device failed, %v", err)
+				}
 			default:
-				log.Warn("unknown command, %v", cmd)
+				log.Warnf("unknown command, %v", cmd)
 			}
 		}
 	}
 	return nil
 }
+
+// close closes brokers and stops devices.
+func (gw *Gateway) close() {
+	gw.resetAvailability()
+	gw.closeAvailability()
+	for _, b := range gw.Brokers {
+		b.Close()
+	}
+	for _, d := range gw.Devices {
+		d.Stop()
+	}
+}
+
+// RestartDevice stops the device and starts new one from the config.
+// The new device uses the same DeviceChannel.
+func (gw *Gateway) RestartDevice(name string) error {
+	var section *config.ConfigSection
+	for _, s := range gw.Config.Sections {
+		if s.Type == "device" && s.Name == name {
+			s := s
+			section = &s
+		}
+	}
+	for i, d := range gw.Devices {
+		if d.DeviceName() != name {
+			continue
+		}
+		// the status device does not have DeviceChannel
+		if section == nil || i >= len(gw.DeviceChannels) {
+			return fmt.Errorf("%v could not be restarted", name)
+		}
+		log.Infof("restarting device: %v", name)
+		if err := d.Stop(); err != nil {
+			log.Warnf("device stop error, %v", err)
+		}
+		nd, err := device.NewDevice(*section, gw.Brokers, gw.DeviceChannels[i])
+		if err != nil {
+			return err
+		}
+		gw.Devices[i] = nd
+		return nd.Start(gw.MsgChan)
+	}
+	return fmt.Errorf("device not found, %v", name)
+}
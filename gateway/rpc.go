@@ -0,0 +1,108 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/shiguredo/fuji/config"
+	"github.com/shiguredo/fuji/device"
+	"github.com/shiguredo/fuji/message"
+)
+
+const DefaultRPCTimeout = 10 // sec
+
+// rpcTarget returns the device of the RPC topic
+// "<prefix>/<gateway>/<device>/rpc".
+func (gw *Gateway) rpcTarget(topic string) (device.Caller, bool) {
+	levels := strings.Split(topic, "/")
+	if len(levels) < 3 || levels[len(levels)-1] != message.TypeRPC || levels[len(levels)-3] != gw.Name {
+		return nil, false
+	}
+	name := levels[len(levels)-2]
+	for _, d := range gw.Devices {
+		if c, ok := d.(device.Caller); ok && c.DeviceName() == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// call calls the device and waits the result until RPCTimeout.
+func (gw *Gateway) call(c device.Caller, req message.Request) message.Response {
+	type result struct {
+		v   interface{}
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		v, err := c.Call(req)
+		done <- result{v, err}
+	}()
+	select {
+	case r := <-done:
+		return message.NewResponse(req.ID, r.v, r.err)
+	case <-time.After(time.Duration(gw.RPCTimeout) * time.Second):
+		return message.NewResponse(req.ID, nil, fmt.Errorf("timeout"))
+	}
+}
+
+// HandleRPC calls the device if the subscribed message is RPC request,
+// and publishes the response to the broker which the request came from.
+// It returns false if the message is not RPC request.
+func (gw *Gateway) HandleRPC(msg message.Message) bool {
+	c, ok := gw.rpcTarget(msg.Topic)
+	if !ok {
+		return false
+	}
+
+	go func() {
+		req, err := message.ParseRequest(msg.Body)
+		var res message.Response
+		switch {
+		case err != nil && req.ID == "":
+			log.Warnf("rpc request discarded, %v", err)
+			return
+		case err != nil:
+			res = message.NewResponse(req.ID, nil, err)
+		case req.ReplyTo != "" && config.ValidMqttPublishTopic(req.ReplyTo, "") != nil:
+			log.Warnf("rpc request discarded, invalid reply_to: %v", req.ReplyTo)
+			return
+		default:
+			log.Infof("rpc request to %v: %v", c.DeviceName(), req.Method)
+			res = gw.call(c, req)
+		}
+
+		body, err := json.Marshal(res)
+		if err != nil {
+			body, _ = json.Marshal(message.NewResponse(req.ID, nil, err))
+		}
+		gw.Publish(message.Message{
+			Sender:     c.DeviceName(),
+			Type:       message.TypeRPC,
+			QoS:        1,
+			BrokerName: msg.Sender, // broker name of the request
+			Topic:      req.ReplyTo,
+			Body:       body,
+			Created:    time.Now(),
+		})
+	}()
+	return true
+}
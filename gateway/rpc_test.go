@@ -0,0 +1,80 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/device"
+	"github.com/shiguredo/fuji/message"
+)
+
+// testCaller is a device.Caller which sleeps before returning.
+type testCaller struct {
+	name  string
+	sleep time.Duration
+}
+
+func (c testCaller) Start(chan message.Message) error { return nil }
+func (c testCaller) DeviceType() string               { return "test" }
+func (c testCaller) Stop() error                      { return nil }
+func (c testCaller) AddSubscribe() error              { return nil }
+func (c testCaller) DeviceName() string               { return c.name }
+
+func (c testCaller) Call(req message.Request) (interface{}, error) {
+	time.Sleep(c.sleep)
+	if req.Method != "ping" {
+		return nil, message.ErrUnknownMethod
+	}
+	return "pong", nil
+}
+
+func TestRPCTarget(t *testing.T) {
+	assert := assert.New(t)
+
+	gw := &Gateway{
+		Name:    "ham",
+		Devices: []device.Devicer{testCaller{name: "dora"}, testCaller{name: "nobita"}},
+	}
+	c, ok := gw.rpcTarget("pre/ham/nobita/rpc")
+	assert.True(ok)
+	assert.Equal("nobita", c.DeviceName())
+
+	for _, topic := range []string{
+		"pre/ham/nobita/subscribe",
+		"pre/spam/nobita/rpc",
+		"pre/ham/suneo/rpc",
+		"rpc",
+	} {
+		_, ok = gw.rpcTarget(topic)
+		assert.False(ok, topic)
+	}
+	assert.False(gw.HandleRPC(message.Message{Topic: "pre/ham/dora/subscribe"}))
+}
+
+func TestRPCCall(t *testing.T) {
+	assert := assert.New(t)
+
+	gw := &Gateway{Name: "ham", RPCTimeout: 1}
+	assert.Equal(message.Response{ID: "1", Result: "pong"},
+		gw.call(testCaller{name: "dora"}, message.Request{ID: "1", Method: "ping"}))
+	assert.Equal(message.Response{ID: "2", Error: "unknown method"},
+		gw.call(testCaller{name: "dora"}, message.Request{ID: "2", Method: "reboot"}))
+	assert.Equal(message.Response{ID: "3", Error: "timeout"},
+		gw.call(testCaller{name: "dora", sleep: 2 * time.Second}, message.Request{ID: "3", Method: "ping"}))
+}
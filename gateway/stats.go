@@ -0,0 +1,135 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxLatencySamples is the number of publish latencies kept by Stats.
+// Samples are replaced at random after that, so percentiles stay
+// representative on long runs.
+const MaxLatencySamples = 100000
+
+// Stats counts messages which the gateway published or dropped.
+type Stats struct {
+	sync.Mutex
+
+	Published uint64
+	Dropped   uint64
+
+	latencies []time.Duration
+	observed  uint64
+	rand      *rand.Rand
+}
+
+// StatsReport is a snapshot of Stats.
+type StatsReport struct {
+	Elapsed    time.Duration
+	Published  uint64
+	Dropped    uint64
+	Throughput float64 // msg/s
+	P50        time.Duration
+	P90        time.Duration
+	P99        time.Duration
+	Max        time.Duration
+}
+
+// NewStats returns empty Stats.
+func NewStats() *Stats {
+	return &Stats{
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// published records a published message and its latency. It does
+// nothing on nil Stats, which is not benchmarking.
+func (s *Stats) published(latency time.Duration) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.Published++
+	s.observed++
+	if len(s.latencies) < MaxLatencySamples {
+		s.latencies = append(s.latencies, latency)
+		return
+	}
+	// reservoir sampling
+	if i := s.rand.Int63n(int64(s.observed)); i < MaxLatencySamples {
+		s.latencies[i] = latency
+	}
+}
+
+// dropped records a discarded message.
+func (s *Stats) dropped() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.Dropped++
+}
+
+// Report returns StatsReport of the messages recorded in elapsed.
+func (s *Stats) Report(elapsed time.Duration) StatsReport {
+	s.Lock()
+	sorted := make([]time.Duration, len(s.latencies))
+	copy(sorted, s.latencies)
+	r := StatsReport{
+		Elapsed:   elapsed,
+		Published: s.Published,
+		Dropped:   s.Dropped,
+	}
+	s.Unlock()
+
+	if elapsed > 0 {
+		r.Throughput = float64(r.Published) / elapsed.Seconds()
+	}
+	if len(sorted) == 0 {
+		return r
+	}
+	sort.Sort(durations(sorted))
+	r.P50 = percentile(sorted, 50)
+	r.P90 = percentile(sorted, 90)
+	r.P99 = percentile(sorted, 99)
+	r.Max = sorted[len(sorted)-1]
+	return r
+}
+
+func (r StatsReport) String() string {
+	return fmt.Sprintf("elapsed: %v\npublished: %d\ndropped: %d\nthroughput: %.1f msg/s\nlatency p50: %v, p90: %v, p99: %v, max: %v",
+		r.Elapsed, r.Published, r.Dropped, r.Throughput, r.P50, r.P90, r.P99, r.Max)
+}
+
+// percentile returns p-th percentile of sorted by nearest rank.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
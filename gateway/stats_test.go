@@ -0,0 +1,90 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/message"
+)
+
+func TestStatsReport(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewStats()
+	r := s.Report(0)
+	assert.Equal(uint64(0), r.Published)
+	assert.Equal(time.Duration(0), r.P99)
+
+	for i := 100; i >= 1; i-- {
+		s.published(time.Duration(i) * time.Millisecond)
+	}
+	s.dropped()
+
+	r = s.Report(10 * time.Second)
+	assert.Equal(uint64(100), r.Published)
+	assert.Equal(uint64(1), r.Dropped)
+	assert.Equal(10.0, r.Throughput)
+	assert.Equal(50*time.Millisecond, r.P50)
+	assert.Equal(90*time.Millisecond, r.P90)
+	assert.Equal(99*time.Millisecond, r.P99)
+	assert.Equal(100*time.Millisecond, r.Max)
+}
+
+func TestStatsSampleLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewStats()
+	for i := 0; i < MaxLatencySamples+10; i++ {
+		s.published(time.Millisecond)
+	}
+	assert.Equal(MaxLatencySamples, len(s.latencies))
+	assert.Equal(uint64(MaxLatencySamples+10), s.Published)
+}
+
+func TestPublishUnknownBrokerDropped(t *testing.T) {
+	assert := assert.New(t)
+
+	gw := &Gateway{MaxRetryCount: 1, RetryInterval: 1, Stats: NewStats()}
+	gw.publish(message.Message{BrokerName: "sango"})
+	assert.Equal(uint64(1), gw.Stats.Report(time.Second).Dropped)
+}
+
+func TestPublishAllBrokersFailed(t *testing.T) {
+	assert := assert.New(t)
+
+	gw := &Gateway{
+		Brokers: broker.Brokers{
+			&broker.Broker{Name: "sango", Priority: 1},
+			&broker.Broker{Name: "sango", Priority: 2},
+		},
+		MaxRetryCount: 1,
+		Stats:         NewStats(),
+	}
+	gw.publish(message.Message{BrokerName: "sango"})
+	r := gw.Stats.Report(time.Second)
+	assert.Equal(uint64(0), r.Published)
+	assert.Equal(uint64(1), r.Dropped)
+}
+
+func TestPublishWithoutStats(t *testing.T) {
+	// Stats is nil unless benchmarking
+	gw := &Gateway{MaxRetryCount: 1}
+	gw.publish(message.Message{BrokerName: "sango"})
+}
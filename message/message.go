@@ -14,7 +14,10 @@
 
 package message
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 // Message represents a message in the Fuji package.
 type Message struct {
@@ -25,10 +28,20 @@ type Message struct {
 	Retained   bool
 	BrokerName string
 	Topic      string
+	Created    time.Time // when the device created the message
 }
 
 const (
 	TypeSubscribed = "subscribed"
+	// TypeAvailability is Type of the message which tells the gateway
+	// that the device is online or offline. The body is "online" or
+	// "offline".
+	TypeAvailability = "availability"
+)
+
+const (
+	Online  = "online"
+	Offline = "offline"
 )
 
 func (m Message) String() string {
@@ -0,0 +1,70 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// TypeRPC is Type of the RPC response message.
+const TypeRPC = "rpc"
+
+// ErrUnknownMethod is returned if the device does not have the method.
+var ErrUnknownMethod = errors.New("unknown method")
+
+// Request is the envelope of RPC request sent to
+// "<prefix>/<gateway>/<device>/rpc".
+// ex:
+//   {"id": "42", "method": "write", "params": {"data": "\\x01"}, "reply_to": "app/replies"}
+type Request struct {
+	ID      string          `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ReplyTo string          `json:"reply_to,omitempty"`
+}
+
+// Response is the envelope of RPC response. Either Result or Error is set.
+type Response struct {
+	ID     string      `json:"id"`
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// ParseRequest parses the RPC request. ID of the returned Request is
+// set if it is found even when err is not nil, so that the error can be
+// responded.
+func ParseRequest(body []byte) (Request, error) {
+	var req Request
+	if err := json.Unmarshal(body, &req); err != nil {
+		return req, fmt.Errorf("invalid request, %v", err)
+	}
+	if req.ID == "" {
+		return req, fmt.Errorf("id is required")
+	}
+	if req.Method == "" {
+		return req, fmt.Errorf("method is required")
+	}
+	return req, nil
+}
+
+// NewResponse returns the response of the result.
+func NewResponse(id string, result interface{}, err error) Response {
+	if err != nil {
+		return Response{ID: id, Error: err.Error()}
+	}
+	return Response{ID: id, Result: result}
+}
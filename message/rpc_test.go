@@ -0,0 +1,52 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	req, err := ParseRequest([]byte(`{"id": "42", "method": "write", "params": {"data": "a"}, "reply_to": "app/replies"}`))
+	assert.Nil(err)
+	assert.Equal("42", req.ID)
+	assert.Equal("write", req.Method)
+	assert.Equal(`{"data": "a"}`, string(req.Params))
+	assert.Equal("app/replies", req.ReplyTo)
+
+	req, err = ParseRequest([]byte(`{"id": "43"}`))
+	assert.NotNil(err)
+	assert.Equal("43", req.ID)
+
+	for _, body := range []string{`{"method": "ping"}`, `ping`, `{"id": 1, "method": "ping"}`} {
+		_, err = ParseRequest([]byte(body))
+		assert.NotNil(err, body)
+	}
+}
+
+func TestNewResponse(t *testing.T) {
+	assert := assert.New(t)
+
+	b, _ := json.Marshal(NewResponse("42", map[string]int{"v": 1}, nil))
+	assert.Equal(`{"id":"42","result":{"v":1}}`, string(b))
+	b, _ = json.Marshal(NewResponse("42", nil, fmt.Errorf("timeout")))
+	assert.Equal(`{"id":"42","error":"timeout"}`, string(b))
+}
@@ -0,0 +1,71 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCron(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, expr := range []string{
+		"* * * * *", "*/5 * * * *", "0 9-17 * * mon-fri", "30 */10 9-17 * * 1,3,5",
+		"0 0 1 jan *", "@hourly", "@daily", "0 0 * * 7",
+	} {
+		_, err := ParseCron(expr)
+		assert.Nil(err, expr)
+	}
+	for _, expr := range []string{
+		"", "* * * *", "* * * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *",
+		"* * * 13 *", "*/0 * * * *", "5-1 * * * *", "* * * foo *", "@often",
+	} {
+		_, err := ParseCron(expr)
+		assert.NotNil(err, expr)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	assert := assert.New(t)
+
+	base := time.Date(2015, 10, 9, 12, 3, 20, 500, time.UTC) // friday
+	cases := []struct {
+		expr     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2015, 10, 9, 12, 4, 0, 0, time.UTC)},
+		{"*/5 * * * *", time.Date(2015, 10, 9, 12, 5, 0, 0, time.UTC)},
+		{"*/10 * * * * *", time.Date(2015, 10, 9, 12, 3, 30, 0, time.UTC)},
+		{"0 9 * * mon-fri", time.Date(2015, 10, 12, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2015, 11, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2016, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2015, 10, 11, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2015, 10, 11, 0, 0, 0, 0, time.UTC)},
+		// either day of month or day of week
+		{"0 0 13 * fri", time.Date(2015, 10, 13, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		s, err := ParseCron(c.expr)
+		assert.Nil(err, c.expr)
+		assert.Equal(c.expected, s.Next(base), c.expr)
+	}
+
+	s, _ := ParseCron("0 0 31 2 *")
+	assert.True(s.Next(base).IsZero())
+}
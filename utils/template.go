@@ -0,0 +1,99 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// PayloadTemplate is a payload with placeholders.
+// ex:
+//   {"seq": {{.Seq}}, "temp": {{randfloat 20 30 | printf "%.1f"}}, "at": "{{.Timestamp}}"}
+type PayloadTemplate struct {
+	tmpl *template.Template
+}
+
+// PayloadContext is values which can be used in PayloadTemplate.
+type PayloadContext struct {
+	Gateway string
+	Device  string
+	Version string
+	Seq     uint64
+	Time    time.Time
+}
+
+// Timestamp returns the time in RFC3339.
+func (c PayloadContext) Timestamp() string {
+	return c.Time.Format(time.RFC3339)
+}
+
+// Unix returns the time in unix epoch seconds.
+func (c PayloadContext) Unix() int64 {
+	return c.Time.Unix()
+}
+
+// payloadRand is shared by the templates of all devices, which run in
+// their own goroutines. rand.Rand is not safe for concurrent use, so it
+// is guarded by payloadRandMu.
+var (
+	payloadRand   = rand.New(rand.NewSource(time.Now().UnixNano()))
+	payloadRandMu sync.Mutex
+)
+
+var payloadFuncs = template.FuncMap{
+	// randint returns an integer in [min, max]
+	"randint": func(min, max int) int {
+		if max <= min {
+			return min
+		}
+		payloadRandMu.Lock()
+		defer payloadRandMu.Unlock()
+		return min + payloadRand.Intn(max-min+1)
+	},
+	// randfloat returns a float in [min, max)
+	"randfloat": func(min, max float64) float64 {
+		payloadRandMu.Lock()
+		defer payloadRandMu.Unlock()
+		return min + payloadRand.Float64()*(max-min)
+	},
+}
+
+// IsPayloadTemplate returns true if the payload has placeholders.
+func IsPayloadTemplate(arg string) bool {
+	return strings.Contains(arg, "{{")
+}
+
+// NewPayloadTemplate parses the payload template.
+func NewPayloadTemplate(arg string) (*PayloadTemplate, error) {
+	tmpl, err := template.New("payload").Funcs(payloadFuncs).Option("missingkey=error").Parse(arg)
+	if err != nil {
+		return nil, err
+	}
+	return &PayloadTemplate{tmpl: tmpl}, nil
+}
+
+// Execute returns the payload rendered with the context.
+func (t *PayloadTemplate) Execute(ctx PayloadContext) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, ctx); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
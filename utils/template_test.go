@@ -0,0 +1,91 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPayloadTemplate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(IsPayloadTemplate(`{{.Seq}}`))
+	assert.False(IsPayloadTemplate(`{"a": 1}`))
+
+	tmpl, err := NewPayloadTemplate(`{{.Gateway}}/{{.Device}} #{{.Seq}} {{.Timestamp}} {{.Unix}}`)
+	assert.Nil(err)
+	ctx := PayloadContext{
+		Gateway: "ham",
+		Device:  "dora",
+		Seq:     3,
+		Time:    time.Date(2015, 10, 9, 12, 0, 0, 0, time.UTC),
+	}
+	ret, err := tmpl.Execute(ctx)
+	assert.Nil(err)
+	assert.Equal("ham/dora #3 2015-10-09T12:00:00Z 1444392000", string(ret))
+
+	tmpl, err = NewPayloadTemplate(`{{randint 1 3}}`)
+	assert.Nil(err)
+	for i := 0; i < 20; i++ {
+		ret, err := tmpl.Execute(ctx)
+		assert.Nil(err)
+		v, _ := strconv.Atoi(string(ret))
+		assert.True(v >= 1 && v <= 3, string(ret))
+	}
+
+	tmpl, err = NewPayloadTemplate(`{{randfloat 20 30 | printf "%.1f"}}`)
+	assert.Nil(err)
+	ret, err = tmpl.Execute(ctx)
+	assert.Nil(err)
+	v, err := strconv.ParseFloat(string(ret), 64)
+	assert.Nil(err)
+	assert.True(v >= 20 && v <= 30, string(ret))
+
+	_, err = NewPayloadTemplate(`{{.Seq`)
+	assert.NotNil(err)
+	tmpl, err = NewPayloadTemplate(`{{.Unknown}}`)
+	assert.Nil(err)
+	_, err = tmpl.Execute(ctx)
+	assert.NotNil(err)
+}
+
+func TestPayloadTemplateConcurrent(t *testing.T) {
+	assert := assert.New(t)
+
+	// templates of two dummy devices, rendered in their own goroutines
+	var tmpls []*PayloadTemplate
+	for _, s := range []string{`{{randint 1 100}}`, `{{randfloat 20 30}}`} {
+		tmpl, err := NewPayloadTemplate(s)
+		assert.Nil(err)
+		tmpls = append(tmpls, tmpl)
+	}
+	done := make(chan error)
+	for _, tmpl := range tmpls {
+		go func(tmpl *PayloadTemplate) {
+			var err error
+			for i := 0; i < 1000 && err == nil; i++ {
+				_, err = tmpl.Execute(PayloadContext{Seq: uint64(i)})
+			}
+			done <- err
+		}(tmpl)
+	}
+	for range tmpls {
+		assert.Nil(<-done)
+	}
+}